@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 var textFormat = "%s" // Changed to "%q" in tests for better error messages.
@@ -22,6 +23,8 @@ type Node interface {
 	Position() Pos // byte position of start of node in full original input string
 }
 
+// New node types go at the end of the list, so the values of existing ones
+// do not change.
 const (
 	NodeList NodeType = iota
 	NodeText
@@ -41,6 +44,29 @@ const (
 	NodeIf
 	NodeElseIf
 	NodeFor
+	NodeAttr
+	NodeFilter
+	NodeNone
+	NodeKeyword
+	NodeSliceExpr
+	NodeCall
+	NodeTuple
+	NodeCompare
+	NodeTest
+	NodeBlock
+	NodeCache
+	NodeStar
+	NodeMacro
+	NodeInclude
+	NodeBreak
+	NodeContinue
+	NodeConcat
+	NodeAnd
+	NodeOr
+	NodeNot
+	NodeTernary
+	NodeListLiteral
+	NodeComment
 )
 
 // This is a stack of nodes starting at a position.  It has the default NodeType
@@ -116,6 +142,21 @@ func newText(pos Pos, text string) *TextNode {
 func (t *TextNode) String() string { return fmt.Sprintf(textFormat, t.Text) }
 func (t *TextNode) Copy() Node     { return &TextNode{NodeText, t.Pos, append([]byte{}, t.Text...)} }
 
+// CommentNode holds the text of a comment, which renders nothing.  Comments
+// are only kept in the tree if the environment's KeepComments is set.
+type CommentNode struct {
+	NodeType
+	Pos
+	Text string
+}
+
+func newComment(pos Pos, text string) *CommentNode {
+	return &CommentNode{NodeType: NodeComment, Pos: pos, Text: text}
+}
+
+func (c *CommentNode) String() string { return "{#" + c.Text + "#}" }
+func (c *CommentNode) Copy() Node     { return newComment(c.Pos, c.Text) }
+
 // VarNode represents a var print expr, ie {{ ... }}.
 // It is represented as a sequence of expressions.
 type VarNode struct {
@@ -129,7 +170,7 @@ func newVar(pos Pos) *VarNode {
 }
 
 func (v *VarNode) String() string { return "{{ " + v.Node.String() + " }}" }
-func (v *VarNode) Copy() Node     { return &VarNode{v.NodeType, v.Pos, v.Node} }
+func (v *VarNode) Copy() Node     { return &VarNode{v.NodeType, v.Pos, copyNode(v.Node)} }
 
 // A LookupNode is a variable lookup.
 type LookupNode struct {
@@ -144,6 +185,20 @@ func newLookup(pos Pos, name string) *LookupNode {
 func (l *LookupNode) String() string { return l.Name }
 func (l *LookupNode) Copy() Node     { return newLookup(l.Pos, l.Name) }
 
+// A StarNode is a starred name in an assignment target, as in `head, *tail`,
+// which is assigned a list of the items not assigned to the other names.
+type StarNode struct {
+	NodeType
+	Pos
+	Name *LookupNode
+}
+
+func newStar(pos Pos, name *LookupNode) *StarNode {
+	return &StarNode{NodeType: NodeStar, Pos: pos, Name: name}
+}
+func (s *StarNode) String() string { return "*" + s.Name.String() }
+func (s *StarNode) Copy() Node     { return newStar(s.Pos, s.Name.Copy().(*LookupNode)) }
+
 type StringNode struct {
 	NodeType
 	Pos
@@ -151,7 +206,10 @@ type StringNode struct {
 }
 
 func (s *StringNode) Copy() Node     { return &StringNode{s.NodeType, s.Pos, s.Value} }
-func (s *StringNode) String() string { return fmt.Sprintf(`"%s"`, s.Value) }
+func (s *StringNode) String() string { return `"` + stringEscaper.Replace(s.Value) + `"` }
+
+// stringEscaper escapes a string's value so it is lexed back unchanged.
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
 
 type BoolNode struct {
 	NodeType
@@ -162,6 +220,15 @@ type BoolNode struct {
 func (s *BoolNode) Copy() Node     { return &BoolNode{s.NodeType, s.Pos, s.Value} }
 func (s *BoolNode) String() string { return fmt.Sprintf("%v", s.Value) }
 
+// NoneNode is the literal `none`, which evaluates to nil.
+type NoneNode struct {
+	NodeType
+	Pos
+}
+
+func (n *NoneNode) Copy() Node     { return &NoneNode{n.NodeType, n.Pos} }
+func (n *NoneNode) String() string { return "none" }
+
 type IntegerNode struct {
 	NodeType
 	Pos
@@ -191,11 +258,15 @@ func newUnaryNode(val Node, unary item) *UnaryNode {
 	return &UnaryNode{NodeUnary, val.Position(), val, unary}
 }
 
-func (u *UnaryNode) Copy() Node     { return &UnaryNode{u.NodeType, u.Pos, u.Value, u.Unary} }
-func (u *UnaryNode) String() string { return fmt.Sprintf("%s%s", u.Unary.val, u.Value) }
+func (u *UnaryNode) Copy() Node     { return &UnaryNode{u.NodeType, u.Pos, copyNode(u.Value), u.Unary} }
+func (u *UnaryNode) String() string { return u.Unary.val + operand(u.Value, precAtom) }
 
 // newLiteral creates a new string, integer, or float node depending on itemType
 func newLiteral(pos Pos, typ itemType, val string) Node {
+	if typ == tokenFloat || typ == tokenInteger {
+		// strip digit separators
+		val = strings.Replace(val, "_", "", -1)
+	}
 	switch typ {
 	case tokenFloat:
 		v, err := strconv.ParseFloat(val, 64)
@@ -204,8 +275,13 @@ func newLiteral(pos Pos, typ itemType, val string) Node {
 		}
 		return &FloatNode{NodeFloat, pos, v}
 	case tokenInteger:
-		// FIXME: complex integer types?  hex, octal, etc?
-		v, err := strconv.ParseInt(val, 10, 64)
+		// base 0 reads the 0x, 0o and 0b prefixes, but would also read
+		// other numbers with a leading zero as octal
+		base := 0
+		if len(val) > 1 && isNumeric(rune(val[1])) {
+			base = 10
+		}
+		v, err := strconv.ParseInt(val, base, 64)
 		if err != nil {
 			panic(err)
 		}
@@ -218,6 +294,8 @@ func newLiteral(pos Pos, typ itemType, val string) Node {
 			v = true
 		}
 		return &BoolNode{NodeBool, pos, v}
+	case tokenNone:
+		return &NoneNode{NodeNone, pos}
 	}
 	panic(fmt.Sprint("unexpected literal type ", typ))
 }
@@ -235,11 +313,120 @@ func newAddExpr(lhs, rhs Node, operator item) *AddExpr {
 }
 
 func (a *AddExpr) String() string {
-	return fmt.Sprintf("%s %s %s", a.lhs, a.operator.val, a.rhs)
+	return fmt.Sprintf("%s %s %s", operand(a.lhs, precAdd), a.operator.val, operand(a.rhs, precAdd+1))
 }
 
 func (a *AddExpr) Copy() Node {
-	return newAddExpr(a.lhs, a.rhs, a.operator)
+	return newAddExpr(copyNode(a.lhs), copyNode(a.rhs), a.operator)
+}
+
+// ConcatNode is the string concatenation `lhs ~ rhs`, which joins the
+// string forms of any two values.
+type ConcatNode struct {
+	NodeType
+	Pos
+	lhs Node
+	rhs Node
+}
+
+func newConcat(lhs, rhs Node) *ConcatNode {
+	return &ConcatNode{NodeConcat, lhs.Position(), lhs, rhs}
+}
+
+func (c *ConcatNode) String() string {
+	return fmt.Sprintf("%s ~ %s", operand(c.lhs, precConcat), operand(c.rhs, precConcat+1))
+}
+
+func (c *ConcatNode) Copy() Node {
+	return newConcat(copyNode(c.lhs), copyNode(c.rhs))
+}
+
+// AndNode is the logical `lhs and rhs`.  Like Python, it evaluates to lhs
+// if lhs is false, without evaluating rhs, and to rhs otherwise.
+type AndNode struct {
+	NodeType
+	Pos
+	lhs Node
+	rhs Node
+}
+
+func newAnd(lhs, rhs Node) *AndNode {
+	return &AndNode{NodeAnd, lhs.Position(), lhs, rhs}
+}
+
+func (a *AndNode) String() string {
+	return fmt.Sprintf("%s and %s", operand(a.lhs, precAnd), operand(a.rhs, precAnd+1))
+}
+
+func (a *AndNode) Copy() Node {
+	return newAnd(copyNode(a.lhs), copyNode(a.rhs))
+}
+
+// OrNode is the logical `lhs or rhs`, which evaluates to lhs if lhs is true,
+// without evaluating rhs, and to rhs otherwise.
+type OrNode struct {
+	NodeType
+	Pos
+	lhs Node
+	rhs Node
+}
+
+func newOr(lhs, rhs Node) *OrNode {
+	return &OrNode{NodeOr, lhs.Position(), lhs, rhs}
+}
+
+func (o *OrNode) String() string {
+	return fmt.Sprintf("%s or %s", operand(o.lhs, precOr), operand(o.rhs, precOr+1))
+}
+
+func (o *OrNode) Copy() Node {
+	return newOr(copyNode(o.lhs), copyNode(o.rhs))
+}
+
+// NotNode is the logical `not value`, which is true if value is false.
+type NotNode struct {
+	NodeType
+	Pos
+	Value Node
+}
+
+func newNot(pos Pos, val Node) *NotNode {
+	return &NotNode{NodeNot, pos, val}
+}
+
+func (n *NotNode) String() string {
+	return "not " + operand(n.Value, precNot)
+}
+
+func (n *NotNode) Copy() Node {
+	return newNot(n.Pos, copyNode(n.Value))
+}
+
+// TernaryNode is the conditional expression `TrueExpr if Cond else
+// FalseExpr`.  FalseExpr is nil if there is no else, when the expression is
+// undefined if Cond is false.
+type TernaryNode struct {
+	NodeType
+	Pos
+	TrueExpr  Node
+	Cond      Node
+	FalseExpr Node
+}
+
+func newTernary(trueExpr, cond, falseExpr Node) *TernaryNode {
+	return &TernaryNode{NodeTernary, trueExpr.Position(), trueExpr, cond, falseExpr}
+}
+
+func (t *TernaryNode) String() string {
+	s := fmt.Sprintf("%s if %s", operand(t.TrueExpr, precOr), operand(t.Cond, precOr))
+	if t.FalseExpr != nil {
+		s += " else " + operand(t.FalseExpr, precTernary)
+	}
+	return s
+}
+
+func (t *TernaryNode) Copy() Node {
+	return newTernary(copyNode(t.TrueExpr), copyNode(t.Cond), copyNode(t.FalseExpr))
 }
 
 type MulExpr struct {
@@ -255,11 +442,45 @@ func newMulExpr(lhs, rhs Node, operator item) *MulExpr {
 }
 
 func (m *MulExpr) String() string {
-	return fmt.Sprintf("%s %s %s", m.lhs, m.operator.val, m.rhs)
+	return fmt.Sprintf("%s %s %s", operand(m.lhs, precMul), m.operator.val, operand(m.rhs, precMul+1))
 }
 
 func (m *MulExpr) Copy() Node {
-	return newMulExpr(m.lhs, m.rhs, m.operator)
+	return newMulExpr(copyNode(m.lhs), copyNode(m.rhs), m.operator)
+}
+
+// CompareExpr is a comparison, which may be chained as in `1 < x < 10`.
+// There is one more operand than there are operators.
+type CompareExpr struct {
+	NodeType
+	Pos
+	Operands  []Node
+	Operators []item
+}
+
+func newCompareExpr(lhs, rhs Node, operator item) *CompareExpr {
+	return &CompareExpr{NodeCompare, lhs.Position(), []Node{lhs, rhs}, []item{operator}}
+}
+
+// append chains another comparison onto c.
+func (c *CompareExpr) append(operator item, rhs Node) {
+	c.Operators = append(c.Operators, operator)
+	c.Operands = append(c.Operands, rhs)
+}
+
+func (c *CompareExpr) String() string {
+	b := new(bytes.Buffer)
+	b.WriteString(operand(c.Operands[0], precCompare+1))
+	for i, op := range c.Operators {
+		fmt.Fprintf(b, " %s %s", op.val, operand(c.Operands[i+1], precCompare+1))
+	}
+	return b.String()
+}
+
+func (c *CompareExpr) Copy() Node {
+	operators := make([]item, len(c.Operators))
+	copy(operators, c.Operators)
+	return &CompareExpr{NodeCompare, c.Pos, copyNodes(c.Operands), operators}
 }
 
 // complex literals
@@ -317,7 +538,53 @@ func (m *MapElem) String() string {
 }
 
 func (m *MapElem) Copy() Node {
-	return newMapElem(m.Key, m.Value)
+	return newMapElem(copyNode(m.Key), copyNode(m.Value))
+}
+
+// ListLiteralNode is a list literal, ie. `[1, 2, 3]`.  Unlike a ListNode,
+// which is a sequence of statements, its elements are expressions.
+type ListLiteralNode struct {
+	NodeType
+	Pos
+	Elems []Node
+}
+
+func newListLiteral(pos Pos) *ListLiteralNode {
+	return &ListLiteralNode{NodeType: NodeListLiteral, Pos: pos}
+}
+
+func (l *ListLiteralNode) append(n Node) { l.Elems = append(l.Elems, n) }
+
+func (l *ListLiteralNode) String() string {
+	return fmt.Sprintf("[%s]", joinNodes(l.Elems, ", "))
+}
+
+func (l *ListLiteralNode) Copy() Node {
+	return &ListLiteralNode{l.NodeType, l.Pos, copyNodes(l.Elems)}
+}
+
+// TupleNode is a comma separated sequence of expressions, such as the names
+// in `{% for k, v in items %}`, or the tuple literal `(1, 2, 3)`, which
+// evaluates to a slice.
+type TupleNode struct {
+	NodeType
+	Pos
+	Elems []Node
+}
+
+func newTuple(pos Pos, elems []Node) *TupleNode {
+	return &TupleNode{NodeTuple, pos, elems}
+}
+
+func (t *TupleNode) String() string {
+	if len(t.Elems) == 1 {
+		return fmt.Sprintf("(%s,)", t.Elems[0])
+	}
+	return fmt.Sprintf("(%s)", joinNodes(t.Elems, ", "))
+}
+
+func (t *TupleNode) Copy() Node {
+	return newTuple(t.Pos, copyNodes(t.Elems))
 }
 
 type IndexExpr struct {
@@ -332,11 +599,246 @@ func newIndexExpr(val, idx Node) *IndexExpr {
 }
 
 func (i *IndexExpr) String() string {
-	return fmt.Sprintf("%s[%s]", i.Value, i.Index)
+	return fmt.Sprintf("%s[%s]", operand(i.Value, precAtom), i.Index)
 }
 
 func (i *IndexExpr) Copy() Node {
-	return newIndexExpr(i.Value, i.Index)
+	return newIndexExpr(copyNode(i.Value), copyNode(i.Index))
+}
+
+// SliceExpr is a slice of the result of an expression, ie. `a[start:stop:step]`.
+// Any of Start, Stop and Step may be nil if they were omitted.
+type SliceExpr struct {
+	NodeType
+	Pos
+	Value Node
+	Start Node
+	Stop  Node
+	Step  Node
+}
+
+func newSliceExpr(val, start, stop, step Node) *SliceExpr {
+	return &SliceExpr{NodeSliceExpr, val.Position(), val, start, stop, step}
+}
+
+func (s *SliceExpr) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "%s[", operand(s.Value, precAtom))
+	if s.Start != nil {
+		fmt.Fprint(b, s.Start)
+	}
+	b.WriteString(":")
+	if s.Stop != nil {
+		fmt.Fprint(b, s.Stop)
+	}
+	if s.Step != nil {
+		fmt.Fprintf(b, ":%s", s.Step)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func (s *SliceExpr) Copy() Node {
+	return newSliceExpr(s.Value.Copy(), copyNode(s.Start), copyNode(s.Stop), copyNode(s.Step))
+}
+
+// AttrExpr is an attribute lookup on the result of an expression, ie. `a.b`.
+// Unlike an IndexExpr, the attribute is always a bare name.
+type AttrExpr struct {
+	NodeType
+	Pos
+	Value Node
+	Name  string
+}
+
+func newAttrExpr(val Node, name string) *AttrExpr {
+	return &AttrExpr{NodeAttr, val.Position(), val, name}
+}
+
+func (a *AttrExpr) String() string {
+	return fmt.Sprintf("%s.%s", operand(a.Value, precAtom), a.Name)
+}
+
+func (a *AttrExpr) Copy() Node {
+	return newAttrExpr(a.Value.Copy(), a.Name)
+}
+
+// CallExpr is a call of the result of an expression with arguments, ie.
+// `fn(arg1, arg2)`.  Keyword arguments are KeywordNodes in Args.
+type CallExpr struct {
+	NodeType
+	Pos
+	Value Node
+	Args  []Node
+}
+
+func newCallExpr(val Node, args []Node) *CallExpr {
+	return &CallExpr{NodeCall, val.Position(), val, args}
+}
+
+func (c *CallExpr) String() string {
+	return fmt.Sprintf("%s(%s)", operand(c.Value, precAtom), joinNodes(c.Args, ", "))
+}
+
+func (c *CallExpr) Copy() Node {
+	return newCallExpr(c.Value.Copy(), copyNodes(c.Args))
+}
+
+// FilterNode applies the filter Name to the result of an expression, along
+// with any arguments, ie. `value|name(arg1, arg2)`.  Chained filters nest, so
+// `a|b|c` is the filter c applied to the FilterNode `a|b`.
+type FilterNode struct {
+	NodeType
+	Pos
+	Value Node
+	Name  string
+	Args  []Node
+}
+
+func newFilterNode(val Node, name string, args []Node) *FilterNode {
+	return &FilterNode{NodeFilter, val.Position(), val, name, args}
+}
+
+func (f *FilterNode) String() string {
+	if len(f.Args) == 0 {
+		return fmt.Sprintf("%s | %s", operand(f.Value, precAtom), f.Name)
+	}
+	return fmt.Sprintf("%s | %s(%s)", operand(f.Value, precAtom), f.Name, joinNodes(f.Args, ", "))
+}
+
+func (f *FilterNode) Copy() Node {
+	return newFilterNode(f.Value.Copy(), f.Name, copyNodes(f.Args))
+}
+
+// TestNode applies the test Name to the result of an expression, along with
+// any arguments, ie. `value is name(args)`.  If Negated is set, the
+// result of the test is inverted, ie. `value is not name`.
+type TestNode struct {
+	NodeType
+	Pos
+	Value   Node
+	Name    string
+	Args    []Node
+	Negated bool
+}
+
+func newTestNode(val Node, name string, args []Node, negated bool) *TestNode {
+	return &TestNode{NodeTest, val.Position(), val, name, args, negated}
+}
+
+func (t *TestNode) String() string {
+	b := new(bytes.Buffer)
+	b.WriteString(operand(t.Value, precAtom))
+	b.WriteString(" is ")
+	if t.Negated {
+		b.WriteString("not ")
+	}
+	b.WriteString(t.Name)
+	if len(t.Args) > 0 {
+		fmt.Fprintf(b, "(%s)", joinNodes(t.Args, ", "))
+	}
+	return b.String()
+}
+
+func (t *TestNode) Copy() Node {
+	return newTestNode(t.Value.Copy(), t.Name, copyNodes(t.Args), t.Negated)
+}
+
+// KeywordNode is a keyword argument in an argument list, ie. `name=value`.
+type KeywordNode struct {
+	NodeType
+	Pos
+	Name  string
+	Value Node
+}
+
+func newKeyword(pos Pos, name string, val Node) *KeywordNode {
+	return &KeywordNode{NodeKeyword, pos, name, val}
+}
+
+func (k *KeywordNode) String() string { return fmt.Sprintf("%s=%s", k.Name, k.Value) }
+func (k *KeywordNode) Copy() Node     { return newKeyword(k.Pos, k.Name, k.Value.Copy()) }
+
+// The precedence of expression nodes when they are printed, matching the
+// precedence of their operators in the parser.  Filters, attributes, calls
+// and subscripts bind tighter than any operator, and tests bind tighter than
+// any binary operator.
+const (
+	precTernary = 0
+	precOr      = 1
+	precAnd     = 2
+	precNot     = 3
+	precCompare = 4
+	precAdd     = 5
+	precConcat  = 6
+	precMul     = 7
+	precTest    = 8
+	precAtom    = 9
+)
+
+func precedence(n Node) int {
+	switch n.(type) {
+	case *TernaryNode:
+		return precTernary
+	case *OrNode:
+		return precOr
+	case *AndNode:
+		return precAnd
+	case *NotNode:
+		return precNot
+	case *CompareExpr:
+		return precCompare
+	case *ConcatNode:
+		return precConcat
+	case *AddExpr:
+		return precAdd
+	case *MulExpr:
+		return precMul
+	case *TestNode:
+		return precTest
+	}
+	return precAtom
+}
+
+// operand returns the string form of n as an operand of an operator with
+// precedence prec, parenthesized if it binds more loosely than that.
+func operand(n Node, prec int) string {
+	if precedence(n) < prec {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+// joinNodes joins the string form of nodes with sep.
+func joinNodes(nodes []Node, sep string) string {
+	b := new(bytes.Buffer)
+	for i, n := range nodes {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		fmt.Fprint(b, n)
+	}
+	return b.String()
+}
+
+// copyNode returns a deep copy of n, which may be nil.
+func copyNode(n Node) Node {
+	if n == nil {
+		return nil
+	}
+	return n.Copy()
+}
+
+// copyNodes returns a deep copy of a slice of nodes.
+func copyNodes(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	c := make([]Node, len(nodes))
+	for i, n := range nodes {
+		c[i] = n.Copy()
+	}
+	return c
 }
 
 // block types
@@ -427,22 +929,24 @@ func (i *IfBlockNode) String() string {
 }
 func (i *IfBlockNode) Copy() Node {
 	n := newIf(i.Pos)
-	n.Conditionals = make([]Node, len(i.Conditionals))
-	for _, e := range i.Conditionals {
-		n.Conditionals = append(n.Conditionals, e.Copy())
-	}
-	if i.Else != nil {
-		n.Else = i.Else.Copy()
-	}
+	n.Conditionals = copyNodes(i.Conditionals)
+	n.Else = copyNode(i.Else)
 	return n
 }
 
+// ForNode represents a {% for %} block.  The Body is rendered for each item
+// in the result of InExpr, which is assigned to ForExpr.  If there are no
+// items, the Else body is rendered instead;  it is nil if not present.
 type ForNode struct {
 	NodeType
 	Pos
 	ForExpr Node
 	InExpr  Node
 	Body    Node
+	Else    Node
+	// If Recursive, the body can call loop(items) to render the loop
+	// again over items, eg. to render a tree.
+	Recursive bool
 }
 
 func newFor(pos Pos) *ForNode {
@@ -452,16 +956,30 @@ func newFor(pos Pos) *ForNode {
 // FIXME: This should use the environment's begin and end tags, which we
 // don't have down at this level...
 func (f *ForNode) String() string {
-	return fmt.Sprintf("{%% for %s in %s %%}%s{%% endfor %%}", f.ForExpr, f.InExpr, f.Body)
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "{%% for %s in %s", f.ForExpr, f.InExpr)
+	if f.Recursive {
+		b.WriteString(" recursive")
+	}
+	fmt.Fprintf(b, " %%}%s", f.Body)
+	if f.Else != nil {
+		fmt.Fprintf(b, "{%% else %%}%s", f.Else)
+	}
+	b.WriteString("{% endfor %}")
+	return b.String()
 }
 func (f *ForNode) Copy() Node {
 	n := newFor(f.Pos)
 	n.ForExpr = f.ForExpr.Copy()
 	n.InExpr = f.InExpr.Copy()
 	n.Body = f.Body.Copy()
+	n.Else = copyNode(f.Else)
+	n.Recursive = f.Recursive
 	return n
 }
 
+// BlockNode represents a {% block name %} tag.  Its Body is rendered in place,
+// and can be rendered again elsewhere via `self.name()`.
 type BlockNode struct {
 	NodeType
 	Pos
@@ -469,6 +987,10 @@ type BlockNode struct {
 	Body Node
 }
 
+func newBlock(pos Pos, name string) *BlockNode {
+	return &BlockNode{NodeType: NodeBlock, Pos: pos, Name: name}
+}
+
 func (b *BlockNode) String() string {
 	return fmt.Sprintf("{%% block %v %%}%v{%% endblock %%}", b.Name, b.Body)
 }
@@ -477,6 +999,28 @@ func (b *BlockNode) Copy() Node {
 	return &BlockNode{b.NodeType, b.Pos, b.Name, b.Body.Copy()}
 }
 
+// CacheNode represents a {% cache timeout key %} tag.  Its Body is rendered
+// once per key and stored in the environment's Cache for timeout seconds.
+type CacheNode struct {
+	NodeType
+	Pos
+	Timeout Node
+	Key     Node
+	Body    Node
+}
+
+func newCache(pos Pos) *CacheNode {
+	return &CacheNode{NodeType: NodeCache, Pos: pos}
+}
+
+func (c *CacheNode) String() string {
+	return fmt.Sprintf("{%% cache %v %v %%}%v{%% endcache %%}", c.Timeout, c.Key, c.Body)
+}
+
+func (c *CacheNode) Copy() Node {
+	return &CacheNode{c.NodeType, c.Pos, c.Timeout.Copy(), c.Key.Copy(), c.Body.Copy()}
+}
+
 type Import struct {
 	Name string
 	As   string
@@ -490,13 +1034,92 @@ type PrintNode struct {
 	NodeType
 	Pos
 }
+
+// BreakNode represents a {% break %} tag, which stops the enclosing loop.
+type BreakNode struct {
+	NodeType
+	Pos
+}
+
+func newBreak(pos Pos) *BreakNode {
+	return &BreakNode{NodeBreak, pos}
+}
+
+func (b *BreakNode) String() string { return "{% break %}" }
+func (b *BreakNode) Copy() Node     { return newBreak(b.Pos) }
+
+// ContinueNode represents a {% continue %} tag, which skips the rest of the
+// current iteration of the enclosing loop.
+type ContinueNode struct {
+	NodeType
+	Pos
+}
+
+func newContinue(pos Pos) *ContinueNode {
+	return &ContinueNode{NodeContinue, pos}
+}
+
+func (c *ContinueNode) String() string { return "{% continue %}" }
+func (c *ContinueNode) Copy() Node     { return newContinue(c.Pos) }
+
+// MacroNode represents a {% macro name(params) %} tag.  Calling the macro
+// renders its Body with its parameters set to the arguments.  Defaults holds
+// the default value of each parameter, or nil if it has none.
 type MacroNode struct {
 	NodeType
 	Pos
+	Name     string
+	Params   []string
+	Defaults []Node
+	Body     Node
+}
+
+func newMacro(pos Pos, name string) *MacroNode {
+	return &MacroNode{NodeType: NodeMacro, Pos: pos, Name: name}
 }
+
+// signature returns the macro's name and parameters, as in its tag.
+func (m *MacroNode) signature() string {
+	params := make([]string, len(m.Params))
+	for i, p := range m.Params {
+		params[i] = p
+		if m.Defaults[i] != nil {
+			params[i] += "=" + m.Defaults[i].String()
+		}
+	}
+	return fmt.Sprintf("%s(%s)", m.Name, strings.Join(params, ", "))
+}
+
+func (m *MacroNode) String() string {
+	return fmt.Sprintf("{%% macro %s %%}%v{%% endmacro %%}", m.signature(), m.Body)
+}
+
+func (m *MacroNode) Copy() Node {
+	n := &MacroNode{m.NodeType, m.Pos, m.Name, append([]string(nil), m.Params...), make([]Node, len(m.Defaults)), copyNode(m.Body)}
+	for i, d := range m.Defaults {
+		n.Defaults[i] = copyNode(d)
+	}
+	return n
+}
+
+// IncludeNode represents an {% include template %} tag, which renders the
+// named template in the current context.
 type IncludeNode struct {
 	NodeType
 	Pos
+	Template Node
+}
+
+func newInclude(pos Pos, template Node) *IncludeNode {
+	return &IncludeNode{NodeInclude, pos, template}
+}
+
+func (i *IncludeNode) String() string {
+	return fmt.Sprintf("{%% include %v %%}", i.Template)
+}
+
+func (i *IncludeNode) Copy() Node {
+	return &IncludeNode{i.NodeType, i.Pos, i.Template.Copy()}
 }
 
 type FromNode struct {
@@ -45,3 +45,487 @@ func TestStack(t *testing.T) {
 		t.Errorf("Expected len of 1, got %d\n", s.len())
 	}
 }
+
+func TestVarNodeCopy(t *testing.T) {
+	tree, err := NewEnvironment().parse(`{{ a + 1 }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := tree.Root.Nodes[0].(*VarNode)
+	c := v.Copy().(*VarNode)
+	v.Node.(*AddExpr).rhs.(*IntegerNode).Value = 2
+	if s := c.String(); s != "{{ a + 1 }}" {
+		t.Errorf("Expected the copy to be unaffected, got %s", s)
+	}
+	if c.Node == v.Node {
+		t.Errorf("Expected Copy to copy the expression")
+	}
+	if c := (&VarNode{NodeType: NodeVar}).Copy().(*VarNode); c.Node != nil {
+		t.Errorf("Expected a nil expression to be copied as nil, got %v", c.Node)
+	}
+}
+
+func TestFilterNode(t *testing.T) {
+	e := NewEnvironment()
+	tree, err := e.parse(`{{ a|b|c(1, "x") }}`, "test", "test.jigo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := tree.Root.Nodes[0].(*VarNode)
+	f, ok := v.Node.(*FilterNode)
+	if !ok {
+		t.Fatalf("Expected FilterNode, got %T", v.Node)
+	}
+	if f.Name != "c" || len(f.Args) != 2 {
+		t.Errorf("Expected outer filter c with 2 args, got %s with %d", f.Name, len(f.Args))
+	}
+	if inner, ok := f.Value.(*FilterNode); !ok || inner.Name != "b" {
+		t.Errorf("Expected inner filter b, got %v", f.Value)
+	}
+	if s := f.String(); s != `a | b | c(1, "x")` {
+		t.Errorf("Unexpected String() %s", s)
+	}
+
+	c := f.Copy().(*FilterNode)
+	c.Args[0].(*IntegerNode).Value = 2
+	if f.Args[0].(*IntegerNode).Value != 1 {
+		t.Error("Expected Copy to deep copy filter args")
+	}
+}
+
+// exprTest is a template holding a single `{{ expr }}`, and the string form
+// expected of the expression it parses to.
+type exprTest struct{ in, out string }
+
+// checkExprString parses the template in and checks that the string form of
+// its expression, of a copy of it and of the expression it parses to again
+// are all out.  It returns the expression, or nil if it did not parse.
+func checkExprString(t *testing.T, in, out string) Node {
+	t.Helper()
+	e := NewEnvironment()
+	tree, err := e.parse(in, "test", "test")
+	if err != nil {
+		t.Errorf("%s: %s", in, err)
+		return nil
+	}
+	n := tree.Root.Nodes[0].(*VarNode).Node
+	if s := n.String(); s != out {
+		t.Errorf("%s: expected `%s`, got `%s`", in, out, s)
+	}
+	if s := n.Copy().String(); s != out {
+		t.Errorf("%s: expected copy `%s`, got `%s`", in, out, s)
+	}
+	again, err := e.parse("{{ "+n.String()+" }}", "test", "test")
+	if err != nil {
+		t.Errorf("%s: %s", out, err)
+	} else if s := again.Root.Nodes[0].(*VarNode).Node.String(); s != out {
+		t.Errorf("%s: expected round trip `%s`, got `%s`", in, out, s)
+	}
+	return n
+}
+
+// checkExprStrings runs checkExprString on each test.
+func checkExprStrings(t *testing.T, tests []exprTest) {
+	t.Helper()
+	for _, test := range tests {
+		checkExprString(t, test.in, test.out)
+	}
+}
+
+func TestFilterNodeString(t *testing.T) {
+	checkExprStrings(t, []exprTest{
+		{`{{ name|upper }}`, "name | upper"},
+		{`{{ price | round(2) }}`, "price | round(2)"},
+		{`{{ a | b | c }}`, "a | b | c"},
+		{`{{ (a + b)|abs }}`, "(a + b) | abs"},
+		{`{{ a + b|abs }}`, "a + b | abs"},
+		{`{{ user.name|default("x", true)|e }}`, `user.name | default("x", true) | e`},
+	})
+}
+
+func TestTestNode(t *testing.T) {
+	tests := []struct {
+		in, out, name string
+		args          int
+		negated       bool
+	}{
+		{`{{ x is defined }}`, "x is defined", "defined", 0, false},
+		{`{{ x is not none }}`, "x is not none", "none", 0, true},
+		{`{{ n is divisibleby(3) }}`, "n is divisibleby(3)", "divisibleby", 1, false},
+		{`{{ n is divisibleby 3 }}`, "n is divisibleby(3)", "divisibleby", 1, false},
+		{`{{ (a + b) is not odd }}`, "(a + b) is not odd", "odd", 0, true},
+	}
+	for _, test := range tests {
+		expr := checkExprString(t, test.in, test.out)
+		if expr == nil {
+			continue
+		}
+		n, ok := expr.(*TestNode)
+		if !ok {
+			t.Errorf("%s: expected TestNode, got %T", test.in, expr)
+			continue
+		}
+		if n.Name != test.name || len(n.Args) != test.args || n.Negated != test.negated {
+			t.Errorf("%s: expected %s with %d args, negated %v, got %s with %d, %v",
+				test.in, test.name, test.args, test.negated, n.Name, len(n.Args), n.Negated)
+		}
+	}
+}
+
+func TestConcatNode(t *testing.T) {
+	checkExprStrings(t, []exprTest{
+		{`{{ "a" ~ 1 ~ "b" }}`, `"a" ~ 1 ~ "b"`},
+		{`{{ a ~ (b ~ c) }}`, "a ~ (b ~ c)"},
+		{`{{ a + 1 ~ b * 2 }}`, "a + 1 ~ b * 2"},
+		{`{{ (a ~ b) + c }}`, "a ~ b + c"},
+		{`{{ (a + 1) ~ b }}`, "(a + 1) ~ b"},
+		{`{{ a ~ b == "ab" }}`, `a ~ b == "ab"`},
+		{`{{ a ~ b|upper }}`, "a ~ b | upper"},
+	})
+
+	e := NewEnvironment()
+	tree, _ := e.parse(`{{ a ~ 1 ~ "b" }}`, "test", "test")
+	c, ok := tree.Root.Nodes[0].(*VarNode).Node.(*ConcatNode)
+	if !ok || c.Type() != NodeConcat || c.Position() != 3 {
+		t.Fatalf("Expected a ConcatNode at 3, got %#v", tree.Root.Nodes[0].(*VarNode).Node)
+	}
+	if _, ok := c.lhs.(*ConcatNode); !ok {
+		t.Errorf("Expected concatenation to associate to the left, got %#v", c)
+	}
+	if cp := c.Copy().(*ConcatNode); cp.lhs == c.lhs {
+		t.Errorf("Expected Copy to copy the operands")
+	}
+
+	testFixtures(t, e, []evalFixture{
+		{"Concat", `{{ "a" ~ 1 ~ "b" }}`, m{}, "a1b"},
+		{"Precedence", `{{ 1 ~ 2 * 3 }}`, m{}, "16"},
+		{"Parens", `{{ (1 + 2) ~ 3 * 4 }}`, m{}, "312"},
+		{"Values", `{{ name ~ ":" ~ n ~ ok }}`, m{"name": "x", "n": 1.5, "ok": true}, "x:1.5true"},
+		{"Undefined", `[{{ missing ~ "a" }}]`, m{}, "[a]"},
+		{"Compare", `{{ a ~ b == "ab" }}`, m{"a": "a", "b": "b"}, "true"},
+	})
+
+	// `~` binds tighter than `+`, so this adds 2 to "n=1", as in Jinja2
+	tpl, err := e.ParseString(`{{ "n=" ~ 1 + 2 }}`, "add", "add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(m{}); err == nil {
+		t.Error("Expected an error adding a number to a concatenation")
+	}
+}
+
+func TestSliceExpr(t *testing.T) {
+	tests := []struct {
+		in, out           string
+		start, stop, step bool
+	}{
+		{`{{ items[1:3] }}`, "items[1:3]", true, true, false},
+		{`{{ items[::2] }}`, "items[::2]", false, false, true},
+		{`{{ items[:] }}`, "items[:]", false, false, false},
+		{`{{ items[1:] }}`, "items[1:]", true, false, false},
+		{`{{ items[:-1] }}`, "items[:-1]", false, true, false},
+		{`{{ items[a + 1:b:-1] }}`, "items[a + 1:b:-1]", true, true, true},
+		{`{{ (a ~ b)[1:] }}`, "(a ~ b)[1:]", true, false, false},
+		{`{{ x.items[1:2][0] }}`, "x.items[1:2][0]", true, true, false},
+	}
+	for _, test := range tests {
+		n := checkExprString(t, test.in, test.out)
+		if n == nil {
+			continue
+		}
+		if idx, ok := n.(*IndexExpr); ok {
+			n = idx.Value
+		}
+		s, ok := n.(*SliceExpr)
+		if !ok {
+			t.Errorf("%s: expected a SliceExpr, got %T", test.in, n)
+			continue
+		}
+		if (s.Start != nil) != test.start || (s.Stop != nil) != test.stop || (s.Step != nil) != test.step {
+			t.Errorf("%s: expected bounds %v %v %v, got %v %v %v", test.in, test.start, test.stop, test.step, s.Start, s.Stop, s.Step)
+		}
+	}
+}
+
+func TestMacroNodeCopy(t *testing.T) {
+	e := NewEnvironment()
+	tree, err := e.parse(`{% macro greet(name, greeting="Hello") %}{{ greeting }}, {{ name }}!{% endmacro %}{{ greet("Ann") }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := tree.Copy()
+	orig := tree.Root.Nodes[0].(*MacroNode)
+	macro := cp.Root.Nodes[0].(*MacroNode)
+	if macro == orig || macro.String() != orig.String() {
+		t.Fatalf("Expected an equal copy of %s, got %s", orig, macro)
+	}
+
+	// mutate every part of the copy
+	macro.Name = "wave"
+	macro.Params[0] = "who"
+	macro.Defaults[1].(*StringNode).Value = "Hi"
+	macro.Defaults = append(macro.Defaults[:1], newLiteral(0, tokenString, "Yo"))
+	body := macro.Body.(*ListNode)
+	body.Nodes[1].(*TextNode).Text[0] = ';'
+	body.append(newText(0, "?"))
+
+	want := `{% macro greet(name, greeting="Hello") %}{{ greeting }}, {{ name }}!{% endmacro %}`
+	if s := orig.String(); s != want {
+		t.Errorf("Expected the original macro to be unchanged, got %s", s)
+	}
+	if s := macro.String(); s != `{% macro wave(who, greeting="Yo") %}{{ greeting }}; {{ name }}!?{% endmacro %}` {
+		t.Errorf("Expected the copy to be changed, got %s", s)
+	}
+	if len(orig.Body.(*ListNode).Nodes) != 4 {
+		t.Errorf("Expected the original body to keep 4 nodes, got %d", len(orig.Body.(*ListNode).Nodes))
+	}
+}
+
+func TestLogicalNodes(t *testing.T) {
+	checkExprStrings(t, []exprTest{
+		{`{{ a and b }}`, "a and b"},
+		{`{{ a or b }}`, "a or b"},
+		{`{{ not a }}`, "not a"},
+		{`{{ a or b and c }}`, "a or b and c"},
+		{`{{ (a or b) and c }}`, "(a or b) and c"},
+		{`{{ a and (b or c) }}`, "a and (b or c)"},
+		{`{{ a and b and c }}`, "a and b and c"},
+		{`{{ a and (b and c) }}`, "a and (b and c)"},
+		{`{{ not a and b }}`, "not a and b"},
+		{`{{ not (a and b) }}`, "not (a and b)"},
+		{`{{ not not a }}`, "not not a"},
+		{`{{ not a == b }}`, "not a == b"},
+		{`{{ (not a) == b }}`, "(not a) == b"},
+		{`{{ a or not b }}`, "a or not b"},
+		{`{{ x not in l and y in l }}`, "x not in l and y in l"},
+		{`{{ a && b || c }}`, "a and b or c"},
+		{`{{ x is defined and x > 1 }}`, "x is defined and x > 1"},
+	})
+
+	e := NewEnvironment()
+	tree, _ := e.parse(`{{ not a or b and c }}`, "test", "test")
+	or, ok := tree.Root.Nodes[0].(*VarNode).Node.(*OrNode)
+	if !ok {
+		t.Fatalf("Expected an OrNode, got %T", tree.Root.Nodes[0].(*VarNode).Node)
+	}
+	if _, ok := or.lhs.(*NotNode); !ok {
+		t.Errorf("Expected `not` to bind tighter than `or`, got %T", or.lhs)
+	}
+	and, ok := or.rhs.(*AndNode)
+	if !ok {
+		t.Fatalf("Expected `and` to bind tighter than `or`, got %T", or.rhs)
+	}
+	cp := or.Copy().(*OrNode)
+	if cp.lhs == or.lhs || cp.rhs == or.rhs || cp.rhs.(*AndNode).lhs == and.lhs || cp.lhs.(*NotNode).Value == or.lhs.(*NotNode).Value {
+		t.Errorf("Expected Copy to copy the operands")
+	}
+
+	ctx := m{"t": true, "f": false, "name": "", "l": []int{1}}
+	testFixtures(t, e, []evalFixture{
+		{"And", `{{ t and f }} {{ t and t }}`, ctx, "false true"},
+		{"Or", `{{ f or t }} {{ f or f }}`, ctx, "true false"},
+		{"Not", `{{ not t }} {{ not name }}`, ctx, "false true"},
+		{"Values", `{{ name or "anon" }} {{ 1 and "x" }}`, ctx, "anon x"},
+		{"Short circuit", `{{ f and missing.call() }}{{ t or missing.call() }}`, ctx, "falsetrue"},
+		{"If", `{% if t and not f %}yes{% endif %}`, ctx, "yes"},
+		{"Membership", `{{ 1 in l and 2 not in l }}`, ctx, "true"},
+		{"Defined test", `{{ x is defined and x > 1 }}`, ctx, "false"},
+	})
+}
+
+func TestTernaryNode(t *testing.T) {
+	checkExprStrings(t, []exprTest{
+		{`{{ a if c else b }}`, "a if c else b"},
+		{`{{ a if c }}`, "a if c"},
+		{`{{ a + 1 if x > 1 and y else b ~ c }}`, "a + 1 if x > 1 and y else b ~ c"},
+		{`{{ a if x else b if y else c }}`, "a if x else b if y else c"},
+		{`{{ (a if x else b) if y else c }}`, "(a if x else b) if y else c"},
+		{`{{ a if (x if y else z) }}`, "a if (x if y else z)"},
+		{`{{ (a if c else b)|e }}`, "(a if c else b) | e"},
+		{`{{ f(a if c else b) }}`, "f(a if c else b)"},
+	})
+
+	e := NewEnvironment()
+	for _, src := range []string{`{{ a if c else b }}`, `{{ a if c }}`} {
+		tree, _ := e.parse(src, "test", "test")
+		n := tree.Root.Nodes[0].(*VarNode).Node.(*TernaryNode)
+		cp := n.Copy().(*TernaryNode)
+		if cp.TrueExpr == n.TrueExpr || cp.Cond == n.Cond || (n.FalseExpr != nil && cp.FalseExpr == n.FalseExpr) {
+			t.Errorf("%s: expected Copy to copy the sub-expressions", src)
+		}
+		if (cp.FalseExpr == nil) != (n.FalseExpr == nil) {
+			t.Errorf("%s: expected Copy to keep the else branch %v, got %v", src, n.FalseExpr, cp.FalseExpr)
+		}
+		if cp.Position() != n.Position() {
+			t.Errorf("%s: expected copy at %d, got %d", src, n.Position(), cp.Position())
+		}
+	}
+
+	ctx := m{"t": true, "f": false, "n": 3}
+	testFixtures(t, e, []evalFixture{
+		{"True", `{{ "yes" if t else "no" }}`, ctx, "yes"},
+		{"False", `{{ "yes" if f else "no" }}`, ctx, "no"},
+		{"No else", `[{{ "yes" if f }}]`, ctx, "[]"},
+		{"Chained", `{{ "a" if n == 1 else "b" if n == 2 else "c" }}`, ctx, "c"},
+		{"Lazy", `{{ "ok" if t else missing.call() }}`, ctx, "ok"},
+		{"Set", `{% set s = n * 2 if t else 0 %}{{ s }}`, ctx, "6"},
+	})
+}
+
+func TestTupleNode(t *testing.T) {
+	tests := []struct {
+		in, out string
+		elems   int
+	}{
+		{`{{ () }}`, "()", 0},
+		{`{{ (1,) }}`, "(1,)", 1},
+		{`{{ (1, 2, 3) }}`, "(1, 2, 3)", 3},
+		{`{{ (1, "a", (b, c),) }}`, `(1, "a", (b, c))`, 3},
+		{`{{ (a + 1, f(x)) }}`, "(a + 1, f(x))", 2},
+	}
+	for _, test := range tests {
+		expr := checkExprString(t, test.in, test.out)
+		if expr == nil {
+			continue
+		}
+		n, ok := expr.(*TupleNode)
+		if !ok {
+			t.Errorf("%s: expected TupleNode, got %T", test.in, expr)
+			continue
+		}
+		if len(n.Elems) != test.elems {
+			t.Errorf("%s: expected %d elements, got %d", test.in, test.elems, len(n.Elems))
+		}
+		if test.elems > 0 && n.Position() != n.Elems[0].Position() {
+			t.Errorf("%s: expected position %d, got %d", test.in, n.Elems[0].Position(), n.Position())
+		}
+		cp := n.Copy().(*TupleNode)
+		for i := range n.Elems {
+			if cp.Elems[i] == n.Elems[i] {
+				t.Errorf("%s: expected Copy to copy element %d", test.in, i)
+			}
+		}
+	}
+
+	e := NewEnvironment()
+	tree, err := e.parse(`{{ (1) }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := tree.Root.Nodes[0].(*VarNode).Node; n.Type() != NodeInteger {
+		t.Errorf("Expected a parenthesized expression to be its value, got %T", n)
+	}
+
+	ctx := m{"a": 1}
+	testFixtures(t, e, []evalFixture{
+		{"Iterate", `{% for x in (1, "b", a) %}{{ x }}{% endfor %}`, ctx, "1b1"},
+		{"Unpack", `{% set x, y = (a, a + 1) %}{{ x }}{{ y }}`, ctx, "12"},
+		{"Index", `{{ (1, 2, 3)[1] }}`, ctx, "2"},
+		{"Membership", `{{ a in (1, 2) }}`, ctx, "true"},
+	})
+}
+
+func TestListLiteralNode(t *testing.T) {
+	tests := []struct {
+		in, out string
+		elems   int
+	}{
+		{`{{ [] }}`, "[]", 0},
+		{`{{ [1] }}`, "[1]", 1},
+		{`{{ [1, 2, 3] }}`, "[1, 2, 3]", 3},
+		{`{{ [ 1 , "a" , ] }}`, `[1, "a"]`, 2},
+		{`{{ [a + 1, [b], (c,)] }}`, "[a + 1, [b], (c,)]", 3},
+	}
+	for _, test := range tests {
+		expr := checkExprString(t, test.in, test.out)
+		if expr == nil {
+			continue
+		}
+		n, ok := expr.(*ListLiteralNode)
+		if !ok {
+			t.Errorf("%s: expected ListLiteralNode, got %T", test.in, expr)
+			continue
+		}
+		if len(n.Elems) != test.elems {
+			t.Errorf("%s: expected %d elements, got %d", test.in, test.elems, len(n.Elems))
+		}
+		if n.Position() != 3 {
+			t.Errorf("%s: expected position 3, got %d", test.in, n.Position())
+		}
+		cp := n.Copy().(*ListLiteralNode)
+		for i := range n.Elems {
+			if cp.Elems[i] == n.Elems[i] {
+				t.Errorf("%s: expected Copy to copy element %d", test.in, i)
+			}
+		}
+		if cp.Position() != n.Position() {
+			t.Errorf("%s: expected copy at %d, got %d", test.in, n.Position(), cp.Position())
+		}
+	}
+
+	e := NewEnvironment()
+	tree, err := e.parse(`{{ [1, 2][0] }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := tree.Root.Nodes[0].(*VarNode).Node.(*IndexExpr); !ok || n.String() != "[1, 2][0]" {
+		t.Errorf("Expected an index of a list literal, got %v", tree.Root.Nodes[0].(*VarNode).Node)
+	}
+	for _, src := range []string{`{{ [,] }}`, `{{ [1,,] }}`, `{{ [1 2] }}`, `{{ [1 }}`} {
+		if _, err := e.parse(src, "test", "test"); err == nil {
+			t.Errorf("%s: expected a parse error", src)
+		}
+	}
+}
+
+func TestCompareExpr(t *testing.T) {
+	tests := []struct {
+		in, out string
+		ops     []itemType
+	}{
+		{`{{ a < b }}`, "a < b", []itemType{tokenLt}},
+		{`{{ a<=b }}`, "a <= b", []itemType{tokenLteq}},
+		{`{{ a > b }}`, "a > b", []itemType{tokenGt}},
+		{`{{ a >= b }}`, "a >= b", []itemType{tokenGteq}},
+		{`{{ a == b }}`, "a == b", []itemType{tokenEqEq}},
+		{`{{ a != b }}`, "a != b", []itemType{tokenNeq}},
+		{`{{ 1 < x < 10 }}`, "1 < x < 10", []itemType{tokenLt, tokenLt}},
+		{`{{ a == b != c >= d }}`, "a == b != c >= d", []itemType{tokenEqEq, tokenNeq, tokenGteq}},
+		{`{{ a + 1 < b * 2 }}`, "a + 1 < b * 2", []itemType{tokenLt}},
+		{`{{ (a < b) == c }}`, "(a < b) == c", []itemType{tokenEqEq}},
+		{`{{ a < (b < c) }}`, "a < (b < c)", []itemType{tokenLt}},
+	}
+	for _, test := range tests {
+		expr := checkExprString(t, test.in, test.out)
+		if expr == nil {
+			continue
+		}
+		c, ok := expr.(*CompareExpr)
+		if !ok {
+			t.Errorf("%s: expected a CompareExpr, got %T", test.in, expr)
+			continue
+		}
+		if len(c.Operands) != len(c.Operators)+1 || len(c.Operators) != len(test.ops) {
+			t.Errorf("%s: expected %d operators and one more operand, got %d and %d", test.in, len(test.ops), len(c.Operators), len(c.Operands))
+			continue
+		}
+		for i, typ := range test.ops {
+			if c.Operators[i].typ != typ {
+				t.Errorf("%s: expected operator %d to be %d, got %v", test.in, i, typ, c.Operators[i])
+			}
+		}
+		if c.Position() != c.Operands[0].Position() || c.Type() != NodeCompare {
+			t.Errorf("%s: expected a NodeCompare at its first operand, got %s at %d", test.in, c.Type(), c.Position())
+		}
+	}
+
+	tree, _ := NewEnvironment().parse(`{{ 1 < x < 10 }}`, "test", "test")
+	c := tree.Root.Nodes[0].(*VarNode).Node.(*CompareExpr)
+	cp := c.Copy().(*CompareExpr)
+	cp.Operators[1] = item{typ: tokenLteq, val: "<="}
+	cp.Operands[2] = newLookup(0, "y")
+	if c.String() != "1 < x < 10" || cp.String() != "1 < x <= y" {
+		t.Errorf("Expected an independent copy, got `%s` and `%s`", c, cp)
+	}
+}
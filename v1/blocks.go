@@ -0,0 +1,65 @@
+package v1
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// self is the `self` variable, whose attributes are the blocks of the
+// template being rendered.  Calling one renders the block again.
+type self struct {
+	r      *renderer
+	blocks map[string]*BlockNode
+}
+
+func newSelf(r *renderer) *self {
+	s := &self{r: r, blocks: make(map[string]*BlockNode)}
+	s.find(r.t.base.Root)
+	return s
+}
+
+// find records the blocks in n and the nodes beneath it.
+func (s *self) find(n Node) {
+	if b, ok := n.(*BlockNode); ok {
+		s.blocks[b.Name] = b
+	}
+	for _, c := range children(n) {
+		s.find(c)
+	}
+}
+
+func (s *self) getattr(name string) (interface{}, bool) {
+	b, ok := s.blocks[name]
+	if !ok {
+		return nil, false
+	}
+	return &blockRef{s.r, b}, true
+}
+
+func (s *self) String() string {
+	return fmt.Sprintf("<template %s>", s.r.t.Name)
+}
+
+// blockRef is a block referenced via `self`, which renders the block when
+// called.
+type blockRef struct {
+	r *renderer
+	n *BlockNode
+}
+
+// call renders the block in the current context and returns its output.
+func (b *blockRef) call(args []interface{}, kwargs Kwargs) (interface{}, error) {
+	if len(args) > 0 || len(kwargs) > 0 {
+		return nil, fmt.Errorf("wrong number of args: want 0, got %d", len(args)+len(kwargs))
+	}
+	w := b.r.w
+	defer func() { b.r.w = w }()
+	var buf bytes.Buffer
+	b.r.w = &buf
+	err := b.r.renderNode(b.n.Body)
+	return Safe(buf.String()), err
+}
+
+func (b *blockRef) String() string {
+	return fmt.Sprintf("<block %s>", b.n.Name)
+}
@@ -0,0 +1,39 @@
+package v1
+
+import "testing"
+
+func TestBlocks(t *testing.T) {
+	ctx := m{"title": "Home", "l": []int{1, 2}}
+	fixtures := []evalFixture{
+		{"Block in place", `<h1>{% block header %}{{ title }}{% endblock %}</h1>`, ctx, "<h1>Home</h1>"},
+		{
+			"Block via self",
+			`<h1>{% block header %}{{ title }}{% endblock header %}</h1><footer>{{ self.header() }}</footer>`,
+			ctx,
+			"<h1>Home</h1><footer>Home</footer>",
+		},
+		{"Self before block", `{{ self.header() }}|{% block header %}h{% endblock %}`, ctx, "h|h"},
+		{"Nested block", `{% block outer %}[{% block inner %}i{% endblock %}]{% endblock %}{{ self.inner() }}`, ctx, "[i]i"},
+		{"Self in loop", `{% block b %}{{ x }}{% endblock %}{% for x in l %}{{ self.b() }}{% endfor %}`, ctx, "12"},
+		{"Undefined block", `[{{ self.missing }}]`, ctx, "[]"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.AutoEscape = true
+	tpl, _ := e.ParseString(`{% block b %}<b>{{ s }}</b>{% endblock %}{{ self.b() }}`, "blocks", "blocks")
+	if out, err := tpl.Render(m{"s": "<"}); err != nil || out != "<b>&lt;</b><b>&lt;</b>" {
+		t.Errorf("Expected block output to be safe, got %q (%v)", out, err)
+	}
+
+	for _, bad := range []string{
+		`{% block a %}{% endblock %}{% block a %}{% endblock %}`,
+		`{% block a %}{% endblock b %}`,
+		`{% block a %}`,
+		`{% block %}{% endblock %}`,
+	} {
+		if _, err := NewEnvironment().ParseString(bad, "blocks", "blocks"); err == nil {
+			t.Errorf("Expected parse error for %s", bad)
+		}
+	}
+}
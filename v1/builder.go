@@ -0,0 +1,511 @@
+package v1
+
+import (
+	"fmt"
+	"reflect"
+	"unicode"
+)
+
+// The functions below build templates in Go without parsing source, eg. to
+// generate them.  Each checks its arguments, so a tree built from them can
+// be rendered like a parsed one.  Nodes built this way have no position in
+// any source, so errors rendering them refer to the start of the template.
+
+// NewTemplate returns a template called name with the tree root, and
+// registers it with the environment like ParseString.
+func (e *Environment) NewTemplate(name string, root *ListNode) (*Template, error) {
+	if root == nil {
+		return nil, fmt.Errorf("template %s has no root", name)
+	}
+	if err := checkLoopControl(root, false); err != nil {
+		return nil, fmt.Errorf("template %s: %s", name, err)
+	}
+	tree := newTree(name)
+	tree.ParseName = name
+	tree.Root = root
+	t := &Template{Name: name, base: tree, env: e}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.templates == nil {
+		e.templates = make(map[string]*Template)
+	}
+	e.templates[name] = t
+	return t, nil
+}
+
+// NewListNode returns a list of the statement nodes, such as text, vars and
+// blocks, rendered one after another.
+func NewListNode(nodes ...Node) (*ListNode, error) {
+	l := newList(0)
+	for _, n := range nodes {
+		if n == nil {
+			return nil, fmt.Errorf("missing statement")
+		}
+		// a conditional is only a statement as part of an if
+		if _, ok := n.(*ConditionalNode); ok || isExpr(n) {
+			return nil, fmt.Errorf("%s is not a statement", n)
+		}
+		l.append(n)
+	}
+	return l, nil
+}
+
+// NewTextNode returns a node which outputs text as-is.
+func NewTextNode(text string) *TextNode {
+	return newText(0, text)
+}
+
+// NewVarNode returns a node which outputs the value of the expression expr,
+// ie. `{{ expr }}`.
+func NewVarNode(expr Node) (*VarNode, error) {
+	if err := checkExpr(expr); err != nil {
+		return nil, err
+	}
+	v := newVar(0)
+	v.Node = expr
+	return v, nil
+}
+
+// NewLookupNode returns the expression for the variable name.
+func NewLookupNode(name string) (*LookupNode, error) {
+	if !isName(name) {
+		return nil, fmt.Errorf("%q is not a valid name", name)
+	}
+	return newLookup(0, name), nil
+}
+
+// NewLiteralNode returns the literal expression for v, which must be a
+// string, bool, integer, float or nil.
+func NewLiteralNode(v interface{}) (Node, error) {
+	if v == nil {
+		return &NoneNode{NodeNone, 0}, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return &StringNode{NodeString, 0, rv.String()}, nil
+	case reflect.Bool:
+		return &BoolNode{NodeBool, 0, rv.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &IntegerNode{NodeInteger, 0, rv.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= 1<<63-1 {
+			return &IntegerNode{NodeInteger, 0, int64(u)}, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		return &FloatNode{NodeFloat, 0, rv.Float()}, nil
+	}
+	return nil, fmt.Errorf("%v is not a literal", v)
+}
+
+// NewAttrExpr returns the expression for the attribute name of val, ie.
+// `val.name`.
+func NewAttrExpr(val Node, name string) (*AttrExpr, error) {
+	if err := checkExpr(val); err != nil {
+		return nil, err
+	}
+	if !isName(name) {
+		return nil, fmt.Errorf("%q is not a valid attribute name", name)
+	}
+	return newAttrExpr(val, name), nil
+}
+
+// NewCallExpr returns the expression calling fn with args, ie. `fn(args)`.
+func NewCallExpr(fn Node, args ...Node) (*CallExpr, error) {
+	if err := checkExpr(fn); err != nil {
+		return nil, err
+	}
+	if err := checkArgs(args); err != nil {
+		return nil, err
+	}
+	return newCallExpr(fn, args), nil
+}
+
+// NewFilterNode returns the expression applying the filter name to val with
+// args, ie. `val|name(args)`.
+func NewFilterNode(val Node, name string, args ...Node) (*FilterNode, error) {
+	if err := checkExpr(val); err != nil {
+		return nil, err
+	}
+	if !isName(name) {
+		return nil, fmt.Errorf("%q is not a valid filter name", name)
+	}
+	if err := checkArgs(args); err != nil {
+		return nil, err
+	}
+	return newFilterNode(val, name, args), nil
+}
+
+// NewKeywordNode returns the keyword argument `name=value`, for the args of
+// NewCallExpr and NewFilterNode.
+func NewKeywordNode(name string, value Node) (*KeywordNode, error) {
+	if !isName(name) {
+		return nil, fmt.Errorf("%q is not a valid argument name", name)
+	}
+	if err := checkExpr(value); err != nil {
+		return nil, err
+	}
+	return newKeyword(0, name, value), nil
+}
+
+// NewSetNode returns the statement assigning value to target, which is a
+// lookup or a tuple of lookups, ie. `{% set target = value %}`.
+func NewSetNode(target, value Node) (*SetNode, error) {
+	if err := checkTarget(target); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(value); err != nil {
+		return nil, err
+	}
+	return newSet(0, target, value), nil
+}
+
+// NewIfNode returns the statement rendering body if cond is true, or els,
+// which may be nil, otherwise.  An if with elifs is built by nesting another
+// if in els.
+func NewIfNode(cond Node, body, els *ListNode) (*IfBlockNode, error) {
+	if err := checkExpr(cond); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("if %s has no body", cond)
+	}
+	c := newConditional(0, NodeIf)
+	c.Guard, c.Body = cond, body
+	n := newIf(0)
+	n.Conditionals = append(n.Conditionals, c)
+	if els != nil {
+		n.Else = els
+	}
+	return n, nil
+}
+
+// NewForNode returns the statement rendering body for each item of iter,
+// assigned to target, which is a lookup or a tuple of lookups, ie.
+// `{% for target in iter %}`.
+func NewForNode(target, iter Node, body *ListNode) (*ForNode, error) {
+	if err := checkTarget(target); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(iter); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("for %s has no body", target)
+	}
+	n := newFor(0)
+	n.ForExpr, n.InExpr, n.Body = target, iter, body
+	return n, nil
+}
+
+// NewBreakNode returns the statement `{% break %}`, which must be in the
+// body of a for loop.
+func NewBreakNode() *BreakNode {
+	return newBreak(0)
+}
+
+// NewContinueNode returns the statement `{% continue %}`, which must be in
+// the body of a for loop.
+func NewContinueNode() *ContinueNode {
+	return newContinue(0)
+}
+
+// NewTupleNode returns a tuple of the expressions elems, which is also an
+// assignment target if they are lookups.
+func NewTupleNode(elems ...Node) (*TupleNode, error) {
+	for _, n := range elems {
+		if err := checkExpr(n); err != nil {
+			return nil, err
+		}
+	}
+	return newTuple(0, elems), nil
+}
+
+// binaryOps are the item types of the operators NewBinaryExpr accepts.
+var binaryOps = map[string]itemType{
+	"+": tokenAdd, "-": tokenSub, "*": tokenMul, "/": tokenDiv, "//": tokenFloordiv,
+	"%": tokenMod, "~": tokenTilde, "and": tokenAnd, "or": tokenOr,
+}
+
+// NewBinaryExpr returns the expression `lhs op rhs`, where op is an
+// arithmetic operator, `~`, `and` or `or`.
+func NewBinaryExpr(op string, lhs, rhs Node) (Node, error) {
+	typ, ok := binaryOps[op]
+	if !ok {
+		return nil, fmt.Errorf("%q is not a binary operator", op)
+	}
+	if err := checkExpr(lhs); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(rhs); err != nil {
+		return nil, err
+	}
+	switch typ {
+	case tokenAdd, tokenSub:
+		return newAddExpr(lhs, rhs, item{typ: typ, val: op}), nil
+	case tokenTilde:
+		return newConcat(lhs, rhs), nil
+	case tokenAnd:
+		return newAnd(lhs, rhs), nil
+	case tokenOr:
+		return newOr(lhs, rhs), nil
+	}
+	return newMulExpr(lhs, rhs, item{typ: typ, val: op}), nil
+}
+
+// compareOps are the item types of the operators NewCompareExpr accepts.
+var compareOps = map[string]itemType{
+	"==": tokenEqEq, "!=": tokenNeq, "<": tokenLt, "<=": tokenLteq, ">": tokenGt,
+	">=": tokenGteq, "in": tokenKeyword, "not in": tokenKeyword,
+}
+
+// NewCompareExpr returns the comparison `lhs op rhs`, where op is one of
+// `==`, `!=`, `<`, `<=`, `>`, `>=`, `in` and `not in`.
+func NewCompareExpr(lhs Node, op string, rhs Node) (*CompareExpr, error) {
+	typ, ok := compareOps[op]
+	if !ok {
+		return nil, fmt.Errorf("%q is not a comparison operator", op)
+	}
+	if err := checkExpr(lhs); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(rhs); err != nil {
+		return nil, err
+	}
+	return newCompareExpr(lhs, rhs, item{typ: typ, val: op}), nil
+}
+
+// NewNotNode returns the expression `not val`.
+func NewNotNode(val Node) (*NotNode, error) {
+	if err := checkExpr(val); err != nil {
+		return nil, err
+	}
+	return newNot(0, val), nil
+}
+
+// NewTernaryNode returns the expression `trueExpr if cond else falseExpr`.
+// falseExpr may be nil, for `trueExpr if cond`.
+func NewTernaryNode(trueExpr, cond, falseExpr Node) (*TernaryNode, error) {
+	if err := checkExpr(trueExpr); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(cond); err != nil {
+		return nil, err
+	}
+	if falseExpr != nil {
+		if err := checkExpr(falseExpr); err != nil {
+			return nil, err
+		}
+	}
+	return newTernary(trueExpr, cond, falseExpr), nil
+}
+
+// NewListLiteralNode returns the list literal of the expressions elems, ie.
+// `[elems]`.
+func NewListLiteralNode(elems ...Node) (*ListLiteralNode, error) {
+	l := newListLiteral(0)
+	for _, n := range elems {
+		if err := checkExpr(n); err != nil {
+			return nil, err
+		}
+		l.append(n)
+	}
+	return l, nil
+}
+
+// NewMapElem returns the entry `key: value`, for NewMapExpr.
+func NewMapElem(key, value Node) (*MapElem, error) {
+	if err := checkExpr(key); err != nil {
+		return nil, err
+	}
+	if err := checkExpr(value); err != nil {
+		return nil, err
+	}
+	return newMapElem(key, value), nil
+}
+
+// NewMapExpr returns the map literal of the entries elems, ie. `{elems}`.
+func NewMapExpr(elems ...*MapElem) (*MapExpr, error) {
+	m := newMapExpr(0)
+	for _, elem := range elems {
+		if elem == nil {
+			return nil, fmt.Errorf("missing map entry")
+		}
+		m.append(elem)
+	}
+	return m, nil
+}
+
+// NewMacroNode returns the statement defining the macro name with params,
+// ie. `{% macro name(params) %}body{% endmacro %}`.  defaults is nil, or
+// holds the default value of each parameter, nil for those which have none;
+// parameters with defaults must come last.
+func NewMacroNode(name string, params []string, defaults []Node, body *ListNode) (*MacroNode, error) {
+	if !isName(name) {
+		return nil, fmt.Errorf("%q is not a valid macro name", name)
+	}
+	if defaults != nil && len(defaults) != len(params) {
+		return nil, fmt.Errorf("macro %s has %d parameters but %d defaults", name, len(params), len(defaults))
+	}
+	if body == nil {
+		return nil, fmt.Errorf("macro %s has no body", name)
+	}
+	// a macro's body is not in any loop around it
+	if err := checkLoopControl(body, false); err != nil {
+		return nil, fmt.Errorf("macro %s: %s", name, err)
+	}
+	n := newMacro(0, name)
+	for i, p := range params {
+		if !isName(p) {
+			return nil, fmt.Errorf("%q is not a valid parameter name", p)
+		}
+		if indexOf(n.Params, p) >= 0 {
+			return nil, fmt.Errorf("duplicate parameter %q in macro %q", p, name)
+		}
+		var def Node
+		if defaults != nil {
+			def = defaults[i]
+		}
+		if def != nil {
+			if err := checkExpr(def); err != nil {
+				return nil, err
+			}
+		} else if i > 0 && n.Defaults[i-1] != nil {
+			return nil, fmt.Errorf("parameter %q without a default follows one with a default in macro %q", p, name)
+		}
+		n.Params = append(n.Params, p)
+		n.Defaults = append(n.Defaults, def)
+	}
+	n.Body = body
+	return n, nil
+}
+
+// NewIncludeNode returns the statement rendering the template named by the
+// expression template, ie. `{% include template %}`.
+func NewIncludeNode(template Node) (*IncludeNode, error) {
+	if err := checkExpr(template); err != nil {
+		return nil, err
+	}
+	return newInclude(0, template), nil
+}
+
+// checkLoopControl returns an error if a break or continue among the
+// statements n is not in the body of a for loop, as the parser does.  inLoop
+// is whether n itself is.
+func checkLoopControl(n Node, inLoop bool) error {
+	var check []Node
+	switch t := n.(type) {
+	case *BreakNode:
+		if !inLoop {
+			return fmt.Errorf("break outside of a loop")
+		}
+	case *ContinueNode:
+		if !inLoop {
+			return fmt.Errorf("continue outside of a loop")
+		}
+	case *ListNode:
+		if t != nil {
+			check = t.Nodes
+		}
+	case *IfBlockNode:
+		check = append(append(check, t.Conditionals...), t.Else)
+	case *ConditionalNode:
+		check = []Node{t.Body}
+	case *ForNode:
+		if err := checkLoopControl(t.Body, true); err != nil {
+			return err
+		}
+		check = []Node{t.Else}
+	case *BlockNode:
+		check = []Node{t.Body}
+	case *CacheNode:
+		check = []Node{t.Body}
+	case *MacroNode:
+		return checkLoopControl(t.Body, false)
+	}
+	for _, c := range check {
+		if err := checkLoopControl(c, inLoop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExpr reports whether n is an expression, rather than a statement.
+func isExpr(n Node) bool {
+	switch n.(type) {
+	case *ListNode, *TextNode, *CommentNode, *VarNode, *SetNode, *IfBlockNode, *ConditionalNode,
+		*ForNode, *BlockNode, *CacheNode, *MacroNode, *IncludeNode, *BreakNode, *ContinueNode:
+		return false
+	}
+	return n != nil
+}
+
+// checkExpr returns an error unless n is an expression.
+func checkExpr(n Node) error {
+	switch n.(type) {
+	case nil:
+		return fmt.Errorf("missing expression")
+	case *KeywordNode, *StarNode, *MapElem:
+		return fmt.Errorf("%s is not an expression", n)
+	}
+	if !isExpr(n) {
+		return fmt.Errorf("%s is not an expression", n)
+	}
+	return nil
+}
+
+// checkArgs returns an error unless args are expressions, with any keyword
+// arguments last.
+func checkArgs(args []Node) error {
+	kwargs := false
+	for _, arg := range args {
+		if k, ok := arg.(*KeywordNode); ok {
+			if err := checkExpr(k.Value); err != nil {
+				return err
+			}
+			kwargs = true
+			continue
+		}
+		if kwargs {
+			return fmt.Errorf("argument %s follows keyword arguments", arg)
+		}
+		if err := checkExpr(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTarget returns an error unless n is a lookup or a tuple of lookups.
+func checkTarget(n Node) error {
+	switch t := n.(type) {
+	case *LookupNode:
+		return nil
+	case *TupleNode:
+		for _, elem := range t.Elems {
+			if _, ok := elem.(*LookupNode); !ok {
+				return fmt.Errorf("cannot assign to %s", elem)
+			}
+		}
+		if len(t.Elems) > 0 {
+			return nil
+		}
+	case nil:
+		return fmt.Errorf("missing assignment target")
+	}
+	return fmt.Errorf("cannot assign to %s", n)
+}
+
+// isName reports whether s is an identifier which is not a keyword.
+func isName(s string) bool {
+	if _, ok := keywords[s]; ok || s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package v1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	must := func(n Node, err error) Node {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	lookup := func(name string) Node { return must(NewLookupNode(name)) }
+	literal := func(v interface{}) Node { return must(NewLiteralNode(v)) }
+
+	// <ul>{% for u in users %}<li>{{ u.Name|default("anon") }}</li>{% endfor %}</ul>
+	// {% set ok = true %}{% if ok %}{{ ok }}{% else %}none{% endif %}
+	name := must(NewFilterNode(must(NewAttrExpr(lookup("u"), "Name")), "default", literal("anon")))
+	item := must(NewListNode(NewTextNode("<li>"), must(NewVarNode(name)), NewTextNode("</li>")))
+	loop := must(NewForNode(lookup("u"), lookup("users"), item.(*ListNode)))
+	set := must(NewSetNode(lookup("ok"), literal(true)))
+	then := must(NewListNode(must(NewVarNode(lookup("ok")))))
+	els := must(NewListNode(NewTextNode("none")))
+	cond := must(NewIfNode(lookup("ok"), then.(*ListNode), els.(*ListNode)))
+	root := must(NewListNode(NewTextNode("<ul>"), loop, NewTextNode("</ul>"), set, cond))
+
+	e := NewEnvironment()
+	tpl, err := e.NewTemplate("built", root.(*ListNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type user struct{ Name string }
+	out, err := tpl.Render(m{"users": []user{{"jigo"}, {""}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<ul><li>jigo</li><li></li></ul>true"; out != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+	if _, err := e.Get("built"); err != nil {
+		t.Errorf("Expected the template to be registered, got %v", err)
+	}
+	want := `<ul>{% for u in users %}<li>{{ u.Name | default("anon") }}</li>{% endfor %}</ul>`
+	if s := root.(*ListNode).Nodes[0].String() + loop.String() + root.(*ListNode).Nodes[2].String(); s != want {
+		t.Errorf("Expected %s, got %s", want, s)
+	}
+
+	pair := must(NewTupleNode(lookup("k"), lookup("v")))
+	call := must(NewCallExpr(lookup("f"), literal(1), must(NewKeywordNode("x", literal(2.5)))))
+	body := must(NewListNode(must(NewVarNode(lookup("k"))), must(NewVarNode(call))))
+	tpl, err = e.NewTemplate("pairs", must(NewListNode(must(NewForNode(pair, lookup("items"), body.(*ListNode))))).(*ListNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = tpl.Render(m{"items": [][]interface{}{{"a", 1}}, "f": func(a int, kw Kwargs) interface{} { return kw["x"] }})
+	if err != nil || out != "a2.5" {
+		t.Errorf("Expected %q, got %q, %v", "a2.5", out, err)
+	}
+
+	text := NewTextNode("x")
+	for _, err := range []error{
+		second(NewLookupNode("")),
+		second(NewLookupNode("if")),
+		second(NewLookupNode("1a")),
+		second(NewLookupNode("a.b")),
+		second(NewLiteralNode([]int{1})),
+		second(NewLiteralNode(uint64(1 << 63))),
+		second(NewVarNode(nil)),
+		second(NewVarNode(text)),
+		second(NewAttrExpr(lookup("a"), "b c")),
+		second(NewFilterNode(lookup("a"), "")),
+		second(NewCallExpr(lookup("f"), must(NewKeywordNode("x", literal(1))), literal(2))),
+		second(NewSetNode(literal(1), literal(2))),
+		second(NewSetNode(must(NewTupleNode(lookup("a"), literal(1))), literal(2))),
+		second(NewForNode(lookup("x"), lookup("l"), nil)),
+		second(NewIfNode(text, nil, nil)),
+		second(NewListNode(lookup("x"))),
+		second(NewListNode(nil)),
+		second(NewListNode(cond.(*IfBlockNode).Conditionals[0])),
+	} {
+		if err == nil {
+			t.Errorf("Expected a validation error")
+		}
+	}
+	if _, err := e.NewTemplate("empty", nil); err == nil {
+		t.Errorf("Expected an error for a template with no root")
+	}
+}
+
+func TestExprBuilders(t *testing.T) {
+	must := func(n Node, err error) Node {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	lookup := func(name string) Node { return must(NewLookupNode(name)) }
+	literal := func(v interface{}) Node { return must(NewLiteralNode(v)) }
+
+	sum := must(NewBinaryExpr("+", lookup("a"), literal(1)))
+	prod := must(NewBinaryExpr("*", sum, literal(2)))
+	cmp := must(NewCompareExpr(prod, ">", literal(5)))
+	list := must(NewListLiteralNode(literal(1), literal(3)))
+	in := must(NewCompareExpr(lookup("a"), "not in", list))
+	exprs := []struct {
+		expr Node
+		out  string
+	}{
+		{must(NewBinaryExpr("~", literal("n="), prod)), `"n=" ~ (a + 1) * 2`},
+		{must(NewBinaryExpr("//", must(NewBinaryExpr("-", literal(7), lookup("a"))), literal(2))), "(7 - a) // 2"},
+		{cmp, "(a + 1) * 2 > 5"},
+		{in, "a not in [1, 3]"},
+		{must(NewBinaryExpr("or", must(NewBinaryExpr("and", cmp, must(NewNotNode(in)))), literal("no"))),
+			`(a + 1) * 2 > 5 and not a not in [1, 3] or "no"`},
+		{must(NewTernaryNode(literal("big"), cmp, literal("small"))), `"big" if (a + 1) * 2 > 5 else "small"`},
+		{must(NewTernaryNode(literal("big"), cmp, nil)), `"big" if (a + 1) * 2 > 5`},
+		{must(NewMapExpr(must(NewMapElem(literal("k"), sum)).(*MapElem))), `{"k": a + 1}`},
+	}
+	var nodes []Node
+	for _, x := range exprs {
+		if s := x.expr.String(); s != x.out {
+			t.Errorf("Expected `%s`, got `%s`", x.out, s)
+		}
+		// built expressions print as the source they would be parsed from
+		checkExprString(t, "{{ "+x.out+" }}", x.out)
+		nodes = append(nodes, must(NewVarNode(x.expr)), NewTextNode(","))
+	}
+
+	// {% macro em(s, tag="em") %}<{{ tag }}>{{ s }}</{{ tag }}>{% endmacro %}
+	tag := must(NewVarNode(lookup("tag")))
+	body := must(NewListNode(NewTextNode("<"), tag, NewTextNode(">"), must(NewVarNode(lookup("s"))), NewTextNode("</"), tag, NewTextNode(">")))
+	macro := must(NewMacroNode("em", []string{"s", "tag"}, []Node{nil, literal("em")}, body.(*ListNode)))
+	if want := `{% macro em(s, tag="em") %}<{{ tag }}>{{ s }}</{{ tag }}>{% endmacro %}`; macro.String() != want {
+		t.Errorf("Expected %s, got %s", want, macro)
+	}
+	include := must(NewIncludeNode(literal("inc")))
+	nodes = append(nodes, macro, must(NewVarNode(must(NewCallExpr(lookup("em"), literal("hi"))))), include)
+
+	e := NewEnvironment()
+	if _, err := e.ParseString("[{{ a }}]", "inc", "inc"); err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := e.NewTemplate("exprs", must(NewListNode(nodes...)).(*ListNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tpl.Render(m{"a": 2})
+	if want := "n=6,2,true,true,no,big,big,map[k:3],<em>hi</em>[2]"; err != nil || out != want {
+		t.Errorf("Expected %q, got %q, %v", want, out, err)
+	}
+
+	for _, err := range []error{
+		second(NewBinaryExpr("**", literal(2), literal(3))),
+		second(NewBinaryExpr("+", nil, literal(1))),
+		second(NewBinaryExpr("and", literal(true), NewTextNode("x"))),
+		second(NewCompareExpr(lookup("a"), "=", literal(1))),
+		second(NewCompareExpr(lookup("a"), "is", lookup("b"))),
+		second(NewNotNode(nil)),
+		second(NewTernaryNode(literal(1), nil, nil)),
+		second(NewListLiteralNode(must(NewKeywordNode("x", literal(1))))),
+		second(NewMapElem(literal("k"), nil)),
+		second(NewMapExpr(nil)),
+		second(NewMacroNode("if", nil, nil, body.(*ListNode))),
+		second(NewMacroNode("m", []string{"a", "a"}, nil, body.(*ListNode))),
+		second(NewMacroNode("m", []string{"a", "b"}, []Node{literal(1), nil}, body.(*ListNode))),
+		second(NewMacroNode("m", []string{"a"}, []Node{}, body.(*ListNode))),
+		second(NewMacroNode("m", []string{"a b"}, nil, body.(*ListNode))),
+		second(NewMacroNode("m", nil, nil, nil)),
+		second(NewIncludeNode(nil)),
+	} {
+		if err == nil {
+			t.Errorf("Expected a validation error")
+		}
+	}
+}
+
+func TestBuilderLoopControl(t *testing.T) {
+	must := func(n Node, err error) Node {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	lookup := func(name string) Node { return must(NewLookupNode(name)) }
+	list := func(nodes ...Node) *ListNode { return must(NewListNode(nodes...)).(*ListNode) }
+
+	// {% for i in items %}{% if i == 2 %}{% continue %}{% endif %}{{ i }}{% if i == 3 %}{% break %}{% endif %}{% endfor %}
+	skip := must(NewIfNode(must(NewCompareExpr(lookup("i"), "==", must(NewLiteralNode(2)))), list(NewContinueNode()), nil))
+	stop := must(NewIfNode(must(NewCompareExpr(lookup("i"), "==", must(NewLiteralNode(3)))), list(NewBreakNode()), nil))
+	loop := must(NewForNode(lookup("i"), lookup("items"), list(skip, must(NewVarNode(lookup("i"))), stop)))
+	e := NewEnvironment()
+	tpl, err := e.NewTemplate("loop", list(loop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tpl.Render(m{"items": []int{1, 2, 3, 4}}); err != nil || out != "13" {
+		t.Errorf("Expected %q, got %q, %v", "13", out, err)
+	}
+
+	inElse := must(NewForNode(lookup("i"), lookup("items"), list()))
+	inElse.(*ForNode).Else = list(NewBreakNode())
+	inMacro := &MacroNode{NodeType: NodeMacro, Name: "m", Body: list(NewContinueNode())}
+	for _, root := range []*ListNode{
+		list(NewBreakNode()),
+		list(must(NewIfNode(lookup("x"), list(NewContinueNode()), nil))),
+		list(inElse),
+		list(must(NewForNode(lookup("i"), lookup("items"), list(inMacro)))),
+	} {
+		if _, err := e.NewTemplate("bad", root); err == nil || !strings.Contains(err.Error(), "outside of a loop") {
+			t.Errorf("%s: expected an error for loop control outside of a loop, got %v", root, err)
+		}
+	}
+	if _, err := NewMacroNode("m", nil, nil, list(NewBreakNode())); err == nil {
+		t.Errorf("Expected an error for break in a macro body")
+	}
+}
+
+// second returns the second of two results, to collect errors from builders.
+func second(_ interface{}, err error) error { return err }
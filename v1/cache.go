@@ -0,0 +1,74 @@
+package v1
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A Cache stores the rendered output of {% cache %} blocks;  see
+// Environment.Cache.  It must be safe for concurrent use if templates are
+// rendered concurrently.
+type Cache interface {
+	// Get returns the output stored for key, if there is any which has not
+	// expired.
+	Get(key string) (string, bool)
+	// Set stores the output for key, to expire after ttl.  A ttl of 0 means
+	// the output does not expire.
+	Set(key, value string, ttl time.Duration)
+}
+
+// renderCache renders a cache block, writing its cached output if there is
+// any, or rendering its body and storing the output otherwise.  The output
+// is stored under the template's name, the block's position in it and the
+// string form of the key expression, joined by colons, so blocks in other
+// templates or elsewhere in the same one do not share output.  Output with
+// errors collected while validating is not stored.
+func (r *renderer) renderCache(n *CacheNode) error {
+	cache := r.t.env.Cache
+	if cache == nil {
+		return r.renderNode(n.Body)
+	}
+	timeout, err := r.eval(n.Timeout)
+	if err != nil {
+		return err
+	}
+	secs, ok := asFloat(timeout)
+	if !ok || !isNumericVar(typeOf(timeout)) || secs < 0 {
+		return r.errorf(n.Timeout, "cache timeout must be a non-negative number of seconds, not %v", timeout)
+	}
+	key, err := r.eval(n.Key)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return r.errorf(n.Key, "cache key %s is undefined", n.Key)
+	}
+	k := fmt.Sprintf("%s:%d:%s", r.t.Name, n.Pos, asString(key))
+	if out, ok := cache.Get(k); ok {
+		_, err := io.WriteString(r.w, out)
+		return err
+	}
+
+	w := r.w
+	var b bytes.Buffer
+	r.w = &b
+	errs := len(r.errs)
+	err = r.renderNode(n.Body)
+	r.w = w
+	if err == errBreak || err == errContinue {
+		// the body was cut short by its loop, so is not cached
+		if _, werr := r.w.Write(b.Bytes()); werr != nil {
+			return werr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(r.errs) == errs {
+		cache.Set(k, b.String(), time.Duration(secs*float64(time.Second)))
+	}
+	_, err = r.w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,114 @@
+package v1
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// memCache is an in-memory Cache which records the ttl of each entry.
+type memCache struct {
+	entries map[string]string
+	ttls    map[string]time.Duration
+}
+
+func newMemCache() *memCache {
+	return &memCache{make(map[string]string), make(map[string]time.Duration)}
+}
+
+func (c *memCache) Get(key string) (string, bool) {
+	v, ok := c.entries[key]
+	return v, ok
+}
+
+func (c *memCache) Set(key, value string, ttl time.Duration) {
+	c.entries[key] = value
+	c.ttls[key] = ttl
+}
+
+func TestCache(t *testing.T) {
+	cache := newMemCache()
+	e := NewEnvironment()
+	e.Cache = cache
+	calls := 0
+	ctx := m{"user": m{"name": "ann"}, "render": func() int { calls++; return calls }}
+
+	tpl, err := e.ParseString(`<{% cache 60 "sidebar-" + user.name %}rendered {{ render() }}{% endcache %}>`, "cache", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		out, err := tpl.Render(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != "<rendered 1>" {
+			t.Errorf("Expected cached output on render %d, got %q", i+1, out)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the body to render once, rendered %d times", calls)
+	}
+	if ttl := cache.ttls["cache:1:sidebar-ann"]; ttl != time.Minute {
+		t.Errorf("Expected ttl of a minute for key cache:1:sidebar-ann, got %v (%v)", ttl, cache.ttls)
+	}
+
+	// a different key renders again
+	out, _ := tpl.Render(m{"user": m{"name": "bob"}, "render": ctx["render"]})
+	if out != "<rendered 2>" || calls != 2 {
+		t.Errorf("Expected a new key to render, got %q after %d calls", out, calls)
+	}
+
+	// without a cache, the body is always rendered
+	tpl, _ = NewEnvironment().ParseString(`{% cache 60 "k" %}{{ render() }}{% endcache %}`, "cache", "cache")
+	a, _ := tpl.Render(ctx)
+	b, _ := tpl.Render(ctx)
+	if a == b {
+		t.Errorf("Expected uncached renders to differ, got %q twice", a)
+	}
+
+	for _, src := range []string{
+		`{% cache "x" "k" %}{% endcache %}`,
+		`{% cache -1 "k" %}{% endcache %}`,
+		`{% cache 1 missing %}{% endcache %}`,
+	} {
+		tpl, err := e.ParseString(src, "cache", "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(ctx); err == nil {
+			t.Errorf("Expected error rendering %s", src)
+		}
+	}
+
+	// the same key in another block or template is a different entry
+	other, err := e.ParseString(`{% cache 60 "sidebar-" + user.name %}other{% endcache %}`, "other", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := other.Render(ctx); out != "other" {
+		t.Errorf("Expected another template's block not to share output, got %q", out)
+	}
+	tpl, _ = e.ParseString(`{% cache 60 "k" %}a{% endcache %}{% cache 60 "k" %}b{% endcache %}`, "twice", "twice")
+	if out, _ := tpl.Render(ctx); out != "ab" {
+		t.Errorf("Expected blocks with the same key not to share output, got %q", out)
+	}
+
+	// output with errors collected while validating is not cached
+	cache = newMemCache()
+	e.Cache = cache
+	tpl, _ = e.ParseString(`{% cache 60 "v" %}{{ user.name }}{{ missing }}{% endcache %}`, "validate", "validate")
+	if err := tpl.Validate(ctx); err == nil {
+		t.Errorf("Expected a validation error for an undefined variable")
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("Expected nothing cached after a failed validation, got %v", cache.entries)
+	}
+	if out, err := tpl.Render(m{"user": m{"name": "ann"}, "missing": "!"}); err != nil || out != "ann!" {
+		t.Errorf("Expected %q, got %q, %v", "ann!", out, err)
+	}
+
+	if _, err := e.ParseString(`{% cache 60 "k" %}body`, "cache", "cache"); err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("Expected EOF error for an unclosed cache block, got %v", err)
+	}
+}
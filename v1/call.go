@@ -0,0 +1,148 @@
+package v1
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Args can be used as the final argument of a function to accept any number
+// of positional arguments from a template.
+type Args []interface{}
+
+// Kwargs can be used as the final argument of a function to accept keyword
+// arguments from a template.  To accept both, a function's final arguments
+// must be (Args, Kwargs).
+type Kwargs map[string]interface{}
+
+var (
+	argsType   = reflect.TypeOf(Args{})
+	kwargsType = reflect.TypeOf(Kwargs{})
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// bindArgs binds positional args and keyword args to the parameters named by
+// names, in order, for functions which accept (Args, Kwargs) but want Python
+// style named parameters.  Parameters which are not passed are taken from
+// defaults, which must be the same length as names.
+func bindArgs(args Args, kwargs Kwargs, names []string, defaults ...interface{}) ([]interface{}, error) {
+	if len(args) > len(names) {
+		return nil, fmt.Errorf("wrong number of args: want at most %d, got %d", len(names), len(args))
+	}
+	bound := make([]interface{}, len(names))
+	copy(bound, defaults)
+	copy(bound, args)
+	for key, val := range kwargs {
+		i := indexOf(names, key)
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected keyword argument %q", key)
+		}
+		if i < len(args) {
+			return nil, fmt.Errorf("got multiple values for argument %q", key)
+		}
+		bound[i] = val
+	}
+	return bound, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkFunc returns an error if fn is not a function that can be called from
+// a template.  Callable functions return a single value, or a value and an
+// error.
+func checkFunc(fn reflect.Value) error {
+	if fn.Kind() != reflect.Func {
+		return fmt.Errorf("%v is not a function", fn)
+	}
+	typ := fn.Type()
+	switch {
+	case typ.NumOut() == 1:
+	case typ.NumOut() == 2 && typ.Out(1) == errorType:
+	default:
+		return fmt.Errorf("%v must return a value or a value and an error", typ)
+	}
+	return nil
+}
+
+// call calls fn with the evaluated arguments args and kwargs, converting
+// each to the type the function expects.  Variadic functions and functions
+// whose final argument is of type Args receive any remaining arguments, and
+// functions whose final argument is of type Kwargs receive keyword arguments.
+func call(fn reflect.Value, args []interface{}, kwargs Kwargs) (interface{}, error) {
+	typ := fn.Type()
+	numIn := typ.NumIn()
+	if numIn > 0 && typ.In(numIn-1) == kwargsType {
+		numIn--
+	} else if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%v does not accept keyword arguments", typ)
+	}
+	fixed := numIn
+	if typ.IsVariadic() || (numIn > 0 && typ.In(numIn-1) == argsType) {
+		fixed--
+		if len(args) < fixed {
+			return nil, fmt.Errorf("wrong number of args: want at least %d, got %d", fixed, len(args))
+		}
+	} else if len(args) != numIn {
+		return nil, fmt.Errorf("wrong number of args: want %d, got %d", numIn, len(args))
+	}
+
+	in := make([]reflect.Value, 0, typ.NumIn())
+	for i := 0; i < fixed; i++ {
+		v, err := convertArg(args[i], typ.In(i))
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, v)
+	}
+
+	switch {
+	case typ.IsVariadic():
+		elem := typ.In(numIn - 1).Elem()
+		for _, arg := range args[fixed:] {
+			v, err := convertArg(arg, elem)
+			if err != nil {
+				return nil, err
+			}
+			in = append(in, v)
+		}
+	case fixed < numIn:
+		in = append(in, reflect.ValueOf(Args(args[fixed:])))
+	}
+	if numIn < typ.NumIn() {
+		if kwargs == nil {
+			kwargs = Kwargs{}
+		}
+		in = append(in, reflect.ValueOf(kwargs))
+	}
+
+	out := fn.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
+
+// convertArg converts an evaluated argument to a value of type typ.  Nil
+// arguments become the zero value for typ, and numeric arguments can be
+// converted to any other numeric type.
+func convertArg(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		return reflect.Zero(typ), nil
+	}
+	v := reflect.ValueOf(arg)
+	switch {
+	case v.Type().AssignableTo(typ):
+		return v, nil
+	case isNumericKind(v.Kind()) && isNumericKind(typ.Kind()):
+		return v.Convert(typ), nil
+	case v.Kind() == reflect.String && typ.Kind() == reflect.String:
+		return v.Convert(typ), nil
+	}
+	return v, fmt.Errorf("type error: cannot use %v (%T) as %v", arg, arg, typ)
+}
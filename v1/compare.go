@@ -0,0 +1,229 @@
+package v1
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A Comparator compares two values of a type registered with
+// Environment.RegisterComparator, returning a negative number if a < b, zero
+// if a == b, and a positive number if a > b.
+type Comparator func(a, b reflect.Value) (int, error)
+
+// RegisterComparator makes values of type typ comparable with the comparison
+// operators, using fn.  Types with a `Compare(T) int` method, or with `Before`
+// and `After` methods like time.Time, are comparable without registration.
+func (e *Environment) RegisterComparator(typ reflect.Type, fn Comparator) {
+	if e.comparators == nil {
+		e.comparators = make(map[reflect.Type]Comparator)
+	}
+	e.comparators[typ] = fn
+}
+
+// evalCompare evaluates a comparison.  Chained comparisons are evaluated
+// left to right and stop at the first false comparison, so `a < b < c` is
+// `a < b and b < c` with b only evaluated once.
+func (r *renderer) evalCompare(n *CompareExpr) (interface{}, error) {
+	lhs, err := r.eval(n.Operands[0])
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range n.Operators {
+		rhs, err := r.eval(n.Operands[i+1])
+		if err != nil {
+			return nil, err
+		}
+		ok, err := r.t.env.compare(lhs, rhs, op)
+		if err != nil || !ok {
+			return false, err
+		}
+		lhs = rhs
+	}
+	return true, nil
+}
+
+// compare compares lhs and rhs with the comparison operator op.  Numbers and
+// strings are ordered naturally, and values with a registered comparator or
+// comparison methods use those.  Other values can only be compared for
+// equality.
+func (e *Environment) compare(lhs, rhs interface{}, op item) (bool, error) {
+	switch op.val {
+	case "in":
+		return e.contains(rhs, lhs)
+	case "not in":
+		ok, err := e.contains(rhs, lhs)
+		return !ok, err
+	}
+	cmp, ok, err := e.order(lhs, rhs)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		switch op.typ {
+		case tokenEqEq:
+			return equal(lhs, rhs), nil
+		case tokenNeq:
+			return !equal(lhs, rhs), nil
+		}
+		return false, fmt.Errorf("type error: cannot compare %s and %s with %s", typeName(lhs), typeName(rhs), op.val)
+	}
+	switch op.typ {
+	case tokenEqEq:
+		return cmp == 0, nil
+	case tokenNeq:
+		return cmp != 0, nil
+	case tokenLt:
+		return cmp < 0, nil
+	case tokenLteq:
+		return cmp <= 0, nil
+	case tokenGt:
+		return cmp > 0, nil
+	case tokenGteq:
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("unknown comparison %s", op.val)
+}
+
+// eqOp is the equality operator, for comparisons outside of expressions.
+var eqOp = item{typ: tokenEqEq, val: "=="}
+
+// contains reports whether elem is in container, which is a substring of a
+// string, an element of a slice or array, a key of a map, or the name of an
+// attribute of a struct, resolved by the environment's FieldResolver.  Nothing is in an undefined container or a nil
+// pointer.
+func (e *Environment) contains(container, elem interface{}) (bool, error) {
+	v := indirect(reflect.ValueOf(container))
+	if !v.IsValid() {
+		return false, nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if typeOf(elem) != stringType {
+			return false, fmt.Errorf("type error: 'in <string>' requires a string, not %s", typeName(elem))
+		}
+		return strings.Contains(v.String(), asString(elem)), nil
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			ok, err := e.compare(v.Index(i).Interface(), elem, eqOp)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		k := reflect.ValueOf(elem)
+		if !k.IsValid() || !k.Type().ConvertibleTo(v.Type().Key()) {
+			return false, nil
+		}
+		return v.MapIndex(k.Convert(v.Type().Key())).IsValid(), nil
+	case reflect.Struct:
+		if typeOf(elem) != stringType {
+			return false, fmt.Errorf("type error: 'in <struct>' requires a field name, not %s", typeName(elem))
+		}
+		// resolved as `container.elem` is, so the two agree
+		_, ok := e.resolver()(reflect.ValueOf(container), asString(elem))
+		return ok, nil
+	}
+	return false, fmt.Errorf("type error: %s is not a container", typeName(container))
+}
+
+// order returns the ordering of lhs and rhs as -1, 0 or 1, and whether they
+// can be ordered at all.
+func (e *Environment) order(lhs, rhs interface{}) (int, bool, error) {
+	lt, rt := typeOf(lhs), typeOf(rhs)
+	switch {
+	case lt == intType && rt == intType:
+		l, _ := asInteger(lhs)
+		r, _ := asInteger(rhs)
+		switch {
+		case l < r:
+			return -1, true, nil
+		case l > r:
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case isNumericVar(lt) && isNumericVar(rt):
+		l, _ := asFloat(lhs)
+		r, _ := asFloat(rhs)
+		return sign(l - r), true, nil
+	case lt == stringType && rt == stringType:
+		l, r := asString(lhs), asString(rhs)
+		switch {
+		case l < r:
+			return -1, true, nil
+		case l > r:
+			return 1, true, nil
+		}
+		return 0, true, nil
+	}
+	if lhs == nil || rhs == nil {
+		return 0, false, nil
+	}
+
+	l, rv := reflect.ValueOf(lhs), reflect.ValueOf(rhs)
+	if l.Type() != rv.Type() {
+		return 0, false, nil
+	}
+	if fn, ok := e.comparators[l.Type()]; ok {
+		cmp, err := fn(l, rv)
+		return sign(float64(cmp)), err == nil, err
+	}
+	if m := l.MethodByName("Compare"); m.IsValid() && isMethod(m, l.Type(), reflect.TypeOf(0)) {
+		cmp := m.Call([]reflect.Value{rv})[0].Int()
+		return sign(float64(cmp)), true, nil
+	}
+	before, after := l.MethodByName("Before"), l.MethodByName("After")
+	if before.IsValid() && after.IsValid() {
+		boolType := reflect.TypeOf(true)
+		if isMethod(before, l.Type(), boolType) && isMethod(after, l.Type(), boolType) {
+			switch {
+			case before.Call([]reflect.Value{rv})[0].Bool():
+				return -1, true, nil
+			case after.Call([]reflect.Value{rv})[0].Bool():
+				return 1, true, nil
+			}
+			return 0, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// isMethod reports whether the method value m takes a single argument of type
+// in and returns a single value of type out.
+func isMethod(m reflect.Value, in, out reflect.Type) bool {
+	typ := m.Type()
+	return typ.NumIn() == 1 && typ.In(0) == in && typ.NumOut() == 1 && typ.Out(0) == out
+}
+
+func sign(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+// equal reports whether two unordered values are equal.
+func equal(lhs, rhs interface{}) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == nil && rhs == nil
+	}
+	return reflect.DeepEqual(lhs, rhs)
+}
+
+// typeName is the name of the type of i, for error messages.
+func typeName(i interface{}) string {
+	if i == nil {
+		return "none"
+	}
+	if t := typeOf(i); t != unknownType {
+		return t.String()
+	}
+	return reflect.TypeOf(i).String()
+}
@@ -0,0 +1,112 @@
+package v1
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type version struct{ Major, Minor int }
+
+func TestCompare(t *testing.T) {
+	created := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	deadline := time.Date(2014, 7, 1, 0, 0, 0, 0, time.UTC)
+	times := m{"created": created, "deadline": deadline, "same": created}
+
+	fixtures := []evalFixture{
+		{"Int lt", `{{ 1 < 2 }}`, m{}, "true"},
+		{"Int gteq", `{{ 2 >= 3 }}`, m{}, "false"},
+		{"Mixed numbers", `{{ 1 == 1.0 }}`, m{}, "true"},
+		{"String", `{{ "abc" < "abd" }}`, m{}, "true"},
+		{"Neq", `{{ x != "a" }}`, m{"x": "b"}, "true"},
+		{"None eq", `{{ x == none }}`, m{}, "true"},
+		{"Arithmetic", `{{ 1 + 2 * 3 == 7 }}`, m{}, "true"},
+		{"Chained", `{{ 1 < x < 10 }}`, m{"x": 5}, "true"},
+		{"Chained false", `{{ 1 < x < 3 }}`, m{"x": 5}, "false"},
+		{"Slice eq", `{{ a == b }}`, m{"a": []int{1, 2}, "b": []int{1, 2}}, "true"},
+		{"If", `{% if n > 3 %}big{% else %}small{% endif %}`, m{"n": 4}, "big"},
+		{"Time lt", `{% if created < deadline %}on time{% endif %}`, times, "on time"},
+		{"Time gt", `{{ created > deadline }}`, times, "false"},
+		{"Time eq", `{{ created == same }}`, times, "true"},
+		{"Time lteq", `{{ deadline <= created }}`, times, "false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestRegisterComparator(t *testing.T) {
+	e := NewEnvironment()
+	e.RegisterComparator(reflect.TypeOf(version{}), func(a, b reflect.Value) (int, error) {
+		x, y := a.Interface().(version), b.Interface().(version)
+		if x.Major != y.Major {
+			return x.Major - y.Major, nil
+		}
+		return x.Minor - y.Minor, nil
+	})
+	ctx := m{"a": version{1, 2}, "b": version{1, 10}}
+	fixtures := []evalFixture{
+		{"Lt", `{{ a < b }}`, ctx, "true"},
+		{"Gt", `{{ a > b }}`, ctx, "false"},
+		{"Eq", `{{ a == a }}`, ctx, "true"},
+	}
+	testFixtures(t, e, fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ a < b }}`, "cmp", "cmp")
+	if _, err := tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "cannot compare") {
+		t.Errorf("Expected unregistered comparison to fail, got %v", err)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	ctx := m{"list": []string{"a", "b"}, "nums": []int{1, 2}, "s": "hello", "d": map[string]int{"k": 1}}
+	fixtures := []evalFixture{
+		{"In slice", `{{ "a" in list }}`, ctx, "true"},
+		{"In slice numeric", `{{ 2.0 in nums }}`, ctx, "true"},
+		{"In string", `{{ "ell" in s }}`, ctx, "true"},
+		{"In map", `{{ "k" in d }}`, ctx, "true"},
+		{"In undefined", `{{ "a" in missing }}`, ctx, "false"},
+		{"Not in slice", `{% if x not in list %}missing{% endif %}`, m{"x": "c", "list": []string{"a", "b"}}, "missing"},
+		{"Not in slice false", `{{ "a" not in list }}`, ctx, "false"},
+		{"Not in string", `{{ "xyz" not in s }}`, ctx, "true"},
+		{"Not in string false", `{{ "lo" not in s }}`, ctx, "false"},
+		{"Chained", `{{ 1 < 2 in nums }}`, ctx, "true"},
+		{"Not in map", `{{ "x" in d }}`, ctx, "false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	type user struct {
+		Name  string
+		email string
+	}
+	ctx = m{"u": user{Name: "jigo"}, "p": &user{}, "none": (*user)(nil)}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Struct field", `{{ "Name" in u }}`, ctx, "true"},
+		{"Struct missing field", `{{ "Age" in u }}`, ctx, "false"},
+		{"Struct unexported field", `{{ "email" in u }}`, ctx, "false"},
+		{"Struct pointer", `{% if "Name" in p %}name{% endif %}`, ctx, "name"},
+		{"Struct not in", `{{ "Age" not in p }}`, ctx, "true"},
+		{"Nil struct pointer", `{{ "Name" in none }}`, ctx, "false"},
+	})
+
+	// struct membership agrees with attribute access through FieldResolver
+	type person struct{ FirstName string }
+	e := NewEnvironment()
+	e.FieldResolver = snakeResolver
+	testFixtures(t, e, []evalFixture{
+		{"Resolver field", `{{ "first_name" in u }} {{ u.first_name }}`, struct{ U person }{person{"jigo"}}, "true jigo"},
+		{"Resolver missing", `{{ "last_name" in u }}`, struct{ U *person }{&person{}}, "false"},
+	})
+
+	tpl, _ := NewEnvironment().ParseString(`{{ 1 in u }}`, "in", "in")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected type error for a non-string in a struct")
+	}
+
+	tpl, _ = NewEnvironment().ParseString(`{{ 1 in s }}`, "in", "in")
+	if _, err := tpl.Render(m{"s": "hello"}); err == nil {
+		t.Errorf("Expected type error for a non-string in a string")
+	}
+	if _, err := NewEnvironment().ParseString(`{{ a not b }}`, "in", "in"); err == nil {
+		t.Errorf("Expected parse error for not without in")
+	}
+}
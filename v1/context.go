@@ -12,15 +12,29 @@ type Context struct {
 	ctx   interface{}
 	kind  reflect.Kind
 	value reflect.Value
+	// vars holds the variables of a scope created by the template itself,
+	// which can be assigned to by set.  It is nil for user contexts.
+	vars map[string]interface{}
+}
+
+// newScope returns a context for a scope created while rendering, whose
+// variables are vars.
+func newScope(vars map[string]interface{}) *Context {
+	return &Context{ctx: vars, kind: reflect.Map, value: reflect.ValueOf(vars), vars: vars}
 }
 
 // Contexts can be structs or maps, or pointers to these types, but no other type.
+// A reflect.Value of one of these types is used as it is, rather than being
+// reflected on again.
 func NewContext(i interface{}) (*Context, error) {
 	// save the original value, though we likely won't use it
-	var v reflect.Value
 	c := &Context{ctx: i}
+	v, ok := i.(reflect.Value)
+	if !ok {
+		v = reflect.ValueOf(i)
+	}
 	// indirect v
-	for v = reflect.ValueOf(i); v.Kind() == reflect.Ptr; v = reflect.Indirect(v) {
+	for ; v.Kind() == reflect.Ptr; v = reflect.Indirect(v) {
 	}
 	c.kind = v.Kind()
 	c.value = v
@@ -33,18 +47,36 @@ func NewContext(i interface{}) (*Context, error) {
 // lookup finds a single name in a single context.  If no name is found, then
 // an empty Value is returned and ok is False.
 func (c Context) lookup(name string) (v reflect.Value, ok bool) {
-	switch c.kind {
+	return resolveField(c.value, name)
+}
+
+// resolveField is the default resolution of a name on a value, used for both
+// top level names in a context and attribute lookups.  Maps with string keys
+// are indexed by name, and structs return the exported field name.  If there
+// is no such key or field, the exported method name is returned.  Pointers
+// and interfaces are followed.
+func resolveField(v reflect.Value, name string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	var f reflect.Value
+	switch iv := indirect(v); iv.Kind() {
 	case reflect.Map:
-		v := c.value.MapIndex(reflect.ValueOf(name))
-		return v, v.IsValid()
+		if kt := iv.Type().Key(); kt.Kind() == reflect.String {
+			f = iv.MapIndex(reflect.ValueOf(name).Convert(kt))
+		}
 	case reflect.Struct:
 		// FIXME: reflectx fieldmaps will be much faster but a fair bit more code.
 		// We should use them eventually.
-		v := c.value.FieldByName(name)
-		return v, v.IsValid()
-	default:
-		return v, false
+		f = iv.FieldByName(name)
+		if f.IsValid() && !f.CanInterface() {
+			f = reflect.Value{}
+		}
+	}
+	if !f.IsValid() && v.IsValid() {
+		f = v.MethodByName(name)
 	}
+	return f, f.IsValid()
 }
 
 // A stack of contexts.  Lookup failures go up the stack until there's a success
@@ -74,13 +106,51 @@ func (c *contextStack) pop() (ctx *Context) {
 // lookup finds a name in the context stack.  If no name is found, then an undefined
 // sentinel is returned.
 func (c contextStack) lookup(name string) (v reflect.Value, ok bool) {
-	var ctx *Context
+	return c.resolve(name, resolveField)
+}
+
+// resolve finds a name in the context stack using the resolver fn.
+func (c contextStack) resolve(name string, fn func(reflect.Value, string) (reflect.Value, bool)) (v reflect.Value, ok bool) {
 	for i := len(c) - 1; i >= 0; i-- {
-		ctx = c[i]
-		v, ok = ctx.lookup(name)
+		v, ok = fn(c[i].value, name)
 		if ok {
 			return v, ok
 		}
 	}
 	return v, ok
 }
+
+// find returns the innermost context in the stack which defines name using
+// the resolver fn, or nil if none does.
+func (c contextStack) find(name string, fn func(reflect.Value, string) (reflect.Value, bool)) *Context {
+	for i := len(c) - 1; i >= 0; i-- {
+		if _, ok := fn(c[i].value, name); ok {
+			return c[i]
+		}
+	}
+	return nil
+}
+
+// assign sets name to val in the innermost scope which already defines name,
+// or else in the innermost scope.  User contexts are never modified.  If
+// there is no scope, false is returned.
+func (c contextStack) assign(name string, val interface{}) bool {
+	var inner *Context
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].vars == nil {
+			continue
+		}
+		if _, ok := c[i].vars[name]; ok {
+			c[i].vars[name] = val
+			return true
+		}
+		if inner == nil {
+			inner = c[i]
+		}
+	}
+	if inner == nil {
+		return false
+	}
+	inner.vars[name] = val
+	return true
+}
@@ -48,6 +48,31 @@ func TestStructContext(t *testing.T) {
 	checkLookup(t, c, "four", nil, false)
 }
 
+func TestReflectValueContext(t *testing.T) {
+	x := struct {
+		One, Two int
+		hidden   int
+	}{1, 2, 3}
+	for _, v := range []reflect.Value{reflect.ValueOf(x), reflect.ValueOf(&x), reflect.ValueOf(map[string]int{"One": 1, "Two": 2})} {
+		c, err := NewContext(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLookup(t, c, "One", 1, true)
+		checkLookup(t, c, "Two", 2, true)
+		checkLookup(t, c, "hidden", nil, false)
+	}
+	var nilPtr *struct{ One int }
+	for _, v := range []reflect.Value{reflect.ValueOf(1), reflect.ValueOf([]int{1}), reflect.ValueOf(nilPtr), {}} {
+		if _, err := NewContext(v); err == nil {
+			t.Errorf("Expected an error for a context of %v", v)
+		}
+	}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Render", `{{ One }}{{ Two }}`, reflect.ValueOf(&x), "12"},
+	})
+}
+
 func TestStructMulti(t *testing.T) {
 	x := struct {
 		Name, Age string
@@ -144,3 +169,27 @@ func TestMixedMulti(t *testing.T) {
 	checkLookup(t, ctx, "Age", "32", true)
 	checkLookup(t, ctx, "Foo", 1, true)
 }
+
+func TestDefaults(t *testing.T) {
+	e := NewEnvironment()
+	type site struct{ SiteName, Theme string }
+	if err := e.SetDefaults(&site{"jigo", "dark"}); err != nil {
+		t.Fatal(err)
+	}
+	e.Globals["theme"] = "light"
+	testFixtures(t, e, []evalFixture{
+		{"Visible", `{{ SiteName }}`, m{}, "jigo"},
+		{"Shadowed by data", `{{ SiteName }}`, m{"SiteName": "mine"}, "mine"},
+		{"Shadowed by set", `{% set SiteName = "set" %}{{ SiteName }}`, m{}, "set"},
+		{"Other names", `{{ SiteName }} {{ title }}`, m{"title": "t"}, "jigo t"},
+		{"Globals", `{{ Theme }} {{ theme }}`, m{}, "dark light"},
+	})
+
+	if err := e.SetDefaults(3); err == nil {
+		t.Errorf("Expected error setting non-struct defaults")
+	}
+	if err := e.SetDefaults(nil); err != nil {
+		t.Fatal(err)
+	}
+	testFixtures(t, e, []evalFixture{{"Removed", `[{{ SiteName }}]`, m{}, "[]"}})
+}
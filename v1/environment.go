@@ -2,8 +2,27 @@ package v1
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// UnknownFilterPolicy is how an Environment treats filters which are not
+// registered.
+type UnknownFilterPolicy int
+
+const (
+	// UnknownFilterError makes an unknown filter an error when rendering.
+	UnknownFilterError UnknownFilterPolicy = iota
+	// UnknownFilterPassThrough passes the value through an unknown filter
+	// unchanged, reporting a warning to Environment.Warn, to ease porting
+	// templates.
+	UnknownFilterPassThrough
 )
 
 type Environment struct {
@@ -19,19 +38,97 @@ type Environment struct {
 	CommentStartString string
 	// The string marking the end of a comment.  Defaults to `#}`.
 	CommentEndString string
-	// If true, first newline after a block is removed.  Default false.
+	// If true, the first newline after a block tag is removed, so a line
+	// holding only a block tag does not leave a blank line.  Variable tags are
+	// unaffected.  Default false.
 	TrimBlocks bool
-	// If true, leading whitespace is stripped from the start of a line to a block.  Default false.
+	// If true, spaces and tabs are stripped from the start of a line to a block
+	// tag or comment.  Default false.  Independently of this, a `-` inside a
+	// tag's delimiters, as in `{%- if x -%}`, strips all whitespace before or
+	// after the tag.
 	LstripBlocks bool
+	// If true, a doubled BlockStartString or VariableStartString in text is
+	// output literally, so `{{{{` renders as `{{`.  Default false.
+	DoubledDelimiters bool
 	// If true, html auto-escaping is enabled by default for all var output.
 	AutoEscape bool
 	// Should the loader attempt to auto reload.
 	AutoReload bool
+	// If true, maps are iterated in sorted key order, rather than Go's random
+	// map order.  Defaults to true.
+	SortMapKeys bool
+	// Alternate names for block keywords, mapping an alias to the keyword it
+	// stands for, eg. {"fi": "endif"}.  Aliases are only recognized as the
+	// first name in a block tag.
+	KeywordAliases map[string]string
+	// If set, UndefinedString returns the output for a var which is
+	// undefined, given the path of the undefined name or attribute, eg.
+	// "user.email".  By default, undefined vars render as nothing.  An
+	// undefined factory set with SetUndefined takes precedence.
+	UndefinedString func(path string) string
+	// If set, OnUndefined is called with the path of every undefined name or
+	// attribute encountered while rendering, eg. "user.email".
+	OnUndefined func(path string)
+	// If set, Warn is called with each warning found while rendering, such
+	// as an unknown filter passed through by UnknownFilterPassThrough.  By
+	// default, warnings are written with the standard logger.
+	Warn func(msg string)
+	// If set, AuditAccess is called with the path of every name, attribute
+	// or item found in the data passed to Execute while rendering, eg.
+	// "user.email", so deployments can log which data a template touched.
+	// Names from other scopes, such as loop variables, macro arguments and
+	// globals, are not reported.  A chain like `user.email` is one
+	// access, reported by its full path only.
+	AuditAccess func(path string)
+	// If set, FieldResolver replaces the default resolution of names in the
+	// context and of attributes on values.  It returns the value for name on
+	// v, and whether it was found.  V may be a pointer or interface.
+	FieldResolver func(v reflect.Value, name string) (reflect.Value, bool)
+	// If true, the output of each block tag is wrapped in html comments giving
+	// the template and line it came from, eg. `<!-- jigo: page.html:12 -->`,
+	// to trace which template produced which output.  Default false.
+	DebugComments bool
+	// How filters which are not registered are treated.  Defaults to
+	// UnknownFilterError.
+	UnknownFilterPolicy UnknownFilterPolicy
+	// If set, OutputEncoder wraps the writer a template is executed into, to
+	// transcode the output from UTF-8 to another encoding, eg. with
+	// golang.org/x/text/encoding.  Templates are rendered in UTF-8, so only
+	// the final bytes are transcoded.  If the wrapping writer is an
+	// io.Closer, it is closed to flush it when rendering finishes.
+	OutputEncoder func(io.Writer) io.Writer
+	// If true, each run of whitespace between html tags in the output is
+	// collapsed to a single space as it is written, for compact html.
+	// Whitespace in text, in attribute values and inside <pre>, <textarea>,
+	// <script> and <style> elements is kept.  Default false.
+	CollapseWhitespace bool
+	// If positive, templates whose source is larger than MaxTemplateBytes
+	// are rejected before they are lexed, to guard against huge untrusted
+	// templates.  Default 0, for no limit.
+	MaxTemplateBytes int
+	// If set, a line beginning with this prefix, after optional spaces and
+	// tabs, is a block statement ending at the end of the line, so with a
+	// prefix of `#`, `# for item in items` is `{% for item in items %}`.
+	// Newlines inside brackets continue the statement.  Default "".
+	LineStatementPrefix string
+	// Text from this prefix to the end of the line is a comment, which is
+	// dropped from the output along with the spaces and tabs before it.  A
+	// line holding only a comment is dropped entirely.  Prefixes inside tags
+	// are not comments.  Defaults to `##`;  set it to "" to disable line
+	// comments.
+	LineCommentPrefix string
+	// If set, the output of {% cache timeout key %} blocks is stored in Cache,
+	// and rendering the block again with the same key while it is cached
+	// writes the stored output without rendering the body.  Keys are scoped
+	// to the block, so equal keys in different blocks or templates do not
+	// share output.  If nil, cache blocks are always rendered.
+	Cache Cache
+	// If true, {# comments #} are kept in parse trees as CommentNodes, which
+	// render nothing, for tools which read or rewrite template source.
+	// Default false.
+	KeepComments bool
 
 	// -- Will not support --
-	// I've decided not to support line statements and line comments, they're unnecessary.
-	// LineStatementPrefix string
-	// LineCommentPrefix   string
 	// For simplicity, trailing newlines will always be kept.
 	// KeepTrailingNewline bool
 	// The sequence that starts a newline.  Only allow `\n`.
@@ -43,12 +140,6 @@ type Environment struct {
 	// as it is being output.  For example can convert `nil` to "".  I think since
 	// Go is statically typed it's unlikely we'll have use for this
 
-	// filters ~ a mapping of names to functions for use in | filters.  Mandira
-	// already supports these, so these should not be too difficult.
-
-	// tests ~ a mapping of functions for use with the is operator;  will have to define
-	// a TestFunc interface.
-
 	// Global variables to pass to every template.  Shadowed by actual local contexts.
 	Globals map[string]interface{}
 	// extensions ~ not sure these are easily doable with Go.
@@ -65,31 +156,137 @@ type Environment struct {
 
 	// bytecode_cache ~ we're going to do an AST cache which will basically
 	// just be a Gobbed AST.
+
+	// filters are functions available via `value|name`;  see RegisterFilter.
+	filters map[string]*filter
+	// converters render values of specific types;  see RegisterConverter.
+	converters map[reflect.Type]func(reflect.Value) string
+	// tests are functions which check values;  see RegisterTest.
+	tests map[string]*test
+	// comparators order values of types which are not otherwise comparable;
+	// see RegisterComparator.
+	comparators map[reflect.Type]Comparator
+	// operators implement arithmetic on other types;  see RegisterOperator.
+	operators map[operatorKey]Operator
+	// undefined makes the values of undefined names;  see SetUndefined.
+	undefined func(path string) Undefined
+
+	// defaults is the context beneath every render;  see SetDefaults.
+	defaults *Context
+
+	// templates are the parsed templates by name;  see Get.
+	mu        sync.RWMutex
+	templates map[string]*Template
 }
 
 // sanityCheck checks an environment for possible improper configurations.
-func (e Environment) sanityCheck() error {
+func (e *Environment) sanityCheck() error {
 	if e.CommentStartString == e.BlockStartString || e.CommentStartString == e.VariableStartString || e.BlockStartString == e.VariableStartString {
 		return errors.New("BlockStartString, VariableBlockString, and CommentStartString must be distinct.")
 	}
+	for alias, name := range e.KeywordAliases {
+		if blockKeywords[alias] {
+			return fmt.Errorf("keyword alias %q shadows a block keyword", alias)
+		}
+		if !blockKeywords[name] {
+			return fmt.Errorf("keyword alias %q is for unknown keyword %q", alias, name)
+		}
+	}
 	return nil
 }
 
 func NewEnvironment() *Environment {
-	return &Environment{
+	e := &Environment{
 		BlockStartString:    "{%",
 		BlockEndString:      "%}",
 		VariableStartString: "{{",
 		VariableEndString:   "}}",
 		CommentStartString:  "{#",
 		CommentEndString:    "#}",
+		LineCommentPrefix:   "##",
+		SortMapKeys:         true,
 		Globals:             make(map[string]interface{}),
+		filters:             make(map[string]*filter, len(builtinFilters)),
+	}
+	for name, f := range builtinFilters {
+		e.RegisterFilter(name, f.fn, f.flags)
+	}
+	e.RegisterFilter("select", e.filterSelect, 0)
+	e.RegisterFilter("reject", e.filterReject, 0)
+	e.RegisterFilter("selectattr", e.filterSelectAttr, 0)
+	e.RegisterFilter("rejectattr", e.filterRejectAttr, 0)
+	e.RegisterFilter("min", e.filterMin, 0)
+	e.RegisterFilter("max", e.filterMax, 0)
+	e.RegisterFilter("groupby", e.filterGroupBy, 0)
+	e.Globals["min"] = e.globalMin
+	e.Globals["max"] = e.globalMax
+	e.Globals["enumerate"] = e.globalEnumerate
+	e.Globals["zip"] = e.globalZip
+	for name, fn := range builtinTests {
+		e.RegisterTest(name, fn)
+	}
+	for name, op := range comparisonTests {
+		e.RegisterTest(name, e.comparisonTest(op))
 	}
+	return e
 }
 
-// lex returns a new lexer for some source.
-func (e *Environment) lex(source, name, filename string) *lexer {
-	cfg := lexerCfg{
+// RegisterFilter makes fn available to templates as the filter name, replacing
+// any existing filter of that name.  The value being filtered is passed as the
+// first argument to fn, followed by any arguments given in the template.  Fn
+// must return a single value, or a value and an error.
+func (e *Environment) RegisterFilter(name string, fn interface{}, flags FilterFlags) error {
+	f, err := newFilter(fn, flags)
+	if err != nil {
+		return err
+	}
+	if e.filters == nil {
+		e.filters = make(map[string]*filter)
+	}
+	e.filters[name] = f
+	return nil
+}
+
+// RegisterConverter makes fn responsible for the output of values of type typ,
+// replacing the default formatting.  If AutoEscape is set, the result of fn
+// is escaped.
+func (e *Environment) RegisterConverter(typ reflect.Type, fn func(reflect.Value) string) {
+	if e.converters == nil {
+		e.converters = make(map[reflect.Type]func(reflect.Value) string)
+	}
+	e.converters[typ] = fn
+}
+
+// An Operator implements an arithmetic operator for values of the types it
+// was registered with by Environment.RegisterOperator.
+type Operator func(a, b reflect.Value) (reflect.Value, error)
+
+type operatorKey struct {
+	op       string
+	lhs, rhs reflect.Type
+}
+
+// arithmeticOperators are the operators which can be registered.
+var arithmeticOperators = []string{"+", "-", "*", "/", "//", "%"}
+
+// RegisterOperator makes fn the arithmetic operator op, one of `+`, `-`, `*`,
+// `/`, `//` or `%`, for a left operand of type lhsType and a right operand of
+// type rhsType, replacing any existing operator for those types.  Registered
+// operators are used before the builtin arithmetic on numbers and strings.
+func (e *Environment) RegisterOperator(op string, lhsType, rhsType reflect.Type, fn Operator) error {
+	if indexOf(arithmeticOperators, op) < 0 {
+		return fmt.Errorf("unknown arithmetic operator %q", op)
+	}
+	if e.operators == nil {
+		e.operators = make(map[operatorKey]Operator)
+	}
+	e.operators[operatorKey{op, lhsType, rhsType}] = fn
+	return nil
+}
+
+// config returns the environment's template syntax.
+func (e *Environment) config() Config {
+	return Config{
 		BlockStartString:    e.BlockStartString,
 		BlockEndString:      e.BlockEndString,
 		VariableStartString: e.VariableStartString,
@@ -97,37 +294,202 @@ func (e *Environment) lex(source, name, filename string) *lexer {
 		CommentStartString:  e.CommentStartString,
 		CommentEndString:    e.CommentEndString,
 	}
-	l := &lexer{
+}
+
+// setConfig sets the environment's template syntax.
+func (e *Environment) setConfig(cfg Config) {
+	e.BlockStartString = cfg.BlockStartString
+	e.BlockEndString = cfg.BlockEndString
+	e.VariableStartString = cfg.VariableStartString
+	e.VariableEndString = cfg.VariableEndString
+	e.CommentStartString = cfg.CommentStartString
+	e.CommentEndString = cfg.CommentEndString
+}
+
+// SetDefaults sets data visible in every render, like Globals, such as a
+// site's name.  The data passed to Execute shadows it, as do Globals.  Like
+// a render's context, data must be a struct or a map, or a pointer to one.
+// Passing nil removes the defaults.
+func (e *Environment) SetDefaults(data interface{}) error {
+	if data == nil {
+		e.defaults = nil
+		return nil
+	}
+	ctx, err := NewContext(data)
+	if err != nil {
+		return err
+	}
+	e.defaults = ctx
+	return nil
+}
+
+// warn reports a warning found while rendering;  see Environment.Warn.
+func (e *Environment) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if e.Warn != nil {
+		e.Warn(msg)
+		return
+	}
+	log.Printf("jigo: %s", msg)
+}
+
+// lexerCfg returns the lexer configuration for the environment.
+func (e *Environment) lexerCfg() lexerCfg {
+	return lexerCfg{
+		Config:              e.config(),
+		DoubledDelimiters:   e.DoubledDelimiters,
+		TrimBlocks:          e.TrimBlocks,
+		LstripBlocks:        e.LstripBlocks,
+		LineStatementPrefix: e.LineStatementPrefix,
+		LineCommentPrefix:   e.LineCommentPrefix,
+		BatchSize:           lexBatchSize,
+	}
+}
+
+// lexBatchSize is the number of items a lexer running in its own goroutine
+// sends over its channel at a time.
+const lexBatchSize = 64
+
+// lex returns a new lexer for some source.
+func (e *Environment) lex(source, name, filename string) *lexer {
+	return newLexer(e.lexerCfg(), source, name, filename)
+}
+
+// newLexer returns a new lexer for some source with the configuration cfg,
+// which scans in a goroutine and sends its items over a channel.
+func newLexer(cfg lexerCfg, source, name, filename string) *lexer {
+	l := newSyncLexer(cfg, source, name, filename)
+	l.items = make(chan []item)
+	go l.run()
+	return l
+}
+
+// newSyncLexer returns a new lexer for some source with the configuration
+// cfg, which scans as nextItem is called, in the caller's goroutine.
+func newSyncLexer(cfg lexerCfg, source, name, filename string) *lexer {
+	// a leading byte order mark is not part of the template
+	source = strings.TrimPrefix(source, utf8BOM)
+	return &lexer{
 		lexerCfg:   cfg,
 		name:       name,
 		filename:   filename,
 		input:      source,
 		leftDelim:  cfg.BlockStartString,
 		rightDelim: cfg.BlockEndString,
-		items:      make(chan item),
+		state:      lexText,
 		delimStack: make([]rune, 0, 10),
 	}
-	go l.run()
-	return l
 }
 
+// utf8BOM is the UTF-8 encoding of the byte order mark.
+const utf8BOM = "\ufeff"
+
 func (e *Environment) Load(path string) (*Template, error) {
 	return nil, nil
 }
 
+// Parse parses the template read from r and registers it under name;  see
+// ParseString.
 func (e *Environment) Parse(r io.Reader, name, filename string) (*Template, error) {
-	source, err := ioutil.ReadAll(r)
+	source, err := e.read(r)
 	if err != nil {
 		return nil, err
 	}
-	return e.ParseString(string(source), name, filename)
+	return e.ParseString(source, name, filename)
 }
 
+// ParseFragment parses the template read from r without registering it.
 func (e *Environment) ParseFragment(r io.Reader) (*Template, error) {
-	return e.Parse(r, "temporary", "temporary")
+	source, err := e.read(r)
+	if err != nil {
+		return nil, err
+	}
+	return e.newTemplate(source, "temporary", "temporary")
+}
+
+// read reads template source from r.
+func (e *Environment) read(r io.Reader) (string, error) {
+	if e.MaxTemplateBytes > 0 {
+		// read no more than one byte past the limit, so a huge template is
+		// never held in memory
+		r = io.LimitReader(r, int64(e.MaxTemplateBytes)+1)
+	}
+	source, err := ioutil.ReadAll(r)
+	return string(source), err
 }
 
+// ParseString parses the template source and registers it under name, so
+// it can be retrieved with Get or rendered with ExecuteTemplate.  A template
+// parsed with the name of one already registered replaces it.
 func (e *Environment) ParseString(source, name, filename string) (*Template, error) {
+	t, err := e.newTemplate(source, name, filename)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.templates == nil {
+		e.templates = make(map[string]*Template)
+	}
+	e.templates[name] = t
+	return t, nil
+}
+
+// ParseFiles parses the named files, registering each under its base name
+// like html/template, so "views/index.html" is registered as "index.html".
+// If a file cannot be read or parsed, the files after it are not parsed.
+func (e *Environment) ParseFiles(paths ...string) error {
+	if len(paths) == 0 {
+		return errors.New("template: no files named in call to ParseFiles")
+	}
+	for _, path := range paths {
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := e.ParseString(string(source), filepath.Base(path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseGlob parses the files matching pattern, as with filepath.Glob, like
+// ParseFiles.  It is an error if no files match.
+func (e *Environment) ParseGlob(pattern string) error {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("template: pattern matches no files: %#q", pattern)
+	}
+	return e.ParseFiles(paths...)
+}
+
+// Get returns the template registered under name.
+func (e *Environment) Get(name string) (*Template, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	t, ok := e.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("template: no template %q", name)
+	}
+	return t, nil
+}
+
+// ExecuteTemplate renders the template registered under name to w with the
+// given context;  see Template.Execute.
+func (e *Environment) ExecuteTemplate(w io.Writer, name string, context interface{}, opts ...ExecuteOption) error {
+	t, err := e.Get(name)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, context, opts...)
+}
+
+// newTemplate parses source into a new template.
+func (e *Environment) newTemplate(source, name, filename string) (*Template, error) {
 	root, err := e.parse(source, name, filename)
 	if err != nil {
 		return nil, err
@@ -142,7 +504,20 @@ func (e *Environment) ParseString(source, name, filename string) (*Template, err
 
 // parse completely parses template source, returning the Node errors.
 func (e *Environment) parse(source, name, filename string) (*Tree, error) {
-	lex := e.lex(source, name, filename)
+	if err := e.sanityCheck(); err != nil {
+		return nil, err
+	}
+	if e.MaxTemplateBytes > 0 && len(source) > e.MaxTemplateBytes {
+		return nil, fmt.Errorf("template: %s: source is larger than the maximum of %d bytes", name, e.MaxTemplateBytes)
+	}
+	// comments are not represented in the AST unless they are kept
+	cfg := e.lexerCfg()
+	cfg.SkipComments = !e.KeepComments
+	// the lexer runs as the parser reads, so a parse error leaves nothing
+	// running behind it
+	lex := newSyncLexer(cfg, source, name, filename)
 	t := newTree(name)
+	t.aliases = e.KeywordAliases
+	t.comments = e.KeepComments
 	return t.Parse(lex)
 }
@@ -1,10 +1,15 @@
 package v1
 
 import (
-	"bytes"
+	"context"
+	"encoding"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"math"
+	"reflect"
+	"strings"
 )
 
 // This file contains ast evaluation.
@@ -13,31 +18,160 @@ import (
 // burdened with runtime evaluation, and also so that the ast was free
 // to also be used for other purposes such as prettifying or codegen.
 
+// TemplateError is an error that occurred while rendering a template, with
+// the location and source of the node which caused it.
+type TemplateError struct {
+	Location string // name:line:col of the node
+	Context  string // an excerpt of the node's source
+	Err      error
+	// Trace holds the macro calls and includes being rendered when the
+	// error occurred, innermost first.
+	Trace []Frame
+}
+
+func (e *TemplateError) Error() string {
+	msg := fmt.Sprintf("template: %s: %s: %s", e.Location, e.Context, e.Err)
+	if len(e.Location) == 0 {
+		msg = fmt.Sprintf("template: %s", e.Err)
+	}
+	for _, f := range e.Trace {
+		msg += "\n\t" + f.String()
+	}
+	return msg
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// A Frame is a macro call or include which was being rendered when an error
+// occurred.
+type Frame struct {
+	Kind     string // "macro" or "include"
+	Name     string // the name of the macro or included template
+	Template string // the name of the template calling or including it
+	Line     int    // the line of the call or include
+}
+
+func (f Frame) String() string {
+	verb := "called"
+	if f.Kind == "include" {
+		verb = "included"
+	}
+	return fmt.Sprintf("in %s %s, %s from %s, line %d", f.Kind, f.Name, verb, f.Template, f.Line)
+}
+
+// ValidationError is returned by Template.Validate, and holds every error
+// found while rendering the template.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
 type renderer struct {
 	t *Template
 	c contextStack
-	b bytes.Buffer
+	w io.Writer
+	// If validating, errors are collected in errs rather than stopping the
+	// render, and undefined names are errors.
+	validate bool
+	errs     []error
+	// undef is the first undefined name or attribute in the current var.
+	undef Node
+	// chained is the node being evaluated as part of a longer attribute or
+	// item chain, whose access is not audited on its own.
+	chained Node
+	// onUndefined is called with the path of each undefined name or
+	// attribute;  see Environment.OnUndefined and WithResult.
+	onUndefined []func(path string)
+	// filters and globals for this render only;  see ExecuteOption.
+	filters map[string]*filter
+	globals map[string]interface{}
+	// ctx cancels waiting on channels;  see WithContext.
+	ctx context.Context
+	// frames are the macro calls and includes being rendered.
+	frames []frame
+	// data is the context passed to render, the only names AuditAccess
+	// reports.
+	data *Context
+	// loader finds included templates before the environment;  see
+	// WithSearchPath.
+	loader layeredLoader
 }
 
-func newRenderer(t *Template) *renderer {
-	return &renderer{t: t}
+func newRenderer(t *Template, w io.Writer) *renderer {
+	r := &renderer{t: t, w: w, ctx: context.Background()}
+	if t.env.OnUndefined != nil {
+		r.onUndefined = append(r.onUndefined, t.env.OnUndefined)
+	}
+	return r
 }
 
-func (r *renderer) render(c contextStack) (string, error) {
-	r.c = c
-	err := r.renderList(r.t.base.Root)
-	return r.b.String(), err
+// render renders the template with context, which sits on top of the
+// environment's globals and then the render's own globals, with the
+// environment's defaults at the bottom of the stack.
+func (r *renderer) render(context interface{}) error {
+	if r.t.env.defaults != nil {
+		r.c.push(r.t.env.defaults)
+	}
+	for _, globals := range []map[string]interface{}{r.t.env.Globals, r.globals} {
+		if len(globals) > 0 {
+			ctx, _ := NewContext(globals)
+			r.c.push(ctx)
+		}
+	}
+	ctx, _ := NewContext(map[string]interface{}{"self": newSelf(r)})
+	r.c.push(ctx)
+	ctx, err := NewContext(context)
+	if err != nil {
+		return err
+	}
+	r.c.push(ctx)
+	r.data = ctx
+	// variables set at the top level of the template live in their own
+	// scope, so the context passed in is never modified
+	r.c.push(newScope(make(map[string]interface{})))
+	err = r.renderList(r.t.base.Root)
+	if r.validate && len(r.errs) > 0 {
+		return &ValidationError{r.errs}
+	}
+	return err
 }
 
 func (r *renderer) renderNode(n Node) error {
 	switch t := n.(type) {
 	case *TextNode:
-		_, err := r.b.Write(t.Text)
+		_, err := r.w.Write(t.Text)
 		return err
+	case *CommentNode:
+		return nil
 	case *VarNode:
 		return r.renderVar(t)
 	case *IfBlockNode:
-		return r.renderCond(t)
+		return r.annotate(t, func() error { return r.renderCond(t) })
+	case *ForNode:
+		return r.annotate(t, func() error { return r.renderFor(t) })
+	case *BlockNode:
+		return r.annotate(t, func() error { return r.renderNode(t.Body) })
+	case *CacheNode:
+		return r.annotate(t, func() error { return r.renderCache(t) })
+	case *SetNode:
+		return r.renderSet(t)
+	case *MacroNode:
+		return r.renderMacro(t)
+	case *IncludeNode:
+		return r.annotate(t, func() error { return r.renderInclude(t) })
+	case *BreakNode:
+		return errBreak
+	case *ContinueNode:
+		return errContinue
 	case *ListNode:
 		return r.renderList(t)
 	default:
@@ -46,30 +180,140 @@ func (r *renderer) renderNode(n Node) error {
 
 }
 
+// annotate calls render, wrapping its output in comments giving the source
+// position of n if the environment has DebugComments set.
+func (r *renderer) annotate(n Node, render func() error) error {
+	if !r.t.env.DebugComments {
+		return render()
+	}
+	line := 1 + strings.Count(r.t.base.text[:n.Position()], "\n")
+	location := fmt.Sprintf("%s:%d", r.t.base.ParseName, line)
+	if _, err := fmt.Fprintf(r.w, "<!-- jigo: %s -->", location); err != nil {
+		return err
+	}
+	// a break or continue ends the node's output as well, so it is closed
+	// before the loop acts on it
+	err := render()
+	if err != nil && err != errBreak && err != errContinue {
+		return err
+	}
+	if _, werr := fmt.Fprintf(r.w, "<!-- /jigo: %s -->", location); werr != nil {
+		return werr
+	}
+	return err
+}
+
 func (r *renderer) renderList(n *ListNode) error {
 	for _, node := range n.Nodes {
 		err := r.renderNode(node)
-		if err != nil {
+		if err == errBreak || err == errContinue {
+			return err
+		}
+		if err != nil && r.validate {
+			if len(r.frames) > 0 {
+				err = r.trace(err)
+			}
+			r.errs = append(r.errs, err)
+		} else if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r *renderer) renderVar(n *VarNode) error {
+func (r *renderer) renderVar(n *VarNode) (err error) {
+	defer r.recover(n, &err)
+	r.undef = nil
 	switch t := n.Node.(type) {
 	case *LookupNode:
 		return r.renderLookup(t)
-	case *AddExpr:
-		i, err := eval(t, r.c)
+	default:
+		i, err := r.eval(t)
 		if err != nil {
 			return err
 		}
-		// evaluated expressions are coerced to string with Sprint before rendering
-		r.b.WriteString(fmt.Sprint(i))
+		if i == nil && r.undef != nil {
+			return r.renderUndefined(r.undef)
+		}
+		return r.renderValue(i)
+	}
+}
+
+// renderUndefined renders the undefined name or attribute n, which is empty
+// unless the environment has an UndefinedString.
+func (r *renderer) renderUndefined(n Node) error {
+	if r.t.env.UndefinedString == nil {
 		return nil
+	}
+	return r.writeEscaped(r.t.env.UndefinedString(n.String()))
+}
+
+// renderValue writes the string form of an evaluated value to the output.
+// Values whose type has a registered converter are rendered by it.  Otherwise,
+// values implementing fmt.Stringer or encoding.TextMarshaler are rendered
+// via those interfaces, in that order; everything else is coerced to string
+// with Sprint.  If the environment autoescapes, the result is html escaped
+// unless the value is Safe or an html/template HTML.
+func (r *renderer) renderValue(i interface{}) error {
+	// failed lookups evaluate to nil, which renders as nothing, as do nil
+	// maps, slices and pointers
+	if i == nil || isNil(reflect.ValueOf(i)) {
+		return nil
+	}
+	if conv, ok := r.t.env.converters[reflect.TypeOf(i)]; ok {
+		return r.writeEscaped(conv(reflect.ValueOf(i)))
+	}
+	if safe, ok := asSafe(i); ok {
+		_, err := io.WriteString(r.w, string(safe))
+		return err
+	}
+	var s string
+	switch t := i.(type) {
+	case string:
+		s = t
+	case fmt.Stringer:
+		s = t.String()
+	case encoding.TextMarshaler:
+		b, err := t.MarshalText()
+		if err != nil {
+			return err
+		}
+		s = string(b)
 	default:
-		return fmt.Errorf("Unknown node type %v", t.Type())
+		s = fmt.Sprint(i)
+	}
+	return r.writeEscaped(s)
+}
+
+// writeEscaped writes s to the output, escaping it if the environment
+// autoescapes.
+func (r *renderer) writeEscaped(s string) error {
+	if r.t.env.AutoEscape {
+		s = html.EscapeString(s)
+	}
+	_, err := io.WriteString(r.w, s)
+	return err
+}
+
+// renderSet evaluates the value of a set tag and assigns it.
+func (r *renderer) renderSet(n *SetNode) error {
+	val, err := r.eval(n.rhs)
+	if err != nil {
+		return err
+	}
+	switch target := n.lhs.(type) {
+	case *LookupNode:
+		r.c.assign(target.Name, val)
+	case *TupleNode:
+		vars := make(map[string]interface{})
+		if err := unpack(target, val, vars); err != nil {
+			return r.errorf(n, "%s", err)
+		}
+		for name, v := range vars {
+			r.c.assign(name, v)
+		}
+	default:
+		return r.errorf(n, "cannot assign to %s", n.lhs)
 	}
 	return nil
 }
@@ -78,11 +322,14 @@ func (r *renderer) renderVar(n *VarNode) error {
 func (r *renderer) renderCond(n *IfBlockNode) error {
 	for _, cond := range n.Conditionals {
 		c := cond.(*ConditionalNode)
-		g, err := eval(c.Guard, r.c)
+		g, err := r.eval(c.Guard)
 		if err != nil {
 			return err
 		}
 		val, err := asBool(g)
+		if u, ok := g.(Undefined); ok {
+			val, err = u.Bool(), nil
+		}
 		if err != nil {
 			return fmt.Errorf(`Non-boolean "%s" used in boolean context.`, g)
 		}
@@ -99,45 +346,700 @@ func (r *renderer) renderCond(n *IfBlockNode) error {
 
 func (r *renderer) renderLookup(n *LookupNode) error {
 	// FIXME: strict mode where lookup failures are runtime errors?
-	v, ok := r.c.lookup(n.Name)
+	v, ok := r.lookup(n.Name)
 	if ok {
-		r.b.WriteString(fmt.Sprint(v.Interface()))
+		r.audit(n)
+		return r.renderValue(v.Interface())
 	}
-	return nil
+	if u := r.undefined(n); u != nil {
+		return r.renderValue(u)
+	}
+	return r.renderUndefined(n)
+}
+
+// undefined notes that the name or attribute n is undefined, and returns its
+// value, which is nil unless the environment has an undefined factory.  This
+// is only an error when validating, where it is collected without stopping
+// the render.
+func (r *renderer) undefined(n Node) interface{} {
+	if r.undef == nil {
+		r.undef = n
+	}
+	for _, fn := range r.onUndefined {
+		fn(n.String())
+	}
+	if r.validate {
+		r.errs = append(r.errs, r.errorf(n, "%s is undefined", n))
+	}
+	if r.t.env.undefined == nil {
+		return nil
+	}
+	return r.t.env.undefined(n.String())
+}
+
+// audit reports the access of the name, attribute or item n to the
+// environment's AuditAccess hook, unless n is part of a longer chain or does
+// not start from a name in the render's context, such as a loop variable, a
+// macro argument or a global.
+func (r *renderer) audit(n Node) {
+	if r.t.env.AuditAccess == nil || n == r.chained {
+		return
+	}
+	root := chainRoot(n)
+	if root == nil || r.c.find(root.Name, r.t.env.resolver()) != r.data {
+		return
+	}
+	r.t.env.AuditAccess(n.String())
+}
+
+// chainRoot returns the name at the start of the chain of attributes and
+// items n, or nil if it does not start with a name.
+func chainRoot(n Node) *LookupNode {
+	for {
+		switch t := n.(type) {
+		case *LookupNode:
+			return t
+		case *AttrExpr:
+			n = t.Value
+		case *IndexExpr:
+			n = t.Value
+		default:
+			return nil
+		}
+	}
+}
+
+// evalChained evaluates n, the value of an attribute or item expression,
+// without auditing it as a separate access.
+func (r *renderer) evalChained(n Node) (interface{}, error) {
+	chained := r.chained
+	r.chained = n
+	defer func() { r.chained = chained }()
+	return r.eval(n)
+}
+
+// recover converts a panic while rendering or evaluating n into an error.
+// Reflection can panic on values we cannot anticipate, eg. a nil pointer
+// method receiver, and a bad value should not crash the host process.
+func (r *renderer) recover(n Node, errp *error) {
+	if e := recover(); e != nil {
+		*errp = r.errorf(n, "%v", e)
+	}
+}
+
+// maxFrames is the deepest that macro calls and includes may nest, so
+// unbounded recursion fails rather than overflowing the stack.
+const maxFrames = 256
+
+// A frame is a macro call or include being rendered, at pos in tree.  Its
+// line is only counted if it is in a trace.
+type frame struct {
+	kind, name string
+	tree       *Tree
+	pos        Pos
+}
+
+// Frame returns the frame as it appears in a trace.
+func (f frame) Frame() Frame {
+	line := 1 + strings.Count(f.tree.text[:f.pos], "\n")
+	return Frame{f.kind, f.name, f.tree.ParseName, line}
+}
+
+// enter pushes a frame for a macro call or include at n, and returns a
+// function which pops it again, adding the trace to the error in errp.  It
+// is an error to nest more than maxFrames deep.
+func (r *renderer) enter(kind, name string, n Node) (func(errp *error), error) {
+	if len(r.frames) >= maxFrames {
+		return nil, r.errorf(n, "%s %s: maximum macro and include depth of %d exceeded", kind, name, maxFrames)
+	}
+	r.frames = append(r.frames, frame{kind, name, r.t.base, n.Position()})
+	return func(errp *error) {
+		if *errp != nil {
+			*errp = r.trace(*errp)
+		}
+		r.frames = r.frames[:len(r.frames)-1]
+	}, nil
+}
+
+// trace returns err as a TemplateError with the frames being rendered, unless
+// it already has a trace from an inner frame.
+func (r *renderer) trace(err error) error {
+	e, ok := err.(*TemplateError)
+	if !ok {
+		e = &TemplateError{Err: err}
+	}
+	if e.Trace == nil {
+		for i := len(r.frames) - 1; i >= 0; i-- {
+			e.Trace = append(e.Trace, r.frames[i].Frame())
+		}
+	}
+	return e
+}
+
+// errorf returns a TemplateError for n.
+func (r *renderer) errorf(n Node, format string, args ...interface{}) error {
+	location, context := r.t.base.ErrorContext(n)
+	return &TemplateError{Location: location, Context: context, Err: fmt.Errorf(format, args...)}
 }
 
 // main ltr eval
-func eval(n Node, c contextStack) (interface{}, error) {
+func (r *renderer) eval(n Node) (v interface{}, err error) {
+	defer r.recover(n, &err)
 	switch t := n.(type) {
 	case *LookupNode:
 		// we ignore lookup errors here and return nil
-		val, ok := c.lookup(t.Name)
+		val, ok := r.lookup(t.Name)
 		if !ok {
-			return nil, nil
+			return r.undefined(t), nil
 		}
+		r.audit(t)
 		return val.Interface(), nil
 	case *FloatNode:
 		return t.Value, nil
 	case *IntegerNode:
-		return t.Value, nil
+		return boxInt(t.Value), nil
 	case *StringNode:
 		return t.Value, nil
 	case *BoolNode:
 		return t.Value, nil
+	case *NoneNode:
+		return nil, nil
+	case *TupleNode:
+		return r.evalElems(t.Elems)
+	case *ListLiteralNode:
+		return r.evalElems(t.Elems)
+	case *MapExpr:
+		return r.evalMap(t)
 	case *AddExpr:
-		lhs, err := eval(t.lhs, c)
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		return r.t.env.arithmetic(lhs, rhs, t.operator)
+	case *MulExpr:
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		return r.t.env.arithmetic(lhs, rhs, t.operator)
+	case *ConcatNode:
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		return asString(lhs) + asString(rhs), nil
+	case *AndNode:
+		lhs, err := r.eval(t.lhs)
+		if err != nil || !truthy(lhs) {
+			return lhs, err
+		}
+		return r.eval(t.rhs)
+	case *OrNode:
+		lhs, err := r.eval(t.lhs)
+		if err != nil || truthy(lhs) {
+			return lhs, err
+		}
+		return r.eval(t.rhs)
+	case *NotNode:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		return !truthy(val), nil
+	case *TernaryNode:
+		cond, err := r.eval(t.Cond)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case truthy(cond):
+			return r.eval(t.TrueExpr)
+		case t.FalseExpr != nil:
+			return r.eval(t.FalseExpr)
+		case r.t.env.undefined != nil:
+			return r.t.env.undefined(t.String()), nil
+		}
+		return nil, nil
+	case *CompareExpr:
+		return r.evalCompare(t)
+	case *IndexExpr:
+		val, err := r.evalChained(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := r.eval(t.Index)
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := val.(Undefined); ok {
+			return r.undefinedAttr(t, u, asString(idx))
+		}
+		v, ok := r.t.env.getitem(val, idx)
+		if !ok && val != nil {
+			return r.undefined(t), nil
+		}
+		if ok {
+			r.audit(t)
+		}
+		return v, nil
+	case *SliceExpr:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		bounds, _, err := r.evalArgs([]Node{t.Start, t.Stop, t.Step})
+		if err != nil {
+			return nil, err
+		}
+		return slice(val, bounds[0], bounds[1], bounds[2])
+	case *AttrExpr:
+		return r.evalAttr(t, true)
+	case *CallExpr:
+		var fn interface{}
+		if a, ok := t.Value.(*AttrExpr); ok {
+			fn, err = r.evalAttr(a, false)
+		} else {
+			fn, err = r.eval(t.Value)
+		}
 		if err != nil {
 			return nil, err
 		}
-		rhs, err := eval(t.rhs, c)
+		args, kwargs, err := r.evalArgs(t.Args)
 		if err != nil {
 			return nil, err
 		}
-		return evalAdd(lhs, rhs, t.operator)
+		if isUndefined(fn) {
+			return nil, r.errorf(t, "%s is undefined", t.Value)
+		}
+		if m, ok := fn.(*macro); ok {
+			return r.callMacro(m, args, kwargs, t)
+		}
+		if c, ok := fn.(callable); ok {
+			return c.call(args, kwargs)
+		}
+		f := reflect.ValueOf(fn)
+		if err = checkFunc(f); err != nil {
+			return nil, err
+		}
+		return call(f, args, kwargs)
+	case *FilterNode:
+		var val interface{}
+		if t.Name == "default" || t.Name == "d" {
+			val, err = r.evalQuiet(t.Value)
+		} else {
+			val, err = r.eval(t.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := r.evalArgs(t.Args)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := r.filter(t.Name)
+		if !ok {
+			if m, ok := r.macroFilter(t.Name); ok {
+				return r.callMacro(m, append([]interface{}{val}, args...), kwargs, t)
+			}
+		}
+		if !ok && r.t.env.UnknownFilterPolicy == UnknownFilterPassThrough {
+			location, _ := r.t.base.ErrorContext(t)
+			r.t.env.warn("%s: unknown filter %q, passing value through", location, t.Name)
+			return val, nil
+		}
+		if !ok {
+			return nil, r.errorf(t, "unknown filter %q", t.Name)
+		}
+		return f.apply(val, args, kwargs, r.t.env.AutoEscape)
+	case *TestNode:
+		return r.evalTest(t)
 	}
 	return nil, nil
 }
 
+// evalAttr evaluates the attribute expression n.  Attribute access never
+// passes arguments:  a method which takes none is called if autoCall is set,
+// as it is unless n is itself being called, and any other method evaluates to
+// the bound method value, which only explicit call syntax calls.
+func (r *renderer) evalAttr(n *AttrExpr, autoCall bool) (interface{}, error) {
+	val, err := r.evalChained(n.Value)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := val.(Undefined); ok {
+		return r.undefinedAttr(n, u, n.Name)
+	}
+	v, ok := r.t.env.getattr(val, n.Name)
+	if !ok && val != nil {
+		return r.undefined(n), nil
+	}
+	if !ok {
+		return v, nil
+	}
+	r.audit(n)
+	if autoCall && hasMethod(val, n.Name) {
+		if f := reflect.ValueOf(v); f.Kind() == reflect.Func && f.Type().NumIn() == 0 && checkFunc(f) == nil {
+			return call(f, nil, nil)
+		}
+	}
+	return v, nil
+}
+
+// hasMethod reports whether name is a method of i.
+func hasMethod(i interface{}, name string) bool {
+	if i == nil {
+		return false
+	}
+	_, ok := reflect.TypeOf(i).MethodByName(name)
+	return ok
+}
+
+// evalElems evaluates the elements of a list or tuple literal to a slice.
+func (r *renderer) evalElems(elems []Node) ([]interface{}, error) {
+	vals := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		var err error
+		if vals[i], err = r.eval(elem); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// evalMap evaluates a map literal.  If every key is a string, it evaluates
+// to a map with string keys, whose values are also attributes, so
+// `{"a": 1}.a` is 1;  otherwise the keys may be of any comparable type.
+func (r *renderer) evalMap(n *MapExpr) (interface{}, error) {
+	keys := make([]interface{}, len(n.Elems))
+	vals := make([]interface{}, len(n.Elems))
+	strs := true
+	for i, elem := range n.Elems {
+		var err error
+		if keys[i], err = r.eval(elem.Key); err != nil {
+			return nil, err
+		}
+		if vals[i], err = r.eval(elem.Value); err != nil {
+			return nil, err
+		}
+		if keys[i] != nil && !reflect.TypeOf(keys[i]).Comparable() {
+			return nil, r.errorf(elem.Key, "unhashable map key %s", typeName(keys[i]))
+		}
+		strs = strs && typeOf(keys[i]) == stringType
+	}
+	if strs {
+		m := make(map[string]interface{}, len(keys))
+		for i, k := range keys {
+			m[asString(k)] = vals[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, len(keys))
+	for i, k := range keys {
+		m[k] = vals[i]
+	}
+	return m, nil
+}
+
+// evalTest evaluates a test expression.  The defined and undefined tests
+// expect their value may be undefined, so it is not reported, as with the
+// default filter.
+func (r *renderer) evalTest(n *TestNode) (interface{}, error) {
+	var val interface{}
+	var err error
+	if n.Name == "defined" || n.Name == "undefined" {
+		val, err = r.evalQuiet(n.Value)
+	} else {
+		val, err = r.eval(n.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	args, kwargs, err := r.evalArgs(n.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(kwargs) > 0 {
+		return nil, r.errorf(n, "test %q does not accept keyword arguments", n.Name)
+	}
+	ok, err := r.t.env.runTest(n.Name, val, args)
+	if err != nil {
+		return nil, r.errorf(n, "%s", err)
+	}
+	return ok != n.Negated, nil
+}
+
+// undefinedAttr returns the attribute or item name of the undefined value u,
+// for the attribute or item expression n.
+func (r *renderer) undefinedAttr(n Node, u Undefined, name string) (interface{}, error) {
+	v, err := u.Attr(name)
+	if err != nil {
+		return nil, r.errorf(n, "%s", err)
+	}
+	return v, nil
+}
+
+// evalQuiet evaluates n without reporting undefined names or attributes, for
+// the tests and filters which expect their value may be undefined.
+func (r *renderer) evalQuiet(n Node) (interface{}, error) {
+	undef, validate, hooks := r.undef, r.validate, r.onUndefined
+	r.validate, r.onUndefined = false, nil
+	defer func() { r.undef, r.validate, r.onUndefined = undef, validate, hooks }()
+	return r.eval(n)
+}
+
+// evalArgs evaluates a list of argument expressions into positional and
+// keyword arguments.
+func (r *renderer) evalArgs(nodes []Node) (args []interface{}, kwargs Kwargs, err error) {
+	args = make([]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		if k, ok := n.(*KeywordNode); ok {
+			if kwargs == nil {
+				kwargs = make(Kwargs)
+			}
+			if kwargs[k.Name], err = r.eval(k.Value); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		v, err := r.eval(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	return args, kwargs, nil
+}
+
+// filter returns the filter name, preferring the render's own filters to
+// the environment's.
+func (r *renderer) filter(name string) (*filter, bool) {
+	if f, ok := r.filters[name]; ok {
+		return f, true
+	}
+	f, ok := r.t.env.filters[name]
+	return f, ok
+}
+
+// macroFilter returns the macro in scope called name, which filters without
+// a registered filter of their name fall back to, so `{{ s|shout }}` calls
+// the macro shout with s as its first argument.
+func (r *renderer) macroFilter(name string) (*macro, bool) {
+	v, ok := r.lookup(name)
+	if !ok || !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	m, ok := v.Interface().(*macro)
+	return m, ok
+}
+
+// callMacro calls the macro m at n, adding a frame for it to any error.
+func (r *renderer) callMacro(m *macro, args []interface{}, kwargs Kwargs, n Node) (interface{}, error) {
+	exit, err := r.enter("macro", m.n.Name, n)
+	if err != nil {
+		return nil, err
+	}
+	out, err := m.call(args, kwargs)
+	exit(&err)
+	return out, err
+}
+
+// resolver returns the function used to resolve names on values, which is
+// the environment's FieldResolver if it has one.
+func (e *Environment) resolver() func(reflect.Value, string) (reflect.Value, bool) {
+	if e.FieldResolver != nil {
+		return e.FieldResolver
+	}
+	return resolveField
+}
+
+// lookup finds a top level name in the context stack.
+func (r *renderer) lookup(name string) (reflect.Value, bool) {
+	return r.c.resolve(name, r.t.env.resolver())
+}
+
+// getattr looks up the attribute name on i.  Dotted attribute access (`a.b.c`)
+// is a chain of getattr calls, so a name is never split on its own.  Maps
+// without a key name fall back to the methods items, keys and values.  If the
+// attribute is not found, nil and false are returned.
+func (e *Environment) getattr(i interface{}, name string) (interface{}, bool) {
+	if a, ok := i.(attrGetter); ok {
+		return a.getattr(name)
+	}
+	v, ok := e.resolver()(reflect.ValueOf(i), name)
+	if ok {
+		return valueOf(v)
+	}
+	if mv := indirect(reflect.ValueOf(i)); mv.Kind() == reflect.Map {
+		return e.mapMethod(mv, name)
+	}
+	return nil, false
+}
+
+// getitem looks up the key on i like getitem below, but falls back to the
+// attribute key for string keys, so `data["a"]["b"]` and `data.a.b` resolve
+// the same way on structs as well as maps.
+func (e *Environment) getitem(i, key interface{}) (interface{}, bool) {
+	if v, ok := getitem(i, key); ok {
+		return v, ok
+	}
+	if name, ok := key.(string); ok && i != nil {
+		return e.getattr(i, name)
+	}
+	return nil, false
+}
+
+// getitem looks up the key on i, which must be a map, slice, array or string.
+// The key is used as-is, so `data["user.email"]` fetches that literal key from
+// a map rather than being treated as an attribute path.  Negative indexes on
+// sequences count from the end.  If the key is not found, nil and false are
+// returned.
+func getitem(i, key interface{}) (interface{}, bool) {
+	v := indirect(reflect.ValueOf(i))
+	switch v.Kind() {
+	case reflect.Map:
+		k := reflect.ValueOf(key)
+		if !k.IsValid() || !k.Type().ConvertibleTo(v.Type().Key()) {
+			return nil, false
+		}
+		return valueOf(v.MapIndex(k.Convert(v.Type().Key())))
+	case reflect.Slice, reflect.Array, reflect.String:
+		idx, ok := asInteger(key)
+		if !ok || typeOf(key) != intType {
+			return nil, false
+		}
+		if idx < 0 {
+			idx += int64(v.Len())
+		}
+		if idx < 0 || idx >= int64(v.Len()) {
+			return nil, false
+		}
+		return valueOf(v.Index(int(idx)))
+	}
+	return nil, false
+}
+
+// slice returns the elements of i, which must be a slice, array or string,
+// from start up to but not including stop, taking every step'th element.
+// Nil bounds take their defaults, and all bounds follow Python's semantics,
+// so negative bounds count from the end and negative steps walk backwards.
+// Strings are sliced by rune.  If i cannot be sliced, nil is returned.
+func slice(i, start, stop, step interface{}) (interface{}, error) {
+	v := indirect(reflect.ValueOf(i))
+	isString := v.Kind() == reflect.String
+	if isString {
+		v = reflect.ValueOf([]rune(v.String()))
+	} else if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, nil
+	}
+
+	var bounds [3]int
+	for x, b := range []interface{}{start, stop, step} {
+		if b == nil {
+			continue
+		}
+		n, ok := asInteger(b)
+		if !ok || typeOf(b) != intType {
+			return nil, fmt.Errorf("type error: slice indices must be integers, not %s", typeOf(b))
+		}
+		bounds[x] = int(n)
+	}
+	length := v.Len()
+	lo, hi, inc := bounds[0], bounds[1], bounds[2]
+	if step == nil {
+		inc = 1
+	}
+	if inc == 0 {
+		return nil, errors.New("slice step cannot be zero")
+	}
+	// adjust takes a bound and its default to an index in [-1, length]
+	adjust := func(b interface{}, n, def int) int {
+		switch {
+		case b == nil:
+			return def
+		case n < 0:
+			n += length
+			if n < 0 {
+				if inc < 0 {
+					return -1
+				}
+				return 0
+			}
+		case n >= length:
+			if inc < 0 {
+				return length - 1
+			}
+			return length
+		}
+		return n
+	}
+	if inc > 0 {
+		lo, hi = adjust(start, lo, 0), adjust(stop, hi, length)
+	} else {
+		lo, hi = adjust(start, lo, length-1), adjust(stop, hi, -1)
+	}
+
+	out := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), 0, 0)
+	for x := lo; (inc > 0 && x < hi) || (inc < 0 && x > hi); x += inc {
+		out = reflect.Append(out, v.Index(x))
+	}
+	if isString {
+		return string(out.Interface().([]rune)), nil
+	}
+	return out.Interface(), nil
+}
+
+// indirect follows pointers and interfaces until it reaches a concrete value.
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return v
+}
+
+// isNil reports whether v is a nil map, slice or pointer.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// valueOf returns the interface value of v, if v is valid and exported.
+func valueOf(v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+// arithmetic evaluates an arithmetic expression, using the operator
+// registered for the types of lhs and rhs if there is one.
+func (e *Environment) arithmetic(lhs, rhs interface{}, oper item) (interface{}, error) {
+	if e.operators != nil && lhs != nil && rhs != nil {
+		if fn, ok := e.operators[operatorKey{oper.val, reflect.TypeOf(lhs), reflect.TypeOf(rhs)}]; ok {
+			v, err := fn(reflect.ValueOf(lhs), reflect.ValueOf(rhs))
+			if err != nil || !v.IsValid() {
+				return nil, err
+			}
+			return v.Interface(), nil
+		}
+	}
+	return evalAdd(lhs, rhs, oper)
+}
+
 // evalAdd evaluatse arithmetic expressions between an lhs and an rhs, which
 // have already been evaluated themselves and turned to interface{} values.
 // The type of the lhs determines the expected type on the rhs.  If the types
@@ -160,13 +1062,17 @@ func evalAdd(lhs, rhs interface{}, oper item) (interface{}, error) {
 	case intType:
 		l, _ := asInteger(lhs)
 		r, _ := asInteger(rhs)
-		return arithmeticInt(l, r, oper)
+		n, err := arithmeticInt(l, r, oper)
+		if err != nil {
+			return nil, err
+		}
+		return boxInt(n), nil
 	case floatType:
-		l, _ := asFloat(lt)
-		r, _ := asFloat(rt)
+		l, _ := asFloat(lhs)
+		r, _ := asFloat(rhs)
 		return arithmeticFloat(l, r, oper)
 	}
-	return "?add", nil
+	return nil, fmt.Errorf("type error: %s and %s not compatible with %s", lt, rt, oper.val)
 }
 
 func arithmeticFloat(lhs, rhs float64, oper item) (float64, error) {
@@ -1,15 +1,46 @@
 package v1
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 type m map[string]interface{}
 
+type evalFixture struct {
+	name, body string
+	context    interface{}
+	result     string
+}
+
+// testFixtures renders each fixture with e and compares it to the expected result.
+func testFixtures(t *testing.T, e *Environment, fixtures []evalFixture) {
+	for _, fixture := range fixtures {
+		template, err := e.ParseString(fixture.body, fixture.name, "temp")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		result, err := template.Render(fixture.context)
+		if err != nil {
+			t.Errorf("Test %s: unexpected error %s\n", fixture.name, err)
+			continue
+		}
+		if result != fixture.result {
+			t.Errorf("Test %s: Expected:\n`%s`\nGot:\n`%s`\n", fixture.name, fixture.result, result)
+		}
+	}
+}
+
 func TestSimpleEval(t *testing.T) {
-	fixtures := []struct {
-		name, body string
-		context    m
-		result     string
-	}{
+	fixtures := []evalFixture{
 		{"Hello, World", "Hello, World", m{}, "Hello, World"},
 		{"Comment", "Hello, {# comment #}World", m{}, "Hello, World"},
 		{"Variable", "Hello {{ name }}", m{"name": "Jason"}, "Hello Jason"},
@@ -35,26 +66,16 @@ func TestSimpleEval(t *testing.T) {
 			m{"var": false},
 			"false",
 		},
+		{
+			"Conditional Elif",
+			`{% if a %}a{% elif b %}b{% else %}c{% endif %}{% if a %}a{% endif %}`,
+			m{"a": false, "b": true},
+			"b",
+		},
 	}
 
 	// use defaults
-	e := NewEnvironment()
-
-	for _, fixture := range fixtures {
-		template, err := e.ParseString(fixture.body, fixture.name, "temp")
-		if err != nil {
-			t.Error(err)
-			continue
-		}
-		result, err := template.Render(fixture.context)
-		if err != nil {
-			t.Errorf("Test %s: unexpected error %s\n", fixture.name, err)
-			continue
-		}
-		if result != fixture.result {
-			t.Errorf("Test %s: Expected:\n`%s`\nGot:\n`%s`\n", fixture.name, fixture.result, result)
-		}
-	}
+	testFixtures(t, NewEnvironment(), fixtures)
 
 	/*
 		tester.Test(
@@ -88,3 +109,792 @@ func TestSimpleEval(t *testing.T) {
 		)
 	*/
 }
+
+func TestAttrAndIndexEval(t *testing.T) {
+	type user struct {
+		Name  string
+		email string
+	}
+	ctx := m{
+		"data": m{"user.email": "flat@example.com", "user": m{"email": "nested@example.com"}},
+		"flat": m{"user.email": "flat@example.com"},
+		"u":    user{"Jason", "j@example.com"},
+		"p":    &user{"Jason", "j@example.com"},
+		"l":    []string{"a", "b", "c"},
+		"ints": map[int]string{2: "two"},
+	}
+	fixtures := []evalFixture{
+		{"Subscript literal key", `{{ data["user.email"] }}`, ctx, "flat@example.com"},
+		{"Attribute path", `{{ data.user.email }}`, ctx, "nested@example.com"},
+		{"Subscript path", `{{ data["user"]["email"] }}`, ctx, "nested@example.com"},
+		{"Attribute path missing", `{{ flat.user.email }}`, ctx, ""},
+		{"Struct field", `{{ u.Name }}`, ctx, "Jason"},
+		{"Struct pointer field", `{{ p.Name }}`, ctx, "Jason"},
+		{"Unexported field", `{{ u.email }}`, ctx, ""},
+		{"Slice index", `{{ l[1] }}`, ctx, "b"},
+		{"Negative index", `{{ l[-1] }}`, ctx, "c"},
+		{"Index out of range", `{{ l[3] }}`, ctx, ""},
+		{"Int keyed map", `{{ ints[2] }}`, ctx, "two"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+type stringer struct{ name string }
+
+func (s stringer) String() string { return "<" + s.name + ">" }
+
+type marshaler struct{ name string }
+
+func (m marshaler) MarshalText() ([]byte, error) {
+	if len(m.name) == 0 {
+		return nil, errors.New("empty name")
+	}
+	return []byte("[" + m.name + "]"), nil
+}
+
+// stringMarshaler implements both interfaces;  String should win.
+type stringMarshaler struct{ stringer }
+
+func (s stringMarshaler) MarshalText() ([]byte, error) { return []byte("text"), nil }
+
+func TestRenderValue(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Stringer", `{{ s }}`, m{"s": stringer{"foo"}}, "<foo>"},
+		{"TextMarshaler", `{{ s }}`, m{"s": marshaler{"foo"}}, "[foo]"},
+		{"Stringer first", `{{ s }}`, m{"s": stringMarshaler{stringer{"foo"}}}, "<foo>"},
+		{"Stringer attr", `{{ s.x }}`, m{"s": m{"x": stringer{"bar"}}}, "<bar>"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.AutoEscape = true
+	fixtures = []evalFixture{
+		{"Escaped Stringer", `{{ s }}`, m{"s": stringer{"foo"}}, "&lt;foo&gt;"},
+		{"Escaped TextMarshaler", `{{ s }}`, m{"s": marshaler{"a&b"}}, "[a&amp;b]"},
+		{"Escaped string", `<p>{{ s }}</p>`, m{"s": `"hi"`}, "<p>&#34;hi&#34;</p>"},
+	}
+	testFixtures(t, e, fixtures)
+
+	tpl, err := e.ParseString(`{{ s }}`, "err", "err")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(m{"s": marshaler{}}); err == nil {
+		t.Error("Expected MarshalText error to be returned")
+	}
+}
+
+func TestSliceEval(t *testing.T) {
+	list := m{"l": []int{0, 1, 2, 3, 4, 5, 6}, "s": "héllo"}
+	fixtures := []evalFixture{
+		{"Slice", `{{ l[1:3] }}`, list, "[1 2]"},
+		{"Slice open start", `{{ l[:2] }}`, list, "[0 1]"},
+		{"Slice open stop", `{{ l[5:] }}`, list, "[5 6]"},
+		{"Slice negative bounds", `{{ l[-3:-1] }}`, list, "[4 5]"},
+		{"Slice step", `{{ l[::2] }}`, list, "[0 2 4 6]"},
+		{"Slice out of range", `{{ l[5:100] }}`, list, "[5 6]"},
+		{"Slice empty", `{{ l[4:2] }}`, list, "[]"},
+		{"Reverse", `{{ l[::-1] }}`, list, "[6 5 4 3 2 1 0]"},
+		{"Partial reverse", `{{ l[5:1:-1] }}`, list, "[5 4 3 2]"},
+		{"Reverse open stop", `{{ l[2::-1] }}`, list, "[2 1 0]"},
+		{"Reverse out of range", `{{ l[100:4:-1] }}`, list, "[6 5]"},
+		{"Reverse negative bounds", `{{ l[-2:-5:-1] }}`, list, "[5 4 3]"},
+		{"Reverse step two", `{{ l[::-2] }}`, list, "[6 4 2 0]"},
+		{"Reverse step two bounded", `{{ l[5:0:-2] }}`, list, "[5 3 1]"},
+		{"Reverse empty", `{{ l[1:5:-1] }}`, list, "[]"},
+		{"String", `{{ s[1:4] }}`, list, "éll"},
+		{"String reverse", `{{ s[::-1] }}`, list, "olléh"},
+		{"Array", `{{ a[::-1] }}`, m{"a": [3]string{"a", "b", "c"}}, "[c b a]"},
+		{"Undefined", `{{ u[1:] }}`, list, ""},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	for _, body := range []string{`{{ l[::0] }}`, `{{ l["a":] }}`} {
+		tpl, err := e.ParseString(body, "err", "err")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tpl.Render(list); err == nil {
+			t.Errorf("Expected error rendering %s", body)
+		}
+	}
+}
+
+// snakeResolver resolves snake_case names to CamelCase struct fields.
+func snakeResolver(v reflect.Value, name string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	f := v.FieldByName(strings.Join(parts, ""))
+	return f, f.IsValid()
+}
+
+func TestFieldResolver(t *testing.T) {
+	type user struct {
+		FirstName, LastName string
+	}
+	ctx := struct {
+		PageTitle string
+		User      *user
+	}{"Home", &user{"Jason", "Moiron"}}
+
+	e := NewEnvironment()
+	e.FieldResolver = snakeResolver
+	fixtures := []evalFixture{
+		{"Top level", `{{ page_title }}`, ctx, "Home"},
+		{"Attribute", `{{ user.first_name }} {{ user.last_name }}`, ctx, "Jason Moiron"},
+		{"Missing", `{{ user.middle_name }}`, ctx, ""},
+	}
+	testFixtures(t, e, fixtures)
+
+	// the default resolver is used when FieldResolver is nil
+	e.FieldResolver = nil
+	fixtures = []evalFixture{
+		{"Default", `{{ PageTitle }} {{ User.FirstName }}`, ctx, "Home Jason"},
+		{"Default snake", `{{ page_title }}`, ctx, ""},
+	}
+	testFixtures(t, e, fixtures)
+}
+
+type greeter struct{ Name string }
+
+func (g *greeter) Greet(greeting string) string { return greeting + ", " + g.Name }
+func (g greeter) Boom() string                  { panic("boom") }
+func (g *greeter) Shout() string                { return strings.ToUpper(g.Name) }
+
+type panicStringer struct{}
+
+func (p panicStringer) String() string { panic("bad stringer") }
+
+func TestCallEval(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Method", `{{ g.Greet("Hello") }}`, m{"g": &greeter{"Jason"}}, "Hello, Jason"},
+		{"Func", `{{ f(1, 2) }}`, m{"f": func(a, b int) int { return a + b }}, "3"},
+		{"Func kwargs", `{{ f(x=1) }}`, m{"f": func(k Kwargs) interface{} { return k["x"] }}, "1"},
+		{"Method value", `{{ g.Greet("Hi")|e }}`, m{"g": &greeter{"<b>"}}, "Hi, &lt;b&gt;"},
+		{"Zero arg method", `{{ g.Shout }}`, m{"g": &greeter{"Jason"}}, "JASON"},
+		{"Zero arg method call", `{{ g.Shout() }}`, m{"g": &greeter{"Jason"}}, "JASON"},
+		{"Bound method", `{% set f = g.Greet %}{{ f("Hi") }}`, m{"g": &greeter{"Jason"}}, "Hi, Jason"},
+		{"Func field", `{% set f = s.F %}{{ f() }}`, m{"s": struct{ F func() string }{func() string { return "F" }}}, "F"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	e := NewEnvironment()
+	tests := []struct {
+		body    string
+		context m
+		msg     string
+	}{
+		{"Hi {{ g.Boom() }}", m{"g": greeter{}}, "boom"},
+		{"Hi\n  {{ g.Greet(\"x\") }}", m{"g": (*greeter)(nil)}, "nil pointer"},
+		{"{{ s }}", m{"s": panicStringer{}}, "bad stringer"},
+	}
+	for _, test := range tests {
+		tpl, err := e.ParseString(test.body, "panic", "panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpl.Render(test.context)
+		var terr *TemplateError
+		if !errors.As(err, &terr) {
+			t.Errorf("Expected TemplateError rendering %q, got %v", test.body, err)
+			continue
+		}
+		if !strings.Contains(terr.Err.Error(), test.msg) {
+			t.Errorf("Expected error to contain %q, got %q", test.msg, terr.Err)
+		}
+		if !strings.HasPrefix(terr.Location, "panic:") {
+			t.Errorf("Expected location in template panic, got %q", terr.Location)
+		}
+	}
+
+	tpl, _ := e.ParseString("Hi\n  {{ g.Greet(\"x\") }}", "panic", "panic")
+	_, err := tpl.Render(m{"g": (*greeter)(nil)})
+	if loc := err.(*TemplateError).Location; loc != "panic:2:5" {
+		t.Errorf("Expected location panic:2:5, got %s", loc)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	e := NewEnvironment()
+	tpl, err := e.ParseString(`Hello, {{ name }}`, "execute", "execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := tpl.Execute(&b, m{"name": "World"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "Hello, World" {
+		t.Errorf("Expected `Hello, World`, got `%s`", b.String())
+	}
+}
+
+func TestRender(t *testing.T) {
+	e := NewEnvironment()
+	tpl, err := e.ParseString(`{% for x in l %}{{ x }},{% endfor %}{{ name }}`, "render", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []m{{"l": []int{1, 2}, "name": "a"}, {"name": "b"}, {"l": []string{"x"}}} {
+		var b bytes.Buffer
+		if err := tpl.Execute(&b, ctx); err != nil {
+			t.Fatal(err)
+		}
+		out, err := tpl.Render(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != b.String() {
+			t.Errorf("Expected Render to match Execute `%s`, got `%s`", b.String(), out)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	e := NewEnvironment()
+	body := "{{ name }} {{ user.email }}\n{% for i in items %}{{ i + 1 }}{% endfor %}{{ 1 + 2 }}"
+	tpl, err := e.ParseString(body, "validate", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tpl.Validate(m{"name": "a", "user": m{"email": "b"}, "items": []int{1}}); err != nil {
+		t.Errorf("Expected valid context, got %v", err)
+	}
+
+	err = tpl.Validate(m{"user": m{}, "items": []string{"a", "b"}})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+	expected := []string{"name is undefined", "user.email is undefined", "type error", "type error"}
+	if len(verr.Errors) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(verr.Errors), verr)
+	}
+	for i, msg := range expected {
+		if !strings.Contains(verr.Errors[i].Error(), msg) {
+			t.Errorf("Expected error %d to contain %q, got %q", i, msg, verr.Errors[i])
+		}
+	}
+	// rendering normally stops at the first error and undefined names are empty
+	if _, err := tpl.Render(m{"user": m{}, "items": []string{"a"}}); strings.Count(err.Error(), "type error") != 1 {
+		t.Errorf("Expected a single type error, got %v", err)
+	}
+}
+
+func TestExecuteOptions(t *testing.T) {
+	e := NewEnvironment()
+	e.Globals["site"] = "jigo"
+	e.Globals["year"] = 2014
+	tpl, err := e.ParseString(`{{ site }} {{ year }} {{ name|shout }}`, "options", "options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shout := func(s string) string { return strings.ToUpper(s) + "!" }
+
+	var b strings.Builder
+	err = tpl.Execute(&b, m{"name": "hi", "year": 2015}, WithFilter("shout", shout, 0), WithGlobal("site", "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "local 2015 HI!" {
+		t.Errorf("Expected `local 2015 HI!`, got `%s`", b.String())
+	}
+
+	// the overrides only lasted for that render
+	if _, err := tpl.Render(m{"name": "hi"}); err == nil || !strings.Contains(err.Error(), "unknown filter") {
+		t.Errorf("Expected unknown filter error, got %v", err)
+	}
+	if _, ok := e.filters["shout"]; ok {
+		t.Errorf("Expected override filter not to be added to the environment")
+	}
+	tpl, _ = e.ParseString(`{{ site }}`, "options", "options")
+	if out, _ := tpl.Render(m{}); out != "jigo" {
+		t.Errorf("Expected environment global `jigo`, got `%s`", out)
+	}
+
+	if err := tpl.Execute(&b, m{}, WithFilter("bad", 1, 0)); err == nil {
+		t.Errorf("Expected error for invalid filter")
+	}
+}
+
+func TestArithmeticEval(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Precedence", `{{ 1 + 2 * 3 + 4 }}`, m{}, "11"},
+		{"Left assoc", `{{ 10 - 2 - 3 }}`, m{}, "5"},
+		{"Parens", `{{ (1 + 2) * 3 }}`, m{}, "9"},
+		{"Floordiv", `{{ 7 // 2 }}`, m{}, "3"},
+		{"Float", `{{ 1.5 * 2 }}`, m{}, "3"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+type money struct {
+	Cents    int64
+	Currency string
+}
+
+func TestRegisterConverter(t *testing.T) {
+	e := NewEnvironment()
+	e.RegisterConverter(reflect.TypeOf(money{}), func(v reflect.Value) string {
+		m := v.Interface().(money)
+		return fmt.Sprintf("%d.%02d <%s>", m.Cents/100, m.Cents%100, m.Currency)
+	})
+	// converters take priority over fmt.Stringer
+	e.RegisterConverter(reflect.TypeOf(stringer{}), func(v reflect.Value) string { return "converted" })
+	ctx := m{"price": money{1250, "EUR"}, "ptr": &money{5, "USD"}, "s": stringer{"foo"}}
+	fixtures := []evalFixture{
+		{"Converter", `{{ price }}`, ctx, "12.50 <EUR>"},
+		{"Pointer", `{{ ptr }}`, ctx, "&{5 USD}"},
+		{"Over Stringer", `{{ s }}`, ctx, "converted"},
+	}
+	testFixtures(t, e, fixtures)
+
+	e.AutoEscape = true
+	testFixtures(t, e, []evalFixture{{"Escaped", `{{ price }}`, ctx, "12.50 &lt;EUR&gt;"}})
+}
+
+func TestUndefinedString(t *testing.T) {
+	e := NewEnvironment()
+	e.UndefinedString = func(path string) string { return "«undefined:" + path + "»" }
+	ctx := m{"user": m{"name": "ann", "tags": []string{"a"}}, "empty": nil}
+	fixtures := []evalFixture{
+		{"Name", `{{ name }}`, ctx, "«undefined:name»"},
+		{"Attr", `{{ user.email }}`, ctx, "«undefined:user.email»"},
+		{"Attr of undefined", `{{ missing.email }}`, ctx, "«undefined:missing»"},
+		{"Index", `{{ user.tags[3] }}`, ctx, "«undefined:user.tags[3]»"},
+		{"Defined", `{{ user.name }}`, ctx, "ann"},
+		{"None", `{{ none }}{{ empty }}`, ctx, ""},
+	}
+	testFixtures(t, e, fixtures)
+
+	e.AutoEscape = true
+	e.UndefinedString = func(path string) string { return "<" + path + ">" }
+	testFixtures(t, e, []evalFixture{{"Escaped", `{{ name }}`, ctx, "&lt;name&gt;"}})
+	testFixtures(t, NewEnvironment(), []evalFixture{{"Default", `{{ name }}`, ctx, ""}})
+}
+
+func TestMixedAccess(t *testing.T) {
+	type address struct {
+		City  string
+		Lines []string
+	}
+	type person struct {
+		Name    string
+		Address address
+		Meta    map[string]interface{}
+	}
+	p := person{"ann", address{"Oslo", []string{"1 Main St"}}, m{"tags": []string{"x", "y"}}}
+	ctx := m{"data": m{"a": m{"b": []int{7}}, "p": p}, "p": &p}
+	fixtures := []evalFixture{
+		{"Subscript maps", `{{ data["a"]["b"][0] }}`, ctx, "7"},
+		{"Mixed map", `{{ data["a"].b[0] }}`, ctx, "7"},
+		{"Subscript struct", `{{ p["Address"]["City"] }}`, ctx, "Oslo"},
+		{"Mixed struct", `{{ data.p["Address"].Lines[0] }}`, ctx, "1 Main St"},
+		{"Struct map", `{{ p["Meta"].tags[-1] }}`, ctx, "y"},
+		{"Subscript method", `{{ p["Address"]["Missing"] }}`, ctx, ""},
+		{"Same as dot", `{{ p.Meta["tags"][0] == p["Meta"]["tags"][0] }}`, ctx, "true"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.FieldResolver = snakeResolver
+	testFixtures(t, e, []evalFixture{{"Resolver", `{{ p["address"]["city"] }}`, struct{ P person }{p}, "Oslo"}})
+}
+
+func TestUndefinedTracking(t *testing.T) {
+	e := NewEnvironment()
+	var seen []string
+	e.OnUndefined = func(path string) { seen = append(seen, path) }
+	tpl, err := e.ParseString(`{{ title }} {{ user.name }} {{ user.email }} {{ title }}`, "undef", "undef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res RenderResult
+	var b strings.Builder
+	if err := tpl.Execute(&b, m{"user": m{"name": "ann"}}, WithResult(&res)); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != " ann  " {
+		t.Errorf("Expected undefined vars to render empty, got `%s`", b.String())
+	}
+	if !reflect.DeepEqual(res.Undefined, []string{"title", "user.email"}) {
+		t.Errorf("Expected undefined set [title user.email], got %v", res.Undefined)
+	}
+	if !reflect.DeepEqual(seen, []string{"title", "user.email", "title"}) {
+		t.Errorf("Expected OnUndefined for each undefined path, got %v", seen)
+	}
+
+	res = RenderResult{}
+	tpl.Execute(&b, m{"title": "t", "user": m{"name": "ann", "email": "e"}}, WithResult(&res))
+	if len(res.Undefined) != 0 {
+		t.Errorf("Expected no undefined paths, got %v", res.Undefined)
+	}
+}
+
+func TestDebugComments(t *testing.T) {
+	e := NewEnvironment()
+	e.DebugComments = true
+	src := "<ul>\n{% for x in l %}<li>{{ x }}</li>{% endfor %}\n</ul>{% if ok %}!{% endif %}"
+	tpl, err := e.ParseString(src, "list.html", "list.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tpl.Render(m{"l": []int{1, 2}, "ok": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<ul>\n<!-- jigo: list.html:2 --><li>1</li><li>2</li><!-- /jigo: list.html:2 -->\n</ul>" +
+		"<!-- jigo: list.html:3 -->!<!-- /jigo: list.html:3 -->"
+	if out != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out)
+	}
+
+	tpl, _ = e.ParseString("{% block title %}Home{% endblock %}", "page.html", "page.html")
+	if out, _ = tpl.Render(m{}); out != "<!-- jigo: page.html:1 -->Home<!-- /jigo: page.html:1 -->" {
+		t.Errorf("Expected debug comments around block, got %q", out)
+	}
+
+	// an if which breaks or continues its loop is still closed
+	tpl, _ = e.ParseString("{% for x in l %}{% if x == 2 %}{% continue %}{% endif %}{% if x == 3 %}{% break %}{% endif %}{{ x }}{% endfor %}", "loop.html", "loop.html")
+	out, err = tpl.Render(m{"l": []int{1, 2, 3, 4}})
+	expected = "<!-- jigo: loop.html:1 -->" +
+		"<!-- jigo: loop.html:1 --><!-- /jigo: loop.html:1 --><!-- jigo: loop.html:1 --><!-- /jigo: loop.html:1 -->1" +
+		"<!-- jigo: loop.html:1 --><!-- /jigo: loop.html:1 -->" +
+		"<!-- jigo: loop.html:1 --><!-- /jigo: loop.html:1 --><!-- jigo: loop.html:1 --><!-- /jigo: loop.html:1 -->" +
+		"<!-- /jigo: loop.html:1 -->"
+	if err != nil || out != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s (%v)", expected, out, err)
+	}
+	if opened, closed := strings.Count(out, "<!-- jigo:"), strings.Count(out, "<!-- /jigo:"); opened != closed {
+		t.Errorf("Expected balanced debug comments, got %d opened and %d closed", opened, closed)
+	}
+
+	e.DebugComments = false
+	tpl, _ = e.ParseString(src, "list.html", "list.html")
+	if out, _ = tpl.Render(m{"l": []int{1}}); out != "<ul>\n<li>1</li>\n</ul>" {
+		t.Errorf("Expected no debug comments, got %q", out)
+	}
+}
+
+func TestBoxInt(t *testing.T) {
+	for _, n := range []int64{-2, -1, 0, 1, 255, 256, 257, 1 << 40} {
+		if v, ok := boxInt(n).(int64); !ok || v != n {
+			t.Errorf("Expected boxInt(%d) to be int64 %d, got %#v", n, n, boxInt(n))
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { boxInt(-1); boxInt(256) }); allocs != 0 {
+		t.Errorf("Expected small ints not to allocate, got %v allocs", allocs)
+	}
+
+	fixtures := []evalFixture{
+		{"Interned arithmetic", `{% for i in l %}{{ i * 100 - 1 }},{% endfor %}`, m{"l": []int{0, 1, 2, 3}}, "-1,99,199,299,"},
+		{"Loop counters", `{% for x in l %}{{ loop.index * loop.revindex }},{% endfor %}`, m{"l": []int{0, 1, 2}}, "3,4,3,"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func BenchmarkArithmeticLoop(b *testing.B) {
+	l := make([]int, 256)
+	for i := range l {
+		l[i] = i
+	}
+	tpl, err := NewEnvironment().ParseString(`{% for i in l %}{{ (i * 2 + loop.index - 1) // 3 }}{% endfor %}`, "bench", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := m{"l": l}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tpl.Execute(ioutil.Discard, ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// latin1Writer encodes UTF-8 as Latin-1, replacing other runes with '?'.
+type latin1Writer struct {
+	w      io.Writer
+	closed bool
+}
+
+func (l *latin1Writer) Write(p []byte) (int, error) {
+	var b []byte
+	for _, r := range string(p) {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	if _, err := l.w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *latin1Writer) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestOutputEncoder(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	var enc *latin1Writer
+	e.OutputEncoder = func(w io.Writer) io.Writer {
+		enc = &latin1Writer{w: w}
+		return enc
+	}
+	tpl, err := e.ParseString(`café {{ name }} {{ name|length_is_ok }}`, "latin1", "latin1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = tpl.Execute(&b, m{"name": "Zoë & €"}, WithFilter("length_is_ok", func(s string) int { return len([]rune(s)) }, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("caf\xe9 Zo\xeb &amp; ? 7")
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Expected %q, got %q", expected, b.Bytes())
+	}
+	if !enc.closed {
+		t.Errorf("Expected the encoder to be closed")
+	}
+}
+
+func TestSet(t *testing.T) {
+	type item struct{ Price int }
+	ctx := m{"items": []item{{3}, {4}, {5}}, "x": 1}
+	fixtures := []evalFixture{
+		{"Set", `{% set y = x + 1 %}{{ y }}`, ctx, "2"},
+		{"Set shadows context", `{% set x = 5 %}{{ x }}`, ctx, "5"},
+		{
+			"Accumulate",
+			`{% set total = 0 %}{% for i in items %}{% set total = total + i.Price %}{% endfor %}{{ total }}`,
+			ctx,
+			"12",
+		},
+		{
+			"Augmented accumulate",
+			`{% set total = 0 %}{% for i in items %}{% set total += i.Price %}{{ total }},{% endfor %}{{ total }}`,
+			ctx,
+			"3,7,12,12",
+		},
+		{"Augmented sub", `{% set n = 10 %}{% set n -= 3 %}{{ n }}`, ctx, "7"},
+		{"Augmented mul", `{% set n = 2 %}{% set n *= 1 + 2 %}{{ n }}`, ctx, "6"},
+		{"Augmented div", `{% set n = 9.0 %}{% set n /= 2 %}{{ n }}`, ctx, "4.5"},
+		{"Augmented string", `{% set s = "a" %}{% set s += "b" %}{{ s }}`, ctx, "ab"},
+		{"Loop scope", `{% for i in items %}{% set last = i.Price %}{% endfor %}[{{ last }}]`, ctx, "[]"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{% set x += 1 %}{{ x }}`, "set", "set")
+	if out, _ := tpl.Render(ctx); out != "2" || ctx["x"] != 1 {
+		t.Errorf("Expected set to shadow the context without changing it, got %s and %v", out, ctx["x"])
+	}
+	for _, bad := range []string{`{% set x + = 1 %}`, `{% set x ~= 1 %}`, `{% set x %}`} {
+		if _, err := NewEnvironment().ParseString(bad, "set", "set"); err == nil {
+			t.Errorf("Expected parse error for %s", bad)
+		}
+	}
+	tree, _ := NewEnvironment().ParseString(`{% set n *= a + b %}`, "set", "set")
+	if s := tree.base.Root.Nodes[0].String(); s != `{% set n = n * (a + b) %}` {
+		t.Errorf("Expected augmented set to expand, got %s", s)
+	}
+}
+
+func TestSetLiterals(t *testing.T) {
+	ctx := m{"x": 1}
+	fixtures := []evalFixture{
+		{"Map", `{% set opts = {"a": 1, "b": 2} %}{% for k in opts %}{{ k }}={{ opts[k] }};{% endfor %}`, ctx, "a=1;b=2;"},
+		{"Map items", `{% set opts = {"b": x, "a": x + 1} %}{% for k, v in opts.items() %}{{ k }}{{ v }}{% endfor %}`, ctx, "a2b1"},
+		{"Map attr", `{% set opts = {"a": {"b": "c"}} %}{{ opts.a.b }}`, ctx, "c"},
+		{"Map int keys", `{% set names = {1: "one", 2: "two"} %}{{ names[2] }}{% for k in names %}{{ k }}{% endfor %}`, ctx, "two12"},
+		{"Map membership", `{% set opts = {"a": 1} %}{{ "a" in opts }} {{ "b" in opts }}`, ctx, "true false"},
+		{"Empty map", `{% set opts = {} %}{% for k in opts %}{{ k }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"List", `{% set l = [1, "two", x + 2] %}{{ l[1] }} {{ l[-1] }}`, ctx, "two 3"},
+		{"List iterate", `{% set l = ["a", "b",] %}{% for i in l %}{{ loop.index }}{{ i }}{% endfor %}`, ctx, "1a2b"},
+		{"List of maps", `{% set l = [{"n": 1}, {"n": 2}] %}{% for i in l %}{{ i.n }}{% endfor %}`, ctx, "12"},
+		{"List unpack", `{% set a, b = [1, 2] %}{{ b }}{{ a }}`, ctx, "21"},
+		{"Empty list", `{% set l = [] %}{% for i in l %}{{ i }}{% else %}empty{% endfor %}`, ctx, "empty"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{% set m = {[1]: 2} %}`, "set", "set")
+	if _, err := tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "unhashable") {
+		t.Errorf("Expected an unhashable key error, got %v", err)
+	}
+}
+
+func TestSetUnpacking(t *testing.T) {
+	ctx := m{"l": []int{1, 2, 3}, "one": []string{"a"}, "empty": []int{}, "pairs": [][]int{{1, 2, 3}, {4}}}
+	fixtures := []evalFixture{
+		{"Head and tail", `{% set head, *tail = l %}{{ head }} {{ tail }}`, ctx, "1 [2 3]"},
+		{"Single element", `{% set head, *tail = one %}{{ head }} {{ tail }}`, ctx, "a []"},
+		{"Init and last", `{% set *init, last = l %}{{ init }} {{ last }}`, ctx, "[1 2] 3"},
+		{"Middle", `{% set a, *b, c = l %}{{ a }} {{ b }} {{ c }}`, ctx, "1 [2] 3"},
+		{"Tuple", `{% set a, b, c = l %}{{ a }}{{ b }}{{ c }}`, ctx, "123"},
+		{"Nested", `{% set (a, *b), c = pairs %}{{ a }}{{ b }}{{ c }}`, ctx, "1[2 3][4]"},
+		{"For loop", `{% for first, *rest in pairs %}{{ first }}:{{ rest }},{% endfor %}`, ctx, "1:[2 3],4:[],"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	for _, src := range []string{
+		`{% set head, *tail = empty %}`,
+		`{% set a, b = one %}`,
+		`{% set a, *b = 1 %}`,
+	} {
+		tpl, err := NewEnvironment().ParseString(src, "set", "set")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(ctx); err == nil {
+			t.Errorf("Expected error rendering %s", src)
+		}
+	}
+	for _, bad := range []string{`{% set *a = l %}`, `{% set *a, *b = l %}`, `{% set a, b += l %}`} {
+		if _, err := NewEnvironment().ParseString(bad, "set", "set"); err == nil {
+			t.Errorf("Expected parse error for %s", bad)
+		}
+	}
+}
+
+func TestAuditAccess(t *testing.T) {
+	e := NewEnvironment()
+	var seen []string
+	e.AuditAccess = func(path string) { seen = append(seen, path) }
+	tpl, err := e.ParseString(
+		`{{ user.name }} {{ user.name }} {{ title }}{{ missing }}{{ user.email }}{% for r in user.roles %}{{ r }}{% endfor %}{{ user["roles"][i] }}`,
+		"audit", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := m{"user": m{"name": "ann", "roles": []string{"a", "b"}}, "title": "t", "i": 1}
+	out, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "ann ann tabb" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	expected := []string{"user.name", "user.name", "title", "user.roles", "i", `user["roles"][i]`}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected accesses %v, got %v", expected, seen)
+	}
+
+	// loop variables, macro arguments, sets and globals are not context data
+	e.Globals["site"] = m{"name": "jigo"}
+	tpl, err = e.ParseString(
+		`{% macro m(user) %}{{ user.name }}{% endmacro %}{{ site.name }}{% for user in users %}{{ loop.index }}{{ user.name }}{% endfor %}`+
+			`{{ m(admin) }}{% set x = admin %}{{ x.name }}{{ users[0].name }}`,
+		"scopes", "scopes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen = nil
+	if _, err := tpl.Render(m{"users": []m{{"name": "a"}}, "admin": m{"name": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"users", "admin", "admin", "users[0].name"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected accesses %v, got %v", expected, seen)
+	}
+}
+
+func TestHTMLTemplateTypes(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	ctx := m{
+		"html":  template.HTML("<b>bold</b>"),
+		"attr":  template.HTMLAttr(`title="a&b"`),
+		"js":    template.JS("a < b"),
+		"css":   template.CSS("a > b"),
+		"url":   template.URL("/a?b=1&c=2"),
+		"xss":   template.URL(`" onmouseover="alert(1)`),
+		"tag":   template.JS("<script>alert(1)</script>"),
+		"plain": "<b>bold</b>",
+	}
+	testFixtures(t, e, []evalFixture{
+		{"HTML", `<p>{{ html }}</p>`, ctx, "<p><b>bold</b></p>"},
+		{"HTMLAttr", `<p {{ attr }}>`, ctx, `<p title=&#34;a&amp;b&#34;>`},
+		{"JS", `<script>{{ js }}</script>`, ctx, "<script>a &lt; b</script>"},
+		{"CSS", `<style>{{ css }}</style>`, ctx, "<style>a &gt; b</style>"},
+		{"URL", `<a href="{{ url }}">`, ctx, `<a href="/a?b=1&amp;c=2">`},
+		{"URL breaking out of attribute", `<a href="{{ xss }}">`, ctx, `<a href="&#34; onmouseover=&#34;alert(1)">`},
+		{"JS in text", `<p>{{ tag }}</p>`, ctx, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"Safe filter", `<p>{{ tag|safe }}</p>`, ctx, "<p><script>alert(1)</script></p>"},
+		{"Plain string", `{{ plain }}`, ctx, "&lt;b&gt;bold&lt;/b&gt;"},
+		{"Escape filter", `{{ html|escape }}`, ctx, "<b>bold</b>"},
+		{"Attribute", `{{ page.body }}`, m{"page": m{"body": template.HTML("<i>x</i>")}}, "<i>x</i>"},
+		{"Comparison", `{{ html == "<b>bold</b>" }}`, ctx, "true"},
+	})
+}
+
+// amount is a sum of money in cents, with arithmetic registered by
+// RegisterOperator.
+type amount struct{ cents int64 }
+
+func (m amount) String() string { return fmt.Sprintf("$%d.%02d", m.cents/100, m.cents%100) }
+
+func TestRegisterOperator(t *testing.T) {
+	e := NewEnvironment()
+	amountType, intType := reflect.TypeOf(amount{}), reflect.TypeOf(int64(0))
+	add := func(a, b reflect.Value) (reflect.Value, error) {
+		return reflect.ValueOf(amount{a.Interface().(amount).cents + b.Interface().(amount).cents}), nil
+	}
+	mul := func(a, b reflect.Value) (reflect.Value, error) {
+		return reflect.ValueOf(amount{a.Interface().(amount).cents * b.Int()}), nil
+	}
+	div := func(a, b reflect.Value) (reflect.Value, error) {
+		if b.Interface().(amount).cents == 0 {
+			return reflect.Value{}, errors.New("division by zero amount")
+		}
+		return reflect.ValueOf(a.Interface().(amount).cents / b.Interface().(amount).cents), nil
+	}
+	for _, op := range []struct {
+		op       string
+		lhs, rhs reflect.Type
+		fn       Operator
+	}{{"+", amountType, amountType, add}, {"*", amountType, intType, mul}, {"//", amountType, amountType, div}} {
+		if err := e.RegisterOperator(op.op, op.lhs, op.rhs, op.fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.RegisterOperator("**", amountType, amountType, add); err == nil {
+		t.Error("Expected an error registering an unknown operator")
+	}
+
+	ctx := m{"price": amount{1250}, "tax": amount{99}, "zero": amount{}}
+	testFixtures(t, e, []evalFixture{
+		{"Add", `{{ price + tax }}`, ctx, "$13.49"},
+		{"Chained", `{{ price + tax + tax }}`, ctx, "$14.48"},
+		{"Mul int literal", `{{ price * 3 }}`, ctx, "$37.50"},
+		{"Result type", `{{ price // tax }}`, ctx, "12"},
+		{"Numbers unchanged", `{{ 1 + 2 }}`, ctx, "3"},
+	})
+
+	for _, src := range []string{`{{ price - tax }}`, `{{ 3 * price }}`, `{{ price // zero }}`} {
+		tpl, err := e.ParseString(src, "op", "op")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(ctx); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
@@ -0,0 +1,771 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilterFlags change how a filter's input and output are treated when
+// autoescaping is enabled.
+type FilterFlags int
+
+const (
+	// FilterSafe marks the output of a filter as safe, so it is not escaped.
+	// Filters which produce html should use this.
+	FilterSafe FilterFlags = 1 << iota
+	// FilterEscapeInput escapes the filter's input before the filter is called,
+	// unless it is already Safe.  Together with FilterSafe, this allows filters
+	// to add markup to untrusted text.
+	FilterEscapeInput
+)
+
+// A filter is a function which takes a value and optional arguments and
+// returns a new value, used via `value|name(args)`.
+type filter struct {
+	fn    reflect.Value
+	flags FilterFlags
+}
+
+func newFilter(fn interface{}, flags FilterFlags) (*filter, error) {
+	f := &filter{fn: reflect.ValueOf(fn), flags: flags}
+	if err := checkFunc(f.fn); err != nil {
+		return nil, err
+	}
+	if f.fn.Type().NumIn() == 0 {
+		return nil, fmt.Errorf("filter %v must accept at least one argument", f.fn.Type())
+	}
+	return f, nil
+}
+
+// apply calls the filter on value with args and kwargs.  If autoescape is true, the
+// filter's flags are used to escape its input or mark its output safe.
+func (f *filter) apply(value interface{}, args []interface{}, kwargs Kwargs, autoescape bool) (interface{}, error) {
+	if autoescape && f.flags&FilterEscapeInput != 0 && value != nil {
+		if _, ok := asSafe(value); !ok {
+			value = Safe(html.EscapeString(asString(value)))
+		}
+	}
+	out, err := call(f.fn, append([]interface{}{value}, args...), kwargs)
+	if err != nil || out == nil {
+		return out, err
+	}
+	if autoescape && f.flags&FilterSafe != 0 {
+		if safe, ok := asSafe(out); ok {
+			out = safe
+		} else {
+			out = Safe(asString(out))
+		}
+	}
+	return out, nil
+}
+
+// builtin filters available to every environment.
+var builtinFilters = map[string]struct {
+	fn    interface{}
+	flags FilterFlags
+}{
+	"safe":   {filterSafe, FilterSafe},
+	"escape": {filterEscape, 0},
+	"e":      {filterEscape, 0},
+	"urlize": {filterUrlize, FilterSafe},
+
+	"startswith": {strings.HasPrefix, 0},
+	"endswith":   {strings.HasSuffix, 0},
+	"split":      {filterSplit, 0},
+	"currency":   {filterCurrency, 0},
+
+	"snakecase": {filterSnakeCase, 0},
+	"camelcase": {filterCamelCase, 0},
+	"kebabcase": {filterKebabCase, 0},
+
+	"truncate_html": {filterTruncateHTML, FilterSafe | FilterEscapeInput},
+	"tojson":        {filterToJSON, FilterSafe},
+
+	"filesizeformat": {filterFileSizeFormat, 0},
+	"ordinal":        {filterOrdinal, 0},
+
+	"default": {filterDefault, 0},
+	"d":       {filterDefault, 0},
+}
+
+// filterSafe marks a value as safe.
+func filterSafe(value interface{}) Safe {
+	if s, ok := asSafe(value); ok {
+		return s
+	}
+	return Safe(asString(value))
+}
+
+// filterEscape html escapes a value, unless it is already safe.
+func filterEscape(value interface{}) Safe {
+	if s, ok := asSafe(value); ok {
+		return s
+	}
+	return Safe(html.EscapeString(asString(value)))
+}
+
+// filterSplit splits a string like Python's str.split, with the arguments
+// (sep=none, maxsplit=-1).  If sep is none, the string is split on runs of
+// whitespace and leading and trailing whitespace is ignored.  If maxsplit is
+// not negative, at most maxsplit splits are done.
+func filterSplit(value string, args Args, kwargs Kwargs) ([]string, error) {
+	params, err := bindArgs(args, kwargs, []string{"sep", "maxsplit"}, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	maxsplit, ok := asInteger(params[1])
+	if !ok {
+		return nil, fmt.Errorf("type error: maxsplit must be an integer, not %s", typeOf(params[1]))
+	}
+	if params[0] != nil {
+		sep := asString(params[0])
+		if len(sep) == 0 {
+			return nil, errors.New("empty separator")
+		}
+		if maxsplit < 0 {
+			return strings.Split(value, sep), nil
+		}
+		return strings.SplitN(value, sep, int(maxsplit+1)), nil
+	}
+
+	var parts []string
+	value = strings.TrimLeftFunc(value, unicode.IsSpace)
+	for len(value) > 0 {
+		if maxsplit >= 0 && int64(len(parts)) == maxsplit {
+			return append(parts, value), nil
+		}
+		end := strings.IndexFunc(value, unicode.IsSpace)
+		if end < 0 {
+			return append(parts, value), nil
+		}
+		parts = append(parts, value[:end])
+		value = strings.TrimLeftFunc(value[end:], unicode.IsSpace)
+	}
+	return parts, nil
+}
+
+// filterCurrency formats a number as an amount of money, with the arguments
+// (symbol="$", decimals=2, thousands=",", parens=false).  The integer part is
+// grouped in thousands by the thousands separator.  Negative amounts are
+// signed, or wrapped in parentheses if parens is true.
+func filterCurrency(value interface{}, args Args, kwargs Kwargs) (string, error) {
+	params, err := bindArgs(args, kwargs, []string{"symbol", "decimals", "thousands", "parens"}, "$", 2, ",", false)
+	if err != nil {
+		return "", err
+	}
+	decimals, ok := asInteger(params[1])
+	if !ok || decimals < 0 {
+		return "", fmt.Errorf("type error: decimals must be a non-negative integer, not %v", params[1])
+	}
+	var s string
+	switch typeOf(value) {
+	case intType:
+		n, _ := asInteger(value)
+		s = strconv.FormatInt(n, 10)
+		if decimals > 0 {
+			s += "." + strings.Repeat("0", int(decimals))
+		}
+	case floatType:
+		f, _ := asFloat(value)
+		s = strconv.FormatFloat(f, 'f', int(decimals), 64)
+	default:
+		return "", fmt.Errorf("type error: currency requires a number, not %s", typeName(value))
+	}
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i:]
+	}
+	b := new(strings.Builder)
+	b.WriteString(asString(params[0]))
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(asString(params[2]))
+		}
+		b.WriteRune(c)
+	}
+	b.WriteString(frac)
+
+	switch {
+	case !negative || strings.Trim(s, "0.") == "":
+		return b.String(), nil
+	case truthy(params[3]):
+		return "(" + b.String() + ")", nil
+	}
+	return "-" + b.String(), nil
+}
+
+// filterSnakeCase converts an identifier to snake_case.
+func filterSnakeCase(value string) string {
+	return strings.ToLower(strings.Join(splitWords(value), "_"))
+}
+
+// filterKebabCase converts an identifier to kebab-case.
+func filterKebabCase(value string) string {
+	return strings.ToLower(strings.Join(splitWords(value), "-"))
+}
+
+// filterCamelCase converts an identifier to camelCase.  Acronyms are treated
+// as a single word, so "HTTPServer" becomes "httpServer".
+func filterCamelCase(value string) string {
+	words := splitWords(value)
+	for i, w := range words {
+		w = strings.ToLower(w)
+		if i > 0 {
+			r := []rune(w)
+			r[0] = unicode.ToUpper(r[0])
+			w = string(r)
+		}
+		words[i] = w
+	}
+	return strings.Join(words, "")
+}
+
+// splitWords splits an identifier into words at runs of punctuation or
+// whitespace and at changes of case.  A run of capitals is a single word,
+// except for its last letter if a lower case letter follows, so "HTTPServer"
+// is split into "HTTP" and "Server".  Digits belong to the word before them.
+func splitWords(s string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(s)
+	for i, c := range runes {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		if len(word) > 0 && unicode.IsUpper(c) {
+			prev := word[len(word)-1]
+			next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || next {
+				words = append(words, string(word))
+				word = nil
+			}
+		}
+		word = append(word, c)
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// filterDefault returns its value, or the default if the value is undefined,
+// with the arguments (default_value="", boolean=false).  If boolean is set,
+// the default is also used for values which are false.  The whole of an
+// attribute chain like `user.name` is undefined if any part of it is.
+func filterDefault(value interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	params, err := bindArgs(args, kwargs, []string{"default_value", "boolean"}, "", false)
+	if err != nil {
+		return nil, err
+	}
+	if isUndefined(value) || (truthy(params[1]) && !truthy(value)) {
+		return params[0], nil
+	}
+	return value, nil
+}
+
+// filterFileSizeFormat formats a number of bytes as a human readable file
+// size like Jinja2, with the arguments (binary=false).  Decimal prefixes
+// (kB, MB) are used, or binary prefixes (KiB, MiB) if binary is set.
+// Negative sizes are formatted like positive ones, with a sign.
+func filterFileSizeFormat(value interface{}, args Args, kwargs Kwargs) (string, error) {
+	params, err := bindArgs(args, kwargs, []string{"binary"}, false)
+	if err != nil {
+		return "", err
+	}
+	size, ok := asFloat(value)
+	if !ok || !isNumericVar(typeOf(value)) {
+		return "", fmt.Errorf("type error: filesizeformat requires a number, not %s", typeName(value))
+	}
+	sign := ""
+	if size < 0 {
+		sign, size = "-", -size
+	}
+	base := 1000.0
+	prefixes := []string{"kB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
+	if truthy(params[0]) {
+		base = 1024
+		prefixes = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB", "ZiB", "YiB"}
+	}
+	switch {
+	case size == 1:
+		return sign + "1 Byte", nil
+	case size < base:
+		return fmt.Sprintf("%s%d Bytes", sign, int64(size)), nil
+	}
+	// sizes beyond the last prefix are given in it
+	unit := base
+	last := len(prefixes) - 1
+	for _, prefix := range prefixes[:last] {
+		if size < unit*base {
+			return fmt.Sprintf("%s%.1f %s", sign, size/unit, prefix), nil
+		}
+		unit *= base
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, size/unit, prefixes[last]), nil
+}
+
+// filterOrdinal formats an integer as an English ordinal, eg. 1st, 2nd, 3rd,
+// 4th, 11th and 21st.
+func filterOrdinal(value int64) string {
+	n := value
+	if n < 0 {
+		n = -n
+	}
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.FormatInt(value, 10) + suffix
+}
+
+// filterToJSON serializes a value to json, with the arguments (indent=none,
+// sort_keys=false).  Indent is a number of spaces or a string to indent
+// nested values by.  Map keys are always sorted, and if sort_keys is set
+// the fields of structs are sorted too.  The output is safe to use in html,
+// including in single quoted attributes.
+func filterToJSON(value interface{}, args Args, kwargs Kwargs) (Safe, error) {
+	params, err := bindArgs(args, kwargs, []string{"indent", "sort_keys"}, nil, false)
+	if err != nil {
+		return "", err
+	}
+	if truthy(params[1]) {
+		// decoding into interface{} turns structs into maps, which are
+		// encoded in key order
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err = d.Decode(&value); err != nil {
+			return "", err
+		}
+	}
+	var b []byte
+	switch indent := params[0]; typeOf(indent) {
+	case intType:
+		n, _ := asInteger(indent)
+		b, err = json.MarshalIndent(value, "", strings.Repeat(" ", int(n)))
+	case stringType:
+		b, err = json.MarshalIndent(value, "", asString(indent))
+	default:
+		if indent != nil {
+			return "", fmt.Errorf("type error: indent must be an integer or string, not %s", typeName(indent))
+		}
+		b, err = json.Marshal(value)
+	}
+	if err != nil {
+		return "", err
+	}
+	return Safe(strings.Replace(string(b), "'", `\u0027`, -1)), nil
+}
+
+// voidElements are the html elements which have no closing tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "link": true, "meta": true, "source": true,
+	"track": true, "wbr": true,
+}
+
+// filterTruncateHTML truncates html to at most length visible characters,
+// with the arguments (length=255, end="...").  Tags do not count towards the
+// length and entities count as one character.  If the html is truncated, end
+// is appended and any tags left open are closed, so the markup stays valid.
+// With autoescaping, input which is not Safe is escaped first, as it is text
+// rather than html.
+func filterTruncateHTML(value string, args Args, kwargs Kwargs) (Safe, error) {
+	params, err := bindArgs(args, kwargs, []string{"length", "end"}, 255, "...")
+	if err != nil {
+		return "", err
+	}
+	length, ok := asInteger(params[0])
+	if !ok || length < 0 {
+		return "", fmt.Errorf("type error: length must be a non-negative integer, not %v", params[0])
+	}
+
+	b := new(strings.Builder)
+	var open []string
+	var visible int64
+	for i := 0; i < len(value); {
+		if value[i] == '<' {
+			if j := tagEnd(value[i:]); j > 0 {
+				tag := value[i : i+j+1]
+				b.WriteString(tag)
+				open = trackTag(open, tag)
+				i += j + 1
+				continue
+			}
+		}
+		if visible == length {
+			b.WriteString(asString(params[1]))
+			for k := len(open) - 1; k >= 0; k-- {
+				fmt.Fprintf(b, "</%s>", open[k])
+			}
+			return Safe(b.String()), nil
+		}
+		n := entityLen(value[i:])
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(value[i:])
+		}
+		b.WriteString(value[i : i+n])
+		visible++
+		i += n
+	}
+	return Safe(value), nil
+}
+
+// tagEnd returns the index of the `>` ending the html tag at the start of
+// s, skipping any in quoted attribute values, or -1 if the tag is unclosed.
+func tagEnd(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// trackTag updates the stack of open elements with the html tag.  Closing
+// tags close the most recent matching element and any opened within it.
+// Comments, doctypes, void elements and self-closing tags are ignored.
+func trackTag(open []string, tag string) []string {
+	inner := strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	if strings.HasPrefix(inner, "!") || strings.HasPrefix(inner, "?") || strings.HasSuffix(inner, "/") {
+		return open
+	}
+	closing := strings.HasPrefix(inner, "/")
+	inner = strings.TrimPrefix(inner, "/")
+	fields := strings.Fields(inner)
+	if len(fields) == 0 {
+		return open
+	}
+	name := strings.ToLower(fields[0])
+	switch {
+	case voidElements[name]:
+	case closing:
+		for k := len(open) - 1; k >= 0; k-- {
+			if open[k] == name {
+				return open[:k]
+			}
+		}
+	default:
+		open = append(open, name)
+	}
+	return open
+}
+
+// entityLen returns the length of the html entity at the start of s, such as
+// `&amp;` or `&#39;`, or 0 if s does not start with one.
+func entityLen(s string) int {
+	if !strings.HasPrefix(s, "&") {
+		return 0
+	}
+	for i := 1; i < len(s) && i < 32; i++ {
+		switch c := s[i]; {
+		case c == ';':
+			if i == 1 {
+				return 0
+			}
+			return i + 1
+		case c == '#' && i == 1:
+		case c < '0' || c > 'z' || (c > '9' && c < 'A') || (c > 'Z' && c < 'a'):
+			return 0
+		}
+	}
+	return 0
+}
+
+var (
+	urlizeWordRe  = regexp.MustCompile(`\S+`)
+	urlizeEmailRe = regexp.MustCompile(`^[^@\s:/]+@[\w-]+(\.[\w-]+)+$`)
+)
+
+// filterUrlize converts urls and email addresses in plain text into links.
+// All other text is escaped, so the result is always safe.  It accepts the
+// arguments (trim_url_limit=none, nofollow=false, target=none).
+func filterUrlize(value string, args Args, kwargs Kwargs) (Safe, error) {
+	params, err := bindArgs(args, kwargs, []string{"trim_url_limit", "nofollow", "target"}, nil, false, nil)
+	if err != nil {
+		return "", err
+	}
+	limit, hasLimit := asInteger(params[0])
+	if hasLimit && limit < 0 {
+		return "", fmt.Errorf("type error: trim_url_limit must be a non-negative integer, not %v", params[0])
+	}
+	nofollow, _ := params[1].(bool)
+	target := asString(params[2])
+
+	var attrs string
+	if nofollow {
+		attrs += ` rel="nofollow"`
+	}
+	if len(target) > 0 {
+		attrs += fmt.Sprintf(` target="%s"`, html.EscapeString(target))
+	}
+	// trim cuts s to limit runes, rather than bytes, so no rune is split
+	trim := func(s string) string {
+		if !hasLimit {
+			return s
+		}
+		var n int64
+		for i := range s {
+			if n == limit {
+				return s[:i] + "..."
+			}
+			n++
+		}
+		return s
+	}
+
+	b := new(strings.Builder)
+	last := 0
+	for _, loc := range urlizeWordRe.FindAllStringIndex(value, -1) {
+		b.WriteString(html.EscapeString(value[last:loc[0]]))
+		last = loc[1]
+		word := value[loc[0]:loc[1]]
+		// split off leading and trailing punctuation
+		middle := strings.TrimLeft(word, "(<")
+		lead := word[:len(word)-len(middle)]
+		middle = strings.TrimRight(middle, ".,:;!?)>")
+		trail := word[len(lead)+len(middle):]
+
+		var href string
+		switch {
+		case strings.HasPrefix(middle, "http://"), strings.HasPrefix(middle, "https://"):
+			href = middle
+		case strings.HasPrefix(middle, "www."):
+			href = "http://" + middle
+		case urlizeEmailRe.MatchString(middle):
+			href = "mailto:" + middle
+		}
+		if len(href) == 0 {
+			b.WriteString(html.EscapeString(word))
+			continue
+		}
+		b.WriteString(html.EscapeString(lead))
+		if strings.HasPrefix(href, "mailto:") {
+			fmt.Fprintf(b, `<a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(middle))
+		} else {
+			fmt.Fprintf(b, `<a href="%s"%s>%s</a>`, html.EscapeString(href), attrs, html.EscapeString(trim(middle)))
+		}
+		b.WriteString(html.EscapeString(trail))
+	}
+	b.WriteString(html.EscapeString(value[last:]))
+	return Safe(b.String()), nil
+}
+
+// filterSelect returns the items of value which pass the test named by its
+// first argument, which is called with any remaining arguments.  With no
+// test, items which are true in a boolean context are selected.
+func (e *Environment) filterSelect(value interface{}, args Args) ([]interface{}, error) {
+	return e.selectItems(value, "", args, true)
+}
+
+// filterReject returns the items of value which fail a test, like select.
+func (e *Environment) filterReject(value interface{}, args Args) ([]interface{}, error) {
+	return e.selectItems(value, "", args, false)
+}
+
+// filterSelectAttr returns the items of value whose attribute attr passes a
+// test, like select.  Attr may be a dotted path of attributes.
+func (e *Environment) filterSelectAttr(value interface{}, attr string, args Args) ([]interface{}, error) {
+	return e.selectItems(value, attr, args, true)
+}
+
+// filterRejectAttr returns the items of value whose attribute attr fails a
+// test, like select.
+func (e *Environment) filterRejectAttr(value interface{}, attr string, args Args) ([]interface{}, error) {
+	return e.selectItems(value, attr, args, false)
+}
+
+// selectItems returns the items of value for which the test in args, applied
+// to the item or its attribute attr if given, returns keep.
+func (e *Environment) selectItems(value interface{}, attr string, args Args, keep bool) ([]interface{}, error) {
+	items, err := e.iterate(value)
+	if err != nil {
+		return nil, err
+	}
+	selected := []interface{}{}
+	for _, item := range items {
+		v := item
+		if len(attr) > 0 {
+			v = e.attrPath(item, attr)
+		}
+		ok := truthy(v)
+		if len(args) > 0 {
+			if ok, err = e.runTest(args[0], v, args[1:]); err != nil {
+				return nil, err
+			}
+		}
+		if ok == keep {
+			selected = append(selected, item)
+		}
+	}
+	return selected, nil
+}
+
+// attrPath looks up a dotted path of attributes on i, returning nil if any
+// of them is not found.
+func (e *Environment) attrPath(i interface{}, path string) interface{} {
+	for _, name := range strings.Split(path, ".") {
+		v, ok := e.getattr(i, name)
+		if !ok {
+			return nil
+		}
+		i = v
+	}
+	return i
+}
+
+// filterMin returns the smallest item of value, with the arguments
+// (case_sensitive=false, attribute=none).
+func (e *Environment) filterMin(value interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	return e.filterExtreme(value, args, kwargs, -1)
+}
+
+// filterMax returns the largest item of value, like min.
+func (e *Environment) filterMax(value interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	return e.filterExtreme(value, args, kwargs, 1)
+}
+
+func (e *Environment) filterExtreme(value interface{}, args Args, kwargs Kwargs, want int) (interface{}, error) {
+	params, err := bindArgs(args, kwargs, []string{"case_sensitive", "attribute"}, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	items, err := e.iterate(value)
+	if err != nil {
+		return nil, err
+	}
+	return e.extreme(items, asString(params[1]), truthy(params[0]), want)
+}
+
+// group is a group of items made by the groupby filter, which unpacks as a
+// (grouper, list) pair and also has those attributes.
+type group []interface{}
+
+func (g group) getattr(name string) (interface{}, bool) {
+	switch name {
+	case "grouper":
+		return g[0], true
+	case "list":
+		return g[1], true
+	}
+	return nil, false
+}
+
+// filterGroupBy groups the items of value by the attributes named by its
+// arguments, with the keyword arguments (default=none, reverse=false).  Each
+// group is a (grouper, list) pair, and groups are sorted by their grouper,
+// in descending order if reverse is set.  With more than one attribute, the
+// list of each group holds its items grouped by the next attribute, so
+// `groupby("dept", "team")` groups teams within departments.  Items without
+// an attribute are grouped under default.  Attributes may be dotted paths.
+func (e *Environment) filterGroupBy(value interface{}, args Args, kwargs Kwargs) ([]interface{}, error) {
+	params, err := bindArgs(nil, kwargs, []string{"default", "reverse"}, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("groupby needs at least one attribute")
+	}
+	attrs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("groupby attribute must be a string, not %s", typeName(arg))
+		}
+		attrs[i] = s
+	}
+	items, err := e.iterate(value)
+	if err != nil {
+		return nil, err
+	}
+	return e.groupBy(items, attrs, params[0], truthy(params[1]))
+}
+
+// groupBy groups items by the first of attrs, and each group's items by the
+// rest of them.
+func (e *Environment) groupBy(items []interface{}, attrs []string, def interface{}, reverse bool) ([]interface{}, error) {
+	key := func(i interface{}) interface{} {
+		if k := e.attrPath(i, attrs[0]); k != nil {
+			return k
+		}
+		return def
+	}
+	cmp := func(a, b interface{}) (int, error) {
+		c, ok, err := e.order(key(a), key(b))
+		if err == nil && !ok {
+			err = fmt.Errorf("type error: cannot compare %s and %s", typeName(key(a)), typeName(key(b)))
+		}
+		if reverse {
+			c = -c
+		}
+		return c, err
+	}
+	sorted := append([]interface{}{}, items...)
+	var err error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		c, cerr := cmp(sorted[i], sorted[j])
+		if err == nil {
+			err = cerr
+		}
+		return c < 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []interface{}{}
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) {
+			if c, _ := cmp(sorted[start], sorted[end]); c != 0 {
+				break
+			}
+			end++
+		}
+		var list interface{} = sorted[start:end:end]
+		if len(attrs) > 1 {
+			if list, err = e.groupBy(sorted[start:end], attrs[1:], def, reverse); err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, group{key(sorted[start]), list})
+		start = end
+	}
+	return groups, nil
+}
@@ -0,0 +1,440 @@
+package v1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	e := NewEnvironment()
+	e.RegisterFilter("upper", strings.ToUpper, 0)
+	e.RegisterFilter("repeat", strings.Repeat, 0)
+	e.RegisterFilter("join", func(sep string, parts ...string) string {
+		return strings.Join(parts, sep)
+	}, 0)
+
+	fixtures := []evalFixture{
+		{"Filter", `{{ name|upper }}`, m{"name": "jason"}, "JASON"},
+		{"Filter literal", `{{ "jason" | upper }}`, m{}, "JASON"},
+		{"Filter args", `{{ "ab"|repeat(3) }}`, m{}, "ababab"},
+		{"Filter chain", `{{ "ab"|repeat(2)|upper }}`, m{}, "ABAB"},
+		{"Filter variadic", `{{ "-"|join("a", "b", c) }}`, m{"c": "c"}, "a-b-c"},
+		{"Filter attr", `{{ user.name|upper }}`, m{"user": m{"name": "jason"}}, "JASON"},
+		{"Filter add", `{{ "a"|upper + "b"|upper }}`, m{}, "AB"},
+	}
+	testFixtures(t, e, fixtures)
+
+	for _, body := range []string{`{{ "a"|missing }}`, `{{ "ab"|repeat("x") }}`, `{{ "ab"|repeat(1, 2) }}`} {
+		tpl, err := e.ParseString(body, "err", "err")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(m{}); err == nil {
+			t.Errorf("Expected error rendering %s", body)
+		}
+	}
+
+	if err := e.RegisterFilter("bad", "not a function", 0); err == nil {
+		t.Error("Expected error registering a non-function filter")
+	}
+	if err := e.RegisterFilter("bad", func() string { return "" }, 0); err == nil {
+		t.Error("Expected error registering a filter with no arguments")
+	}
+}
+
+func TestFilterFlags(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	bold := func(s string) string { return "<b>" + s + "</b>" }
+	e.RegisterFilter("plainbold", bold, 0)
+	e.RegisterFilter("bold", bold, FilterSafe)
+	e.RegisterFilter("nl2br", func(s string) string {
+		return strings.Replace(s, "\n", "<br>", -1)
+	}, FilterSafe|FilterEscapeInput)
+
+	ctx := m{"s": "<i>\n"}
+	fixtures := []evalFixture{
+		{"Unflagged", `{{ s|plainbold }}`, ctx, "&lt;b&gt;&lt;i&gt;\n&lt;/b&gt;"},
+		{"Safe output", `{{ s|bold }}`, ctx, "<b><i>\n</b>"},
+		{"Escaped input", `{{ s|nl2br }}`, ctx, "&lt;i&gt;<br>"},
+		{"Escaped safe input", `{{ s|safe|nl2br }}`, ctx, "<i><br>"},
+		{"Safe", `{{ s|safe }}`, ctx, "<i>\n"},
+		{"Escape", `{{ s|escape }}`, ctx, "&lt;i&gt;\n"},
+		{"Double escape", `{{ s|e|e }}`, ctx, "&lt;i&gt;\n"},
+	}
+	testFixtures(t, e, fixtures)
+
+	// without autoescape, flags make no difference
+	e.AutoEscape = false
+	fixtures = []evalFixture{
+		{"Unflagged", `{{ s|plainbold }}`, ctx, "<b><i>\n</b>"},
+		{"Escaped input", `{{ s|nl2br }}`, ctx, "<i><br>"},
+	}
+	testFixtures(t, e, fixtures)
+}
+
+func TestUrlize(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	fixtures := []evalFixture{
+		{
+			"Url",
+			`{{ s|urlize }}`,
+			m{"s": "see http://example.com/a?b=1&c=2."},
+			`see <a href="http://example.com/a?b=1&amp;c=2">http://example.com/a?b=1&amp;c=2</a>.`,
+		},
+		{
+			"Www",
+			`{{ s|urlize }}`,
+			m{"s": "(www.example.com)"},
+			`(<a href="http://www.example.com">www.example.com</a>)`,
+		},
+		{
+			"Email",
+			`{{ s|urlize }}`,
+			m{"s": "mail me@example.com now"},
+			`mail <a href="mailto:me@example.com">me@example.com</a> now`,
+		},
+		{
+			"Options",
+			`{{ s|urlize(10, nofollow=true, target="_blank") }}`,
+			m{"s": "https://example.com"},
+			`<a href="https://example.com" rel="nofollow" target="_blank">https://ex...</a>`,
+		},
+		{
+			"None limit",
+			`{{ s|urlize(trim_url_limit=None) }}`,
+			m{"s": "https://example.com"},
+			`<a href="https://example.com">https://example.com</a>`,
+		},
+		{
+			"Unicode limit",
+			`{{ s|urlize(9) }}`,
+			m{"s": "http://例子.测试/路径"},
+			`<a href="http://例子.测试/路径">http://例子...</a>`,
+		},
+		{
+			"Zero limit",
+			`{{ s|urlize(0) }}`,
+			m{"s": "http://x.com"},
+			`<a href="http://x.com">...</a>`,
+		},
+		{
+			"Escaped input",
+			`{{ s|urlize }}`,
+			m{"s": `<script>alert("x")</script> http://x.com/"onclick="y <b>`},
+			`&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; ` +
+				`<a href="http://x.com/&#34;onclick=&#34;y">http://x.com/&#34;onclick=&#34;y</a> &lt;b&gt;`,
+		},
+	}
+	testFixtures(t, e, fixtures)
+
+	tpl, err := e.ParseString(`{{ s|urlize(nofollow=true, bogus=1) }}`, "err", "err")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(m{"s": "x"}); err == nil {
+		t.Error("Expected error for unexpected keyword argument")
+	}
+
+	tpl, err = e.ParseString(`{{ s|urlize(-3) }}`, "neg", "neg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tpl.Render(m{"s": "http://example.com"})
+	if err == nil || !strings.Contains(err.Error(), "trim_url_limit must be a non-negative integer") {
+		t.Errorf("Expected error for a negative limit, got %v", err)
+	}
+}
+
+func TestStringFilters(t *testing.T) {
+	ctx := m{"s": "a,b,c,d", "w": "  one two\tthree  four "}
+	fixtures := []evalFixture{
+		{"Startswith", `{{ s|startswith("a,") }} {{ s|startswith("b") }}`, ctx, "true false"},
+		{"Endswith", `{{ s|endswith(",d") }} {{ s|endswith("c") }}`, ctx, "true false"},
+		{"Startswith if", `{% if s|startswith("a") %}yes{% endif %}`, ctx, "yes"},
+		{"Split", `{% for p in s|split(",") %}[{{ p }}]{% endfor %}`, ctx, "[a][b][c][d]"},
+		{"Split max", `{% for p in s|split(",", 2) %}[{{ p }}]{% endfor %}`, ctx, "[a][b][c,d]"},
+		{"Split max kwarg", `{% for p in s|split(",", maxsplit=1) %}[{{ p }}]{% endfor %}`, ctx, "[a][b,c,d]"},
+		{"Split max zero", `{{ s|split(",", 0) }}`, ctx, "[a,b,c,d]"},
+		{"Split whitespace", `{% for p in w|split %}[{{ p }}]{% endfor %}`, ctx, "[one][two][three][four]"},
+		{"Split whitespace max", `{% for p in w|split(none, 2) %}[{{ p }}]{% endfor %}`, ctx, "[one][two][three  four ]"},
+		{"Split empty", `{% for p in "  "|split %}x{% endfor %}`, ctx, ""},
+	}
+	e := NewEnvironment()
+	testFixtures(t, e, fixtures)
+
+	tpl, err := e.ParseString(`{{ s|split("") }}`, "err", "err")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(ctx); err == nil {
+		t.Error("Expected error splitting on an empty separator")
+	}
+}
+
+type member struct {
+	Name   string
+	Age    int
+	Active bool
+}
+
+func TestSelectFilters(t *testing.T) {
+	users := []member{{"ann", 34, true}, {"bob", 12, false}, {"cy", 18, true}}
+	ctx := m{"users": users, "nums": []int{1, 2, 3, 4, 0}}
+	fixtures := []evalFixture{
+		{"Select", `{% for n in nums|select %}{{ n }}{% endfor %}`, ctx, "1234"},
+		{"Select test", `{% for n in nums|select("odd") %}{{ n }}{% endfor %}`, ctx, "13"},
+		{"Reject test arg", `{% for n in nums|reject("divisibleby", 2) %}{{ n }}{% endfor %}`, ctx, "13"},
+		{"Selectattr", `{% for u in users|selectattr("Active") %}{{ u.Name }} {% endfor %}`, ctx, "ann cy "},
+		{"Rejectattr", `{% for u in users|rejectattr("Active") %}{{ u.Name }}{% endfor %}`, ctx, "bob"},
+		{"Rejectattr test", `{% for u in users|rejectattr("Age", "lessthan", 18) %}{{ u.Name }} {% endfor %}`, ctx, "ann cy "},
+		{"Selectattr eq", `{% for u in users|selectattr("Name", "equalto", "bob") %}{{ u.Age }}{% endfor %}`, ctx, "12"},
+		{"Selectattr map", `{% for u in maps|selectattr("a.b") %}{{ u.a.b }}{% endfor %}`, m{"maps": []m{{"a": m{"b": 1}}, {"a": m{}}}}, "1"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ nums|select("nope") }}`, "select", "select")
+	if _, err := tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "unknown test") {
+		t.Errorf("Expected unknown test error, got %v", err)
+	}
+}
+
+func TestCurrency(t *testing.T) {
+	ctx := m{"amount": 1234567.891, "debt": -1234.5, "small": 12, "zero": -0.001}
+	fixtures := []evalFixture{
+		{"Positive", `{{ amount|currency }}`, ctx, "$1,234,567.89"},
+		{"Integer", `{{ small|currency }}`, ctx, "$12.00"},
+		{"Negative", `{{ debt|currency }}`, ctx, "-$1,234.50"},
+		{"Negative parens", `{{ debt|currency(parens=true) }}`, ctx, "($1,234.50)"},
+		{"Negative zero", `{{ zero|currency }}`, ctx, "$0.00"},
+		{"Custom symbol", `{{ amount|currency("€", thousands=".", decimals=0) }}`, ctx, "€1.234.568"},
+		{"Positional", `{{ 1000|currency("£", 1) }}`, ctx, "£1,000.0"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ "a"|currency }}`, "currency", "currency")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error formatting a string as currency")
+	}
+}
+
+func TestCaseFilters(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Snake from pascal", `{{ "HelloWorld"|snakecase }}`, m{}, "hello_world"},
+		{"Camel from snake", `{{ "hello_world"|camelcase }}`, m{}, "helloWorld"},
+		{"Kebab from camel", `{{ "helloWorld"|kebabcase }}`, m{}, "hello-world"},
+		{"Snake acronym", `{{ "HTTPServerError"|snakecase }}`, m{}, "http_server_error"},
+		{"Camel acronym", `{{ "HTTPServer"|camelcase }}`, m{}, "httpServer"},
+		{"Snake trailing acronym", `{{ "userID"|snakecase }}`, m{}, "user_id"},
+		{"Snake digits", `{{ "utf8Decoder2Go"|snakecase }}`, m{}, "utf8_decoder2_go"},
+		{"Camel digits", `{{ "field 1 name"|camelcase }}`, m{}, "field1Name"},
+		{"Kebab separators", `{{ "  Hello--big_World "|kebabcase }}`, m{}, "hello-big-world"},
+		{"Empty", `{{ ""|camelcase }}`, m{}, ""},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestUnknownFilterPolicy(t *testing.T) {
+	e := NewEnvironment()
+	tpl, err := e.ParseString(`[{{ x|unknownfilter }}]`, "policy.html", "policy.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(m{"x": "a"}); err == nil || !strings.Contains(err.Error(), `unknown filter "unknownfilter"`) {
+		t.Errorf("Expected unknown filter error, got %v", err)
+	}
+
+	var warnings []string
+	e.Warn = func(msg string) { warnings = append(warnings, msg) }
+	e.UnknownFilterPolicy = UnknownFilterPassThrough
+	out, err := tpl.Render(m{"x": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "[a]" {
+		t.Errorf("Expected value passed through, got %q", out)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `policy.html:1:4: unknown filter "unknownfilter"`) {
+		t.Errorf("Expected a warning, got %q", warnings)
+	}
+}
+
+func TestTruncateHTML(t *testing.T) {
+	ctx := m{"html": "<p>Hello <b>bold world</b> and <i>more</i></p>"}
+	fixtures := []evalFixture{
+		{"Inside tag", `{{ html|truncate_html(10) }}`, ctx, "<p>Hello <b>bold...</b></p>"},
+		{"After tag", `{{ html|truncate_html(16) }}`, ctx, "<p>Hello <b>bold world</b>...</p>"},
+		{"Fits", `{{ html|truncate_html(100) }}`, ctx, ctx["html"].(string)},
+		{"Exact", `{{ "<b>abc</b>"|truncate_html(3) }}`, ctx, "<b>abc</b>"},
+		{"Custom end", `{{ html|truncate_html(5, end="") }}`, ctx, "<p>Hello</p>"},
+		{"Entities", `{{ "<b>a &amp; b</b>"|truncate_html(3) }}`, ctx, "<b>a &amp;...</b>"},
+		{"Void elements", `{{ "<p>a<br>b<img src=x/>cd</p>"|truncate_html(3) }}`, ctx, "<p>a<br>b<img src=x/>c...</p>"},
+		{"Nested", `{{ "<div><ul><li>one</li><li>two</li></ul></div>"|truncate_html(4) }}`, ctx, "<div><ul><li>one</li><li>t...</li></ul></div>"},
+		{"Comment", `{{ "<!-- x --><em>abc</em>"|truncate_html(1) }}`, ctx, "<!-- x --><em>a...</em>"},
+		{"Unicode", `{{ "<b>héllo</b>"|truncate_html(2) }}`, ctx, "<b>hé...</b>"},
+		{"Zero", `{{ "<b>abc</b>"|truncate_html(0) }}`, ctx, "<b>...</b>"},
+		{"Quoted >", `{{ "<a title='x>y' href=\"#\">link</a>"|truncate_html(2) }}`, ctx, `<a title='x>y' href="#">li...</a>`},
+	}
+	e := NewEnvironment()
+	testFixtures(t, e, fixtures)
+
+	// with autoescaping, plain strings are untrusted text rather than html
+	e = NewEnvironment()
+	e.AutoEscape = true
+	testFixtures(t, e, []evalFixture{
+		{"Script", `{{ s|truncate_html(100) }}`, m{"s": "<script>alert(1)</script>"}, "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"Escaped truncation", `{{ s|truncate_html(3) }}`, m{"s": "<script>alert(1)</script>"}, "&lt;sc..."},
+		{"Safe", `{{ html|safe|truncate_html(10) }}`, ctx, "<p>Hello <b>bold...</b></p>"},
+		{"Safe context", `{{ html|truncate_html(10) }}`, m{"html": Safe(ctx["html"].(string))}, "<p>Hello <b>bold...</b></p>"},
+	})
+
+	tpl, _ := e.ParseString(`{{ html|truncate_html(-1) }}`, "truncate", "truncate")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error for a negative length")
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	type user struct {
+		Name  string
+		Admin bool
+		Age   int `json:"age"`
+	}
+	ctx := m{
+		"data": map[string]interface{}{"b": []int{1, 2}, "a": "x", "c": map[string]int{"z": 1, "y": 2}},
+		"user": user{"ann", true, 34},
+		"html": "</script><b>'&'</b>",
+		"nums": []int{1},
+	}
+	fixtures := []evalFixture{
+		{"Compact", `{{ data|tojson }}`, ctx, `{"a":"x","b":[1,2],"c":{"y":2,"z":1}}`},
+		{
+			"Indented sorted",
+			`{{ data|tojson(indent=2, sort_keys=true) }}`,
+			ctx,
+			"{\n  \"a\": \"x\",\n  \"b\": [\n    1,\n    2\n  ],\n  \"c\": {\n    \"y\": 2,\n    \"z\": 1\n  }\n}",
+		},
+		{"String indent", `{{ nums|tojson(indent="--") }}`, ctx, "[\n--1\n]"},
+		{"Struct", `{{ user|tojson }}`, ctx, `{"Name":"ann","Admin":true,"age":34}`},
+		{"Struct sorted", `{{ user|tojson(sort_keys=true) }}`, ctx, `{"Admin":true,"Name":"ann","age":34}`},
+		{"Html safe", `{{ html|tojson }}`, ctx, `"\u003c/script\u003e\u003cb\u003e\u0027\u0026\u0027\u003c/b\u003e"`},
+		{"None", `{{ none|tojson }}`, ctx, `null`},
+	}
+	e := NewEnvironment()
+	e.AutoEscape = true
+	testFixtures(t, e, fixtures)
+
+	tpl, _ := e.ParseString(`{{ data|tojson(indent=true) }}`, "tojson", "tojson")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error for a bool indent")
+	}
+}
+
+func TestFileSizeFormat(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Zero", `{{ 0|filesizeformat }}`, m{}, "0 Bytes"},
+		{"One", `{{ 1|filesizeformat }}`, m{}, "1 Byte"},
+		{"Bytes", `{{ 999|filesizeformat }}`, m{}, "999 Bytes"},
+		{"Kilobytes", `{{ 1000|filesizeformat }}`, m{}, "1.0 kB"},
+		{"Megabytes", `{{ 1500000|filesizeformat }}`, m{}, "1.5 MB"},
+		{"Gigabytes float", `{{ n|filesizeformat }}`, m{"n": 2.5e9}, "2.5 GB"},
+		{"Binary bytes", `{{ 1000|filesizeformat(true) }}`, m{}, "1000 Bytes"},
+		{"Kibibytes", `{{ 1024|filesizeformat(binary=true) }}`, m{}, "1.0 KiB"},
+		{"Mebibytes", `{{ 1500000|filesizeformat(true) }}`, m{}, "1.4 MiB"},
+		{"Negative", `{{ -1500|filesizeformat }}`, m{}, "-1.5 kB"},
+		{"Zettabytes", `{{ n|filesizeformat }}`, m{"n": 999e21}, "999.0 ZB"},
+		{"Yottabytes", `{{ n|filesizeformat }}`, m{"n": 1e24}, "1.0 YB"},
+		{"Huge", `{{ n|filesizeformat }}`, m{"n": 1e30}, "1000000.0 YB"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ "big"|filesizeformat }}`, "size", "size")
+	if _, err := tpl.Render(m{}); err == nil {
+		t.Errorf("Expected error formatting a string")
+	}
+}
+
+func TestOrdinal(t *testing.T) {
+	var fixtures []evalFixture
+	for n, want := range map[int]string{
+		1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th",
+		21: "21st", 101: "101st", 111: "111th", 0: "0th", 112: "112th", 1003: "1003rd", -2: "-2nd",
+	} {
+		fixtures = append(fixtures, evalFixture{want, `{{ n|ordinal }}`, m{"n": n}, want})
+	}
+	fixtures = append(fixtures, evalFixture{"Literal", `{{ 22|ordinal }} place`, m{}, "22nd place"})
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ "first"|ordinal }}`, "ordinal", "ordinal")
+	if _, err := tpl.Render(m{}); err == nil {
+		t.Errorf("Expected error for the ordinal of a string")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	type user struct{ Name, Email string }
+	ctx := m{
+		"user":  m{"email": "a@b.c"},
+		"named": m{"name": "Ann"},
+		"typed": user{Name: "Bob"},
+		"empty": "",
+	}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Missing attribute", `{{ user.name | default("Anon") }}`, ctx, "Anon"},
+		{"Missing parent", `{{ nobody.name | default("Anon") }}`, ctx, "Anon"},
+		{"Missing chain", `{{ nobody.a.b.c|default("Anon") }}`, ctx, "Anon"},
+		{"Defined", `{{ named.name | default("Anon") }}`, ctx, "Ann"},
+		{"Struct field", `{{ typed.Name|default("Anon") }}`, ctx, "Bob"},
+		{"Alias", `{{ user.name|d("Anon") }}`, ctx, "Anon"},
+		{"No argument", `[{{ user.name|default }}]`, ctx, "[]"},
+		{"Empty string", `[{{ empty|default("x") }}]`, ctx, "[]"},
+		{"Boolean", `[{{ empty|default("x", true) }}]`, ctx, "[x]"},
+		{"Boolean keyword", `[{{ empty|default("x", boolean=true) }}]`, ctx, "[x]"},
+		{"Chained filters", `{{ user.name|default("anon")|camelcase }}`, ctx, "anon"},
+	})
+
+	// the value of default is not reported as undefined
+	tpl, _ := NewEnvironment().ParseString(`{{ user.name|default("Anon") }}`, "default", "default")
+	if err := tpl.Validate(ctx); err != nil {
+		t.Errorf("Unexpected validation error: %s", err)
+	}
+	tpl, _ = NewEnvironment().ParseString(`{{ user.name|default(missing) }}`, "default", "default")
+	if err := tpl.Validate(ctx); err == nil {
+		t.Errorf("Expected undefined default value to be reported")
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	staff := []m{
+		{"name": "ann", "dept": "eng", "team": "web"},
+		{"name": "bob", "dept": "ops", "team": "net"},
+		{"name": "cy", "dept": "eng", "team": "api"},
+		{"name": "di", "dept": "eng", "team": "web"},
+		{"name": "ed"},
+	}
+	ctx := m{"staff": staff}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Single key", `{% for dept, people in staff[:4]|groupby("dept") %}{{ dept }}:{% for p in people %}{{ p.name }} {% endfor %}{% endfor %}`, ctx, "eng:ann cy di ops:bob "},
+		{"Attributes", `{% for g in staff[:4]|groupby("dept") %}{{ g.grouper }}={% for p in g.list %}{{ p.name }}{% endfor %} {% endfor %}`, ctx, "eng=anncydi ops=bob "},
+		{"Reverse", `{% for dept, _ in staff[:4]|groupby("dept", reverse=true) %}{{ dept }} {% endfor %}`, ctx, "ops eng "},
+		{"Default", `{% for dept, people in staff|groupby("dept", default="none") %}{{ dept }} {% endfor %}`, ctx, "eng none ops "},
+		{"Two levels", `{% for dept, teams in staff[:4]|groupby("dept", "team") %}{{ dept }}[{% for team, people in teams %}{{ team }}:{% for p in people %}{{ p.name }}{% endfor %} {% endfor %}]{% endfor %}`, ctx, "eng[api:cy web:anndi ]ops[net:bob ]"},
+		{"Two levels reversed", `{% for dept, teams in staff[:4]|groupby("dept", "team", reverse=true) %}{{ dept }}[{% for team, _ in teams %}{{ team }} {% endfor %}]{% endfor %}`, ctx, "ops[net ]eng[web api ]"},
+		{"Empty", `[{% for g in empty|groupby("dept") %}{{ g }}{% endfor %}]`, m{"empty": []m{}}, "[]"},
+	})
+
+	for _, src := range []string{
+		`{{ staff|groupby }}`,
+		`{{ staff|groupby(1) }}`,
+		`{{ staff|groupby("dept", nope=1) }}`,
+	} {
+		tpl, err := NewEnvironment().ParseString(src, "groupby", "groupby")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(ctx); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
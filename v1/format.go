@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormatSource parses a template written in the syntax cfg and returns it in
+// a canonical form, with single spaces inside delimiters and around
+// operators, eg. `{{a+b}}` becomes `{{ a + b }}`.  Text is left untouched.
+// Formatting is idempotent, so formatting the result again returns it
+// unchanged.  Comments are dropped unless the KeepComments option is given.
+// Delimiters left empty in cfg are those of DefaultConfig, as in a new
+// Environment, so the zero Config formats the default syntax.
+func FormatSource(src string, cfg Config, opts ...FormatOption) (string, error) {
+	cfg = cfg.withDefaults()
+	f := &formatter{cfg: cfg}
+	for _, opt := range opts {
+		opt(f)
+	}
+	e := NewEnvironment()
+	e.setConfig(cfg)
+	e.KeepComments = f.comments
+	tree, err := e.parse(src, "format", "format")
+	if err != nil {
+		return "", err
+	}
+	if err := f.format(tree.Root); err != nil {
+		return "", err
+	}
+	return f.b.String(), nil
+}
+
+// withDefaults returns the config with its empty delimiters set to those of
+// DefaultConfig.
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	for _, p := range []struct{ s, def *string }{
+		{&c.BlockStartString, &def.BlockStartString},
+		{&c.BlockEndString, &def.BlockEndString},
+		{&c.VariableStartString, &def.VariableStartString},
+		{&c.VariableEndString, &def.VariableEndString},
+		{&c.CommentStartString, &def.CommentStartString},
+		{&c.CommentEndString, &def.CommentEndString},
+	} {
+		if *p.s == "" {
+			*p.s = *p.def
+		}
+	}
+	return c
+}
+
+// A FormatOption configures FormatSource.
+type FormatOption func(*formatter)
+
+// KeepComments keeps comments when formatting, in their place among the
+// text and tags around them, with single spaces inside their delimiters,
+// eg. `{#note  #}` becomes `{# note #}`.
+func KeepComments() FormatOption {
+	return func(f *formatter) { f.comments = true }
+}
+
+// formatter writes the canonical source of a parse tree.
+type formatter struct {
+	cfg      Config
+	comments bool // whether comments are kept.
+	b        strings.Builder
+}
+
+// block writes a block tag with the contents format and args.
+func (f *formatter) block(format string, args ...interface{}) {
+	fmt.Fprintf(&f.b, "%s %s %s", f.cfg.BlockStartString, fmt.Sprintf(format, args...), f.cfg.BlockEndString)
+}
+
+func (f *formatter) format(n Node) error {
+	switch t := n.(type) {
+	case *ListNode:
+		for _, n := range t.Nodes {
+			if err := f.format(n); err != nil {
+				return err
+			}
+		}
+	case *TextNode:
+		f.b.Write(t.Text)
+	case *CommentNode:
+		if text := strings.TrimSpace(t.Text); text != "" {
+			fmt.Fprintf(&f.b, "%s %s %s", f.cfg.CommentStartString, text, f.cfg.CommentEndString)
+		} else {
+			fmt.Fprintf(&f.b, "%s %s", f.cfg.CommentStartString, f.cfg.CommentEndString)
+		}
+	case *VarNode:
+		fmt.Fprintf(&f.b, "%s %s %s", f.cfg.VariableStartString, t.Node, f.cfg.VariableEndString)
+	case *SetNode:
+		target := t.lhs.String()
+		if tuple, ok := t.lhs.(*TupleNode); ok {
+			target = joinNodes(tuple.Elems, ", ")
+		}
+		f.block("set %s = %s", target, t.rhs)
+	case *IfBlockNode:
+		for i, c := range t.Conditionals {
+			cond := c.(*ConditionalNode)
+			if i == 0 {
+				f.block("if %s", cond.Guard)
+			} else {
+				f.block("elif %s", cond.Guard)
+			}
+			if err := f.format(cond.Body); err != nil {
+				return err
+			}
+		}
+		if t.Else != nil {
+			f.block("else")
+			if err := f.format(t.Else); err != nil {
+				return err
+			}
+		}
+		f.block("endif")
+	case *ForNode:
+		target := t.ForExpr.String()
+		if tuple, ok := t.ForExpr.(*TupleNode); ok {
+			target = joinNodes(tuple.Elems, ", ")
+		}
+		if t.Recursive {
+			f.block("for %s in %s recursive", target, t.InExpr)
+		} else {
+			f.block("for %s in %s", target, t.InExpr)
+		}
+		if err := f.format(t.Body); err != nil {
+			return err
+		}
+		if t.Else != nil {
+			f.block("else")
+			if err := f.format(t.Else); err != nil {
+				return err
+			}
+		}
+		f.block("endfor")
+	case *BlockNode:
+		f.block("block %s", t.Name)
+		if err := f.format(t.Body); err != nil {
+			return err
+		}
+		f.block("endblock")
+	case *CacheNode:
+		f.block("cache %s %s", t.Timeout, t.Key)
+		if err := f.format(t.Body); err != nil {
+			return err
+		}
+		f.block("endcache")
+	case *MacroNode:
+		f.block("macro %s", t.signature())
+		if err := f.format(t.Body); err != nil {
+			return err
+		}
+		f.block("endmacro")
+	case *IncludeNode:
+		f.block("include %s", t.Template)
+	case *BreakNode:
+		f.block("break")
+	case *ContinueNode:
+		f.block("continue")
+	default:
+		return fmt.Errorf("cannot format %s", n)
+	}
+	return nil
+}
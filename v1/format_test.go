@@ -0,0 +1,112 @@
+package v1
+
+import "testing"
+
+func TestFormatSource(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{`{{a+b}}`, `{{ a + b }}`},
+		{`Hello,  {{   name|e   }}!`, `Hello,  {{ name | e }}!`},
+		{`{{(1+2)*x[0]  }}`, `{{ (1 + 2) * x[0] }}`},
+		{`{{ f( 1,"a\"b" ,k = 2) }}`, `{{ f(1, "a\"b", k=2) }}`},
+		{`{{ {"a":1} }}`, `{{ {"a": 1} }}`},
+		{`{{ 'a\tb\\' }}`, `{{ "a\tb\\" }}`},
+		{`{%if a<b%}x{%elif c%}y{%else%}z{%endif%}`, `{% if a < b %}x{% elif c %}y{% else %}z{% endif %}`},
+		{`{%for k,v in d.items()  recursive%}{{k}}{%else%}-{%endfor%}`, `{% for k, v in d.items() recursive %}{{ k }}{% else %}-{% endfor %}`},
+		{`{%for i,(a,b) in enumerate(l)%}{{a}}{%endfor%}`, `{% for i, (a, b) in enumerate(l) %}{{ a }}{% endfor %}`},
+		{`{%block header%}{{title}}{%endblock header%}`, `{% block header %}{{ title }}{% endblock %}`},
+		{`{%cache 60 "k" + id%}{{x}}{%endcache%}`, `{% cache 60 "k" + id %}{{ x }}{% endcache %}`},
+		{`{%set x=1+2%}`, `{% set x = 1 + 2 %}`},
+		{`{%macro f(a,b = 1)%}{{a}}{%endmacro%}`, `{% macro f(a, b=1) %}{{ a }}{% endmacro %}`},
+		{`{%include  "a.html"%}`, `{% include "a.html" %}`},
+		{`{%for i in l%}{%if i%}{%continue%}{%endif%}{%break%}{%endfor%}`, `{% for i in l %}{% if i %}{% continue %}{% endif %}{% break %}{% endfor %}`},
+		{`{%set head,*tail=l%}`, `{% set head, *tail = l %}`},
+		{"a {# comment #}\n  b", "a \n  b"},
+	}
+	for _, test := range tests {
+		out, err := FormatSource(test.in, DefaultConfig())
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%s: expected `%s`, got `%s`", test.in, test.out, out)
+		}
+		again, err := FormatSource(out, DefaultConfig())
+		if err != nil {
+			t.Errorf("%s: %s", out, err)
+			continue
+		}
+		if again != out {
+			t.Errorf("Formatting is not idempotent: `%s` became `%s`", out, again)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.BlockStartString, cfg.BlockEndString = "<%", "%>"
+	cfg.VariableStartString, cfg.VariableEndString = "<{", "}>"
+	out, err := FormatSource(`<%if x%><{x+1}><%endif%>`, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `<% if x %><{ x + 1 }><% endif %>` {
+		t.Errorf("Expected custom delimiters to be kept, got `%s`", out)
+	}
+
+	out, err = FormatSource(`{%if x%}{{x}}{%endif%}`, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `{% if x %}{{ x }}{% endif %}` {
+		t.Errorf("Expected the zero Config to format the default syntax, got `%s`", out)
+	}
+
+	if _, err := FormatSource(`{{ a + }}`, DefaultConfig()); err == nil {
+		t.Errorf("Expected parse error for invalid source")
+	}
+}
+
+func TestFormatKeepComments(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"a {# comment #}\n  b", "a {# comment #}\n  b"},
+		{`{#note#}{{x}}`, `{# note #}{{ x }}`},
+		{"{#   spaced \t #}", "{# spaced #}"},
+		{`{##}{#   #}`, `{# #}{# #}`},
+		{"{# line one\n   line two #}", "{# line one\n   line two #}"},
+		{`{# {{ not a var }} {% if %} #}`, `{# {{ not a var }} {% if %} #}`},
+		{"a  {#- trimmed -#}  b", "a{# trimmed #}b"},
+		{`{%if x%}{#in if#}y{%else%}{# in else #}{%endif%}`, `{% if x %}{# in if #}y{% else %}{# in else #}{% endif %}`},
+		{`{%for i in l%}{{i}}{#each#}{%endfor%}{# end #}`, `{% for i in l %}{{ i }}{# each #}{% endfor %}{# end #}`},
+		{`{%macro f()%}{#body#}{%endmacro%}`, `{% macro f() %}{# body #}{% endmacro %}`},
+	}
+	for _, test := range tests {
+		out, err := FormatSource(test.in, DefaultConfig(), KeepComments())
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%s: expected `%s`, got `%s`", test.in, test.out, out)
+		}
+		again, err := FormatSource(out, DefaultConfig(), KeepComments())
+		if err != nil {
+			t.Errorf("%s: %s", out, err)
+			continue
+		}
+		if again != out {
+			t.Errorf("Formatting is not idempotent: `%s` became `%s`", out, again)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.CommentStartString, cfg.CommentEndString = "<#", "#>"
+	out, err := FormatSource(`<#x#>{{y}}`, cfg, KeepComments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `<# x #>{{ y }}` {
+		t.Errorf("Expected custom comment delimiters to be kept, got `%s`", out)
+	}
+	if _, err := FormatSource(`{# unclosed`, DefaultConfig(), KeepComments()); err == nil {
+		t.Errorf("Expected an error for an unclosed comment")
+	}
+}
@@ -0,0 +1,114 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// globalEnumerate returns pairs of a count and each item of value, with the
+// arguments (start=0), for use as `for i, item in enumerate(items)`.
+func (e *Environment) globalEnumerate(value interface{}, args Args, kwargs Kwargs) ([]interface{}, error) {
+	params, err := bindArgs(args, kwargs, []string{"start"}, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, ok := asInteger(params[0])
+	if !ok {
+		return nil, fmt.Errorf("type error: start must be an integer, not %s", typeName(params[0]))
+	}
+	items, err := e.iterate(value)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]interface{}, len(items))
+	for i, item := range items {
+		pairs[i] = []interface{}{start + int64(i), item}
+	}
+	return pairs, nil
+}
+
+// globalZip returns tuples of the parallel items of each of its arguments,
+// stopping at the end of the shortest.
+func (e *Environment) globalZip(args Args) ([]interface{}, error) {
+	seqs := make([][]interface{}, len(args))
+	for i, arg := range args {
+		items, err := e.iterate(arg)
+		if err != nil {
+			return nil, err
+		}
+		seqs[i] = items
+	}
+	tuples := []interface{}{}
+	for i := 0; len(seqs) > 0; i++ {
+		tuple := make([]interface{}, len(seqs))
+		for j, items := range seqs {
+			if i >= len(items) {
+				return tuples, nil
+			}
+			tuple[j] = items[i]
+		}
+		tuples = append(tuples, tuple)
+	}
+	return tuples, nil
+}
+
+// globalMin returns the smallest of its arguments, or of the items of its only
+// argument, with the keyword argument attribute to compare an attribute of
+// each item.
+func (e *Environment) globalMin(args Args, kwargs Kwargs) (interface{}, error) {
+	return e.globalExtreme(args, kwargs, -1)
+}
+
+// globalMax returns the largest of its arguments, like min.
+func (e *Environment) globalMax(args Args, kwargs Kwargs) (interface{}, error) {
+	return e.globalExtreme(args, kwargs, 1)
+}
+
+func (e *Environment) globalExtreme(args Args, kwargs Kwargs, want int) (interface{}, error) {
+	params, err := bindArgs(nil, kwargs, []string{"attribute"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}(args)
+	if len(args) == 1 {
+		if items, err = e.iterate(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	return e.extreme(items, asString(params[0]), true, want)
+}
+
+// extreme returns the item which orders first by want, -1 for the smallest
+// and 1 for the largest.  If attr is set, each item's attribute attr is
+// compared instead of the item, and strings are compared ignoring case
+// unless caseSensitive is set.  If there are no items, nil is returned.
+func (e *Environment) extreme(items []interface{}, attr string, caseSensitive bool, want int) (interface{}, error) {
+	key := func(i interface{}) interface{} {
+		if len(attr) > 0 {
+			i = e.attrPath(i, attr)
+		}
+		if s, ok := i.(string); ok && !caseSensitive {
+			return strings.ToLower(s)
+		}
+		return i
+	}
+	var best, bestKey interface{}
+	for i, item := range items {
+		k := key(item)
+		if i == 0 {
+			best, bestKey = item, k
+			continue
+		}
+		cmp, ok, err := e.order(k, bestKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("type error: cannot compare %s and %s", typeName(k), typeName(bestKey))
+		}
+		if cmp == want {
+			best, bestKey = item, k
+		}
+	}
+	return best, nil
+}
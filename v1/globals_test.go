@@ -0,0 +1,42 @@
+package v1
+
+import "testing"
+
+func TestMinMax(t *testing.T) {
+	ctx := m{
+		"nums":  []int{3, 1, 2},
+		"words": []string{"b", "C", "a"},
+		"users": []member{{"ann", 34, true}, {"bob", 12, false}},
+	}
+	fixtures := []evalFixture{
+		{"Max args", `{{ max(1, 5, 3) }}`, ctx, "5"},
+		{"Min args", `{{ min(4, 2.5, 3) }}`, ctx, "2.5"},
+		{"Max iterable", `{{ max(nums) }}`, ctx, "3"},
+		{"Min iterable", `{{ min(nums) }}`, ctx, "1"},
+		{"Max attribute", `{{ max(users, attribute="Age").Name }}`, ctx, "ann"},
+		{"Min empty", `{{ min([]) }}`, ctx, ""},
+		{"Min filter", `{{ nums|min }}`, ctx, "1"},
+		{"Max filter", `{{ words|max }}`, ctx, "C"},
+		{"Max filter case", `{{ words|max(case_sensitive=true) }}`, ctx, "b"},
+		{"Min filter attribute", `{{ (users|min(attribute="Age")).Name }}`, ctx, "bob"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestEnumerateZip(t *testing.T) {
+	ctx := m{"a": []string{"x", "y", "z"}, "b": []int{1, 2}}
+	fixtures := []evalFixture{
+		{"Enumerate", `{% for i, v in enumerate(a) %}{{ i }}{{ v }} {% endfor %}`, ctx, "0x 1y 2z "},
+		{"Enumerate start", `{% for i, v in enumerate(a, 10) %}{{ i }}{{ v }} {% endfor %}`, ctx, "10x 11y 12z "},
+		{"Zip", `{% for x, n in zip(a, b) %}{{ x }}{{ n }} {% endfor %}`, ctx, "x1 y2 "},
+		{"Zip three", `{% for x, n, c in zip(a, b, "pq") %}{{ x }}{{ n }}{{ c }} {% endfor %}`, ctx, "x1p y2q "},
+		{"Zip empty", `{% for x in zip() %}{{ x }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"Zip length", `{{ zip(a, []) }}`, ctx, "[]"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{{ zip(a, 1) }}`, "zip", "zip")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error zipping a non-iterable")
+	}
+}
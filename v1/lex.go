@@ -6,6 +6,7 @@ package v1
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -21,9 +22,11 @@ type itemType int
 
 // item represents a token or text string returned from the scanner.
 type item struct {
-	typ itemType // The type of this item.
-	pos Pos      // The starting position, in bytes, of this item in the input string.
-	val string   // The value of this item.
+	typ  itemType // The type of this item.
+	pos  Pos      // The starting position, in bytes, of this item in the input string.
+	val  string   // The value of this item.
+	line int      // The line of the item's start, starting at 1.
+	col  int      // The column of the item's start, in runes, starting at 1.
 }
 
 func (i item) String() string {
@@ -32,7 +35,7 @@ func (i item) String() string {
 		return "EOF"
 	case i.typ == tokenError:
 		return fmt.Sprintf("<Err: %s>", i.val)
-	case i.typ == tokenName:
+	case i.typ == tokenName, i.typ == tokenKeyword:
 		return fmt.Sprintf("<%s>", i.val)
 	case len(i.val) > 10:
 		return fmt.Sprintf("%.10q...", i.val)
@@ -45,19 +48,33 @@ func (i item) String() string {
 // The index operator is special cased to have the highest priorty by the
 // parser's maybeIndexExpr function.
 // Precedence    Operator
-//    5             *  /  //  %
+//    6             *  /  //  %
+//    5             ~
 //    4             +  -
-//    3             ==  !=  <  <=  >  >=
-//    2             &&
-//    1             ||
+//    3             ==  !=  <  <=  >  >=  in  not in
+//    2             and  &&
+//    1             or  ||
 func (i item) precedence() int {
 	switch i.typ {
 	case tokenMul, tokenDiv, tokenFloordiv, tokenMod:
+		return 6
+	case tokenTilde:
 		return 5
 	case tokenAdd, tokenSub:
 		return 4
 	case tokenEqEq, tokenNeq, tokenLt, tokenLteq, tokenGt, tokenGteq:
 		return 3
+	case tokenKeyword:
+		// `not` is only an operator in `not in`
+		switch i.val {
+		case "in", "not":
+			return 3
+		case "and":
+			return 2
+		case "or":
+			return 1
+		}
+		return 0
 	case tokenAnd:
 		return 2
 	case tokenOr:
@@ -126,12 +143,24 @@ const (
 	tokenError
 	// add a distinct token for bool constants
 	tokenBool
+	tokenNone
+	tokenKeyword
 )
 
+// keywords are the names lexed as something other than tokenName.  Keywords
+// cannot be used as variable names.
+var keywords = map[string]itemType{
+	"true": tokenBool, "false": tokenBool, "none": tokenNone, "None": tokenNone,
+	"if": tokenKeyword, "for": tokenKeyword, "in": tokenKeyword, "not": tokenKeyword,
+	"and": tokenKeyword, "or": tokenKeyword, "is": tokenKeyword,
+}
+
 // stateFn represents the state of the scanner as a function that returns the next state.
 type stateFn func(*lexer) stateFn
 
-type lexerCfg struct {
+// Config is a template syntax:  the delimiters which mark blocks, vars and
+// comments.
+type Config struct {
 	BlockStartString    string
 	BlockEndString      string
 	VariableStartString string
@@ -140,6 +169,77 @@ type lexerCfg struct {
 	CommentEndString    string
 }
 
+// DefaultConfig returns the default syntax, `{% %}`, `{{ }}` and `{# #}`.
+func DefaultConfig() Config {
+	return Config{
+		BlockStartString:    "{%",
+		BlockEndString:      "%}",
+		VariableStartString: "{{",
+		VariableEndString:   "}}",
+		CommentStartString:  "{#",
+		CommentEndString:    "#}",
+	}
+}
+
+// NewLexerConfig returns the syntax with the given delimiters, eg. `<%` and
+// `%>` for blocks, for templates embedded in formats which use braces.  It
+// returns an error for delimiters which would be ambiguous:  empty ones, a
+// start delimiter which is the same as its end, or a start delimiter which
+// is the same as another or begins with it.
+func NewLexerConfig(blockStart, blockEnd, variableStart, variableEnd, commentStart, commentEnd string) (Config, error) {
+	cfg := Config{
+		BlockStartString:    blockStart,
+		BlockEndString:      blockEnd,
+		VariableStartString: variableStart,
+		VariableEndString:   variableEnd,
+		CommentStartString:  commentStart,
+		CommentEndString:    commentEnd,
+	}
+	pairs := []struct{ kind, start, end string }{
+		{"block", blockStart, blockEnd},
+		{"variable", variableStart, variableEnd},
+		{"comment", commentStart, commentEnd},
+	}
+	for i, p := range pairs {
+		if p.start == "" || p.end == "" {
+			return Config{}, fmt.Errorf("%s delimiters must not be empty", p.kind)
+		}
+		if p.start == p.end {
+			return Config{}, fmt.Errorf("%s start and end delimiters are both %q", p.kind, p.start)
+		}
+		for _, q := range pairs[:i] {
+			if strings.HasPrefix(p.start, q.start) || strings.HasPrefix(q.start, p.start) {
+				return Config{}, fmt.Errorf("%s start %q and %s start %q are ambiguous", q.kind, q.start, p.kind, p.start)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+type lexerCfg struct {
+	Config
+	// If true, a doubled block or variable start string in text is a
+	// literal start string, eg. `{{{{` renders `{{`.
+	DoubledDelimiters bool
+	// If true, the first newline after a block tag is removed.
+	TrimBlocks bool
+	// If true, spaces and tabs before a block tag or comment at the start of
+	// a line are removed.
+	LstripBlocks bool
+	// If set, a line beginning with this prefix, after optional spaces and
+	// tabs, is a block statement ending at the end of the line.
+	LineStatementPrefix string
+	// If set, text from this prefix to the end of the line is a comment.
+	LineCommentPrefix string
+	// If true, comments emit no tokens, rather than tokenCommentBegin,
+	// tokenComment and tokenCommentEnd.
+	SkipComments bool
+	// BatchSize is the number of items sent to the client at a time.  Items
+	// are sent one at a time if it is less than 2;  larger batches amortize
+	// the cost of the channel over several items.
+	BatchSize int
+}
+
 // lexer holds the state of the scanner.
 type lexer struct {
 	lexerCfg
@@ -148,15 +248,24 @@ type lexer struct {
 	input    string // the string being scanned
 	// these are supposed to represent the delims we're looking for, but jigo
 	// has a list of possible delims.
-	leftDelim  string    // start of action
-	rightDelim string    // end of action
-	state      stateFn   // the next lexing function to enter
-	pos        Pos       // current position in the input
-	start      Pos       // start position of this item
-	width      Pos       // width of last rune read from input
-	lastPos    Pos       // position of most recent item returned by nextItem
-	items      chan item // channel of scanned items
+	leftDelim  string      // start of action
+	rightDelim string      // end of action
+	state      stateFn     // the next lexing function to enter
+	pos        Pos         // current position in the input
+	start      Pos         // start position of this item
+	width      Pos         // width of last rune read from input
+	last       item        // most recent item returned by nextItem
+	line       int         // line of linePos
+	lineStart  Pos         // position of the start of the line holding linePos
+	linePos    Pos         // position up to which lines have been counted
+	items      chan []item // channel of scanned items, sent in batches
+	pending    []item      // items scanned but not yet sent
+	received   []item      // items received but not yet returned by nextItem
 	delimStack []rune
+	// lineStatement is true while lexing a line statement.
+	lineStatement bool
+	// quote is the quote character of the string being lexed.
+	quote rune
 	// we will need a more sophisticated delim stack to parse jigo
 	//parenDepth int       // nesting depth of ( ) exprs
 }
@@ -215,11 +324,7 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	val := l.input[l.start:l.pos]
-	if t == tokenString {
-		val = strings.Replace(val, `\"`, `"`, -1)
-	}
-	l.items <- item{t, l.start, val}
+	l.send(item{typ: t, pos: l.start, val: l.input[l.start:l.pos]})
 	l.start = l.pos
 }
 
@@ -248,20 +353,74 @@ func (l *lexer) acceptRun(valid string) {
 // the previous item returned by nextItem. Doing it this way
 // means we don't have to worry about peek double counting.
 func (l *lexer) lineNumber() int {
-	return 1 + strings.Count(l.input[:l.lastPos], "\n")
+	return l.last.line
+}
+
+// position returns the line and column of the position p.  Lexing states
+// skip over delimiters and text without reading them rune by rune, so lines
+// are counted here as items are sent, continuing from the previous item.
+// Only a CRLF's `\n` ends a line.
+func (l *lexer) position(p Pos) (line, col int) {
+	if p < l.linePos {
+		l.line, l.lineStart, l.linePos = 0, 0, 0
+	}
+	skipped := l.input[l.linePos:p]
+	if n := strings.Count(skipped, "\n"); n > 0 {
+		l.line += n
+		l.lineStart = l.linePos + Pos(strings.LastIndexByte(skipped, '\n')) + 1
+	}
+	l.linePos = p
+	return l.line + 1, 1 + utf8.RuneCountInString(l.input[l.lineStart:p])
 }
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{tokenError, l.start, fmt.Sprintf(format, args...)}
+	l.send(item{typ: tokenError, pos: l.start, val: fmt.Sprintf(format, args...)})
 	return nil
 }
 
-// nextItem returns the next item from the input.
+// send queues an item for the client, sending the queue once it holds a
+// whole batch.  Synchronous lexers keep the queue for nextItem.
+func (l *lexer) send(i item) {
+	i.line, i.col = l.position(i.pos)
+	l.pending = append(l.pending, i)
+	if l.items != nil && len(l.pending) >= l.BatchSize {
+		l.flush()
+	}
+}
+
+// flush sends any queued items to the client.
+func (l *lexer) flush() {
+	if len(l.pending) > 0 {
+		l.items <- l.pending
+		l.pending = make([]item, 0, l.BatchSize)
+	}
+}
+
+// nextItem returns the next item from the input.  Synchronous lexers run
+// their states until there is an item to return.
 func (l *lexer) nextItem() item {
-	item := <-l.items
-	l.lastPos = item.pos
+	for len(l.received) == 0 {
+		if l.items == nil {
+			if l.state == nil && len(l.pending) == 0 {
+				return item{}
+			}
+			if l.state != nil {
+				l.state = l.state(l)
+			}
+			l.received, l.pending = l.pending, l.received[:0]
+			continue
+		}
+		batch, ok := <-l.items
+		if !ok {
+			return item{}
+		}
+		l.received = batch
+	}
+	item := l.received[0]
+	l.received = l.received[1:]
+	l.last = item
 	return item
 }
 
@@ -270,9 +429,127 @@ func (l *lexer) run() {
 	for l.state = lexText; l.state != nil; {
 		l.state = l.state(l)
 	}
+	l.flush()
 	close(l.items)
 }
 
+// A Lexer scans template source into tokens on demand.  Unlike the lexer
+// used to parse templates, it runs in the caller's goroutine rather than
+// starting its own, so it can be abandoned at any point.
+type Lexer struct {
+	l *lexer
+}
+
+// NewLexer returns a Lexer for input with the environment's syntax and
+// lexer settings, such as its delimiters, LineCommentPrefix and TrimBlocks,
+// so it scans input as the environment's templates are scanned.
+func (e *Environment) NewLexer(input string) *Lexer {
+	return &Lexer{newSyncLexer(e.lexerCfg(), input, "", "")}
+}
+
+// Next scans and returns the next token.  After the TokenEOF or TokenError
+// token, it returns the zero Token.
+func (x *Lexer) Next() Token {
+	i := x.l.nextItem()
+	if i == (item{}) {
+		return Token{}
+	}
+	return i.token()
+}
+
+// A Token is a token scanned by a Lexer.
+type Token struct {
+	Type TokenType
+	Val  string // the source of the token, or the message of a TokenError.
+	Line int    // the line of the token's start, starting at 1.
+	Col  int    // the column of the token's start, in runes, starting at 1.
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%d:%d %s %q", t.Line, t.Col, t.Type, t.Val)
+}
+
+// TokenType is the type of a Token.
+type TokenType int
+
+const (
+	TokenEOF TokenType = iota
+	TokenError
+	TokenText
+	TokenBlockBegin
+	TokenBlockEnd
+	TokenVariableBegin
+	TokenVariableEnd
+	TokenCommentBegin
+	TokenComment
+	TokenCommentEnd
+	TokenRawBegin
+	TokenRawEnd
+	TokenLineStatementBegin
+	TokenLineStatementEnd
+	TokenLineComment
+	TokenWhitespace
+	TokenName
+	TokenKeyword // eg. `if` or `and`
+	TokenString
+	TokenInteger
+	TokenFloat
+	TokenBool
+	TokenNone
+	TokenOperator // eg. `+` or `(`
+)
+
+var tokenTypeNames = [...]string{
+	"EOF", "Error", "Text", "BlockBegin", "BlockEnd", "VariableBegin",
+	"VariableEnd", "CommentBegin", "Comment", "CommentEnd", "RawBegin",
+	"RawEnd", "LineStatementBegin", "LineStatementEnd", "LineComment",
+	"Whitespace", "Name", "Keyword", "String", "Integer", "Float", "Bool",
+	"None", "Operator",
+}
+
+func (t TokenType) String() string {
+	if t < 0 || int(t) >= len(tokenTypeNames) {
+		return fmt.Sprintf("TokenType(%d)", int(t))
+	}
+	return tokenTypeNames[t]
+}
+
+// tokenTypes are the TokenTypes of the item types other than operators.
+var tokenTypes = map[itemType]TokenType{
+	tokenEOF:                TokenEOF,
+	tokenError:              TokenError,
+	tokenText:               TokenText,
+	tokenBlockBegin:         TokenBlockBegin,
+	tokenBlockEnd:           TokenBlockEnd,
+	tokenVariableBegin:      TokenVariableBegin,
+	tokenVariableEnd:        TokenVariableEnd,
+	tokenCommentBegin:       TokenCommentBegin,
+	tokenComment:            TokenComment,
+	tokenCommentEnd:         TokenCommentEnd,
+	tokenRawBegin:           TokenRawBegin,
+	tokenRawEnd:             TokenRawEnd,
+	tokenLinestatementBegin: TokenLineStatementBegin,
+	tokenLinestatementEnd:   TokenLineStatementEnd,
+	tokenLinecomment:        TokenLineComment,
+	tokenWhitespace:         TokenWhitespace,
+	tokenName:               TokenName,
+	tokenKeyword:            TokenKeyword,
+	tokenString:             TokenString,
+	tokenInteger:            TokenInteger,
+	tokenFloat:              TokenFloat,
+	tokenBool:               TokenBool,
+	tokenNone:               TokenNone,
+}
+
+// token returns the item as a Token.
+func (i item) token() Token {
+	typ, ok := tokenTypes[i.typ]
+	if !ok {
+		typ = TokenOperator
+	}
+	return Token{Type: typ, Val: i.val, Line: i.line, Col: i.col}
+}
+
 // conditionally emit the current text token
 func (l *lexer) emitText() {
 	if l.pos > l.start {
@@ -280,6 +557,37 @@ func (l *lexer) emitText() {
 	}
 }
 
+// emitTextBefore emits the text before the start delimiter delim.  If the
+// delimiter is followed by the trim marker `-`, trailing whitespace is
+// removed from the text.  Otherwise, if lstrip is set and the delimiter is
+// preceded only by spaces and tabs on its line, they are removed.
+func (l *lexer) emitTextBefore(delim string, lstrip bool) {
+	text := l.input[l.start:l.pos]
+	switch {
+	case strings.HasPrefix(l.input[l.pos+Pos(len(delim)):], "-"):
+		text = strings.TrimRightFunc(text, unicode.IsSpace)
+	case lstrip:
+		line := text[strings.LastIndexByte(text, '\n')+1:]
+		atLineStart := len(line) < len(text) || l.start == 0 || l.input[l.start-1] == '\n'
+		if atLineStart && strings.Trim(line, " \t") == "" {
+			text = text[:len(text)-len(line)]
+		}
+	}
+	if len(text) > 0 {
+		l.send(item{typ: tokenText, pos: l.start, val: text})
+	}
+	l.ignore()
+}
+
+// trimSpace skips the whitespace which follows a right delimiter with the
+// trim marker `-`.
+func (l *lexer) trimSpace() {
+	for r := l.peek(); r != eof && unicode.IsSpace(r); r = l.peek() {
+		l.next()
+	}
+	l.ignore()
+}
+
 // emit the left delimiter
 func (l *lexer) emitLeft() {
 	switch l.leftDelim {
@@ -292,6 +600,11 @@ func (l *lexer) emitLeft() {
 
 // emit the right delimiter
 func (l *lexer) emitRight() {
+	if l.lineStatement {
+		l.lineStatement = false
+		l.emit(tokenLinestatementEnd)
+		return
+	}
 	switch l.rightDelim {
 	case l.BlockEndString:
 		l.emit(tokenBlockEnd)
@@ -300,6 +613,20 @@ func (l *lexer) emitRight() {
 	}
 }
 
+// trimNewline skips a single newline, either `\n` or `\r\n`, if the input
+// continues with one.
+func (l *lexer) trimNewline() {
+	switch {
+	case strings.HasPrefix(l.input[l.pos:], "\r\n"):
+		l.pos += 2
+	case strings.HasPrefix(l.input[l.pos:], "\n"):
+		l.pos++
+	default:
+		return
+	}
+	l.ignore()
+}
+
 // atTerminator reports whether the input is at valid termination character to
 // appear after an identifier. Breaks .X.Y into two pieces.
 func (l *lexer) atTerminator() bool {
@@ -309,7 +636,7 @@ func (l *lexer) atTerminator() bool {
 	}
 	// if r is an operator...
 	switch r {
-	case eof, '.', ',', '|', ':', ')', '(', '+', '/', '~', '{', '}', '-', '%', '*', '=', '!', '&':
+	case eof, '.', ',', '|', ':', ')', '(', '+', '/', '~', '{', '}', '[', ']', '-', '%', '*', '=', '!', '&', '<', '>':
 		return true
 	}
 
@@ -327,10 +654,23 @@ func lexText(l *lexer) stateFn {
 		if l.pos == Pos(len(l.input)) {
 			break
 		}
+		if l.escapedDelim(l.BlockStartString) || l.escapedDelim(l.VariableStartString) {
+			continue
+		}
+		if l.atLineComment() {
+			return lexLineComment
+		}
+		if l.atLineStatement() {
+			return lexLineStatement
+		}
 		switch l.input[l.pos] {
 		case l.BlockStartString[0]:
+			if l.tagLen(l.input[l.pos:], "raw") > 0 {
+				l.emitTextBefore(l.BlockStartString, l.LstripBlocks)
+				return lexRaw
+			}
 			if strings.HasPrefix(l.input[l.pos:], l.BlockStartString) {
-				l.emitText()
+				l.emitTextBefore(l.BlockStartString, l.LstripBlocks)
 				l.leftDelim = l.BlockStartString
 				l.rightDelim = l.BlockEndString
 				return lexBlock
@@ -338,7 +678,7 @@ func lexText(l *lexer) stateFn {
 			fallthrough
 		case l.VariableStartString[0]:
 			if strings.HasPrefix(l.input[l.pos:], l.VariableStartString) {
-				l.emitText()
+				l.emitTextBefore(l.VariableStartString, false)
 				l.leftDelim = l.VariableStartString
 				l.rightDelim = l.VariableEndString
 				return lexBlock
@@ -346,7 +686,7 @@ func lexText(l *lexer) stateFn {
 			fallthrough
 		case l.CommentStartString[0]:
 			if strings.HasPrefix(l.input[l.pos:], l.CommentStartString) {
-				l.emitText()
+				l.emitTextBefore(l.CommentStartString, l.LstripBlocks)
 				return lexComment
 			}
 			fallthrough
@@ -362,41 +702,215 @@ func lexText(l *lexer) stateFn {
 	return nil
 }
 
+// escapedDelim reports whether the input is at a doubled delim, which is
+// emitted as text containing a single delim if DoubledDelimiters is set.
+func (l *lexer) escapedDelim(delim string) bool {
+	if !l.DoubledDelimiters || !strings.HasPrefix(l.input[l.pos:], delim+delim) {
+		return false
+	}
+	l.pos += Pos(len(delim))
+	l.emitText()
+	l.pos += Pos(len(delim))
+	l.ignore()
+	return true
+}
+
+// atLineStatement reports whether the input is at the start of a line which
+// begins with the line statement prefix.  If so, the text before the line is
+// emitted and the position is left at the prefix, skipping the spaces and tabs
+// before it.
+func (l *lexer) atLineStatement() bool {
+	if l.LineStatementPrefix == "" || (l.pos > 0 && l.input[l.pos-1] != '\n') {
+		return false
+	}
+	line := l.input[l.pos:]
+	indent := len(line) - len(strings.TrimLeft(line, " \t"))
+	if !strings.HasPrefix(line[indent:], l.LineStatementPrefix) {
+		return false
+	}
+	if l.LineCommentPrefix != "" && strings.HasPrefix(line[indent:], l.LineCommentPrefix) {
+		return false
+	}
+	l.emitText()
+	l.pos += Pos(indent)
+	l.ignore()
+	return true
+}
+
+// lexLineStatement scans a line statement, which is lexed like a block tag
+// ending at the end of the line.  Newlines inside brackets continue the
+// statement onto the next line.
+func lexLineStatement(l *lexer) stateFn {
+	l.pos += Pos(len(l.LineStatementPrefix))
+	l.emit(tokenLinestatementBegin)
+	l.lineStatement = true
+	l.leftDelim = l.LineStatementPrefix
+	l.rightDelim = "\n"
+	return lexInsideBlock
+}
+
+// atLineComment reports whether the input is at the line comment prefix.  If
+// so, the text before it is emitted without the spaces and tabs which precede
+// the comment.
+func (l *lexer) atLineComment() bool {
+	if l.LineCommentPrefix == "" || !strings.HasPrefix(l.input[l.pos:], l.LineCommentPrefix) {
+		return false
+	}
+	if text := strings.TrimRight(l.input[l.start:l.pos], " \t"); len(text) > 0 {
+		l.send(item{typ: tokenText, pos: l.start, val: text})
+	}
+	l.ignore()
+	return true
+}
+
+// lexLineComment scans a line comment up to the end of the line.  If the
+// comment is all there is on its line, the line's newline is also dropped, so
+// it leaves no blank line.
+func lexLineComment(l *lexer) stateFn {
+	before := strings.TrimRight(l.input[:l.pos], " \t")
+	ownLine := before == "" || strings.HasSuffix(before, "\n")
+	end := strings.IndexByte(l.input[l.pos:], '\n')
+	if end < 0 {
+		end = len(l.input) - int(l.pos)
+	}
+	l.pos += Pos(end)
+	if strings.HasSuffix(l.input[l.start:l.pos], "\r") {
+		l.pos--
+	}
+	l.emit(tokenLinecomment)
+	if ownLine {
+		l.trimNewline()
+	}
+	return lexText
+}
+
+// atLineStatementEnd reports whether the input is at the newline ending a
+// line statement.
+func (l *lexer) atLineStatementEnd() bool {
+	return l.lineStatement && len(l.delimStack) == 0 && l.peek() == '\n'
+}
+
+// tagLen returns the length of the block tag with only the keyword name at the
+// start of s, eg. `{% raw %}` or `{%- endraw -%}`, or 0 if s does not start
+// with the tag.
+func (l *lexer) tagLen(s, name string) int {
+	if !strings.HasPrefix(s, l.BlockStartString) {
+		return 0
+	}
+	rest := strings.TrimPrefix(s[len(l.BlockStartString):], "-")
+	rest = strings.TrimLeft(rest, " \t\r\n")
+	if !strings.HasPrefix(rest, name) {
+		return 0
+	}
+	rest = strings.TrimLeft(rest[len(name):], " \t\r\n")
+	rest = strings.TrimPrefix(rest, "-")
+	if !strings.HasPrefix(rest, l.BlockEndString) {
+		return 0
+	}
+	return len(s) - len(rest) + len(l.BlockEndString)
+}
+
+// lexRaw scans a raw block, from `{% raw %}` to the first `{% endraw %}`,
+// whose body is emitted as text without interpreting any tags in it.  Trim
+// markers and TrimBlocks apply to the raw tags as to any other block tag.
+func lexRaw(l *lexer) stateFn {
+	begin := l.pos
+	n := Pos(l.tagLen(l.input[l.pos:], "raw"))
+	l.pos += n
+	l.emit(tokenRawBegin)
+	l.trimAfterTag(l.input[begin : begin+n])
+	for i := l.pos; ; {
+		j := strings.Index(l.input[i:], l.BlockStartString)
+		if j < 0 {
+			l.start = begin
+			return l.errorf("unclosed raw block, expected %sendraw%s", l.BlockStartString, l.BlockEndString)
+		}
+		i += Pos(j)
+		n := Pos(l.tagLen(l.input[i:], "endraw"))
+		if n == 0 {
+			i += Pos(len(l.BlockStartString))
+			continue
+		}
+		text := l.input[l.start:i]
+		if l.input[i+Pos(len(l.BlockStartString))] == '-' {
+			text = strings.TrimRightFunc(text, unicode.IsSpace)
+		}
+		if len(text) > 0 {
+			l.send(item{typ: tokenText, pos: l.start, val: text})
+		}
+		l.start, l.pos = i, i+n
+		l.emit(tokenRawEnd)
+		l.trimAfterTag(l.input[i : i+n])
+		return lexText
+	}
+}
+
+// trimAfterTag skips the whitespace after the block tag tag if it ends with a
+// trim marker, or its newline if TrimBlocks is set.
+func (l *lexer) trimAfterTag(tag string) {
+	switch {
+	case strings.HasSuffix(tag, "-"+l.BlockEndString):
+		l.trimSpace()
+	case l.TrimBlocks:
+		l.trimNewline()
+	}
+}
+
 func lexBlock(l *lexer) stateFn {
 	l.pos += Pos(len(l.leftDelim))
+	// a trim marker is part of the delimiter
+	l.accept("-")
 	l.emitLeft()
 	return lexInsideBlock
-
-	return lexText
 }
 
 func lexInsideBlock(l *lexer) stateFn {
 	for {
 		if l.pos == Pos(len(l.input)) {
-			return nil
+			if l.lineStatement {
+				l.emitRight()
+				return lexText
+			}
+			return l.errorf("unclosed tag, expected %s", l.rightDelim)
+		}
+		if l.atLineStatementEnd() {
+			l.next()
+			l.emitRight()
+			return lexText
 		}
 		// if this is the rightDelim, but we are expecting the next char as a delimiter
 		// then skip marking this as rightDelim.  This allows us to have, eg, '}}' as
 		// part of a literal inside a var block.
-		if strings.HasPrefix(l.input[l.pos:], l.rightDelim) && !l.shouldExpectDelim(l.peek()) {
+		if !l.lineStatement && strings.HasPrefix(l.input[l.pos:], "-"+l.rightDelim) && !l.shouldExpectDelim(l.peek()) {
+			l.pos += Pos(1 + len(l.rightDelim))
+			l.emitRight()
+			l.trimSpace()
+			return lexText
+		}
+		if !l.lineStatement && strings.HasPrefix(l.input[l.pos:], l.rightDelim) && !l.shouldExpectDelim(l.peek()) {
 			l.pos += Pos(len(l.rightDelim))
 			l.emitRight()
+			if l.TrimBlocks && l.rightDelim == l.BlockEndString {
+				l.trimNewline()
+			}
 			return lexText
 		}
 		// take the next rune and see what it is
 		r := l.next()
 
 		switch {
-		case isSpace(r):
+		case isSpace(r), isEndOfLine(r):
 			return lexSpace
 		case isNumeric(r):
 			return lexNumber
 		case isAlphaNumeric(r):
 			return lexIdentifier
-		case r == '"':
+		case r == '"', r == '\'':
+			l.quote = r
 			l.ignore()
 			return lexString
 		case r == '`':
+			l.quote = r
 			l.ignore()
 			return lexRawString
 		}
@@ -404,6 +918,8 @@ func lexInsideBlock(l *lexer) stateFn {
 		switch r {
 		case ',':
 			l.emit(tokenComma)
+		case '.':
+			l.emit(tokenDot)
 		case '|':
 			if l.accept("|") {
 				l.emit(tokenOr)
@@ -416,6 +932,8 @@ func lexInsideBlock(l *lexer) stateFn {
 			l.emit(tokenSub)
 		case '~':
 			l.emit(tokenTilde)
+		case '%':
+			l.emit(tokenMod)
 		case ':':
 			l.emit(tokenColon)
 		case '/':
@@ -488,8 +1006,10 @@ func lexInsideBlock(l *lexer) stateFn {
 	}
 }
 
+// lexSpace scans a run of whitespace inside an action, where newlines are
+// treated like any other space so that actions may span lines.
 func lexSpace(l *lexer) stateFn {
-	for isSpace(l.peek()) {
+	for r := l.peek(); (isSpace(r) || isEndOfLine(r)) && !l.atLineStatementEnd(); r = l.peek() {
 		l.next()
 	}
 	l.emit(tokenWhitespace)
@@ -507,10 +1027,9 @@ func lexIdentifier(l *lexer) stateFn {
 			if !l.atTerminator() {
 				return l.errorf("bad character %#U", r)
 			}
-			switch word {
-			case "true", "false":
-				l.emit(tokenBool)
-			default:
+			if typ, ok := keywords[word]; ok {
+				l.emit(typ)
+			} else {
 				l.emit(tokenName)
 			}
 			return lexInsideBlock
@@ -519,23 +1038,85 @@ func lexIdentifier(l *lexer) stateFn {
 }
 
 func lexNumber(l *lexer) stateFn {
+	if l.input[l.start] == '0' && l.accept("xXoObB") {
+		return lexRadixNumber
+	}
 	tokType := tokenInteger
+scan:
 	for {
 		switch r := l.next(); {
-		case isNumeric(r):
+		case isNumeric(r), r == '_':
 			// abosrb
 		case r == '.':
 			if tokType != tokenFloat {
 				tokType = tokenFloat
 			} else {
-				l.errorf("two dots in numeric token")
+				return l.errorf("two dots in numeric token")
 			}
+		case r == 'e', r == 'E':
+			tokType = tokenFloat
+			l.accept("+-")
+			if !isNumeric(l.peek()) {
+				return l.errorf("missing exponent in numeric literal %q", l.input[l.start:l.pos])
+			}
+			l.acceptRun(decimalDigits + "_")
+			break scan
 		default:
 			l.backup()
-			l.emit(tokType)
-			return lexInsideBlock
+			break scan
 		}
 	}
+	if misplacedSeparator(l.input[l.start:l.pos], decimalDigits) {
+		return l.errorf("invalid underscore in numeric literal %q", l.input[l.start:l.pos])
+	}
+	l.emit(tokType)
+	return lexInsideBlock
+}
+
+// misplacedSeparator reports whether the numeric literal lit has an
+// underscore which is not between two of the digits in digits.
+func misplacedSeparator(lit, digits string) bool {
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(lit)-1 || strings.IndexByte(digits, lit[i-1]) < 0 || strings.IndexByte(digits, lit[i+1]) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+const decimalDigits = "0123456789"
+
+// radixes are the bases of integer literals by their prefix letter.
+var radixes = map[byte]struct {
+	name   string
+	digits string
+}{
+	'x': {"hexadecimal", "0123456789abcdefABCDEF"},
+	'o': {"octal", "01234567"},
+	'b': {"binary", "01"},
+}
+
+// lexRadixNumber scans the digits of an integer literal after its `0x`, `0o`
+// or `0b` prefix.
+func lexRadixNumber(l *lexer) stateFn {
+	radix := radixes[l.input[l.start+1]|0x20]
+	l.acceptRun(radix.digits + "_")
+	// an underscore may also separate the prefix from the digits
+	digits := strings.TrimPrefix(l.input[l.start+2:l.pos], "_")
+	if r := l.peek(); len(digits) == 0 || isAlphaNumeric(r) {
+		for isAlphaNumeric(l.next()) {
+		}
+		l.backup()
+		return l.errorf("invalid %s literal %q", radix.name, l.input[l.start:l.pos])
+	}
+	if misplacedSeparator(digits, radix.digits) {
+		return l.errorf("invalid underscore in numeric literal %q", l.input[l.start:l.pos])
+	}
+	l.emit(tokenInteger)
+	return lexInsideBlock
 }
 
 // Called at the end of a string
@@ -546,12 +1127,73 @@ func (l *lexer) emitString() {
 	l.ignore()
 }
 
+// lexString scans a string quoted with single or double quotes.  The quote
+// it started with may appear in it if escaped with a backslash;  the other
+// kind of quote is literal.
 func lexString(l *lexer) stateFn {
-	var prev rune
-	for r := l.next(); r != '"' || prev == '\\'; r, prev = l.next(), r {
+	for {
+		switch l.next() {
+		case '\\':
+			if l.next() == eof {
+				return l.errorf("unterminated string")
+			}
+		case eof:
+			return l.errorf("unterminated string")
+		case l.quote:
+			l.backup()
+			val, err := unescape(l.input[l.start:l.pos])
+			if err != nil {
+				return l.errorf("%s", err)
+			}
+			l.send(item{typ: tokenString, pos: l.start, val: val})
+			l.next()
+			l.ignore()
+			return lexInsideBlock
+		}
 	}
-	l.emitString()
-	return lexInsideBlock
+}
+
+// unescape decodes the escape sequences `\n`, `\t`, `\r`, `\\`, `\"`, `\'`
+// and `\uXXXX` in the body of a quoted string.
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("invalid escape sequence %q", s[i-1:])
+		}
+		switch c := s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\', '"', '\'':
+			b.WriteByte(c)
+		case 'u':
+			if i+5 > len(s) {
+				return "", fmt.Errorf("invalid escape sequence %q", s[i-1:])
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape sequence %q", s[i-1:i+5])
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			_, w := utf8.DecodeRuneInString(s[i:])
+			return "", fmt.Errorf("invalid escape sequence %q", s[i-1:i+w])
+		}
+	}
+	return b.String(), nil
 }
 
 func lexRawString(l *lexer) stateFn {
@@ -561,20 +1203,45 @@ func lexRawString(l *lexer) stateFn {
 	return lexInsideBlock
 }
 
+// lexComment scans a comment, from the comment start string to the first
+// comment end string.  Nothing in a comment is interpreted, so it may contain
+// tags or delimiters.
 func lexComment(l *lexer) stateFn {
 	l.pos += Pos(len(l.CommentStartString))
-	l.emit(tokenCommentBegin)
+	l.accept("-")
+	l.emitComment(tokenCommentBegin)
 	i := strings.Index(l.input[l.pos:], l.CommentEndString)
 	if i < 0 {
 		return l.errorf("unclosed comment")
 	}
 	l.pos += Pos(i)
-	l.emitText()
+	trim := strings.HasSuffix(l.input[l.start:l.pos], "-")
+	if trim {
+		l.pos--
+	}
+	if l.pos > l.start {
+		l.emitComment(tokenComment)
+	}
+	if trim {
+		l.pos++
+	}
 	l.pos += Pos(len(l.CommentEndString))
-	l.emit(tokenCommentEnd)
+	l.emitComment(tokenCommentEnd)
+	if trim {
+		l.trimSpace()
+	}
 	return lexText
 }
 
+// emitComment emits a comment token, unless comments are skipped.
+func (l *lexer) emitComment(t itemType) {
+	if l.SkipComments {
+		l.ignore()
+		return
+	}
+	l.emit(t)
+}
+
 // -- utils --
 
 // isSpace reports whether r is a space character.
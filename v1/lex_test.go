@@ -2,6 +2,9 @@ package v1
 
 import (
 	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -22,6 +25,7 @@ var (
 	ttAdd           = tokenTest{tokenAdd, "+"}
 	ttDiv           = tokenTest{tokenDiv, "/"}
 	ttComma         = tokenTest{tokenComma, ","}
+	ttDot           = tokenTest{tokenDot, "."}
 	ttPipe          = tokenTest{tokenPipe, "|"}
 	ttLparen        = tokenTest{tokenLparen, "("}
 	ttRparen        = tokenTest{tokenRparen, ")"}
@@ -32,6 +36,7 @@ var (
 	ttColon         = tokenTest{tokenColon, ":"}
 	ttMul           = tokenTest{tokenMul, "*"}
 	ttPow           = tokenTest{tokenPow, "**"}
+	ttMod           = tokenTest{tokenMod, "%"}
 	ttFloordiv      = tokenTest{tokenFloordiv, "//"}
 	ttGt            = tokenTest{tokenGt, ">"}
 	ttLt            = tokenTest{tokenLt, "<"}
@@ -50,28 +55,41 @@ func tn(name string) tokenTest {
 	return tokenTest{tokenName, name}
 }
 
+func tk(name string) tokenTest {
+	return tokenTest{tokenKeyword, name}
+}
+
 func tt(name string) tokenTest {
 	return tokenTest{tokenText, name}
 }
 
+func tc(text string) tokenTest {
+	return tokenTest{tokenComment, text}
+}
+
 func ts(value string) tokenTest {
 	return tokenTest{tokenString, value}
 }
 
 func tokenize(l *lexer) []item {
 	items := make([]item, 0, 50)
-	for t := range l.items {
-		items = append(items, t)
-		// fmt.Printf("%#v\n", t)
+	for batch := range l.items {
+		items = append(items, batch...)
 	}
 	return items
 }
 
-type lextest struct{ *testing.T }
+type lextest struct {
+	*testing.T
+	env *Environment // if nil, a default environment is used
+}
 
 func (lt *lextest) Test(input string, tests []tokenTest) {
 	t := lt.T
-	e := NewEnvironment()
+	e := lt.env
+	if e == nil {
+		e = NewEnvironment()
+	}
 	l := e.lex(input, "test", "test.jigo")
 	tokens := tokenize(l)
 	if len(tokens) != len(tests) {
@@ -94,7 +112,7 @@ func (lt *lextest) Test(input string, tests []tokenTest) {
 }
 
 func TestLexer(t *testing.T) {
-	tester := lextest{t}
+	tester := lextest{T: t}
 
 	// Testing simple text with no jigo syntax
 	tester.Test(
@@ -105,12 +123,12 @@ func TestLexer(t *testing.T) {
 	// Testing simple text with single jigo comment
 	tester.Test(
 		`{# comment #}`,
-		[]tokenTest{ttCommentBegin, tt(" comment "), ttCommentEnd, ttEOF},
+		[]tokenTest{ttCommentBegin, tc(" comment "), ttCommentEnd, ttEOF},
 	)
 
 	tester.Test(
 		`Hello, {# comment #}World`,
-		[]tokenTest{tt("Hello, "), ttCommentBegin, tt(" comment "), ttCommentEnd, tt("World"), ttEOF},
+		[]tokenTest{tt("Hello, "), ttCommentBegin, tc(" comment "), ttCommentEnd, tt("World"), ttEOF},
 	)
 
 	tester.Test(
@@ -129,7 +147,7 @@ func TestLexer(t *testing.T) {
 	tester.Test(
 		`Hello.  {% if true %}World{% else %}Nobody{% endif %}`,
 		[]tokenTest{
-			tt("Hello.  "), ttBlockBegin, sp, tn("if"), sp,
+			tt("Hello.  "), ttBlockBegin, sp, tk("if"), sp,
 			{tokenBool, "true"}, sp, ttBlockEnd, tt("World"), ttBlockBegin, sp, tn("else"), sp,
 			ttBlockEnd, tt("Nobody"), ttBlockBegin, sp, tn("endif"), sp, ttBlockEnd, ttEOF,
 		},
@@ -138,7 +156,7 @@ func TestLexer(t *testing.T) {
 	tester.Test(
 		`<html>{# ignore {% tags %} in comments ##}</html>`,
 		[]tokenTest{
-			tt("<html>"), ttCommentBegin, tt(" ignore {% tags %} in comments #"),
+			tt("<html>"), ttCommentBegin, tc(" ignore {% tags %} in comments #"),
 			ttCommentEnd, tt("</html>"), ttEOF,
 		},
 	)
@@ -146,8 +164,9 @@ func TestLexer(t *testing.T) {
 	tester.Test(
 		`{# comment #}{% if foo -%} bar {%- elif baz %} bing{%endif    %}`,
 		[]tokenTest{
-			ttCommentBegin, tt(" comment "), ttCommentEnd, ttBlockBegin, sp, tn("if"), sp,
-			tn("foo"), sp, ttSub, ttBlockEnd, tt(" bar "), ttBlockBegin, ttSub, sp, tn("elif"),
+			ttCommentBegin, tc(" comment "), ttCommentEnd, ttBlockBegin, sp, tk("if"), sp,
+			tn("foo"), sp, {tokenBlockEnd, "-%}"}, tt("bar"),
+			{tokenBlockBegin, "{%-"}, sp, tn("elif"),
 			sp, tn("baz"), sp, ttBlockEnd, tt(" bing"), ttBlockBegin, tn("endif"), sp,
 			ttBlockEnd, ttEOF,
 		},
@@ -197,7 +216,749 @@ func TestLexer(t *testing.T) {
 		},
 	)
 
+	tester.Test(
+		`{{ data.user["user.email"] }}`,
+		[]tokenTest{
+			ttVariableBegin, sp, tn("data"), ttDot, tn("user"), ttLbracket, ts("user.email"),
+			ttRbracket, sp, ttVariableEnd, ttEOF,
+		},
+	)
+
 	st := []tokenTest{ttVariableBegin, sp, ts(`Hello, "World"`), sp, ttVariableEnd, ttEOF}
 	tester.Test("{{ `Hello, \"World\"` }}", st)
 	tester.Test(`{{ "Hello, \"World\"" }}`, st)
 }
+
+func TestDoubledDelimiters(t *testing.T) {
+	e := NewEnvironment()
+	e.DoubledDelimiters = true
+	tester := lextest{t, e}
+
+	tester.Test(`a {{{{ b`, []tokenTest{tt("a {{"), tt(" b"), ttEOF})
+	tester.Test(`{%{% raw %}`, []tokenTest{tt("{%"), tt(" raw %}"), ttEOF})
+	tester.Test(
+		`{{{{{{ x }}`,
+		[]tokenTest{tt("{{"), ttVariableBegin, sp, tn("x"), sp, ttVariableEnd, ttEOF},
+	)
+
+	fixtures := []evalFixture{
+		{"Variable", `{{{{ name }} is {{ name }}`, m{"name": "x"}, "{{ name }} is x"},
+		{"Block", `{%{% if %}`, m{}, "{% if %}"},
+		{"Quoted", `{{ "{{" }}`, m{}, "{{"},
+	}
+	testFixtures(t, e, fixtures)
+
+	// without the flag, a doubled delimiter starts an action
+	if _, err := NewEnvironment().ParseString(`{{{{ name }}`, "doubled", "doubled"); err == nil {
+		t.Errorf("Expected doubled delimiter to be an error without DoubledDelimiters")
+	}
+}
+
+func TestMultilineActions(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test("{{ a\n+\tb }}", []tokenTest{ttVariableBegin, sp, tn("a"), sp, ttAdd, sp, tn("b"), sp, ttVariableEnd, ttEOF})
+	tester.Test("{%\nif x\n%}", []tokenTest{ttBlockBegin, sp, tk("if"), sp, tn("x"), sp, ttBlockEnd, ttEOF})
+
+	ctx := m{"a": 1, "b": 1, "c": 1, "l": []int{1, 2}}
+	fixtures := []evalFixture{
+		{"Multiline if", "{% if (a ==\n      b ==\n      c) %}yes{% endif %}", ctx, "yes"},
+		{"Multiline var", "{{\n  a +\n  b\n}}", ctx, "2"},
+		{"Multiline for", "{% for x\n   in l %}{{ x }}{% endfor %}\nend", ctx, "12\nend"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	// parse errors report the line of the offending token within the action
+	_, err := NewEnvironment().ParseString("{% if (a ==\n      b ==\n      ) %}{% endif %}", "multi", "multi")
+	if err == nil || !strings.HasPrefix(err.Error(), "template: multi:3:") {
+		t.Errorf("Expected parse error on line 3, got %v", err)
+	}
+	// render errors report the line and column of the node within the action
+	tpl, err := NewEnvironment().ParseString("{% if (a ==\n      b ==\n      c|nosuch) %}{% endif %}", "multi", "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "multi:3:6") {
+		t.Errorf("Expected render error at 3:6, got %v", err)
+	}
+}
+
+func TestTrimBlocks(t *testing.T) {
+	e := NewEnvironment()
+	e.TrimBlocks = true
+	tester := lextest{t, e}
+	tester.Test("{% if x %}\na", []tokenTest{ttBlockBegin, sp, tk("if"), sp, tn("x"), sp, ttBlockEnd, tt("a"), ttEOF})
+	tester.Test("{% if x %}\r\na", []tokenTest{ttBlockBegin, sp, tk("if"), sp, tn("x"), sp, ttBlockEnd, tt("a"), ttEOF})
+	tester.Test("{% if x %}", []tokenTest{ttBlockBegin, sp, tk("if"), sp, tn("x"), sp, ttBlockEnd, ttEOF})
+	tester.Test("{{ x }}\na", []tokenTest{ttVariableBegin, sp, tn("x"), sp, ttVariableEnd, tt("\na"), ttEOF})
+
+	ctx := m{"l": []int{1, 2}, "x": "v"}
+	fixtures := []evalFixture{
+		{"Block tags", "{% for i in l %}\n{{ i }}\n{% endfor %}\n", ctx, "1\n2\n"},
+		{"Only first newline", "{% if true %}\n\nyes{% endif %}", ctx, "\nyes"},
+		{"CRLF", "{% if true %}\r\nyes\r\n{% endif %}\r\n", ctx, "yes\r\n"},
+		{"Spaces before newline", "{% if true %} \nyes{% endif %}", ctx, " \nyes"},
+		{"Variable tags", "{{ x }}\n{{ x }}\n", ctx, "v\nv\n"},
+		{"End of file", "a{% if true %}{% endif %}", ctx, "a"},
+	}
+	testFixtures(t, e, fixtures)
+
+	// without trim_blocks, every newline is kept
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Untrimmed", "{% for i in l %}\n{{ i }}\n{% endfor %}\n", ctx, "\n1\n\n2\n\n"},
+	})
+}
+
+func TestTrimMarkers(t *testing.T) {
+	e := NewEnvironment()
+	tester := lextest{t, e}
+	tester.Test("a \n\t{%- if x -%}\t\n b", []tokenTest{
+		tt("a"), {tokenBlockBegin, "{%-"}, sp, tk("if"), sp, tn("x"), sp,
+		{tokenBlockEnd, "-%}"}, tt("b"), ttEOF,
+	})
+	tester.Test("  {%- if x -%}  ", []tokenTest{
+		{tokenBlockBegin, "{%-"}, sp, tk("if"), sp, tn("x"), sp, {tokenBlockEnd, "-%}"}, ttEOF,
+	})
+	tester.Test("  {{- x -}}  ", []tokenTest{
+		{tokenVariableBegin, "{{-"}, sp, tn("x"), sp, {tokenVariableEnd, "-}}"}, ttEOF,
+	})
+	tester.Test("{{ x - 1 }}", []tokenTest{
+		ttVariableBegin, sp, tn("x"), sp, ttSub, sp, {tokenInteger, "1"}, sp, ttVariableEnd, ttEOF,
+	})
+
+	ctx := m{"x": true, "l": []int{1, 2}}
+	testFixtures(t, e, []evalFixture{
+		{"Both sides", "a  {%- if x -%}  b  {%- endif -%}  c", ctx, "abc"},
+		{"Collapse", "  {%- if x -%}  {{ 1 }}  {%- endif -%}  ", ctx, "1"},
+		{"Newlines and tabs", "a\n\n \t{%- if x %}\t\n\nb{% endif -%}\n\n\t \nc", ctx, "a\t\n\nbc"},
+		{"Variables", "< {{- 1 -}} >", ctx, "<1>"},
+		{"Comments", "a\n {#- note -#}\n b", ctx, "ab"},
+		{"Start of template", "{%- if x %} a{% endif %}", ctx, " a"},
+		{"End of template", "{% if x %}a {% endif -%}", ctx, "a "},
+		{"Loops", "{% for i in l -%}\n  {{ i }}\n{%- endfor %}", ctx, "12"},
+		{"Subtraction", "{{ 3 - 1 -}} !", ctx, "2!"},
+	})
+}
+
+func TestLstripBlocks(t *testing.T) {
+	e := NewEnvironment()
+	e.LstripBlocks = true
+	e.TrimBlocks = true
+	ctx := m{"l": []int{1, 2}}
+	testFixtures(t, e, []evalFixture{
+		{"Indented tags", "<ul>\n  {% for i in l %}\n\t<li>{{ i }}</li>\n  {% endfor %}\n</ul>", ctx, "<ul>\n\t<li>1</li>\n\t<li>2</li>\n</ul>"},
+		{"Start of template", "  {% if true %}yes{% endif %}", ctx, "yes"},
+		{"Text before tag", "a {% if true %}yes{% endif %}", ctx, "a yes"},
+		{"Variables", "  {{ 1 }}", ctx, "  1"},
+		{"Comments", "a\n  {# note #}\nb", ctx, "a\n\nb"},
+	})
+}
+
+func TestLineStatements(t *testing.T) {
+	e := NewEnvironment()
+	e.LineStatementPrefix = "#"
+	tester := lextest{t, e}
+	tester.Test("a\n  # if x\nb", []tokenTest{
+		tt("a\n"), {tokenLinestatementBegin, "#"}, sp, tk("if"), sp, tn("x"),
+		{tokenLinestatementEnd, "\n"}, tt("b"), ttEOF,
+	})
+	tester.Test("a # b", []tokenTest{tt("a # b"), ttEOF})
+	tester.Test("# endif", []tokenTest{
+		{tokenLinestatementBegin, "#"}, sp, tn("endif"), {tokenLinestatementEnd, ""}, ttEOF,
+	})
+	tester.Test("# set x = (1,\n 2)\n", []tokenTest{
+		{tokenLinestatementBegin, "#"}, sp, tn("set"), sp, tn("x"), sp, ttEq, sp, ttLparen,
+		{tokenInteger, "1"}, ttComma, sp, {tokenInteger, "2"}, ttRparen, {tokenLinestatementEnd, "\n"}, ttEOF,
+	})
+
+	ctx := m{"items": []string{"a", "b"}, "x": true}
+	testFixtures(t, e, []evalFixture{
+		{"For", "# for item in items\n<{{ item }}>\n# endfor\n", ctx, "<a>\n<b>\n"},
+		{"Indented", "<ul>\n  # for item in items\n  <li>{{ item }}</li>\n  # endfor\n</ul>", ctx, "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>"},
+		{"Mixed with blocks", "# for item in items\n{% if item == \"a\" %}A{% else %}{{ item }}{% endif %}\n# endfor", ctx, "A\nb\n"},
+		{"Blocks around", "{% if x %}\n# for item in items\n{{ item }}\n# endfor\n{% endif %}", ctx, "\na\nb\n"},
+		{"Mid-line prefix", "a # not a statement\n", ctx, "a # not a statement\n"},
+		{"Prefix after tag", "{{ 1 }}# if x\n", ctx, "1# if x\n"},
+		{"Continuation", "# for item in \"c,d\"|split(\n  \",\")\n{{ item }}\n# endfor\n", ctx, "c\nd\n"},
+		{"CRLF", "# if x\r\nyes\r\n# endif\r\n", ctx, "yes\r\n"},
+	})
+
+	// without a prefix, `#` is text
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Disabled", "# if x\n", ctx, "# if x\n"},
+	})
+}
+
+func TestLineComments(t *testing.T) {
+	e := NewEnvironment()
+	tester := lextest{t, e}
+	tester.Test("a ## note\nb", []tokenTest{tt("a"), {tokenLinecomment, "## note"}, tt("\nb"), ttEOF})
+	tester.Test("## note", []tokenTest{{tokenLinecomment, "## note"}, ttEOF})
+	tester.Test(`{{ "##" }}`, []tokenTest{ttVariableBegin, sp, ts("##"), sp, ttVariableEnd, ttEOF})
+
+	ctx := m{"x": "v", "ok": true}
+	testFixtures(t, e, []evalFixture{
+		{"Comment-only lines", "a\n## note\n  ## indented\nb\n", ctx, "a\nb\n"},
+		{"Trailing comment", "a  ## note\nb", ctx, "a\nb"},
+		{"After var", "{{ x }} ## note\n", ctx, "v\n"},
+		{"At EOF", "a\n## note", ctx, "a\n"},
+		{"Trailing at EOF", "a ## note", ctx, "a"},
+		{"CRLF", "a ## note\r\n## b\r\nc", ctx, "a\r\nc"},
+		{"In string", `{{ "a ## b" }}`, ctx, "a ## b"},
+		{"Tags in comment", "a ## {{ x }} {% if %}\nb", ctx, "a\nb"},
+		{"In block comment", "{# ## #}a", ctx, "a"},
+		{"Around tags", "{% if ok %} ## yes\nyes\n{% endif %}", ctx, "\nyes\n"},
+	})
+
+	e = NewEnvironment()
+	e.LineCommentPrefix = ""
+	testFixtures(t, e, []evalFixture{
+		{"Disabled", "## heading\n", ctx, "## heading\n"},
+	})
+
+	e = NewEnvironment()
+	e.LineStatementPrefix = "#"
+	testFixtures(t, e, []evalFixture{
+		{"With line statements", "# if ok\n  ## note\nyes ## note\n# endif\n", ctx, "yes\n"},
+	})
+}
+
+func TestRawBlocks(t *testing.T) {
+	e := NewEnvironment()
+	tester := lextest{t, e}
+	tester.Test("a{% raw %}{{ x }}{% if %}{% endraw %}b", []tokenTest{
+		tt("a"), {tokenRawBegin, "{% raw %}"}, tt("{{ x }}{% if %}"), {tokenRawEnd, "{% endraw %}"}, tt("b"), ttEOF,
+	})
+	tester.Test("{%raw%}{%endraw%}", []tokenTest{{tokenRawBegin, "{%raw%}"}, {tokenRawEnd, "{%endraw%}"}, ttEOF})
+	tester.Test("{% raw %}\n{% endraw", []tokenTest{{tokenRawBegin, "{% raw %}"}, {tokenError, "unclosed raw block, expected {%endraw%}"}})
+
+	ctx := m{"x": 1}
+	testFixtures(t, e, []evalFixture{
+		{"Verbatim", "{% raw %}{{ x }} {% for %} {# c #}{% endraw %}", ctx, "{{ x }} {% for %} {# c #}"},
+		{"Nested raw", "{% raw %}{% raw %}{% endraw %}{{ x }}", ctx, "{% raw %}1"},
+		{"Non-matching", "{% raw %}{% endrawx %}{%end raw%}{% endraw x %}{% endraw %}", ctx, "{% endrawx %}{%end raw%}{% endraw x %}"},
+		{"Unclosed delimiters", "{% raw %}{{ {% {#{% endraw %}", ctx, "{{ {% {#"},
+		{"Trim markers", "a {%- raw -%} {{ x }} {%- endraw -%} b", ctx, "a{{ x }}b"},
+		{"Around tags", "{% if true %}{% raw %}{{ x }}{% endraw %}{% endif %}", ctx, "{{ x }}"},
+		{"Comment before end tag", "{% if true %}{% raw %}{{ x }}{% endraw %}{# c #}{% endif %}", ctx, "{{ x }}"},
+		{"Line comment", "{% raw %}## {{ x }}{% endraw %}", ctx, "## {{ x }}"},
+	})
+
+	e = NewEnvironment()
+	e.TrimBlocks = true
+	testFixtures(t, e, []evalFixture{
+		{"Trim blocks", "{% raw %}\n{{ x }}\n{% endraw %}\n.", ctx, "{{ x }}\n."},
+	})
+
+	_, err := NewEnvironment().ParseString("line 1\n{% raw %}\n{{ x }}\n", "raw", "raw")
+	if err == nil || !strings.Contains(err.Error(), "raw:2:1: unclosed raw block") {
+		t.Errorf("Expected unclosed raw block error on line 2, got %v", err)
+	}
+}
+
+func TestUnclosedTag(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test("a{{ x", []tokenTest{tt("a"), {tokenVariableBegin, "{{"}, sp, tn("x"), {tokenError, "unclosed tag, expected }}"}})
+	tester.Test("{% if x ", []tokenTest{{tokenBlockBegin, "{%"}, sp, tk("if"), sp, tn("x"), sp, {tokenError, "unclosed tag, expected %}"}})
+	tester.Test("{{- ", []tokenTest{{tokenVariableBegin, "{{-"}, sp, {tokenError, "unclosed tag, expected }}"}})
+
+	// a line statement ends at the end of the input
+	e := NewEnvironment()
+	e.LineStatementPrefix = "#"
+	if _, err := e.ParseString("# if true\nyes\n# endif", "line", "line"); err != nil {
+		t.Errorf("Expected a line statement to close at EOF, got %v", err)
+	}
+
+	_, err := NewEnvironment().ParseString("a\n{{ x }}{{ y", "tag", "tag")
+	if err == nil || !strings.Contains(err.Error(), "tag:2:") || !strings.Contains(err.Error(), "unclosed tag, expected }}") {
+		t.Errorf("Expected an unclosed tag error on line 2, got %v", err)
+	}
+}
+
+func TestComments(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test("{##}", []tokenTest{ttCommentBegin, ttCommentEnd, ttEOF})
+	tester.Test("a{# {{ x }} %} {% if #}b", []tokenTest{tt("a"), ttCommentBegin, tc(" {{ x }} %} {% if "), ttCommentEnd, tt("b"), ttEOF})
+	tester.Test("a{# unclosed", []tokenTest{tt("a"), ttCommentBegin, {tokenError, "unclosed comment"}})
+
+	cfg := NewEnvironment().lexerCfg()
+	cfg.SkipComments = true
+	l := newLexer(cfg, "a{# {{ x }} #}b{#- c -#} c", "test", "test")
+	var tokens []string
+	for _, tok := range tokenize(l) {
+		tokens = append(tokens, tok.String())
+	}
+	if s := strings.Join(tokens, " "); s != `"a" "b" "c" EOF` {
+		t.Errorf("Expected skipped comments, got %s", s)
+	}
+
+	ctx := m{"x": 1}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Tags in comment", "a{# {{ x }} {% if %} #}b", ctx, "ab"},
+		{"Comment end in var", "{{ x }}{# }} #}", ctx, "1"},
+		{"Multiline", "a{# line 1\nline 2 #}b", ctx, "ab"},
+		{"Before end tag", "{% if x %}{{ x }}{# c #}{% endif %}", m{"x": true}, "true"},
+	})
+	tpl, err := NewEnvironment().ParseString("a{# {{ x }} #}b", "comment", "comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range tpl.base.Root.Nodes {
+		if text, ok := n.(*TextNode); ok && strings.ContainsAny(string(text.Text), "{}x") {
+			t.Errorf("Comment leaked into text node %q", text.Text)
+		}
+	}
+	if _, err := NewEnvironment().ParseString("a{# unclosed", "comment", "comment"); err == nil || !strings.Contains(err.Error(), "unclosed comment") {
+		t.Errorf("Expected unclosed comment error, got %v", err)
+	}
+}
+
+func TestArithmeticOperators(t *testing.T) {
+	tester := lextest{T: t}
+	ti := func(v string) tokenTest { return tokenTest{tokenInteger, v} }
+	tester.Test(`{{ 1 + 2 * 3 ** 2 }}`, []tokenTest{
+		ttVariableBegin, sp, ti("1"), sp, ttAdd, sp, ti("2"), sp, ttMul, sp, ti("3"), sp, ttPow, sp,
+		ti("2"), sp, ttVariableEnd, ttEOF,
+	})
+	tester.Test(`{{a-b/c%d//e***f}}`, []tokenTest{
+		ttVariableBegin, tn("a"), ttSub, tn("b"), ttDiv, tn("c"), ttMod, tn("d"), ttFloordiv, tn("e"),
+		ttPow, ttMul, tn("f"), ttVariableEnd, ttEOF,
+	})
+	tester.Test(`{% if x % 2 %}`, []tokenTest{
+		ttBlockBegin, sp, tk("if"), sp, tn("x"), sp, ttMod, sp, ti("2"), sp, ttBlockEnd, ttEOF,
+	})
+	tester.Test(`{{ "a" ~ 1.5 }}`, []tokenTest{
+		ttVariableBegin, sp, ts("a"), sp, {tokenTilde, "~"}, sp, {tokenFloat, "1.5"}, sp, ttVariableEnd, ttEOF,
+	})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Modulo", `{{ 7 % 3 }}`, m{}, "1"},
+		{"Modulo precedence", `{{ 1 + 7 % 3 * 2 }}`, m{}, "3"},
+		{"Modulo in block", `{% for i in l %}{% if i % 2 == 0 %}{{ i }}{% endif %}{% endfor %}`, m{"l": []int{1, 2, 3, 4}}, "24"},
+	})
+}
+
+func TestComparisonOperators(t *testing.T) {
+	tester := lextest{T: t}
+	ttNeq := tokenTest{tokenNeq, "!="}
+	for _, op := range []tokenTest{ttEqEq, ttNeq, ttLt, ttLteq, ttGt, ttGteq} {
+		tester.Test("{{ a "+op.val+" b }}", []tokenTest{
+			ttVariableBegin, sp, tn("a"), sp, op, sp, tn("b"), sp, ttVariableEnd, ttEOF,
+		})
+		tester.Test("{{a"+op.val+"b}}", []tokenTest{ttVariableBegin, tn("a"), op, tn("b"), ttVariableEnd, ttEOF})
+	}
+	tester.Test("{{ x<=-1 }}", []tokenTest{
+		ttVariableBegin, sp, tn("x"), ttLteq, ttSub, {tokenInteger, "1"}, sp, ttVariableEnd, ttEOF,
+	})
+	tester.Test("{{ x>=+1 }}", []tokenTest{
+		ttVariableBegin, sp, tn("x"), ttGteq, ttAdd, {tokenInteger, "1"}, sp, ttVariableEnd, ttEOF,
+	})
+	tester.Test("{{ x==y=z }}", []tokenTest{
+		ttVariableBegin, sp, tn("x"), ttEqEq, tn("y"), ttEq, tn("z"), sp, ttVariableEnd, ttEOF,
+	})
+	tester.Test("{{ x<>y }}", []tokenTest{
+		ttVariableBegin, sp, tn("x"), ttLt, ttGt, tn("y"), sp, ttVariableEnd, ttEOF,
+	})
+
+	ctx := m{"x": -1, "y": 0}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Lteq unary minus", `{{ x<=-1 }}`, ctx, "true"},
+		{"Lt unary minus", `{{ x<-1 }}`, ctx, "false"},
+		{"Gt unary minus", `{{ y>-1 }}`, ctx, "true"},
+		{"Neq", `{{ x!=y }}`, ctx, "true"},
+		{"EqEq", `{{ x==-1 }}`, ctx, "true"},
+	})
+}
+
+func TestQuotedStrings(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test(`{{"a"'b'}}`, []tokenTest{ttVariableBegin, ts("a"), ts("b"), ttVariableEnd, ttEOF})
+	tester.Test(`{{''""}}`, []tokenTest{ttVariableBegin, ts(""), ts(""), ttVariableEnd, ttEOF})
+	tester.Test(`{{'it\'s'"say \"hi\""}}`, []tokenTest{ttVariableBegin, ts("it's"), ts(`say "hi"`), ttVariableEnd, ttEOF})
+	tester.Test(`{{'say "hi"'"it's"}}`, []tokenTest{ttVariableBegin, ts(`say "hi"`), ts("it's"), ttVariableEnd, ttEOF})
+	tester.Test("{{'a\nb'}}", []tokenTest{ttVariableBegin, ts("a\nb"), ttVariableEnd, ttEOF})
+	tester.Test(`{{ 'a }}`, []tokenTest{ttVariableBegin, sp, {tokenError, "unterminated string"}})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Single quoted", `{{ 'a' }}`, m{}, "a"},
+		{"Empty", `{{ '' }}{{ "" }}`, m{}, ""},
+		{"Escaped quote", `{{ 'it\'s' }}`, m{}, "it's"},
+		{"Mixed quotes", `<a title='{{ 'say "hi"' }}'>`, m{}, `<a title='say "hi"'>`},
+		{"Newline", "{{ 'a\nb' }}", m{}, "a\nb"},
+		{"Compare", `{{ 'a' == "a" }}`, m{}, "true"},
+	})
+}
+
+// lexBenchSource is a template with a mix of text, tags and expressions.
+var lexBenchSource = strings.Repeat(`<ul>
+{% for user in users %}
+  <li class="{{ loop.index % 2 }}">{{ user.name|e }} ({{ user.age + 1 }}){# note #}</li>
+{% endfor %}
+</ul>
+`, 50)
+
+// lexAll pulls every item from a lexer with the given batch size, as the
+// parser does.
+func lexAll(source string, batch int) []item {
+	cfg := NewEnvironment().lexerCfg()
+	cfg.BatchSize = batch
+	l := newLexer(cfg, source, "test", "test")
+	var items []item
+	for {
+		i := l.nextItem()
+		items = append(items, i)
+		if i.typ == tokenEOF || i.typ == tokenError {
+			return items
+		}
+	}
+}
+
+func TestLexBatches(t *testing.T) {
+	sources := []string{
+		"",
+		"text",
+		lexBenchSource,
+		"{{ a }}{{ 'unterminated }}",
+		"{% raw %}{{ x }}{% endraw %}{{ y }}",
+	}
+	for _, source := range sources {
+		want := lexAll(source, 1)
+		for _, batch := range []int{0, 2, 7, lexBatchSize, 1000} {
+			if got := lexAll(source, batch); !reflect.DeepEqual(got, want) {
+				t.Errorf("batch %d of %.20q: got %v, want %v", batch, source, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkLexer(b *testing.B) {
+	for _, batch := range []int{1, lexBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			b.SetBytes(int64(len(lexBenchSource)))
+			for i := 0; i < b.N; i++ {
+				lexAll(lexBenchSource, batch)
+			}
+		})
+	}
+	b.Run("sync", func(b *testing.B) {
+		b.SetBytes(int64(len(lexBenchSource)))
+		for i := 0; i < b.N; i++ {
+			l := NewEnvironment().NewLexer(lexBenchSource)
+			for tok := l.Next(); tok.Type != TokenEOF; tok = l.Next() {
+			}
+		}
+	})
+}
+
+func TestSyncLexer(t *testing.T) {
+	sources := []string{
+		"",
+		"text",
+		lexBenchSource,
+		"{{ a }}{{ 'unterminated }}",
+		"{% raw %}{{ x }}{% endraw %}{{ y }}",
+	}
+	for _, source := range sources {
+		want := lexAll(source, 1)
+		l := NewEnvironment().NewLexer(source)
+		var got []Token
+		for {
+			tok := l.Next()
+			got = append(got, tok)
+			if tok.Type == TokenEOF || tok.Type == TokenError {
+				break
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%.20q: got %v, want %v", source, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i].token() {
+				t.Errorf("%.20q: expected token %d to be %v, got %v", source, i, want[i].token(), got[i])
+			}
+		}
+		if tok := l.Next(); tok != (Token{}) {
+			t.Errorf("%.20q: expected the zero token after the end, got %v", source, tok)
+		}
+	}
+
+	// abandoning a lexer part way through leaves no goroutine behind
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		l := NewEnvironment().NewLexer(lexBenchSource)
+		want := []TokenType{TokenText, TokenBlockBegin, TokenWhitespace}
+		for j, typ := range want {
+			if tok := l.Next(); tok.Type != typ {
+				t.Fatalf("Expected token %d to be %v, got %v", j, typ, tok)
+			}
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no new goroutines, went from %d to %d", before, after)
+	}
+
+	// nor does a parse error part way through a template
+	e := NewEnvironment()
+	for i := 0; i < 100; i++ {
+		if _, err := e.ParseString("{% if %}"+lexBenchSource, "bad", "bad"); err == nil {
+			t.Fatal("Expected a parse error")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no goroutines left by parse errors, went from %d to %d", before, after)
+	}
+}
+
+func TestLexerSettings(t *testing.T) {
+	lex := func(e *Environment, source string) []Token {
+		var toks []Token
+		l := e.NewLexer(source)
+		for tok := l.Next(); tok.Type != TokenEOF && tok.Type != TokenError; tok = l.Next() {
+			if tok.Type != TokenWhitespace {
+				toks = append(toks, tok)
+			}
+		}
+		return toks
+	}
+
+	// the environment's default line comment prefix applies
+	e := NewEnvironment()
+	toks := lex(e, "a\n## c\nb")
+	if len(toks) < 2 || toks[1].Type != TokenLineComment || toks[1].Line != 2 {
+		t.Errorf("Expected a line comment on line 2, got %v", toks)
+	}
+
+	e.TrimBlocks = true
+	toks = lex(e, "{% if x %}\nb")
+	if last := toks[len(toks)-1]; last.Type != TokenText || last.Val != "b" || last.Line != 2 {
+		t.Errorf("Expected the newline after the block to be trimmed, got %v", toks)
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tester := lextest{T: t}
+	for escape, want := range map[string]string{
+		`\n`:     "\n",
+		`\t`:     "\t",
+		`\r`:     "\r",
+		`\\`:     `\`,
+		`\"`:     `"`,
+		`\'`:     `'`,
+		`\u00e9`: "\u00e9",
+		`\u263A`: "\u263a",
+	} {
+		tester.Test(`{{"a`+escape+`b"}}`, []tokenTest{ttVariableBegin, ts("a" + want + "b"), ttVariableEnd, ttEOF})
+		tester.Test(`{{'a`+escape+`b'}}`, []tokenTest{ttVariableBegin, ts("a" + want + "b"), ttVariableEnd, ttEOF})
+	}
+	tester.Test(`{{"a\\"}}`, []tokenTest{ttVariableBegin, ts(`a\`), ttVariableEnd, ttEOF})
+	tester.Test(`{{ "\q" }}`, []tokenTest{ttVariableBegin, sp, {tokenError, `invalid escape sequence "\\q"`}})
+	tester.Test(`{{ "\u12" }}`, []tokenTest{ttVariableBegin, sp, {tokenError, `invalid escape sequence "\\u12"`}})
+	tester.Test(`{{ "\u12zz" }}`, []tokenTest{ttVariableBegin, sp, {tokenError, `invalid escape sequence "\\u12zz"`}})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Tab", `{{ "a\tb" }}`, m{}, "a\tb"},
+		{"Newline", `{{ 'a\nb' }}`, m{}, "a\nb"},
+		{"Unicode", `{{ "caf\u00e9" }}`, m{}, "caf\u00e9"},
+	})
+	if _, err := NewEnvironment().ParseString(`{{ "\q" }}`, "escape", "escape"); err == nil || !strings.Contains(err.Error(), "invalid escape") {
+		t.Errorf("Expected invalid escape error, got %v", err)
+	}
+}
+
+func TestRadixIntegers(t *testing.T) {
+	tester := lextest{T: t}
+	ti := func(v string) tokenTest { return tokenTest{tokenInteger, v} }
+	for _, lit := range []string{"0x1F", "0XfF", "0o755", "0O7", "0b1010", "0B1"} {
+		tester.Test("{{"+lit+"}}", []tokenTest{ttVariableBegin, ti(lit), ttVariableEnd, ttEOF})
+	}
+	tester.Test("{{0x1F+0b1}}", []tokenTest{ttVariableBegin, ti("0x1F"), ttAdd, ti("0b1"), ttVariableEnd, ttEOF})
+	tester.Test("{{ 0xZ }}", []tokenTest{ttVariableBegin, sp, {tokenError, `invalid hexadecimal literal "0xZ"`}})
+	tester.Test("{{ 0o78 }}", []tokenTest{ttVariableBegin, sp, {tokenError, `invalid octal literal "0o78"`}})
+	tester.Test("{{ 0b102 }}", []tokenTest{ttVariableBegin, sp, {tokenError, `invalid binary literal "0b102"`}})
+	tester.Test("{{ 0x }}", []tokenTest{ttVariableBegin, sp, {tokenError, `invalid hexadecimal literal "0x"`}})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Hexadecimal", `{{ 0x1F }}`, m{}, "31"},
+		{"Octal", `{{ 0o755 }}`, m{}, "493"},
+		{"Binary", `{{ 0b1010 }}`, m{}, "10"},
+		{"Upper case", `{{ 0XFF + 0B1 }}`, m{}, "256"},
+		{"Leading zero", `{{ 010 }}`, m{}, "10"},
+		{"Zero", `{{ 0 }}`, m{}, "0"},
+	})
+	if _, err := NewEnvironment().ParseString(`{{ 0xZ }}`, "radix", "radix"); err == nil || !strings.Contains(err.Error(), "invalid hexadecimal literal") {
+		t.Errorf("Expected invalid literal error, got %v", err)
+	}
+}
+
+func TestDigitSeparators(t *testing.T) {
+	tester := lextest{T: t}
+	for _, lit := range []string{"1_000_000", "0x_FF_FF", "0b1_0"} {
+		tester.Test("{{"+lit+"}}", []tokenTest{ttVariableBegin, {tokenInteger, lit}, ttVariableEnd, ttEOF})
+	}
+	for _, lit := range []string{"3.141_592", "1_000.5"} {
+		tester.Test("{{"+lit+"}}", []tokenTest{ttVariableBegin, {tokenFloat, lit}, ttVariableEnd, ttEOF})
+	}
+	for _, lit := range []string{"1_", "1__0", "1_.5", "1._5", "1.5_", "0x1__F", "0xF_"} {
+		tester.Test("{{ "+lit+" }}", []tokenTest{ttVariableBegin, sp, {tokenError, fmt.Sprintf("invalid underscore in numeric literal %q", lit)}})
+	}
+	// as in Python, a leading underscore starts a name
+	tester.Test("{{_1}}", []tokenTest{ttVariableBegin, tn("_1"), ttVariableEnd, ttEOF})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Integer", `{{ 1_000_000 + 1 }}`, m{}, "1000001"},
+		{"Float", `{{ 3.141_592 }}`, m{}, "3.141592"},
+		{"Hexadecimal", `{{ 0xFF_FF }}`, m{}, "65535"},
+	})
+}
+
+func TestExponents(t *testing.T) {
+	tester := lextest{T: t}
+	tf := func(v string) tokenTest { return tokenTest{tokenFloat, v} }
+	for _, lit := range []string{"6.022e23", "1E-5", "1e+5", "2.5E10", "1_000e1_0"} {
+		tester.Test("{{"+lit+"}}", []tokenTest{ttVariableBegin, tf(lit), ttVariableEnd, ttEOF})
+	}
+	tester.Test("{{1e5-1}}", []tokenTest{ttVariableBegin, tf("1e5"), ttSub, {tokenInteger, "1"}, ttVariableEnd, ttEOF})
+	tester.Test("{{ 1e }}", []tokenTest{ttVariableBegin, sp, {tokenError, `missing exponent in numeric literal "1e"`}})
+	tester.Test("{{ 1.5E+ }}", []tokenTest{ttVariableBegin, sp, {tokenError, `missing exponent in numeric literal "1.5E+"`}})
+	tester.Test("{{ 1e_5 }}", []tokenTest{ttVariableBegin, sp, {tokenError, `missing exponent in numeric literal "1e"`}})
+	tester.Test("{{ 1_e5 }}", []tokenTest{ttVariableBegin, sp, {tokenError, `invalid underscore in numeric literal "1_e5"`}})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Positive", `{{ 1.5e3 }}`, m{}, "1500"},
+		{"Negative", `{{ 25e-2 }}`, m{}, "0.25"},
+		{"Upper case", `{{ 1E2 + 1 }}`, m{}, "101"},
+		{"Float type", `{{ 1e2 is float }}`, m{}, "true"},
+	})
+}
+
+func TestKeywords(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test("{{x in y}}", []tokenTest{ttVariableBegin, tn("x"), sp, tk("in"), sp, tn("y"), ttVariableEnd, ttEOF})
+	tester.Test("{{not a and b or c}}", []tokenTest{
+		ttVariableBegin, tk("not"), sp, tn("a"), sp, tk("and"), sp, tn("b"), sp, tk("or"), sp, tn("c"), ttVariableEnd, ttEOF,
+	})
+	tester.Test("{{x is defined}}", []tokenTest{ttVariableBegin, tn("x"), sp, tk("is"), sp, tn("defined"), ttVariableEnd, ttEOF})
+	// names only match keywords in full
+	tester.Test("{{index ifx for_ is_in}}", []tokenTest{
+		ttVariableBegin, tn("index"), sp, tn("ifx"), sp, tn("for_"), sp, tn("is_in"), ttVariableEnd, ttEOF,
+	})
+	tester.Test("{{true false none None}}", []tokenTest{
+		ttVariableBegin, {tokenBool, "true"}, sp, {tokenBool, "false"}, sp,
+		{tokenNone, "none"}, sp, {tokenNone, "None"}, ttVariableEnd, ttEOF,
+	})
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Names containing keywords", `{{ index }}{{ ifx }}{{ notes }}`, m{"index": 1, "ifx": 2, "notes": 3}, "123"},
+		{"Bools", `{{ true }} {{ false }}`, m{}, "true false"},
+		{"Keyword operators", `{{ 1 in l }} {{ 2 not in l }}`, m{"l": []int{1}}, "true true"},
+	})
+}
+
+func TestItemPositions(t *testing.T) {
+	type pos struct {
+		val       string
+		line, col int
+	}
+	tests := []struct {
+		source string
+		want   []pos
+	}{
+		{"{{ a }}", []pos{{"{{", 1, 1}, {"a", 1, 4}, {"}}", 1, 6}}},
+		{"héllo {{ wörld }}", []pos{{"héllo ", 1, 1}, {"{{", 1, 7}, {"wörld", 1, 10}, {"}}", 1, 16}}},
+		{"a\r\nb {{ x }}\r\n{{ y }}", []pos{{"a\r\nb ", 1, 1}, {"{{", 2, 3}, {"x", 2, 6}, {"}}", 2, 8}, {"\r\n", 2, 10}, {"{{", 3, 1}, {"y", 3, 4}}},
+		{"日本\n語{{\n  x }}", []pos{{"日本\n語", 1, 1}, {"{{", 2, 2}, {"x", 3, 3}}},
+		{"{# a\nb #}{{ 'ü'\n}}", []pos{{"{#", 1, 1}, {"#}", 2, 3}, {"{{", 2, 5}, {"ü", 2, 9}, {"}}", 3, 1}}},
+	}
+	for _, test := range tests {
+		var got []pos
+		for _, i := range lexAll(test.source, 2) {
+			if i.typ != tokenWhitespace && i.typ != tokenEOF && i.typ != tokenComment {
+				got = append(got, pos{i.val, i.line, i.col})
+			}
+		}
+		if len(got) > len(test.want) {
+			got = got[:len(test.want)]
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected positions %v, got %v", test.source, test.want, got)
+		}
+	}
+
+	_, err := NewEnvironment().ParseString("a\r\n\r\nü {{ x + }}", "pos", "pos")
+	if err == nil || !strings.HasPrefix(err.Error(), "template: pos:3:10:") {
+		t.Errorf("Expected parse error at 3:10, got %v", err)
+	}
+}
+
+func TestNewLexerConfig(t *testing.T) {
+	cfg, err := NewLexerConfig("<%", "%>", "<{", "}>", "<#", "#>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEnvironment()
+	e.setConfig(cfg)
+	var got []Token
+	l := e.NewLexer("{a}<% if x %><{y}><# c #>")
+	for tok := l.Next(); tok.Type != TokenEOF && tok.Type != TokenError; tok = l.Next() {
+		got = append(got, tok)
+	}
+	want := []tokenTest{
+		tt("{a}"), {tokenBlockBegin, "<%"}, sp, tk("if"), sp, tn("x"), sp, {tokenBlockEnd, "%>"},
+		{tokenVariableBegin, "<{"}, tn("y"), {tokenVariableEnd, "}>"},
+		{tokenCommentBegin, "<#"}, tc(" c "), {tokenCommentEnd, "#>"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		typ := item{typ: want[i].typ}.token().Type
+		if got[i].Type != typ || (typ != TokenWhitespace && got[i].Val != want[i].val) {
+			t.Errorf("Expected token %d to be %v, got %v", i, want[i], got[i])
+		}
+	}
+	out, err := FormatSource("<%if x%><{y}><%endif%>", cfg)
+	if err != nil || out != "<% if x %><{ y }><% endif %>" {
+		t.Errorf("Expected custom delimiters to format, got %q, %v", out, err)
+	}
+
+	for _, delims := range [][6]string{
+		{"", "%>", "<{", "}>", "<#", "#>"},
+		{"<%", "%>", "<{", "", "<#", "#>"},
+		{"%%", "%%", "<{", "}>", "<#", "#>"},
+		{"<%", "%>", "<%", "}>", "<#", "#>"},
+		{"<%", "%>", "<{", "}>", "<{", "#>"},
+		{"<", ">", "<{", "}>", "<#", "#>"},
+		{"{%", "%}", "{{", "}}", "{{#", "#}}"},
+	} {
+		if _, err := NewLexerConfig(delims[0], delims[1], delims[2], delims[3], delims[4], delims[5]); err == nil {
+			t.Errorf("%q: expected an error", delims)
+		}
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	tester := lextest{T: t}
+	tester.Test("\ufeffhello", []tokenTest{tt("hello"), ttEOF})
+	tester.Test("\ufeff{{ x }}", []tokenTest{ttVariableBegin, sp, tn("x"), sp, ttVariableEnd, ttEOF})
+	// only a mark at the very start is removed
+	tester.Test("a\ufeffb", []tokenTest{tt("a\ufeffb"), ttEOF})
+	tester.Test("\ufeff\ufeffhello", []tokenTest{tt("\ufeffhello"), ttEOF})
+
+	tpl, err := NewEnvironment().ParseString("\ufeffhello {{ x }}", "bom", "bom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := tpl.base.Root.Nodes[0].(*TextNode); !ok || string(text.Text) != "hello " {
+		t.Errorf("Expected the first TextNode to be %q, got %v", "hello ", tpl.base.Root.Nodes[0])
+	}
+	if items := lexAll("\ufeff{{ x }}", 1); items[0].line != 1 || items[0].col != 1 {
+		t.Errorf("Expected the first item at 1:1, got %d:%d", items[0].line, items[0].col)
+	}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"BOM", "\ufeffhello {{ x }}", m{"x": 1}, "hello 1"},
+	})
+	e := NewEnvironment()
+	e.LineStatementPrefix = "#"
+	testFixtures(t, e, []evalFixture{
+		{"BOM line statement", "\ufeff# if x\nyes\n# endif\n", m{"x": true}, "yes\n"},
+	})
+}
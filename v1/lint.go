@@ -0,0 +1,266 @@
+package v1
+
+import "fmt"
+
+// Lint analyses a parsed template for problems which can be found without
+// rendering it, and returns a TemplateError for each.  Arithmetic on literals
+// is checked for type errors, so `{{ "a" - 1 }}` is reported at parse time
+// rather than when it is rendered.  Expressions involving variables are not
+// checked, as their types are only known when rendering.  Options enable
+// further checks.
+func Lint(t *Template, opts ...LintOption) []error {
+	l := &linter{t: t.base, consts: make(map[Node]constant)}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.scopes != nil {
+		for name := range t.env.Globals {
+			l.scopes[0][name] = "global"
+		}
+	}
+	l.walk(t.base.Root)
+	return l.errs
+}
+
+// A LintOption enables optional checks in Lint.
+type LintOption func(*linter)
+
+// WarnShadowed reports loop variables and {% set %} tags which shadow a
+// variable of the same name:  one of the context names given, a global of
+// the template's environment, or the variable of an enclosing loop.  Reusing
+// a name this way hides the original value, which is a common source of bugs.
+func WarnShadowed(context ...string) LintOption {
+	return func(l *linter) {
+		vars := make(map[string]string)
+		for _, name := range context {
+			vars[name] = "context variable"
+		}
+		l.scopes = []map[string]string{vars}
+	}
+}
+
+// a constant is the value of a literal expression, if it has one.
+type constant struct {
+	val interface{}
+	ok  bool
+}
+
+type linter struct {
+	t      *Tree
+	errs   []error
+	consts map[Node]constant
+	// scopes are the names in scope, innermost last, mapped to what they
+	// are, if checking for shadowed names;  see WarnShadowed.
+	scopes []map[string]string
+}
+
+func (l *linter) errorf(n Node, format string, args ...interface{}) {
+	location, context := l.t.ErrorContext(n)
+	l.errs = append(l.errs, &TemplateError{Location: location, Context: context, Err: fmt.Errorf(format, args...)})
+}
+
+// walk checks n and every node beneath it.
+func (l *linter) walk(n Node) {
+	if n == nil {
+		return
+	}
+	switch t := n.(type) {
+	case *AddExpr, *MulExpr, *UnaryNode:
+		l.constant(n)
+	case *ForNode:
+		if l.scopes != nil {
+			l.walkFor(t)
+			return
+		}
+	case *SetNode:
+		if l.scopes != nil {
+			for _, name := range targetNames(t.lhs) {
+				l.shadowed(name, "set")
+			}
+		}
+	}
+	for _, c := range children(n) {
+		l.walk(c)
+	}
+}
+
+// walkFor walks a for block, with its targets in scope in its body.
+func (l *linter) walkFor(n *ForNode) {
+	l.walk(n.InExpr)
+	vars := make(map[string]string)
+	for _, name := range targetNames(n.ForExpr) {
+		l.shadowed(name, "loop variable")
+		vars[name.Name] = "loop variable"
+	}
+	l.scopes = append(l.scopes, vars)
+	l.walk(n.Body)
+	l.scopes = l.scopes[:len(l.scopes)-1]
+	l.walk(n.Else)
+}
+
+// shadowed reports the name assigned by kind if it is already in scope.
+func (l *linter) shadowed(name *LookupNode, kind string) {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if what, ok := l.scopes[i][name.Name]; ok {
+			l.errorf(name, "%s %s shadows %s %s", kind, name.Name, what, name.Name)
+			return
+		}
+	}
+}
+
+// targetNames returns the names assigned by the target of a for or set tag.
+func targetNames(target Node) []*LookupNode {
+	switch t := target.(type) {
+	case *LookupNode:
+		return []*LookupNode{t}
+	case *StarNode:
+		return targetNames(t.Name)
+	case *TupleNode:
+		var names []*LookupNode
+		for _, elem := range t.Elems {
+			names = append(names, targetNames(elem)...)
+		}
+		return names
+	}
+	return nil
+}
+
+// constant returns the value of n if it is a literal or arithmetic on
+// literals.  Type errors are reported once, at the innermost node which
+// causes them, and such nodes have no value.
+func (l *linter) constant(n Node) (interface{}, bool) {
+	if c, ok := l.consts[n]; ok {
+		return c.val, c.ok
+	}
+	val, ok := l.fold(n)
+	l.consts[n] = constant{val, ok}
+	return val, ok
+}
+
+func (l *linter) fold(n Node) (interface{}, bool) {
+	switch t := n.(type) {
+	case *IntegerNode:
+		return t.Value, true
+	case *FloatNode:
+		return t.Value, true
+	case *StringNode:
+		return t.Value, true
+	case *BoolNode:
+		return t.Value, true
+	case *NoneNode:
+		return nil, true
+	case *UnaryNode:
+		val, ok := l.constant(t.Value)
+		if ok && !isNumericVar(typeOf(val)) {
+			l.errorf(n, "type error: %s not compatible with unary %s", typeName(val), t.Unary.val)
+		}
+		return nil, false
+	case *AddExpr:
+		return l.foldArithmetic(n, t.lhs, t.rhs, t.operator)
+	case *MulExpr:
+		return l.foldArithmetic(n, t.lhs, t.rhs, t.operator)
+	}
+	return nil, false
+}
+
+func (l *linter) foldArithmetic(n, lhs, rhs Node, op item) (interface{}, bool) {
+	lv, lok := l.constant(lhs)
+	rv, rok := l.constant(rhs)
+	if !lok || !rok {
+		return nil, false
+	}
+	for _, v := range []interface{}{lv, rv} {
+		switch typeOf(v) {
+		case intType, floatType, stringType:
+		default:
+			l.errorf(n, "type error: %s and %s not compatible with %s", typeName(lv), typeName(rv), op.val)
+			return nil, false
+		}
+	}
+	if typeOf(lv) == intType && typeOf(rv) == intType && op.typ != tokenAdd && op.typ != tokenSub && op.typ != tokenMul {
+		if r, _ := asInteger(rv); r == 0 {
+			l.errorf(n, "integer division by zero")
+			return nil, false
+		}
+	}
+	val, err := evalAdd(lv, rv, op)
+	if err != nil {
+		l.errorf(n, "%s", err)
+		return nil, false
+	}
+	return val, true
+}
+
+// children returns the nodes directly beneath n.
+func children(n Node) []Node {
+	switch t := n.(type) {
+	case *ListNode:
+		return t.Nodes
+	case *VarNode:
+		return []Node{t.Node}
+	case *UnaryNode:
+		return []Node{t.Value}
+	case *AddExpr:
+		return []Node{t.lhs, t.rhs}
+	case *MulExpr:
+		return []Node{t.lhs, t.rhs}
+	case *ConcatNode:
+		return []Node{t.lhs, t.rhs}
+	case *AndNode:
+		return []Node{t.lhs, t.rhs}
+	case *OrNode:
+		return []Node{t.lhs, t.rhs}
+	case *NotNode:
+		return []Node{t.Value}
+	case *TernaryNode:
+		if t.FalseExpr == nil {
+			return []Node{t.TrueExpr, t.Cond}
+		}
+		return []Node{t.TrueExpr, t.Cond, t.FalseExpr}
+	case *CompareExpr:
+		return t.Operands
+	case *MapExpr:
+		var nodes []Node
+		for _, e := range t.Elems {
+			nodes = append(nodes, e.Key, e.Value)
+		}
+		return nodes
+	case *TupleNode:
+		return t.Elems
+	case *ListLiteralNode:
+		return t.Elems
+	case *IndexExpr:
+		return []Node{t.Value, t.Index}
+	case *SliceExpr:
+		return []Node{t.Value, t.Start, t.Stop, t.Step}
+	case *AttrExpr:
+		return []Node{t.Value}
+	case *CallExpr:
+		return append([]Node{t.Value}, t.Args...)
+	case *FilterNode:
+		return append([]Node{t.Value}, t.Args...)
+	case *TestNode:
+		return append([]Node{t.Value}, t.Args...)
+	case *KeywordNode:
+		return []Node{t.Value}
+	case *StarNode:
+		return []Node{t.Name}
+	case *SetNode:
+		return []Node{t.lhs, t.rhs}
+	case *ConditionalNode:
+		return []Node{t.Guard, t.Body}
+	case *IfBlockNode:
+		return append(append([]Node{}, t.Conditionals...), t.Else)
+	case *ForNode:
+		return []Node{t.ForExpr, t.InExpr, t.Body, t.Else}
+	case *BlockNode:
+		return []Node{t.Body}
+	case *CacheNode:
+		return []Node{t.Timeout, t.Key, t.Body}
+	case *MacroNode:
+		return append(append([]Node{}, t.Defaults...), t.Body)
+	case *IncludeNode:
+		return []Node{t.Template}
+	}
+	return nil
+}
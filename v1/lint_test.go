@@ -0,0 +1,86 @@
+package v1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintLiterals(t *testing.T) {
+	tests := []struct {
+		src  string
+		errs []string
+	}{
+		{`{{ "a" - 1 }}`, []string{"string and int not compatible with -"}},
+		{`{{ true * 2 }}`, []string{"bool and int not compatible with *"}},
+		{`{{ "a" * "b" }}`, []string{"* not defined on string"}},
+		{`{{ none + 1 }}`, []string{"none and int not compatible with +"}},
+		{`{{ 1 / 0 }}`, []string{"integer division by zero"}},
+		{`{{ -"a" }}`, []string{"string not compatible with unary -"}},
+		{`{{ ("a" - 1) + 2 }}`, []string{"string and int not compatible with -"}},
+		{`{% if 1 + "x" == 2 %}{% endif %}{% for x in l %}{{ f(2 - true) }}{% endfor %}`, []string{
+			"int and string not compatible with +",
+			"int and bool not compatible with -",
+		}},
+		// variables and valid constants are left alone
+		{`{{ 1 + 2.5 * 3 }}`, nil},
+		{`{{ "a" + "b" }}`, nil},
+		{`{{ x - 1 }}`, nil},
+		{`{{ "a" - x }}`, nil},
+		{`{{ 1.0 / 0 }}`, nil},
+	}
+	for _, test := range tests {
+		tpl, err := NewEnvironment().ParseString(test.src, "lint", "lint")
+		if err != nil {
+			t.Fatalf("%s: %s", test.src, err)
+		}
+		errs := Lint(tpl)
+		if len(errs) != len(test.errs) {
+			t.Errorf("%s: expected %d errors, got %v", test.src, len(test.errs), errs)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), test.errs[i]) {
+				t.Errorf("%s: expected error containing %q, got %q", test.src, test.errs[i], err)
+			}
+		}
+	}
+}
+
+func TestLintShadowed(t *testing.T) {
+	tests := []struct {
+		src  string
+		errs []string
+	}{
+		{`{% for user in users %}{{ user }}{% endfor %}`, []string{"loop variable user shadows context variable user"}},
+		{`{% for x in l %}{% for x in x %}{% endfor %}{% endfor %}`, []string{"loop variable x shadows loop variable x"}},
+		{`{% for k, (a, *user) in l %}{% endfor %}`, []string{"loop variable user shadows context variable user"}},
+		{`{% set users = 1 %}`, []string{"set users shadows context variable users"}},
+		{`{% for x in l %}{% set x = 1 %}{% endfor %}`, []string{"set x shadows loop variable x"}},
+		{`{% for site in l %}{% endfor %}`, []string{"loop variable site shadows global site"}},
+		// distinct names, and loops which have ended, are fine
+		{`{% for u in users %}{% for v in u %}{{ v }}{% endfor %}{% endfor %}`, nil},
+		{`{% for x in l %}{% endfor %}{% for x in l %}{% endfor %}{% set x = 1 %}`, nil},
+		{`{% for x in l %}{% else %}{% set x = 1 %}{% endfor %}`, nil},
+	}
+	e := NewEnvironment()
+	e.Globals = map[string]interface{}{"site": "jigo"}
+	for _, test := range tests {
+		tpl, err := e.ParseString(test.src, "lint", "lint")
+		if err != nil {
+			t.Fatalf("%s: %s", test.src, err)
+		}
+		if errs := Lint(tpl); len(errs) != 0 {
+			t.Errorf("%s: expected no errors without WarnShadowed, got %v", test.src, errs)
+		}
+		errs := Lint(tpl, WarnShadowed("user", "users"))
+		if len(errs) != len(test.errs) {
+			t.Errorf("%s: expected %d errors, got %v", test.src, len(test.errs), errs)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), test.errs[i]) {
+				t.Errorf("%s: expected error containing %q, got %q", test.src, test.errs[i], err)
+			}
+		}
+	}
+}
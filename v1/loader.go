@@ -0,0 +1,80 @@
+package v1
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A loader finds the templates named by include tags.
+type loader interface {
+	// load returns the template called name, or nil if it has none.
+	load(name string) (*Template, error)
+}
+
+// layeredLoader searches each of its loaders in turn, so templates in
+// earlier layers shadow those of the same name in later ones.
+type layeredLoader []loader
+
+func (ls layeredLoader) load(name string) (*Template, error) {
+	for _, l := range ls {
+		if t, err := l.load(name); t != nil || err != nil {
+			return t, err
+		}
+	}
+	return nil, nil
+}
+
+// dirLoader loads templates from the files beneath a directory.  Each file
+// is parsed once, when it is first loaded.
+type dirLoader struct {
+	env    *Environment
+	dir    string
+	loaded map[string]*Template
+}
+
+func (l *dirLoader) load(name string) (*Template, error) {
+	if t, ok := l.loaded[name]; ok {
+		return t, nil
+	}
+	// names are slash separated and rooted at dir, so `..` cannot escape it
+	filename := filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+name)))
+	source, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := l.env.newTemplate(string(source), name, filename)
+	if err != nil {
+		return nil, err
+	}
+	l.loaded[name] = t
+	return t, nil
+}
+
+// WithSearchPath searches the directories dirs, in order, for the templates
+// named by include tags, before the templates registered with the
+// environment, for a single render.  This lets eg. a tenant's own templates
+// replace the defaults.  Files are parsed when first included, and only
+// reused within the render.
+func WithSearchPath(dirs ...string) ExecuteOption {
+	return func(r *renderer) error {
+		for _, dir := range dirs {
+			r.loader = append(r.loader, &dirLoader{env: r.t.env, dir: dir, loaded: make(map[string]*Template)})
+		}
+		return nil
+	}
+}
+
+// template returns the template called name, from the render's search path
+// if it has one, or else from those registered with the environment.
+func (r *renderer) template(name string) (*Template, error) {
+	t, err := r.loader.load(name)
+	if t != nil || err != nil {
+		return t, err
+	}
+	return r.t.env.Get(name)
+}
@@ -0,0 +1,370 @@
+package v1
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// attrGetter is implemented by jigo's own runtime values, which resolve their
+// attributes themselves rather than via reflection.
+type attrGetter interface {
+	getattr(name string) (interface{}, bool)
+}
+
+// callable is implemented by jigo's own runtime values which can be called
+// from a template.
+type callable interface {
+	call(args []interface{}, kwargs Kwargs) (interface{}, error)
+}
+
+// loop is the `loop` variable available in the body of a for loop.
+type loop struct {
+	index0 int
+	// length is the number of items, or -1 if it is not known, as when
+	// iterating a channel.
+	length int
+	depth0 int
+	// parent is the loop enclosing this one, if any.
+	parent *loop
+	// it iterates the loop's items.
+	it *iterator
+	// recurse renders a recursive loop again over its argument.
+	recurse func(items interface{}) (interface{}, error)
+}
+
+func (l *loop) getattr(name string) (interface{}, bool) {
+	switch name {
+	case "index":
+		return boxInt(int64(l.index0 + 1)), true
+	case "index0":
+		return boxInt(int64(l.index0)), true
+	case "first":
+		return l.index0 == 0, true
+	case "last":
+		// for channels, this waits to receive the next item
+		return !l.it.more(), true
+	case "depth":
+		return boxInt(int64(l.depth0 + 1)), true
+	case "depth0":
+		return boxInt(int64(l.depth0)), true
+	case "parent":
+		if l.parent == nil {
+			return nil, false
+		}
+		return l.parent, true
+	}
+	if l.length < 0 {
+		return nil, false
+	}
+	switch name {
+	case "revindex":
+		return boxInt(int64(l.length - l.index0)), true
+	case "revindex0":
+		return boxInt(int64(l.length - l.index0 - 1)), true
+	case "length":
+		return boxInt(int64(l.length)), true
+	}
+	return nil, false
+}
+
+// call renders a recursive loop's body over the items passed, one level
+// deeper, and returns the output.
+func (l *loop) call(args []interface{}, kwargs Kwargs) (interface{}, error) {
+	if l.recurse == nil {
+		return nil, errors.New("loop is not recursive")
+	}
+	if len(args) != 1 || len(kwargs) > 0 {
+		return nil, fmt.Errorf("wrong number of args: want 1, got %d", len(args)+len(kwargs))
+	}
+	return l.recurse(args[0])
+}
+
+func (l *loop) String() string {
+	if l.length < 0 {
+		return fmt.Sprintf("<loop %d>", l.index0+1)
+	}
+	return fmt.Sprintf("<loop %d/%d>", l.index0+1, l.length)
+}
+
+// renderFor renders a for block, pushing a new context with the loop target
+// and the loop variable for each item.
+func (r *renderer) renderFor(n *ForNode) error {
+	val, err := r.eval(n.InExpr)
+	if err != nil {
+		return err
+	}
+	return r.renderLoop(n, val, 0)
+}
+
+// renderLoop renders the for block n over the items of val, at the recursion
+// depth depth.
+func (r *renderer) renderLoop(n *ForNode, val interface{}, depth int) error {
+	it, err := r.iterator(val)
+	if err != nil {
+		return r.errorf(n.InExpr, "%s", err)
+	}
+	if !it.more() {
+		if it.err != nil {
+			return r.errorf(n.InExpr, "%s", it.err)
+		}
+		if n.Else != nil {
+			return r.renderNode(n.Else)
+		}
+		return nil
+	}
+
+	l := &loop{length: it.length, depth0: depth, it: it}
+	if v, ok := r.lookup("loop"); ok {
+		l.parent, _ = v.Interface().(*loop)
+	}
+
+	vars := make(map[string]interface{})
+	r.c.push(newScope(vars))
+	defer r.c.pop()
+
+	if n.Recursive {
+		l.recurse = func(items interface{}) (interface{}, error) {
+			w := r.w
+			defer func() { r.w = w }()
+			var b bytes.Buffer
+			r.w = &b
+			err := r.renderLoop(n, items, depth+1)
+			return Safe(b.String()), err
+		}
+	}
+	vars["loop"] = l
+	for i := 0; it.more(); i++ {
+		l.index0 = i
+		if err := unpack(n.ForExpr, it.next(), vars); err != nil {
+			return r.errorf(n.ForExpr, "%s", err)
+		}
+		err := r.renderNode(n.Body)
+		if err == errBreak {
+			break
+		}
+		if err != nil && err != errContinue {
+			return err
+		}
+	}
+	if it.err != nil {
+		return r.errorf(n.InExpr, "%s", it.err)
+	}
+	return nil
+}
+
+// errBreak and errContinue are returned by {% break %} and {% continue %}
+// tags, and passed up to the enclosing loop.
+var (
+	errBreak    = errors.New("break outside of a loop")
+	errContinue = errors.New("continue outside of a loop")
+)
+
+// An iterator produces the items of a for loop.  Items are received from
+// channels one at a time, so a template can render a stream as it arrives.
+type iterator struct {
+	// length is the number of items, or -1 if it is not known.
+	length int
+	items  []interface{}
+	// receive receives the next item from a channel.
+	receive func() (interface{}, bool, error)
+	// pending is the next item, received by more but not yet returned.
+	pending interface{}
+	peeked  bool
+	done    bool
+	err     error
+}
+
+// iterator returns an iterator over the items of val, which are the items
+// returned by Environment.iterate, or the values received from a channel
+// until it is closed.  Waiting on a channel is cancelled with the render's
+// context.
+func (r *renderer) iterator(val interface{}) (*iterator, error) {
+	v := indirect(reflect.ValueOf(val))
+	if v.Kind() == reflect.Chan && v.IsNil() {
+		return &iterator{}, nil
+	}
+	if v.Kind() != reflect.Chan {
+		items, err := r.t.env.iterate(val)
+		return &iterator{length: len(items), items: items}, err
+	}
+	if v.Type().ChanDir()&reflect.RecvDir == 0 {
+		return nil, fmt.Errorf("cannot receive from send-only %s", v.Type())
+	}
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.ctx.Done())},
+	}
+	receive := func() (interface{}, bool, error) {
+		chosen, item, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return nil, false, r.ctx.Err()
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		return item.Interface(), true, nil
+	}
+	return &iterator{length: -1, receive: receive}, nil
+}
+
+// more reports whether there is another item, receiving it from a channel
+// if necessary.
+func (it *iterator) more() bool {
+	if it.receive == nil {
+		return len(it.items) > 0
+	}
+	if !it.peeked && !it.done {
+		it.pending, it.peeked, it.err = it.receive()
+		it.done = !it.peeked
+	}
+	return it.peeked
+}
+
+// next returns the next item;  more must have returned true.
+func (it *iterator) next() interface{} {
+	if it.receive == nil {
+		item := it.items[0]
+		it.items = it.items[1:]
+		return item
+	}
+	it.peeked = false
+	return it.pending
+}
+
+// unpack assigns item to the target, which is either a name or a tuple of
+// names, in vars.  Tuple targets require item to be a sequence of the same
+// length, unless one of its names is starred;  the starred name is assigned a
+// list of the items left over by the others.
+func unpack(target Node, item interface{}, vars map[string]interface{}) error {
+	switch t := target.(type) {
+	case *LookupNode:
+		vars[t.Name] = item
+		return nil
+	case *TupleNode:
+		v := indirect(reflect.ValueOf(item))
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return fmt.Errorf("cannot unpack non-sequence %s", typeOf(item))
+		}
+		star := -1
+		for i, elem := range t.Elems {
+			if _, ok := elem.(*StarNode); ok {
+				star = i
+			}
+		}
+		if star < 0 && v.Len() != len(t.Elems) {
+			return fmt.Errorf("cannot unpack %d values into %d names", v.Len(), len(t.Elems))
+		}
+		if star >= 0 && v.Len() < len(t.Elems)-1 {
+			return fmt.Errorf("cannot unpack %d values into at least %d names", v.Len(), len(t.Elems)-1)
+		}
+		// rest is the number of items assigned to the starred name
+		rest := v.Len() - len(t.Elems) + 1
+		for i, elem := range t.Elems {
+			var err error
+			switch {
+			case i < star || star < 0:
+				err = unpack(elem, v.Index(i).Interface(), vars)
+			case i == star:
+				items := make([]interface{}, rest)
+				for j := range items {
+					items[j] = v.Index(i + j).Interface()
+				}
+				err = unpack(elem.(*StarNode).Name, items, vars)
+			default:
+				err = unpack(elem, v.Index(i+rest-1).Interface(), vars)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot assign to %s", target)
+}
+
+// iterate returns the items of a slice, array, string or map.  Maps iterate
+// over their keys, which are sorted if the environment's SortMapKeys is set,
+// and strings iterate over their characters.  Undefined values and nil
+// pointers have no items.
+func (e *Environment) iterate(i interface{}) ([]interface{}, error) {
+	v := indirect(reflect.ValueOf(i))
+	if _, ok := i.(Undefined); ok || !v.IsValid() {
+		return nil, nil
+	}
+	var items []interface{}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		items = make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).Interface()
+		}
+	case reflect.Map:
+		for _, k := range e.mapKeys(v) {
+			items = append(items, k.Interface())
+		}
+	case reflect.String:
+		for _, c := range v.String() {
+			items = append(items, string(c))
+		}
+	default:
+		return nil, fmt.Errorf("%s is not iterable", typeOf(i))
+	}
+	return items, nil
+}
+
+// mapKeys returns the keys of the map v, sorted if SortMapKeys is set.
+func (e *Environment) mapKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	if e.SortMapKeys {
+		sort.Slice(keys, func(i, j int) bool {
+			return lessKey(keys[i].Interface(), keys[j].Interface())
+		})
+	}
+	return keys
+}
+
+// lessKey orders map keys;  numbers and strings are ordered naturally, and
+// anything else by its string form.
+func lessKey(a, b interface{}) bool {
+	if isNumericVar(typeOf(a)) && isNumericVar(typeOf(b)) {
+		x, _ := asFloat(a)
+		y, _ := asFloat(b)
+		return x < y
+	}
+	return asString(a) < asString(b)
+}
+
+// mapMethod returns the dict style methods items, keys and values for the
+// map v, which are used when the map has no such key.
+func (e *Environment) mapMethod(v reflect.Value, name string) (interface{}, bool) {
+	switch name {
+	case "items":
+		return func() []interface{} {
+			var items []interface{}
+			for _, k := range e.mapKeys(v) {
+				items = append(items, []interface{}{k.Interface(), v.MapIndex(k).Interface()})
+			}
+			return items
+		}, true
+	case "keys":
+		return func() []interface{} {
+			var keys []interface{}
+			for _, k := range e.mapKeys(v) {
+				keys = append(keys, k.Interface())
+			}
+			return keys
+		}, true
+	case "values":
+		return func() []interface{} {
+			var values []interface{}
+			for _, k := range e.mapKeys(v) {
+				values = append(values, v.MapIndex(k).Interface())
+			}
+			return values
+		}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,255 @@
+package v1
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestForLoop(t *testing.T) {
+	fixtures := []evalFixture{
+		{"For", `{% for x in l %}{{ x }},{% endfor %}`, m{"l": []int{1, 2, 3}}, "1,2,3,"},
+		{"For else", `{% for x in l %}{{ x }}{% else %}empty{% endfor %}`, m{"l": []int{}}, "empty"},
+		{"For undefined", `{% for x in l %}{{ x }}{% else %}empty{% endfor %}`, m{}, "empty"},
+		{"For string", `{% for c in "abc" %}{{ c }}.{% endfor %}`, m{}, "a.b.c."},
+		{"For map", `{% for k in d %}{{ k }}{% endfor %}`, m{"d": map[string]int{"b": 2, "a": 1, "c": 3}}, "abc"},
+		{
+			"For unpack",
+			`{% for a, b in l %}{{ a }}{{ b }} {% endfor %}`,
+			m{"l": [][]string{{"a", "b"}, {"c", "d"}}},
+			"ab cd ",
+		},
+		{
+			"Loop vars",
+			`{% for x in l %}{{ loop.index }}{{ loop.index0 }}{{ loop.revindex }}{{ loop.revindex0 }}{{ loop.length }} {% endfor %}`,
+			m{"l": []string{"a", "b"}},
+			"10212 21102 ",
+		},
+		{
+			"Loop first last",
+			`{% for x in l %}{% if loop.first %}[{% endif %}{{ x }}{% if loop.last %}]{% endif %}{% endfor %}`,
+			m{"l": []string{"a", "b", "c"}},
+			"[abc]",
+		},
+		{
+			"Loop scope",
+			`{% for x in l %}{% for x in l2 %}{{ x }}{% endfor %}{{ x }}{% endfor %}{{ x }}`,
+			m{"l": []string{"a", "b"}, "l2": []string{"1", "2"}, "x": "!"},
+			"12a12b!",
+		},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestNestedUnpacking(t *testing.T) {
+	pairs := [][]string{{"a", "b"}, {"c", "d"}}
+	fixtures := []evalFixture{
+		{"Enumerate", `{% for i, x in enumerate(l) %}{{ i }}{{ x }} {% endfor %}`, m{"l": []string{"a", "b"}}, "0a 1b "},
+		{"Enumerate start", `{% for i, x in enumerate(l, start=1) %}{{ i }}{{ x }} {% endfor %}`, m{"l": []string{"a", "b"}}, "1a 2b "},
+		{"Nested", `{% for i, (a, b) in enumerate(pairs) %}{{ i }}{{ a }}{{ b }} {% endfor %}`, m{"pairs": pairs}, "0ab 1cd "},
+		{"Nested first", `{% for (a, b), i in l %}{{ a }}{{ b }}{{ i }} {% endfor %}`, m{"l": []interface{}{[]interface{}{pairs[0], 1}}}, "ab1 "},
+		{"Parenthesized", `{% for (a, b) in pairs %}{{ a }}{{ b }} {% endfor %}`, m{"pairs": pairs}, "ab cd "},
+		{"Parenthesized name", `{% for (x) in l %}{{ x }}{% endfor %}`, m{"l": []int{1, 2}}, "12"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, _ := NewEnvironment().ParseString(`{% for i, (a, b) in enumerate(l) %}{% endfor %}`, "unpack", "unpack")
+	if _, err := tpl.Render(m{"l": []string{"ab"}}); err == nil {
+		t.Errorf("Expected error unpacking a string into a tuple")
+	}
+	if _, err := NewEnvironment().ParseString(`{% for i, (a, b in l %}{% endfor %}`, "unpack", "unpack"); err == nil {
+		t.Errorf("Expected parse error for an unclosed target")
+	}
+}
+
+func TestMapMethods(t *testing.T) {
+	ctx := m{"d": map[string]int{"b": 2, "a": 1, "c": 3}}
+	fixtures := []evalFixture{
+		{"Items", `{% for k, v in d.items() %}{{ k }}={{ v }};{% endfor %}`, ctx, "a=1;b=2;c=3;"},
+		{"Keys", `{{ d.keys() }}`, ctx, "[a b c]"},
+		{"Values", `{{ d.values() }}`, ctx, "[1 2 3]"},
+		{"Keys loop", `{% for k in d.keys() %}{{ k }}{% endfor %}`, ctx, "abc"},
+		{"Values loop", `{% for v in d.values() %}{{ v }}{% endfor %}`, ctx, "123"},
+		{"Int keys", `{{ d.keys() }}`, m{"d": map[int]string{10: "x", 2: "y", 1: "z"}}, "[1 2 10]"},
+		{"Key shadows method", `{{ d.items }}`, m{"d": m{"items": "x"}}, "x"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, err := NewEnvironment().ParseString(`{{ l.keys() }}`, "notmap", "notmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(m{"l": []int{1}}); err == nil {
+		t.Error("Expected error calling keys() on a slice")
+	}
+
+	// unsorted iteration still visits every item
+	e := NewEnvironment()
+	e.SortMapKeys = false
+	tpl, err = e.ParseString(`{% for k, v in d.items() %}{{ v }}{% endfor %}`, "unsorted", "unsorted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 {
+		t.Errorf("Expected 3 values, got %q", out)
+	}
+}
+
+type treeNode struct {
+	Name     string
+	Children []treeNode
+}
+
+func TestRecursiveLoop(t *testing.T) {
+	tree := []treeNode{
+		{"a", []treeNode{{"b", nil}, {"c", []treeNode{{"d", nil}}}}},
+		{"e", nil},
+	}
+	body := `{% for n in tree recursive %}{{ loop.depth }}{{ loop.depth0 }}{{ n.Name }}` +
+		`({{ loop(n.Children) }}) {% endfor %}`
+	fixtures := []evalFixture{
+		{"Recursive", body, m{"tree": tree}, "10a(21b() 21c(32d() ) ) 10e() "},
+		{"Depth", `{% for x in l %}{{ loop.depth }}{{ loop.depth0 }}{% endfor %}`, m{"l": []int{1}}, "10"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.AutoEscape = true
+	fixtures = []evalFixture{
+		{"Recursive escaped", `{% for n in tree recursive %}<{{ n.Name }}>{{ loop(n.Children) }}{% endfor %}`,
+			m{"tree": []treeNode{{"&", []treeNode{{"b", nil}}}}}, "<&amp;><b>"},
+	}
+	testFixtures(t, e, fixtures)
+
+	tpl, _ := e.ParseString(`{% for x in l %}{{ loop(l) }}{% endfor %}`, "loop", "loop")
+	if _, err := tpl.Render(m{"l": []int{1}}); err == nil || !strings.Contains(err.Error(), "not recursive") {
+		t.Errorf("Expected error calling a loop which is not recursive, got %v", err)
+	}
+}
+
+func TestLoopParent(t *testing.T) {
+	ctx := m{"rows": []string{"a", "b"}, "cols": []int{1, 2}}
+	fixtures := []evalFixture{
+		{
+			"Parent index",
+			`{% for r in rows %}{% for c in cols %}{{ loop.parent.index }}.{{ loop.index }} {% endfor %}{% endfor %}`,
+			ctx,
+			"1.1 1.2 2.1 2.2 ",
+		},
+		{
+			"Grandparent",
+			`{% for r in rows %}{% for c in cols %}{% for x in "x" %}{{ loop.parent.parent.index0 }}{% endfor %}{% endfor %}{% endfor %}`,
+			ctx,
+			"0011",
+		},
+		{"Outer loop has no parent", `{% for r in rows %}{{ loop.parent is defined }}{% endfor %}`, ctx, "falsefalse"},
+		{"Parent after inner loop", `{% for r in rows %}{% for c in cols %}{% endfor %}{{ loop.index }}{% endfor %}`, ctx, "12"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestNilCollections(t *testing.T) {
+	var (
+		nilSlice []int
+		nilMap   map[string]int
+		nilPtr   *[]int
+	)
+	ctx := m{"s": nilSlice, "d": nilMap, "p": nilPtr}
+	fixtures := []evalFixture{
+		{"For nil slice", `{% for x in s %}{{ x }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"For nil map", `{% for k in d %}{{ k }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"For nil map items", `{% for k, v in d.items() %}{{ k }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"For nil pointer", `{% for x in p %}{{ x }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"Render nil slice", `[{{ s }}]`, ctx, "[]"},
+		{"Render nil map", `[{{ d }}]`, ctx, "[]"},
+		{"Render nil pointer", `[{{ p }}]`, ctx, "[]"},
+		{"Index nil slice", `[{{ s[0] }}]`, ctx, "[]"},
+		{"Key nil map", `[{{ d.key }}{{ d["key"] }}]`, ctx, "[]"},
+		{"Slice nil slice", `{{ s[1:] }}`, ctx, "[]"},
+		{"In nil", `{{ 1 in s }} {{ "k" in d }} {{ 1 in p }}`, ctx, "false false false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestChannelLoop(t *testing.T) {
+	items := func(n int) chan int {
+		ch := make(chan int, n)
+		for i := 1; i <= n; i++ {
+			ch <- i
+		}
+		close(ch)
+		return ch
+	}
+	var nilChan chan int
+	fixtures := []evalFixture{
+		{"Channel", `{% for x in ch %}{{ x }},{% endfor %}`, m{"ch": items(3)}, "1,2,3,"},
+		{"Receive only", `{% for x in ch %}{{ x }}{% endfor %}`, m{"ch": (<-chan int)(items(2))}, "12"},
+		{"Empty", `{% for x in ch %}{{ x }}{% else %}empty{% endfor %}`, m{"ch": items(0)}, "empty"},
+		{"Nil", `{% for x in ch %}{{ x }}{% else %}empty{% endfor %}`, m{"ch": nilChan}, "empty"},
+		{
+			"Loop vars",
+			`{% for x in ch %}{{ loop.index }}{% if loop.first %}F{% endif %}{% if loop.last %}L{% endif %} {% endfor %}`,
+			m{"ch": items(3)},
+			"1F 2 3L ",
+		},
+		{"Unknown length", `{% for x in ch %}[{{ loop.length }}{{ loop.revindex }}]{% endfor %}`, m{"ch": items(1)}, "[]"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	// items are rendered as they are received
+	ch := make(chan string)
+	var out strings.Builder
+	tpl, _ := NewEnvironment().ParseString(`{% for x in ch %}{{ x }}{% endfor %}`, "chan", "chan")
+	done := make(chan error)
+	go func() { done <- tpl.Execute(&out, m{"ch": ch}) }()
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+	if err := <-done; err != nil || out.String() != "ab" {
+		t.Errorf("Expected ab, got %q (%v)", out.String(), err)
+	}
+
+	// waiting on a channel is cancelled with the render's context
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- tpl.Execute(ioutil.Discard, m{"ch": make(chan int)}, WithContext(ctx)) }()
+	cancel()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Expected cancelled error, got %v", err)
+	}
+	if _, err := tpl.Render(m{"ch": make(chan<- int)}); err == nil {
+		t.Errorf("Expected error iterating a send-only channel")
+	}
+}
+
+func TestLoopControls(t *testing.T) {
+	ctx := m{"l": []int{1, 2, 3, 4}, "grid": [][]int{{1, 2}, {3, 4}}}
+	fixtures := []evalFixture{
+		{"Break", `{% for i in l %}{% if i == 3 %}{% break %}{% endif %}{{ i }}{% endfor %}`, ctx, "12"},
+		{"Continue", `{% for i in l %}{% if i % 2 == 0 %}{% continue %}{% endif %}{{ i }}{% endfor %}`, ctx, "13"},
+		{"Break first", `{% for i in l %}{% break %}{{ i }}{% endfor %}done`, ctx, "done"},
+		{"Else after break", `{% for i in l %}{% break %}{% else %}empty{% endfor %}`, ctx, ""},
+		{"Inner loop only", `{% for row in grid %}{% for c in row %}{% if c % 2 == 0 %}{% break %}{% endif %}{{ c }}{% endfor %};{% endfor %}`, ctx, "1;3;"},
+		{"Continue in nested if", `{% for i in l %}{% if i > 1 %}{% if i < 4 %}{% continue %}{% endif %}{% endif %}{{ i }}{% endfor %}`, ctx, "14"},
+		{"Loop index", `{% for i in l %}{% if loop.index == 2 %}{% continue %}{% endif %}{{ loop.index }}{% endfor %}`, ctx, "134"},
+		{"Set before break", `{% set n = 0 %}{% for i in l %}{% set n = i %}{% if i == 2 %}{% break %}{% endif %}{% endfor %}{{ n }}`, ctx, "2"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	for _, src := range []string{
+		`{% break %}`,
+		`{% if true %}{% continue %}{% endif %}`,
+		`{% for i in l %}{% else %}{% break %}{% endfor %}`,
+		`{% for i in l %}{% endfor %}{% continue %}`,
+		`{% for i in l %}{% macro m() %}{% break %}{% endmacro %}{% endfor %}`,
+	} {
+		_, err := NewEnvironment().ParseString(src, "loop", "loop")
+		if err == nil || !strings.Contains(err.Error(), "outside of a loop") {
+			t.Errorf("%s: expected an error outside of a loop, got %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package v1
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// macro is a macro defined by a {% macro %} tag, which renders its body with
+// its parameters set to the arguments when called.
+type macro struct {
+	r *renderer
+	// t is the template defining the macro, whose source errors refer to.
+	t *Template
+	n *MacroNode
+}
+
+// missingArg marks parameters not passed to a macro.
+type missingArg struct{}
+
+// call renders the macro's body and returns its output.  Parameters which
+// are not passed take their default value, which is evaluated with the
+// parameters before it set, or are undefined if they have no default.
+func (m *macro) call(args []interface{}, kwargs Kwargs) (interface{}, error) {
+	missing := make([]interface{}, len(m.n.Params))
+	for i := range missing {
+		missing[i] = missingArg{}
+	}
+	params, err := bindArgs(args, kwargs, m.n.Params, missing...)
+	if err != nil {
+		return nil, fmt.Errorf("macro %s: %s", m.n.Name, err)
+	}
+
+	r := m.r
+	t, w := r.t, r.w
+	defer func() { r.t, r.w = t, w }()
+	r.t = m.t
+	vars := make(map[string]interface{}, len(params))
+	r.c.push(newScope(vars))
+	defer r.c.pop()
+	for i, name := range m.n.Params {
+		switch {
+		case params[i] != missingArg{}:
+			vars[name] = params[i]
+		case m.n.Defaults[i] != nil:
+			if vars[name], err = r.eval(m.n.Defaults[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var b bytes.Buffer
+	r.w = &b
+	err = r.renderNode(m.n.Body)
+	return Safe(b.String()), err
+}
+
+func (m *macro) String() string {
+	return fmt.Sprintf("<macro %s>", m.n.Name)
+}
+
+// renderMacro defines the macro n in the current scope.
+func (r *renderer) renderMacro(n *MacroNode) error {
+	r.c.assign(n.Name, &macro{r, r.t, n})
+	return nil
+}
+
+// renderInclude renders the template named by n in the current context.
+// Variables it sets and macros it defines are not visible to the including
+// template.
+func (r *renderer) renderInclude(n *IncludeNode) (err error) {
+	name, err := r.eval(n.Template)
+	if err != nil {
+		return err
+	}
+	tpl, err := r.template(asString(name))
+	if err != nil {
+		return r.errorf(n, "%s", err)
+	}
+	exit, err := r.enter("include", tpl.Name, n)
+	if err != nil {
+		return err
+	}
+	defer exit(&err)
+	t := r.t
+	defer func() { r.t = t }()
+	r.t = tpl
+	r.c.push(newScope(make(map[string]interface{})))
+	defer r.c.pop()
+	return r.renderList(tpl.base.Root)
+}
@@ -0,0 +1,239 @@
+package v1
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMacros(t *testing.T) {
+	ctx := m{"name": "World", "x": 1}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Call", `{% macro greet(name) %}Hello, {{ name }}!{% endmacro %}{{ greet("jigo") }}`, ctx, "Hello, jigo!"},
+		{"Definition renders nothing", `a{% macro m() %}x{% endmacro %}b`, ctx, "ab"},
+		{"Default", `{% macro greet(name="you") %}Hi {{ name }}{% endmacro %}{{ greet() }}`, ctx, "Hi you"},
+		{"Keyword arg", `{% macro f(a, b=2) %}{{ a }}{{ b }}{% endmacro %}{{ f(b=3, a=1) }}`, ctx, "13"},
+		{"Default uses earlier param", `{% macro f(a, b=a + 1) %}{{ b }}{% endmacro %}{{ f(1) }}`, ctx, "2"},
+		{"Missing param undefined", `{% macro f(a) %}[{{ a }}]{% endmacro %}{{ f() }}`, ctx, "[]"},
+		{"Params shadow context", `{% macro f(name) %}{{ name }}{% endmacro %}{{ f("a") }} {{ name }}`, ctx, "a World"},
+		{"Sees context", `{% macro f() %}{{ x }}{% endmacro %}{{ f() }}`, ctx, "1"},
+		{"Set is local", `{% macro f() %}{% set x = 2 %}{{ x }}{% endmacro %}{{ f() }}{{ x }}`, ctx, "21"},
+		{"Nested call", `{% macro a() %}A{% endmacro %}{% macro b() %}[{{ a() }}]{% endmacro %}{{ b() }}`, ctx, "[A]"},
+		{"In loop", `{% macro sq(n) %}{{ n * n }}{% endmacro %}{% for i in l %}{{ sq(i) }} {% endfor %}`, m{"l": []int{1, 2, 3}}, "1 4 9 "},
+	})
+
+	e := NewEnvironment()
+	e.AutoEscape = true
+	testFixtures(t, e, []evalFixture{
+		{"Output is safe", `{% macro b(s) %}<b>{{ s }}</b>{% endmacro %}{{ b("<i>") }}`, ctx, "<b>&lt;i&gt;</b>"},
+	})
+
+	for _, src := range []string{
+		`{% macro f(a) %}{% endmacro %}{{ f(1, 2) }}`,
+		`{% macro f(a) %}{% endmacro %}{{ f(b=1) }}`,
+		`{% macro f(a) %}{% endmacro %}{{ f(1, a=2) }}`,
+	} {
+		tpl, err := NewEnvironment().ParseString(src, "macro", "macro")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "macro f") {
+			t.Errorf("%s: expected a macro error, got %v", src, err)
+		}
+	}
+	for _, src := range []string{
+		`{% macro f(a, a) %}{% endmacro %}`,
+		`{% macro f(a=1, b) %}{% endmacro %}`,
+		`{% macro f(a b) %}{% endmacro %}`,
+		`{% macro f() %}`,
+	} {
+		if _, err := NewEnvironment().ParseString(src, "macro", "macro"); err == nil {
+			t.Errorf("%s: expected a parse error", src)
+		}
+	}
+}
+
+func TestMacroFilters(t *testing.T) {
+	ctx := m{"name": "jigo", "x": 2}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Filter", `{% macro shout(s) %}{{ s }}!{% endmacro %}{{ name|shout }}`, ctx, "jigo!"},
+		{"Args", `{% macro wrap(s, l, r=")") %}{{ l }}{{ s }}{{ r }}{% endmacro %}{{ name|wrap("(") }}`, ctx, "(jigo)"},
+		{"Kwargs", `{% macro wrap(s, l="(", r=")") %}{{ l }}{{ s }}{{ r }}{% endmacro %}{{ name|wrap(r="]") }}`, ctx, "(jigo]"},
+		{"Chained", `{% macro em(s) %}*{{ s }}*{% endmacro %}{{ name|em|em }}`, ctx, "**jigo**"},
+		{"Registered filter wins", `{% macro e(s) %}macro{% endmacro %}{{ "<"|e }}`, ctx, "&lt;"},
+	})
+
+	tpl, err := NewEnvironment().ParseString("{% set shout = 1 %}{{ name|shout }}", "notmacro", "notmacro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), `unknown filter "shout"`) {
+		t.Errorf("Expected an unknown filter error, got %v", err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	e := NewEnvironment()
+	for name, src := range map[string]string{
+		"header.html": `<h1>{{ title }}</h1>{% set x = 2 %}`,
+		"nested.html": `[{% include "header.html" %}]`,
+	} {
+		if _, err := e.ParseString(src, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := m{"title": "Home", "x": 1, "page": "header.html", "titles": []string{"a"}}
+	testFixtures(t, e, []evalFixture{
+		{"Include", `{% include "header.html" %}`, ctx, "<h1>Home</h1>"},
+		{"Expression", `{% include page %}`, ctx, "<h1>Home</h1>"},
+		{"Sees locals", `{% for title in titles %}{% include "header.html" %}{% endfor %}`, ctx, "<h1>a</h1>"},
+		{"Set is local", `{% include "header.html" %}{{ x }}`, ctx, "<h1>Home</h1>1"},
+		{"Nested", `{% include "nested.html" %}`, ctx, "[<h1>Home</h1>]"},
+	})
+
+	tpl, err := e.ParseString(`{% include "missing.html" %}`, "page", "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(ctx); err == nil || !strings.Contains(err.Error(), "missing.html") {
+		t.Errorf("Expected an error including a missing template, got %v", err)
+	}
+}
+
+func TestRenderTrace(t *testing.T) {
+	e := NewEnvironment()
+	for name, src := range map[string]string{
+		"macros.html": "{% macro greet(n) %}\n{{ n // 0 }}{% endmacro %}{{ greet(1) }}",
+		"page.html":   "<p>\n{% include \"macros.html\" %}</p>",
+	} {
+		if _, err := e.ParseString(src, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tpl, _ := e.Get("page.html")
+	_, err := tpl.Render(m{})
+	terr, ok := err.(*TemplateError)
+	if !ok {
+		t.Fatalf("Expected a TemplateError, got %v", err)
+	}
+	want := []Frame{
+		{"macro", "greet", "macros.html", 2},
+		{"include", "macros.html", "page.html", 2},
+	}
+	if len(terr.Trace) != len(want) {
+		t.Fatalf("Expected trace %v, got %v", want, terr.Trace)
+	}
+	for i := range want {
+		if terr.Trace[i] != want[i] {
+			t.Errorf("Expected frame %d to be %v, got %v", i, want[i], terr.Trace[i])
+		}
+	}
+	msg := err.Error()
+	for _, s := range []string{
+		"template: macros.html:2:",
+		"in macro greet, called from macros.html, line 2",
+		"in include macros.html, included from page.html, line 2",
+	} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("Expected %q in error:\n%s", s, msg)
+		}
+	}
+
+	// errors from macros called directly have only the macro's frame
+	tpl, _ = e.ParseString("{% macro f() %}{{ 1 - \"a\" }}{% endmacro %}\n\n{{ f() }}", "direct.html", "direct.html")
+	_, err = tpl.Render(m{})
+	if err == nil || !strings.HasSuffix(err.Error(), "\n\tin macro f, called from direct.html, line 3") {
+		t.Errorf("Expected a macro frame, got %v", err)
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	e := NewEnvironment()
+	for name, src := range map[string]string{
+		"macro.html":   `{% macro f(n) %}{{ f(n + 1) }}{% endmacro %}{{ f(0) }}`,
+		"include.html": `x{% include "include.html" %}`,
+		"bounded.html": `{% macro f(n) %}{% if n > 0 %}{{ f(n - 1) }}{% else %}done{% endif %}{% endmacro %}{{ f(100) }}`,
+	} {
+		if _, err := e.ParseString(src, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"macro.html", "include.html"} {
+		tpl, _ := e.Get(name)
+		_, err := tpl.Render(m{})
+		terr, ok := err.(*TemplateError)
+		if !ok || !strings.Contains(err.Error(), "maximum macro and include depth of 256 exceeded") {
+			t.Errorf("%s: expected a depth error, got %v", name, err)
+			continue
+		}
+		if len(terr.Trace) != maxFrames {
+			t.Errorf("%s: expected a trace of %d frames, got %d", name, maxFrames, len(terr.Trace))
+		}
+	}
+	tpl, _ := e.Get("bounded.html")
+	if out, err := tpl.Render(m{}); err != nil || out != "done" {
+		t.Errorf("Expected recursion within the limit to render, got %q, %v", out, err)
+	}
+}
+
+func TestIncludeSearchPath(t *testing.T) {
+	e := NewEnvironment()
+	for name, src := range map[string]string{
+		"header.html":   "<h1>default</h1>",
+		"footer.html":   "<p>default {{ x }}</p>",
+		"page.html":     `{% include "header.html" %}{% include "footer.html" %}{% include "nav/menu.html" %}`,
+		"nav/menu.html": "<nav>default</nav>",
+	} {
+		if _, err := e.ParseString(src, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tenant, shared := t.TempDir(), t.TempDir()
+	for path, src := range map[string]string{
+		filepath.Join(tenant, "header.html"):          `<h1>tenant {{ x }}</h1>`,
+		filepath.Join(tenant, "nav", "menu.html"):     `<nav>tenant</nav>{% include "logo.html" %}`,
+		filepath.Join(shared, "header.html"):          `<h1>shared</h1>`,
+		filepath.Join(shared, "logo.html"):            `<img>`,
+		filepath.Join(filepath.Dir(tenant), "x.html"): `secret`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tpl, _ := e.Get("page.html")
+	render := func(opts ...ExecuteOption) string {
+		var b strings.Builder
+		if err := tpl.Execute(&b, m{"x": 1}, opts...); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		return b.String()
+	}
+	if out := render(WithSearchPath(tenant, shared)); out != "<h1>tenant 1</h1><p>default 1</p><nav>tenant</nav><img>" {
+		t.Errorf("Expected tenant templates to shadow the defaults, got %q", out)
+	}
+	if out := render(WithSearchPath(shared, tenant)); out != "<h1>shared</h1><p>default 1</p><nav>tenant</nav><img>" {
+		t.Errorf("Expected earlier directories to be searched first, got %q", out)
+	}
+	if out := render(); out != "<h1>default</h1><p>default 1</p><nav>default</nav>" {
+		t.Errorf("Expected the defaults without a search path, got %q", out)
+	}
+
+	// names cannot escape the search path
+	tpl, _ = e.ParseString(`{% include "../x.html" %}`, "escape", "escape")
+	if err := tpl.Execute(ioutil.Discard, m{}, WithSearchPath(tenant)); err == nil || !strings.Contains(err.Error(), "no template") {
+		t.Errorf("Expected no template outside the search path, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tenant, "bad.html"), []byte("{{ x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tpl, _ = e.ParseString(`{% include "bad.html" %}`, "bad", "bad")
+	if err := tpl.Execute(ioutil.Discard, m{}, WithSearchPath(tenant)); err == nil || !strings.Contains(err.Error(), "unclosed") {
+		t.Errorf("Expected a parse error from the search path, got %v", err)
+	}
+}
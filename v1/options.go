@@ -0,0 +1,67 @@
+package v1
+
+import "context"
+
+// An ExecuteOption changes a single call to Template.Execute, without
+// changing the template's environment.
+type ExecuteOption func(*renderer) error
+
+// WithFilter makes fn available as the filter name for a single render,
+// overriding any filter of that name in the environment.
+func WithFilter(name string, fn interface{}, flags FilterFlags) ExecuteOption {
+	return func(r *renderer) error {
+		f, err := newFilter(fn, flags)
+		if err != nil {
+			return err
+		}
+		if r.filters == nil {
+			r.filters = make(map[string]*filter)
+		}
+		r.filters[name] = f
+		return nil
+	}
+}
+
+// WithGlobal makes value available as the global name for a single render.
+// Like the environment's Globals, it is shadowed by the render's context, but
+// it overrides an environment global of the same name.
+func WithGlobal(name string, value interface{}) ExecuteOption {
+	return func(r *renderer) error {
+		if r.globals == nil {
+			r.globals = make(map[string]interface{})
+		}
+		r.globals[name] = value
+		return nil
+	}
+}
+
+// RenderResult holds information gathered during a render;  see WithResult.
+type RenderResult struct {
+	// Undefined is the set of paths of undefined names and attributes which
+	// were encountered, in the order they were first seen.
+	Undefined []string
+}
+
+// WithResult fills in res while rendering, so callers can check eg. that a
+// template got all of its data.
+func WithResult(res *RenderResult) ExecuteOption {
+	return func(r *renderer) error {
+		seen := make(map[string]bool)
+		r.onUndefined = append(r.onUndefined, func(path string) {
+			if !seen[path] {
+				seen[path] = true
+				res.Undefined = append(res.Undefined, path)
+			}
+		})
+		return nil
+	}
+}
+
+// WithContext renders with ctx, which can cancel a render which is waiting to
+// receive from a channel in a for loop.
+func WithContext(ctx context.Context) ExecuteOption {
+	return func(r *renderer) error {
+		r.ctx = ctx
+		return nil
+	}
+}
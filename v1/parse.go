@@ -1,9 +1,13 @@
 package v1
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // Important to jigo, as to most languages, is the idea of an expression.
@@ -105,11 +109,69 @@ type Template struct {
 	env  *Environment
 }
 
-// Render this template with the given context.
+// Clone returns a copy of this template with a deep copy of its parsed tree,
+// so the clone's tree can be modified, eg. to add blocks, without affecting
+// this template.  The clone shares this template's environment, but is not
+// registered with it.
+func (t *Template) Clone() *Template {
+	return &Template{Name: t.Name, base: t.base.Copy(), env: t.env}
+}
+
+// bufferPool holds buffers for Render, which are reused between renders.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Render this template with the given context, returning the output as a
+// string.
 func (t *Template) Render(context interface{}) (string, error) {
-	c := NewContextStack(context)
-	r := newRenderer(t)
-	return r.render(c)
+	b := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(b)
+	b.Reset()
+	err := t.Execute(b, context)
+	return b.String(), err
+}
+
+// Execute renders this template with the given context, writing the output
+// to w as it is rendered.  Options can add filters and globals for this
+// render only.  If the environment has an OutputEncoder, the output is
+// written through it, after collapsing whitespace if CollapseWhitespace is
+// set.
+func (t *Template) Execute(w io.Writer, context interface{}, opts ...ExecuteOption) (err error) {
+	closeWriter := func(c io.Closer) {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if t.env.OutputEncoder != nil {
+		w = t.env.OutputEncoder(w)
+		if c, ok := w.(io.Closer); ok {
+			defer closeWriter(c)
+		}
+	}
+	if t.env.CollapseWhitespace {
+		cw := newCollapseWriter(w)
+		defer closeWriter(cw)
+		w = cw
+	}
+	r := newRenderer(t, w)
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return err
+		}
+	}
+	return r.render(context)
+}
+
+// Validate renders this template with the given context without producing
+// any output, to check that the template and context are compatible.  Rather
+// than stopping at the first error, every error is collected and returned
+// in a *ValidationError.  Undefined names and attributes, which render as
+// nothing normally, are errors when validating.
+func (t *Template) Validate(context interface{}) error {
+	r := newRenderer(t, ioutil.Discard)
+	r.validate = true
+	return r.render(context)
 }
 
 // Tree is the representation of a single parsed template.
@@ -127,6 +189,10 @@ type Tree struct {
 	token     [3]item // three-token lookahead for parser.
 	peekCount int
 	stack     nodeStack
+	aliases   map[string]string // alternate names for block keywords.
+	blocks    map[string]bool   // names of the blocks parsed so far.
+	loops     int               // depth of the for loops being parsed.
+	comments  bool              // whether comments are kept as CommentNodes.
 	// vars      []string // variables defined at the moment.
 }
 
@@ -148,11 +214,47 @@ func (t *Tree) next() item {
 	if t.peekCount > 0 {
 		t.peekCount--
 	} else {
-		t.token[0] = t.lex.nextItem()
+		t.token[0] = t.lexItem()
 	}
 	return t.token[t.peekCount]
 }
 
+// lexItem returns the next token from the lexer.  Line statements are parsed
+// exactly like block tags, so their delimiters are read as block delimiters.
+// Comments and the tags around raw text are not represented in the AST, so
+// they are skipped here, where they cannot come between a block and its end
+// tag.  If comments are kept, each is instead read as a single tokenComment
+// holding its text, positioned at its start.
+func (t *Tree) lexItem() item {
+	for {
+		token := t.lex.nextItem()
+		switch token.typ {
+		case tokenLinestatementBegin:
+			token.typ = tokenBlockBegin
+		case tokenLinestatementEnd:
+			token.typ = tokenBlockEnd
+		case tokenCommentBegin:
+			begin, text := token, ""
+			for token.typ != tokenCommentEnd && token.typ != tokenError && token.typ != tokenEOF {
+				if token = t.lex.nextItem(); token.typ == tokenComment {
+					text = token.val
+				}
+			}
+			if token.typ != tokenCommentEnd {
+				return token
+			}
+			if t.comments {
+				begin.typ, begin.val = tokenComment, text
+				return begin
+			}
+			continue
+		case tokenLinecomment, tokenRawBegin, tokenRawEnd:
+			continue
+		}
+		return token
+	}
+}
+
 // backup backs the input stream up one token.
 func (t *Tree) backup() {
 	t.peekCount++
@@ -179,7 +281,7 @@ func (t *Tree) peek() item {
 		return t.token[t.peekCount-1]
 	}
 	t.peekCount = 1
-	t.token[0] = t.lex.nextItem()
+	t.token[0] = t.lexItem()
 	return t.token[0]
 }
 
@@ -270,7 +372,7 @@ func (t *Tree) ErrorContext(n Node) (location, context string) {
 // errorf formats the error and terminates processing.
 func (t *Tree) errorf(format string, args ...interface{}) {
 	t.Root = nil
-	format = fmt.Sprintf("template: %s:%d: %s", t.ParseName, t.lex.lineNumber(), format)
+	format = fmt.Sprintf("template: %s:%d:%d: %s", t.ParseName, t.lex.lineNumber(), t.lex.last.col, format)
 	panic(fmt.Errorf(format, args...))
 }
 
@@ -298,6 +400,7 @@ func (t *Tree) unexpected(token item, context string) {
 func (t *Tree) startParse(lex *lexer) {
 	t.Root = nil
 	t.lex = lex
+	t.blocks = make(map[string]bool)
 }
 
 // stopParse terminates parsing.
@@ -334,24 +437,45 @@ func (t *Tree) parse() {
 }
 
 // parseNextNode parses the next outer node and returns it.  If EOF is encountered,
-// parseNextNode returns nil.  Comments are discarded.
+// parseNextNode returns nil.  Comments are discarded unless they are kept.
 func (t *Tree) parseNextNode() Node {
 	for t.peek().typ != tokenEOF {
 		switch t.peek().typ {
-		case tokenCommentBegin:
-			t.skipComment()
-			continue
+		case tokenError:
+			t.errorf("%s", t.next().val)
 		case tokenBlockBegin:
 			return t.parseBlock()
 		case tokenVariableBegin:
 			return t.parseVar()
 		case tokenText:
 			return t.parseText()
+		case tokenComment:
+			token := t.next()
+			return newComment(token.pos, token.val)
 		}
 	}
 	return nil
 }
 
+// blockKeywords are the names which can begin a block tag.
+var blockKeywords = map[string]bool{
+	"for": true, "endfor": true, "if": true, "elif": true, "else": true, "endif": true,
+	"block": true, "endblock": true, "extends": true, "print": true, "macro": true,
+	"endmacro": true, "include": true, "from": true, "import": true, "call": true,
+	"endcall": true, "set": true, "cache": true, "endcache": true, "raw": true,
+	"endraw": true, "break": true, "continue": true,
+}
+
+// blockName returns the block keyword named by token, resolving aliases.
+// Aliases only apply to the names at the start of block tags, so they never
+// conflict with identifiers in expressions.
+func (t *Tree) blockName(token item) string {
+	if name, ok := t.aliases[token.val]; ok {
+		return name
+	}
+	return token.val
+}
+
 func (t *Tree) nextBlockName() string {
 	if t.peekNonSpace().typ != tokenBlockBegin {
 		return ""
@@ -359,7 +483,7 @@ func (t *Tree) nextBlockName() string {
 	eat := t.nextNonSpace()
 	name := t.peekNonSpace()
 	t.backup2(eat)
-	return name.val
+	return t.blockName(name)
 }
 
 func (t *Tree) parseText() Node {
@@ -372,22 +496,6 @@ func (t *Tree) parseText() Node {
 	return nil
 }
 
-// Skips over a comment;  comments are not represented in the final AST.
-func (t *Tree) skipComment() {
-	t.expect(tokenCommentBegin)
-	for {
-		token := t.nextNonSpace()
-		switch token.typ {
-		case tokenText:
-			continue
-		case tokenCommentEnd:
-		default:
-			t.unexpected(token, "end comment")
-		}
-		break
-	}
-}
-
 // Parse a variable print expression, from tokenVariableBegin to tokenVariableEnd
 // Contains a single expression.
 func (t *Tree) parseVar() Node {
@@ -401,37 +509,212 @@ func (t *Tree) parseVar() Node {
 func (t *Tree) parseBlock() Node {
 	start := t.expect(tokenBlockBegin)
 	blockType := t.peekNonSpace()
-	switch blockType.val {
+	switch t.blockName(blockType) {
 	case "for":
+		t.backup2(start)
+		return t.parseFor()
 	case "if":
 		t.backup2(start)
 		return t.parseIf()
 	case "block":
+		t.backup2(start)
+		return t.parseBlockTag()
+	case "cache":
+		t.backup2(start)
+		return t.parseCache()
 	case "extends":
 	case "print":
 	case "macro":
+		t.backup2(start)
+		return t.parseMacro()
 	case "include":
+		t.backup2(start)
+		return t.parseInclude()
 	case "from":
 	case "import":
 	case "call":
 	case "set":
 		t.backup2(start)
 		return t.parseSet()
+	case "break", "continue":
+		t.backup2(start)
+		return t.parseLoopControl()
 	default:
 		t.unexpected(blockType, "invalid block type")
 	}
 	return nil
 }
 
+// parseBlockTag parses a {% block name %} tag up to its {% endblock %}, which
+// may repeat the block's name.  Block names must be unique in a template.
+func (t *Tree) parseBlockTag() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	name := t.expect(tokenName)
+	if t.blocks[name.val] {
+		t.errorf("block %q defined twice", name.val)
+	}
+	t.blocks[name.val] = true
+	t.expect(tokenBlockEnd)
+	node := newBlock(begin.pos, name.val)
+	body := newList(t.peek().pos)
+	for t.nextBlockName() != "endblock" {
+		n := t.parseNextNode()
+		if n == nil {
+			t.errorf("unexpected EOF in block %q", name.val)
+		}
+		body.append(n)
+	}
+	t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	if tok := t.nextNonSpace(); tok.typ == tokenName {
+		if tok.val != name.val {
+			t.errorf("endblock %q does not match block %q", tok.val, name.val)
+		}
+		t.expect(tokenBlockEnd)
+	} else if tok.typ != tokenBlockEnd {
+		t.unexpected(tok, "endblock")
+	}
+	node.Body = body
+	return node
+}
+
+// parseCache parses a {% cache timeout key %} tag up to its {% endcache %}.
+// The timeout is a single expression, and the key is the rest of the tag.
+func (t *Tree) parseCache() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	node := newCache(begin.pos)
+	node.Timeout = t.parseSingleExpr(nil, tokenBlockEnd)
+	node.Key = t.parseExpr(nil, tokenBlockEnd)
+	t.expect(tokenBlockEnd)
+	body := newList(t.peek().pos)
+	for t.nextBlockName() != "endcache" {
+		n := t.parseNextNode()
+		if n == nil {
+			t.errorf("unexpected EOF in cache")
+		}
+		body.append(n)
+	}
+	t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	t.expect(tokenBlockEnd)
+	node.Body = body
+	return node
+}
+
+// parseMacro parses a {% macro name(params) %} tag up to its {% endmacro %}.
+// Parameters are names, optionally with a default value, as in `name=expr`;
+// parameters without a default cannot follow those with one.
+func (t *Tree) parseMacro() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	name := t.expect(tokenName)
+	node := newMacro(begin.pos, name.val)
+	t.expect(tokenLparen)
+	for {
+		token := t.nextNonSpace()
+		if token.typ == tokenRparen {
+			break
+		}
+		if len(node.Params) > 0 {
+			if token.typ != tokenComma {
+				t.unexpected(token, "macro parameters")
+			}
+			token = t.nextNonSpace()
+		}
+		if token.typ != tokenName {
+			t.unexpected(token, "macro parameters")
+		}
+		if indexOf(node.Params, token.val) >= 0 {
+			t.errorf("duplicate parameter %q in macro %q", token.val, name.val)
+		}
+		var def Node
+		if t.peekNonSpace().typ == tokenEq {
+			t.nextNonSpace()
+			def = t.parseExpr(nil, tokenRparen)
+		} else if len(node.Defaults) > 0 && node.Defaults[len(node.Defaults)-1] != nil {
+			t.errorf("parameter %q without a default follows one with a default in macro %q", token.val, name.val)
+		}
+		node.Params = append(node.Params, token.val)
+		node.Defaults = append(node.Defaults, def)
+	}
+	t.expect(tokenBlockEnd)
+	// a macro's body is not in any loop around it
+	loops := t.loops
+	t.loops = 0
+	body := newList(t.peek().pos)
+	for t.nextBlockName() != "endmacro" {
+		n := t.parseNextNode()
+		if n == nil {
+			t.errorf("unexpected EOF in macro %q", name.val)
+		}
+		body.append(n)
+	}
+	t.loops = loops
+	t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	t.expect(tokenBlockEnd)
+	node.Body = body
+	return node
+}
+
+// parseLoopControl parses a {% break %} or {% continue %} tag, which must be
+// in the body of a for loop.
+func (t *Tree) parseLoopControl() Node {
+	begin := t.expect(tokenBlockBegin)
+	name := t.blockName(t.nextNonSpace())
+	t.expect(tokenBlockEnd)
+	if t.loops == 0 {
+		t.errorf("%s outside of a loop", name)
+	}
+	if name == "break" {
+		return newBreak(begin.pos)
+	}
+	return newContinue(begin.pos)
+}
+
+// parseInclude parses an {% include template %} tag, where template is an
+// expression giving the name of the template to include.
+func (t *Tree) parseInclude() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	node := newInclude(begin.pos, t.parseExpr(nil, tokenBlockEnd))
+	t.expect(tokenBlockEnd)
+	return node
+}
+
 func (t *Tree) parseSet() Node {
 	start := t.expect(tokenBlockBegin)
 	set := t.nextNonSpace()
-	if set.val != "set" {
+	if t.blockName(set) != "set" {
 		t.unexpected(set, "set")
 	}
+	if t.startsTupleTarget() {
+		target := t.parseTarget()
+		t.expect(tokenEq)
+		val := t.parseExpr(nil, tokenBlockEnd)
+		t.expect(tokenBlockEnd)
+		return newSet(start.pos, target, val)
+	}
 	name := t.lookupExpr()
-	t.expect(tokenEq)
-	val := t.parseSingleExpr(nil, tokenBlockEnd)
+	// augmented assignments, ie. `x += 1`, set x to `x + 1`
+	switch op := t.nextNonSpace(); op.typ {
+	case tokenEq:
+	case tokenAdd, tokenSub, tokenMul, tokenDiv:
+		if eq := t.next(); eq.typ != tokenEq {
+			t.unexpected(eq, "augmented assignment")
+		}
+		val := t.parseExpr(nil, tokenBlockEnd)
+		t.expect(tokenBlockEnd)
+		if op.typ == tokenAdd || op.typ == tokenSub {
+			return newSet(start.pos, name, newAddExpr(name.Copy(), val, op))
+		}
+		return newSet(start.pos, name, newMulExpr(name.Copy(), val, op))
+	default:
+		t.unexpected(op, "set")
+	}
+	val := t.parseExpr(nil, tokenBlockEnd)
 	t.expect(tokenBlockEnd)
 	return newSet(start.pos, name, val)
 }
@@ -439,13 +722,13 @@ func (t *Tree) parseSet() Node {
 func (t *Tree) parseIf() Node {
 	begin := t.expect(tokenBlockBegin)
 	iftok := t.nextNonSpace()
-	if iftok.val != "if" {
+	if t.blockName(iftok) != "if" {
 		t.unexpected(iftok, "if")
 	}
 	node := newIf(begin.pos)
 
 	cond := newIfCond(begin.pos)
-	cond.Guard = t.parseSingleExpr(nil, tokenBlockEnd)
+	cond.Guard = t.parseExpr(nil, tokenBlockEnd)
 	t.expect(tokenBlockEnd)
 	body := newList(t.peek().pos)
 	// we need some kind of parseBody here
@@ -456,20 +739,20 @@ func (t *Tree) parseIf() Node {
 		switch block {
 		case "elif":
 			if inElse {
-				panic("Elif encountered after previous else")
+				t.errorf("elif encountered after previous else")
 			}
 			// set the body for the previous conditional and append it
 			cond.Body = body
 			node.Conditionals = append(node.Conditionals, cond)
 			// create a new elif conditional
-			cond := newElifCond(t.next().pos)
+			cond = newElifCond(t.next().pos)
 			t.nextNonSpace()
-			cond.Guard = t.parseSingleExpr(nil, tokenBlockEnd)
+			cond.Guard = t.parseExpr(nil, tokenBlockEnd)
 			t.expect(tokenBlockEnd)
 			body = newList(t.peek().pos)
 		case "else":
 			if inElse {
-				panic("Else encountered after previous else")
+				t.errorf("else encountered after previous else")
 			}
 			cond.Body = body
 			node.Conditionals = append(node.Conditionals, cond)
@@ -486,26 +769,135 @@ func (t *Tree) parseIf() Node {
 			if inElse {
 				node.Else = body
 			} else {
+				cond.Body = body
 				node.Conditionals = append(node.Conditionals, cond)
 			}
 			return node
 		default:
 			n := t.parseNextNode()
 			if n == nil {
-				panic("EOF inside an If")
-				// EOF inside an If
-				return nil
+				t.errorf("unexpected EOF in if")
 			}
 			body.append(n)
 		}
 	}
-	fmt.Println(t.peekNonSpace())
-	return nil
+}
+
+func (t *Tree) parseFor() Node {
+	begin := t.expect(tokenBlockBegin)
+	fortok := t.nextNonSpace()
+	if t.blockName(fortok) != "for" {
+		t.unexpected(fortok, "for")
+	}
+	node := newFor(begin.pos)
+	node.ForExpr = t.parseTarget()
+	if in := t.nextNonSpace(); in.typ != tokenKeyword || in.val != "in" {
+		t.unexpected(in, "for")
+	}
+	node.InExpr = t.parseBinaryExpr(1, tokenBlockEnd)
+	if tok := t.peekNonSpace(); tok.typ == tokenName && tok.val == "recursive" {
+		t.nextNonSpace()
+		node.Recursive = true
+	}
+	t.expect(tokenBlockEnd)
+	body := newList(t.peek().pos)
+	// break and continue are allowed in the body, but not the else block
+	t.loops++
+
+	for {
+		switch t.nextBlockName() {
+		case "else":
+			if node.Body != nil {
+				t.errorf("else encountered after previous else")
+			}
+			node.Body = body
+			t.loops--
+			t.expect(tokenBlockBegin)
+			t.nextNonSpace()
+			t.expect(tokenBlockEnd)
+			body = newList(t.peek().pos)
+		case "endfor":
+			t.expect(tokenBlockBegin)
+			t.nextNonSpace()
+			t.expect(tokenBlockEnd)
+			if node.Body != nil {
+				node.Else = body
+			} else {
+				node.Body = body
+				t.loops--
+			}
+			return node
+		default:
+			n := t.parseNextNode()
+			if n == nil {
+				t.errorf("unexpected EOF in for")
+			}
+			body.append(n)
+		}
+	}
+}
+
+// parse the target of a for loop, which is a name or a comma separated list
+// of targets to unpack each item into.  Parenthesized targets unpack nested
+// sequences, ie. `i, (a, b)`.
+func (t *Tree) parseTarget() Node {
+	var names []Node
+	starred := false
+	for {
+		switch t.peekNonSpace().typ {
+		case tokenLparen:
+			t.nextNonSpace()
+			names = append(names, t.parseTarget())
+			t.expect(tokenRparen)
+		case tokenMul:
+			star := t.nextNonSpace()
+			if starred {
+				t.errorf("multiple starred names in assignment")
+			}
+			starred = true
+			name := t.expect(tokenName)
+			names = append(names, newStar(star.pos, newLookup(name.pos, name.val)))
+		default:
+			name := t.expect(tokenName)
+			names = append(names, newLookup(name.pos, name.val))
+		}
+		if t.peekNonSpace().typ != tokenComma {
+			break
+		}
+		t.nextNonSpace()
+	}
+	if len(names) == 1 {
+		if starred {
+			t.errorf("starred assignment target must be in a tuple")
+		}
+		return names[0]
+	}
+	return newTuple(names[0].Position(), names)
+}
+
+// startsTupleTarget reports whether the next tokens begin an assignment
+// target of more than one name, like `a, b` or `head, *tail`.
+func (t *Tree) startsTupleTarget() bool {
+	switch t.peekNonSpace().typ {
+	case tokenLparen, tokenMul:
+		return true
+	case tokenName:
+		eat := t.nextNonSpace()
+		next := t.peekNonSpace()
+		t.backup2(eat)
+		return next.typ == tokenComma
+	}
+	return false
 }
 
 // parse a single expression simple expression.  This is a lookup, literal, or
-// index expression.
+// index expression, optionally followed by filters and a test.
 func (t *Tree) parseSingleExpr(stack *nodeStack, terminator itemType) Node {
+	return t.maybeTestExpr(t.maybeFilterExpr(t.parseOperand(terminator)), terminator)
+}
+
+// parse an operand, which is a single expression without any filters.
+func (t *Tree) parseOperand(terminator itemType) Node {
 	token := t.peekNonSpace()
 	switch token.typ {
 	case terminator:
@@ -513,25 +905,28 @@ func (t *Tree) parseSingleExpr(stack *nodeStack, terminator itemType) Node {
 	case tokenName:
 		return t.lookupExpr()
 	case tokenLparen:
-		t.expect(tokenLparen)
-		return t.parseExpr(nil, tokenRparen)
+		return t.maybeIndexExpr(t.parenExpr())
 	case tokenLbrace:
 		return t.mapExpr()
 	case tokenLbracket:
 		return t.listExpr()
-	case tokenFloat, tokenInteger, tokenString, tokenBool:
+	case tokenFloat, tokenInteger, tokenString, tokenBool, tokenNone:
 		return t.literalExpr()
 	case tokenAdd, tokenSub:
 		unary := t.nextNonSpace()
-		value := t.parseSingleExpr(nil, terminator)
+		value := t.parseOperand(terminator)
 		switch value.Type() {
 		case NodeUnary:
 			t.unexpected(unary, "expression")
 		case NodeFloat:
-			// FIXME: apply unary oper to value
+			if unary.typ == tokenSub {
+				value.(*FloatNode).Value *= -1
+			}
 			return value
 		case NodeInteger:
-			// FIXME: apply unary oper to value
+			if unary.typ == tokenSub {
+				value.(*IntegerNode).Value *= -1
+			}
 			return value
 		default:
 			return newUnaryNode(value, unary)
@@ -542,72 +937,118 @@ func (t *Tree) parseSingleExpr(stack *nodeStack, terminator itemType) Node {
 	panic("unexpected")
 }
 
-// Parses an expression until it hits a terminator.  An expression one of
-// a few types of expressions, some of which can contain Expressions
-// themselves.  A stack is passed with each callframe.
+// Parses an expression until it hits a terminator.  Within a map, list,
+// argument list or index, a comma or colon may also end the expression.
 func (t *Tree) parseExpr(stack *nodeStack, terminator itemType) Node {
-	token := t.peekNonSpace()
-	if stack == nil {
-		stack = newStack(token.pos)
+	n := t.parseTernary(terminator)
+	switch token := t.peekNonSpace(); token.typ {
+	case terminator:
+	case tokenColon:
+		// colons separate the bounds of a slice expression
+		if terminator != tokenRbracket {
+			t.unexpected(token, "expression")
+		}
+	case tokenComma:
+		// if we are terminating a map, param list, or list, return the expression
+		if terminator != tokenRbracket && terminator != tokenRparen && terminator != tokenRbrace {
+			t.unexpected(token, "expression")
+		}
+	default:
+		t.unexpected(token, "expression")
+	}
+	return n
+}
+
+// parseTernary parses a conditional expression, `a if cond else b`, or the
+// binary expression a if there is no `if`.  The else branch is optional, and
+// conditionals in it nest, so `a if x else b if y else c` is
+// `a if x else (b if y else c)`.
+func (t *Tree) parseTernary(terminator itemType) Node {
+	n := t.parseBinaryExpr(1, terminator)
+	if tok := t.peekNonSpace(); tok.typ != tokenKeyword || tok.val != "if" {
+		return n
 	}
-	stack.push(t.parseSingleExpr(stack, terminator))
+	t.nextNonSpace()
+	cond := t.parseBinaryExpr(1, terminator)
+	var els Node
+	if tok := t.peekNonSpace(); tok.typ == tokenName && tok.val == "else" {
+		t.nextNonSpace()
+		els = t.parseTernary(terminator)
+	}
+	return newTernary(n, cond, els)
+}
+
+// parseBinaryExpr parses binary operators by precedence climbing, consuming
+// operators whose precedence is at least prec.  Operators of equal precedence
+// associate to the left, except for comparisons, which chain.  A leading
+// `not` applies to the comparison which follows it, so `not a == b` is
+// `not (a == b)`, but `not a and b` is `(not a) and b`.
+func (t *Tree) parseBinaryExpr(prec int, terminator itemType) Node {
+	var lhs Node
+	if not := t.peekNonSpace(); not.typ == tokenKeyword && not.val == "not" {
+		t.nextNonSpace()
+		lhs = newNot(not.pos, t.parseBinaryExpr(3, terminator))
+	} else {
+		lhs = t.parseSingleExpr(nil, terminator)
+	}
+	var chain *CompareExpr
 	for {
-		token = t.peekNonSpace()
-		switch token.typ {
-		case terminator:
-			if stack.len() == 0 {
-				fmt.Printf("Stack: %#v\n", stack)
-				t.unexpected(token, "zero length expression")
+		op := t.peekNonSpace()
+		p := op.precedence()
+		if p == 0 || p < prec {
+			return lhs
+		}
+		t.nextNonSpace()
+		if op.typ == tokenKeyword && op.val == "not" {
+			if in := t.nextNonSpace(); in.typ != tokenKeyword || in.val != "in" {
+				t.unexpected(in, "not in")
 			}
-			return stack.pop()
+			op.val = "not in"
+		}
+		rhs := t.parseBinaryExpr(p+1, terminator)
+		switch op.typ {
 		case tokenAdd, tokenSub:
-			// consume the plus token
-			t.nextNonSpace()
-			// if the stack isn't empty, the previous expression is the lhs for the
-			// upcoming expression:
-			if stack.len() > 0 {
-				rhs := t.parseExpr(stack, terminator)
-				// if the token after the rhs expression is an operator with greater precedence,
-				// push rhs to the stack and continue going from there
-				if tok := t.peekNonSpace(); tok.precedence() > token.precedence() {
-					stack.push(rhs)
-					return t.parseExpr(stack, terminator)
+			lhs = newAddExpr(lhs, rhs, op)
+		case tokenMul, tokenDiv, tokenFloordiv, tokenMod:
+			lhs = newMulExpr(lhs, rhs, op)
+		case tokenTilde:
+			lhs = newConcat(lhs, rhs)
+		case tokenAnd:
+			lhs = newAnd(lhs, rhs)
+		case tokenOr:
+			lhs = newOr(lhs, rhs)
+		case tokenKeyword:
+			switch op.val {
+			case "and":
+				lhs = newAnd(lhs, rhs)
+			case "or":
+				lhs = newOr(lhs, rhs)
+			default:
+				if chain != nil && chain == lhs {
+					chain.append(op, rhs)
 				} else {
-					// otherwise, take lhs off the stack and create a new AddExpr
-					lhs := stack.pop()
-					stack.push(newAddExpr(lhs, rhs, token))
+					chain = newCompareExpr(lhs, rhs, op)
+					lhs = chain
 				}
 			}
-		case tokenMul, tokenMod, tokenDiv, tokenFloordiv:
-			t.nextNonSpace()
-			if stack.len() > 0 {
-				lhs := stack.pop()
-				rhs := t.parseSingleExpr(stack, terminator)
-				// we know this strongly binds ltr so no need to peek
-				stack.push(newMulExpr(lhs, rhs, token))
+		case tokenEqEq, tokenNeq, tokenLt, tokenLteq, tokenGt, tokenGteq:
+			if chain != nil && chain == lhs {
+				chain.append(op, rhs)
 			} else {
-				t.unexpected(token, "binary op")
-			}
-		case tokenComma:
-			// if we are terminating a map, param list, or list, return the expression
-			if terminator == tokenRbracket || terminator == tokenRparen || terminator == tokenRbrace {
-				if stack.len() != 1 {
-					t.unexpected(token, "expression")
-				}
-				return stack.pop()
+				chain = newCompareExpr(lhs, rhs, op)
+				lhs = chain
 			}
 		default:
-			t.unexpected(token, "expression")
+			t.unexpected(op, "expression")
 		}
 	}
-	panic("required expr but got none")
 }
 
 // in this sense, a literal is a simple lexer-level literal
 func (t *Tree) literalExpr() Node {
 	token := t.nextNonSpace()
 	switch token.typ {
-	case tokenFloat, tokenInteger, tokenString, tokenBool:
+	case tokenFloat, tokenInteger, tokenString, tokenBool, tokenNone:
 		return newLiteral(token.pos, token.typ, token.val)
 	default:
 		t.unexpected(token, "literal")
@@ -620,25 +1061,150 @@ func (t *Tree) lookupExpr() Node {
 	return t.maybeIndexExpr(newLookup(name.pos, name.val))
 }
 
-// determine if there is one or more index expressions on the end
-// of the expression passed in.  If there is, return a lookup expr,
-// otherwise, return the original node
+// determine if there is one or more index, attribute or call expressions on
+// the end of the expression passed in.  If there is, return an index, attr or
+// call expr wrapping n, otherwise, return the original node
 func (t *Tree) maybeIndexExpr(n Node) Node {
 	for {
-		tok := t.peekNonSpace()
-		if tok.typ == tokenLbrace {
+		switch tok := t.peekNonSpace(); tok.typ {
+		case tokenLbracket:
+			n = t.indexExpr(n)
+		case tokenLparen:
+			n = newCallExpr(n, t.parseArgs())
+		case tokenDot:
 			t.nextNonSpace()
-			index := t.parseExpr(nil, tokenRbrace)
-			n = newIndexExpr(n, index)
-		} else {
+			name := t.expect(tokenName)
+			n = newAttrExpr(n, name.val)
+		default:
 			return n
 		}
 	}
 }
 
-func (t *Tree) parenExpr() Node {
-	t.next()
-	return nil
+// parse an index or a slice of n, from the opening '[' to the closing ']'.
+// Slices can have up to three bounds, any of which may be omitted.
+func (t *Tree) indexExpr(n Node) Node {
+	t.expect(tokenLbracket)
+	var bounds [3]Node
+	colons := 0
+	for {
+		switch token := t.peekNonSpace(); token.typ {
+		case tokenRbracket:
+			t.nextNonSpace()
+			if colons > 0 {
+				return newSliceExpr(n, bounds[0], bounds[1], bounds[2])
+			}
+			if bounds[0] == nil {
+				t.unexpected(token, "index expression")
+			}
+			return newIndexExpr(n, bounds[0])
+		case tokenColon:
+			if colons == 2 {
+				t.unexpected(token, "slice expression")
+			}
+			t.nextNonSpace()
+			colons++
+		default:
+			if bounds[colons] != nil {
+				t.unexpected(token, "index expression")
+			}
+			bounds[colons] = t.parseExpr(nil, tokenRbracket)
+		}
+	}
+}
+
+// testArgKeywords are the names which end a test rather than being its
+// argument, ie. the `else` in `a if x is defined else b`.  Keywords like
+// `and` are lexed as tokenKeyword, so never start an argument.
+var testArgKeywords = map[string]bool{
+	"else": true, "recursive": true,
+}
+
+// determine if a test is applied to the expression passed in, ie. `n is even`
+// or `n is not divisibleby 3`.  A test's arguments are either a parenthesized
+// list, or a single operand following its name, so `divisibleby(3)` and
+// `divisibleby 3` are the same.
+func (t *Tree) maybeTestExpr(n Node, terminator itemType) Node {
+	if tok := t.peekNonSpace(); tok.typ != tokenKeyword || tok.val != "is" {
+		return n
+	}
+	t.nextNonSpace()
+	negated := false
+	if tok := t.peekNonSpace(); tok.typ == tokenKeyword && tok.val == "not" {
+		t.nextNonSpace()
+		negated = true
+	}
+	// the none, true and false tests are lexed as literals
+	name := t.nextNonSpace()
+	switch name.typ {
+	case tokenName, tokenNone, tokenBool:
+	default:
+		t.unexpected(name, "test")
+	}
+	var args []Node
+	switch tok := t.peekNonSpace(); tok.typ {
+	case tokenLparen:
+		args = t.parseArgs()
+	case tokenName:
+		if testArgKeywords[tok.val] {
+			break
+		}
+		fallthrough
+	case tokenFloat, tokenInteger, tokenString, tokenBool, tokenNone, tokenLbracket, tokenLbrace:
+		args = []Node{t.parseOperand(terminator)}
+	}
+	return newTestNode(n, name.val, args, negated)
+}
+
+// determine if there are one or more filters applied to the expression
+// passed in.  Each filter wraps the previous, so they apply left to right.
+func (t *Tree) maybeFilterExpr(n Node) Node {
+	for t.peekNonSpace().typ == tokenPipe {
+		t.nextNonSpace()
+		name := t.expect(tokenName)
+		var args []Node
+		if t.peekNonSpace().typ == tokenLparen {
+			args = t.parseArgs()
+		}
+		n = newFilterNode(n, name.val, args)
+	}
+	return n
+}
+
+// parse a parenthesized, comma separated list of argument expressions.
+// Keyword arguments are parsed into KeywordNodes and must come after all
+// positional arguments.
+func (t *Tree) parseArgs() []Node {
+	t.expect(tokenLparen)
+	args := []Node{}
+	kwargs := false
+	for {
+		switch token := t.peekNonSpace(); token.typ {
+		case tokenRparen:
+			t.nextNonSpace()
+			return args
+		case tokenComma:
+			if len(args) == 0 {
+				t.unexpected(token, "argument list")
+			}
+			t.nextNonSpace()
+		case tokenName:
+			name := t.nextNonSpace()
+			if t.peekNonSpace().typ == tokenEq {
+				t.nextNonSpace()
+				args = append(args, newKeyword(name.pos, name.val, t.parseExpr(nil, tokenRparen)))
+				kwargs = true
+				continue
+			}
+			t.backup2(name)
+			fallthrough
+		default:
+			if kwargs {
+				t.unexpected(token, "argument list after keyword arguments")
+			}
+			args = append(args, t.parseExpr(nil, tokenRparen))
+		}
+	}
 }
 
 func (t *Tree) mapExpr() Node {
@@ -674,23 +1240,41 @@ func (t *Tree) mapElem() Node {
 
 }
 
+// parenExpr parses a parenthesized expression, or a tuple literal if it is
+// empty or has a comma, so `(1)` is 1 but `(1,)` is a tuple of one.
+func (t *Tree) parenExpr() Node {
+	lparen := t.expect(tokenLparen)
+	var elems []Node
+	tuple := false
+	for t.peekNonSpace().typ != tokenRparen {
+		elems = append(elems, t.parseExpr(nil, tokenRparen))
+		if t.peekNonSpace().typ != tokenComma {
+			break
+		}
+		t.nextNonSpace()
+		tuple = true
+	}
+	t.expect(tokenRparen)
+	switch {
+	case len(elems) == 0:
+		return newTuple(lparen.pos, elems)
+	case len(elems) == 1 && !tuple:
+		return elems[0]
+	}
+	return newTuple(elems[0].Position(), elems)
+}
+
+// listExpr parses a list literal, which may have a trailing comma.
 func (t *Tree) listExpr() Node {
 	tok := t.expect(tokenLbracket)
-	list := newList(tok.pos)
-	for {
-		token := t.peekNonSpace()
-		switch token.typ {
-		case tokenComma:
-			if list.len() == 0 {
-				t.unexpected(token, "list expression")
-			}
-			t.expect(tokenComma)
-		case tokenRbracket:
-			t.next()
-			return t.maybeIndexExpr(list)
-		default:
-			elem := t.parseExpr(nil, tokenRbrace)
-			list.append(elem)
+	list := newListLiteral(tok.pos)
+	for t.peekNonSpace().typ != tokenRbracket {
+		list.append(t.parseExpr(nil, tokenRbracket))
+		if t.peekNonSpace().typ != tokenComma {
+			break
 		}
+		t.nextNonSpace()
 	}
+	t.expect(tokenRbracket)
+	return t.maybeIndexExpr(list)
 }
@@ -2,6 +2,9 @@ package v1
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -27,16 +30,34 @@ func (n NodeType) String() string {
 		return "NodeString"
 	case NodeBool:
 		return "NodeBool"
+	case NodeNone:
+		return "NodeNone"
 	case NodeAdd:
 		return "NodeAdd"
 	case NodeMul:
 		return "NodeMul"
+	case NodeCompare:
+		return "NodeCompare"
 	case NodeMapExpr:
 		return "NodeMapExpr"
 	case NodeMapElem:
 		return "NodeMapElem"
+	case NodeTuple:
+		return "NodeTuple"
 	case NodeIndexExpr:
 		return "NodeIndexExpr"
+	case NodeSliceExpr:
+		return "NodeSliceExpr"
+	case NodeAttr:
+		return "NodeAttr"
+	case NodeCall:
+		return "NodeCall"
+	case NodeFilter:
+		return "NodeFilter"
+	case NodeTest:
+		return "NodeTest"
+	case NodeKeyword:
+		return "NodeKeyword"
 	case NodeSet:
 		return "NodeSet"
 	case NodeIf:
@@ -45,6 +66,34 @@ func (n NodeType) String() string {
 		return "NodeElseIf"
 	case NodeFor:
 		return "NodeFor"
+	case NodeBlock:
+		return "NodeBlock"
+	case NodeCache:
+		return "NodeCache"
+	case NodeStar:
+		return "NodeStar"
+	case NodeMacro:
+		return "NodeMacro"
+	case NodeInclude:
+		return "NodeInclude"
+	case NodeBreak:
+		return "NodeBreak"
+	case NodeContinue:
+		return "NodeContinue"
+	case NodeConcat:
+		return "NodeConcat"
+	case NodeAnd:
+		return "NodeAnd"
+	case NodeOr:
+		return "NodeOr"
+	case NodeNot:
+		return "NodeNot"
+	case NodeTernary:
+		return "NodeTernary"
+	case NodeListLiteral:
+		return "NodeListLiteral"
+	case NodeComment:
+		return "NodeComment"
 	default:
 		return "Unknown Type"
 	}
@@ -190,6 +239,11 @@ func TestParser(t *testing.T) {
 		parseTest{nodeTypes: []NodeType{NodeVar}},
 	)
 
+	tester.Test(
+		`{{ data.user["user.email"] }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar}},
+	)
+
 	tester.Test(
 		`{% set foo = 1 %}`,
 		parseTest{nodeTypes: []NodeType{NodeSet}},
@@ -199,4 +253,215 @@ func TestParser(t *testing.T) {
 		`{% if true %}something{% else %}something else{% endif %}`,
 		parseTest{nodeTypes: []NodeType{NodeIf}},
 	)
+
+	tester.Test(
+		`{% for k, v in d.items() %}{{ k }}{% else %}empty{% endfor %}!`,
+		parseTest{nodeTypes: []NodeType{NodeFor, NodeText}},
+	)
+}
+
+func TestKeywordAliases(t *testing.T) {
+	e := NewEnvironment()
+	e.KeywordAliases = map[string]string{"fi": "endif", "done": "endfor", "si": "if"}
+	fixtures := []evalFixture{
+		{"Endif alias", `{% if x %}yes{% fi %}`, m{"x": true}, "yes"},
+		{"Endif alias else", `{% si x %}yes{% else %}no{% fi %}`, m{"x": false}, "no"},
+		{"Endfor alias", `{% for i in l %}{{ i }}{% done %}`, m{"l": []int{1, 2}}, "12"},
+		{"Canonical", `{% if x %}yes{% endif %}`, m{"x": true}, "yes"},
+		{"Identifier", `{% if fi %}{{ fi }}{% fi %}`, m{"fi": true}, "true"},
+	}
+	testFixtures(t, e, fixtures)
+
+	for _, aliases := range []map[string]string{{"if": "endif"}, {"fi": "endwhile"}} {
+		e.KeywordAliases = aliases
+		if _, err := e.ParseString(`{% if x %}{% endif %}`, "bad", "bad"); err == nil {
+			t.Errorf("Expected error for aliases %v", aliases)
+		}
+	}
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	e := NewEnvironment()
+	tests := []struct{ in, out string }{
+		{`{{ 1 + 2 * 3 + 4 }}`, "1 + 2 * 3 + 4"},
+		{`{{ 1 - 2 - 3 }}`, "1 - 2 - 3"},
+		{`{{ (1 + 2) * 3 }}`, "(1 + 2) * 3"},
+		{`{{ 1 - (2 - 3) }}`, "1 - (2 - 3)"},
+		{`{{ (a + b).c|f }}`, "(a + b).c | f"},
+		{`{{ x not in l }}`, "x not in l"},
+		{`{{ x  in  l }}`, "x in l"},
+		{`{{ a < b <= c }}`, "a < b <= c"},
+		{`{{ x|length > 1 + 2 }}`, "x | length > 1 + 2"},
+	}
+	for _, test := range tests {
+		tree, err := e.parse(test.in, "test", "test")
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if s := tree.Root.Nodes[0].(*VarNode).Node.String(); s != test.out {
+			t.Errorf("%s: expected `%s`, got `%s`", test.in, test.out, s)
+		}
+	}
+
+	tree, _ := e.parse(`{{ 1 - 2 - 3 }}`, "test", "test")
+	sub := tree.Root.Nodes[0].(*VarNode).Node.(*AddExpr)
+	if _, ok := sub.lhs.(*AddExpr); !ok {
+		t.Errorf("Expected subtraction to associate to the left, got %#v", sub)
+	}
+	tree, _ = e.parse(`{{ a < b < c }}`, "test", "test")
+	if cmp := tree.Root.Nodes[0].(*VarNode).Node.(*CompareExpr); len(cmp.Operands) != 3 {
+		t.Errorf("Expected a chained comparison of 3 operands, got %d", len(cmp.Operands))
+	}
+}
+
+func TestMaxTemplateBytes(t *testing.T) {
+	e := NewEnvironment()
+	e.MaxTemplateBytes = 16
+	under := "{{ x }}" + strings.Repeat("a", 9)
+	over := under + "a"
+
+	if _, err := e.ParseString(under, "under", "under"); err != nil {
+		t.Errorf("Unexpected error for a template at the limit: %s", err)
+	}
+	if _, err := e.Parse(strings.NewReader(under), "under", "under"); err != nil {
+		t.Errorf("Unexpected error reading a template at the limit: %s", err)
+	}
+	for _, parse := range []func() (*Template, error){
+		func() (*Template, error) { return e.ParseString(over, "over", "over") },
+		func() (*Template, error) { return e.Parse(strings.NewReader(over), "over", "over") },
+	} {
+		_, err := parse()
+		if err == nil || !strings.Contains(err.Error(), "larger than the maximum of 16 bytes") {
+			t.Errorf("Expected size error, got %v", err)
+		}
+	}
+
+	e.MaxTemplateBytes = 0
+	if _, err := e.ParseString(over, "over", "over"); err != nil {
+		t.Errorf("Unexpected error without a limit: %s", err)
+	}
+}
+
+func TestTemplateRegistry(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.html":  "a {{ x }}",
+		"b.html":  "b {{ x }}",
+		"c.txt":   "c {{ x }}",
+		"bad.tpl": "{{ x",
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(e *Environment, name string) string {
+		var b strings.Builder
+		if err := e.ExecuteTemplate(&b, name, m{"x": 1}); err != nil {
+			t.Errorf("Unexpected error executing %s: %s", name, err)
+		}
+		return b.String()
+	}
+
+	e := NewEnvironment()
+	if _, err := e.ParseString("s {{ x }}", "s", "s.html"); err != nil {
+		t.Fatal(err)
+	}
+	if out := render(e, "s"); out != "s 1" {
+		t.Errorf("Expected ParseString to register s, got %q", out)
+	}
+	if _, err := e.ParseFragment(strings.NewReader("f")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get("temporary"); err == nil {
+		t.Errorf("Expected fragments not to be registered")
+	}
+
+	if err := e.ParseFiles(filepath.Join(dir, "a.html"), filepath.Join(dir, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if out := render(e, "a.html") + render(e, "c.txt"); out != "a 1c 1" {
+		t.Errorf("Expected ParseFiles to register by base name, got %q", out)
+	}
+	if err := e.ParseFiles(); err == nil {
+		t.Errorf("Expected error for ParseFiles with no files")
+	}
+	if err := e.ParseFiles(filepath.Join(dir, "missing.html")); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+	if err := e.ParseFiles(filepath.Join(dir, "bad.tpl")); err == nil || !strings.Contains(err.Error(), "unclosed tag") {
+		t.Errorf("Expected unclosed tag error for a bad template, got %v", err)
+	}
+
+	e = NewEnvironment()
+	if err := e.ParseGlob(filepath.Join(dir, "*.html")); err != nil {
+		t.Fatal(err)
+	}
+	if out := render(e, "a.html") + render(e, "b.html"); out != "a 1b 1" {
+		t.Errorf("Expected ParseGlob to register matches, got %q", out)
+	}
+	if _, err := e.Get("c.txt"); err == nil {
+		t.Errorf("Expected c.txt not to match the glob")
+	}
+	err := e.ParseGlob(filepath.Join(dir, "*.none"))
+	if err == nil || !strings.Contains(err.Error(), "matches no files") {
+		t.Errorf("Expected zero-match error, got %v", err)
+	}
+	if err := e.ExecuteTemplate(ioutil.Discard, "missing", nil); err == nil {
+		t.Errorf("Expected error executing an unregistered template")
+	}
+}
+
+func TestClone(t *testing.T) {
+	src := `{{ n + 1 }}{% if n * 2 > 4 %}big{% else %}small{% endif %}{% for i in items[1:] %}{{ i }}{% endfor %}`
+	tpl, err := NewEnvironment().ParseString(src, "clone", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := m{"n": 3, "items": []int{1, 2, 3}}
+	want, err := tpl.Render(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := tpl.Clone()
+	root := clone.base.Root
+	root.Nodes[0].(*VarNode).Node.(*AddExpr).rhs.(*IntegerNode).Value = 10
+	guard := root.Nodes[1].(*IfBlockNode).Conditionals[0].(*ConditionalNode).Guard.(*CompareExpr)
+	guard.Operands[0].(*MulExpr).rhs.(*IntegerNode).Value = 1
+	root.Nodes[2].(*ForNode).InExpr.(*SliceExpr).Start.(*IntegerNode).Value = 2
+	block := newBlock(0, "footer")
+	block.Body = newList(0)
+	block.Body.(*ListNode).append(&TextNode{NodeText, 0, []byte("!")})
+	root.append(block)
+
+	if out, err := clone.Render(ctx); err != nil || out != "13small3!" {
+		t.Errorf("Expected the clone to render %q, got %q, %v", "13small3!", out, err)
+	}
+	if out, err := tpl.Render(ctx); err != nil || out != want {
+		t.Errorf("Expected the original to render %q, got %q, %v", want, out, err)
+	}
+	if want != "4big23" {
+		t.Errorf("Expected %q, got %q", "4big23", want)
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	e := NewEnvironment()
+	e.KeepComments = true
+	tpl, err := e.ParseString("a{# one #}{% if x %}{#two#}b{% endif %}", "comments", "comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := tpl.base.Root.Nodes[1].(*CommentNode)
+	if !ok || c.Text != " one " || c.Position() != 1 {
+		t.Errorf("Expected the comment ` one ` at 1, got %v", tpl.base.Root.Nodes[1])
+	}
+	if out, err := tpl.Render(m{"x": true}); err != nil || out != "ab" {
+		t.Errorf("Expected comments to render nothing, got %q, %v", out, err)
+	}
+	if len(tpl.Clone().base.Root.Nodes) != 3 {
+		t.Errorf("Expected comments to be copied")
+	}
 }
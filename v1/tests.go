@@ -0,0 +1,147 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A test is a function which checks a value and returns a bool.  Tests are
+// used by filters such as select and selectattr.
+type test struct {
+	fn reflect.Value
+}
+
+func newTest(fn interface{}) (*test, error) {
+	t := &test{fn: reflect.ValueOf(fn)}
+	if err := checkFunc(t.fn); err != nil {
+		return nil, err
+	}
+	typ := t.fn.Type()
+	if typ.NumIn() == 0 {
+		return nil, fmt.Errorf("test %v must accept at least one argument", typ)
+	}
+	if typ.Out(0).Kind() != reflect.Bool {
+		return nil, fmt.Errorf("test %v must return a bool", typ)
+	}
+	return t, nil
+}
+
+// apply calls the test on value with args.
+func (t *test) apply(value interface{}, args []interface{}) (bool, error) {
+	out, err := call(t.fn, append([]interface{}{value}, args...), nil)
+	if err != nil {
+		return false, err
+	}
+	return reflect.ValueOf(out).Bool(), nil
+}
+
+// builtin tests available to every environment.  Tests which compare values
+// are added by NewEnvironment, as they use the environment's comparators.
+var builtinTests = map[string]interface{}{
+	"defined":     func(v interface{}) bool { return !isUndefined(v) },
+	"undefined":   isUndefined,
+	"none":        func(v interface{}) bool { return v == nil },
+	"boolean":     func(v interface{}) bool { return typeOf(v) == boolType },
+	"true":        func(v interface{}) bool { return v == true },
+	"false":       func(v interface{}) bool { return v == false },
+	"number":      func(v interface{}) bool { return isNumericVar(typeOf(v)) },
+	"integer":     func(v interface{}) bool { return typeOf(v) == intType },
+	"float":       func(v interface{}) bool { return typeOf(v) == floatType },
+	"string":      func(v interface{}) bool { return typeOf(v) == stringType },
+	"sequence":    func(v interface{}) bool { return typeOf(v) == sliceType || typeOf(v) == stringType },
+	"mapping":     func(v interface{}) bool { return typeOf(v) == mapType },
+	"lower":       func(s string) bool { return s == strings.ToLower(s) },
+	"upper":       func(s string) bool { return s == strings.ToUpper(s) },
+	"even":        func(n int64) bool { return n%2 == 0 },
+	"odd":         func(n int64) bool { return n%2 != 0 },
+	"divisibleby": testDivisibleBy,
+}
+
+func testDivisibleBy(n, d int64) (bool, error) {
+	if d == 0 {
+		return false, errors.New("integer division by zero")
+	}
+	return n%d == 0, nil
+}
+
+// comparisonTests are tests which compare a value to their argument, by the
+// names Jinja2 uses for them.
+var comparisonTests = map[string]item{
+	"eq": {typ: tokenEqEq, val: "=="}, "equalto": {typ: tokenEqEq, val: "=="}, "==": {typ: tokenEqEq, val: "=="},
+	"ne": {typ: tokenNeq, val: "!="}, "!=": {typ: tokenNeq, val: "!="},
+	"lt": {typ: tokenLt, val: "<"}, "lessthan": {typ: tokenLt, val: "<"}, "<": {typ: tokenLt, val: "<"},
+	"le": {typ: tokenLteq, val: "<="}, "<=": {typ: tokenLteq, val: "<="},
+	"gt": {typ: tokenGt, val: ">"}, "greaterthan": {typ: tokenGt, val: ">"}, ">": {typ: tokenGt, val: ">"},
+	"ge": {typ: tokenGteq, val: ">="}, ">=": {typ: tokenGteq, val: ">="},
+}
+
+// comparisonTest returns a test comparing a value to its argument with op.
+func (e *Environment) comparisonTest(op item) func(a, b interface{}) (bool, error) {
+	return func(a, b interface{}) (bool, error) {
+		return e.compare(a, b, op)
+	}
+}
+
+// RegisterTest makes fn available to templates as the test name, replacing
+// any existing test of that name.  The value being tested is passed as the
+// first argument to fn, followed by any arguments given in the template.  Fn
+// must return a bool, or a bool and an error.
+func (e *Environment) RegisterTest(name string, fn interface{}) error {
+	t, err := newTest(fn)
+	if err != nil {
+		return err
+	}
+	if e.tests == nil {
+		e.tests = make(map[string]*test)
+	}
+	e.tests[name] = t
+	return nil
+}
+
+// runTest applies the test named by name to value with args.
+func (e *Environment) runTest(name interface{}, value interface{}, args []interface{}) (bool, error) {
+	t, ok := e.tests[asString(name)]
+	if !ok {
+		return false, fmt.Errorf("unknown test %q", asString(name))
+	}
+	return t.apply(value, args)
+}
+
+// A Booler is a value which decides whether it is true in a boolean context.
+type Booler interface {
+	Bool() bool
+}
+
+// IsTruthy reports whether v is true in a boolean context, the way filters
+// like select and default decide:  false, none, nil pointers, zero and empty
+// strings, slices and maps are false, a Booler is its Bool method, and
+// anything else is true.
+func IsTruthy(v interface{}) bool {
+	return truthy(v)
+}
+
+// truthy reports whether a value is true in a boolean context without an
+// explicit test;  see IsTruthy.
+func truthy(i interface{}) bool {
+	if i == nil {
+		return false
+	}
+	if v := reflect.ValueOf(i); v.Kind() == reflect.Ptr && v.IsNil() {
+		return false
+	}
+	if b, ok := i.(Booler); ok {
+		return b.Bool()
+	}
+	switch typeOf(i) {
+	case boolType:
+		return i.(bool)
+	case intType, floatType:
+		f, _ := asFloat(i)
+		return f != 0
+	case stringType, sliceType, mapType:
+		return indirect(reflect.ValueOf(i)).Len() > 0
+	}
+	return true
+}
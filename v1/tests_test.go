@@ -0,0 +1,107 @@
+package v1
+
+import "testing"
+
+func TestIsTests(t *testing.T) {
+	ctx := m{"x": 1, "n": 5, "none": nil, "s": "abc"}
+	fixtures := []evalFixture{
+		{"Is defined", `{{ x is defined }}`, ctx, "true"},
+		{"Is not defined", `{{ missing is not defined }}`, ctx, "true"},
+		{"Is not defined false", `{{ x is not defined }}`, ctx, "false"},
+		{"Is undefined attr", `{{ x.y is undefined }}`, ctx, "true"},
+		{"Is even", `{{ n is even }}`, ctx, "false"},
+		{"Is not even", `{{ n is not even }}`, ctx, "true"},
+		{"Is not odd", `{{ n is not odd }}`, ctx, "false"},
+		{"Is not none", `{{ none is not none }}`, ctx, "false"},
+		{"Is true", `{{ x is true }}`, ctx, "false"},
+		{"Is divisibleby", `{{ n is divisibleby 5 }}`, ctx, "true"},
+		{"Is not divisibleby", `{{ n is not divisibleby 3 }}`, ctx, "true"},
+		{"Is not divisibleby false", `{{ n is not divisibleby 5 }}`, ctx, "false"},
+		{"Is comparison test", `{{ n is gt 3 }}`, ctx, "true"},
+		{"Is after filter", `{{ s|split("b") is not string }}`, ctx, "true"},
+		{"Is in if", `{% if missing is not defined %}ok{% endif %}`, ctx, "ok"},
+		{"Is parenthesized", `{{ n is divisibleby(5) }}`, ctx, "true"},
+		{"Is not parenthesized", `{{ n is not divisibleby(3) }}`, ctx, "true"},
+		{"Is parenthesized expression", `{{ n is divisibleby(x + 4) }}`, ctx, "true"},
+		{"Is in comparison", `{{ n is odd == true }}`, ctx, "true"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	tpl, err := NewEnvironment().ParseString(`{{ x is nosuchtest }}`, "is", "is")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error for an unknown test")
+	}
+	for _, bad := range []string{`{{ x is }}`, `{{ x is not }}`, `{{ x is not 1 }}`} {
+		if _, err := NewEnvironment().ParseString(bad, "is", "is"); err == nil {
+			t.Errorf("Expected parse error for %s", bad)
+		}
+	}
+
+	// both forms of argument produce the same test
+	bare, _ := NewEnvironment().ParseString(`{{ n is not divisibleby 3 }}`, "is", "is")
+	paren, _ := NewEnvironment().ParseString(`{{ n is not divisibleby(3) }}`, "is", "is")
+	if bare.base.Root.String() != paren.base.Root.String() {
+		t.Errorf("Expected equal trees, got %s and %s", bare.base.Root, paren.base.Root)
+	}
+	tpl, _ = NewEnvironment().ParseString(`{{ n is divisibleby(num=3) }}`, "is", "is")
+	if _, err := tpl.Render(ctx); err == nil {
+		t.Errorf("Expected error for a keyword argument to a test")
+	}
+
+	// testing definedness does not report the value as undefined
+	tpl, _ = NewEnvironment().ParseString(`{{ missing is not defined }}`, "is", "is")
+	if err := tpl.Validate(ctx); err != nil {
+		t.Errorf("Unexpected validation error: %s", err)
+	}
+}
+
+func TestTestNodeString(t *testing.T) {
+	for _, src := range []string{
+		`x is defined`,
+		`x is not defined`,
+		`n is not divisibleby(3)`,
+		`n is gt(x + 1)`,
+		`(a + b) is even`,
+		`a + b is even`,
+		`x | lower is not none`,
+	} {
+		tpl, err := NewEnvironment().ParseString("{{ "+src+" }}", "is", "is")
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+		n := tpl.base.Root.Nodes[0].(*VarNode).Node
+		if got := n.String(); got != src {
+			t.Errorf("Expected %q, got %q", src, got)
+		}
+		if got := n.Copy().String(); got != src {
+			t.Errorf("Expected copy %q, got %q", src, got)
+		}
+	}
+}
+
+// flag is a Booler.
+type flag struct{ on bool }
+
+func (f flag) Bool() bool { return f.on }
+
+func TestIsTruthy(t *testing.T) {
+	var nilPtr *flag
+	falsy := []interface{}{nil, false, 0, int8(0), uint(0), 0.0, "", Safe(""), []int{}, []string(nil), map[string]int{}, [0]int{}, nilPtr, flag{false}, &flag{false}}
+	truthy := []interface{}{true, 1, -1, 0.5, "a", Safe("a"), []int{0}, map[string]int{"a": 0}, [1]int{}, &flag{true}, flag{true}, struct{}{}, &struct{}{}}
+	for _, v := range falsy {
+		if IsTruthy(v) {
+			t.Errorf("Expected %#v to be falsy", v)
+		}
+	}
+	for _, v := range truthy {
+		if !IsTruthy(v) {
+			t.Errorf("Expected %#v to be truthy", v)
+		}
+	}
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Booler default", `{{ f|default("off", true) }}`, m{"f": flag{false}}, "off"},
+	})
+}
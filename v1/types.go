@@ -2,6 +2,7 @@ package v1
 
 import (
 	"fmt"
+	"html/template"
 	"reflect"
 )
 
@@ -42,13 +43,37 @@ func isNumericVar(v vartype) bool {
 	return v < stringType
 }
 
+func isNumericKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// Safe is a string that is known to be safe to render without escaping,
+// such as html that has already been escaped.
+type Safe string
+
+// asSafe returns i as a Safe string if it is known to be safe to render
+// without escaping.  As well as Safe values, this accepts html/template's
+// HTML, so html prepared for html/template renders the same in jigo.  The
+// other typed strings of html/template are only safe in attribute, script,
+// style or url contexts, which jigo does not distinguish, so they are escaped
+// like any string.
+func asSafe(i interface{}) (Safe, bool) {
+	switch s := i.(type) {
+	case Safe:
+		return s, true
+	case template.HTML:
+		return Safe(s), true
+	}
+	return "", false
+}
+
 func typeOf(i interface{}) vartype {
 	switch i.(type) {
 	case uint, uint8, uint16, uint32, uint64, int, int8, int16, int32, int64:
 		return intType
 	case float32, float64:
 		return floatType
-	case string:
+	case string, Safe, template.HTML, template.HTMLAttr, template.JS, template.JSStr, template.CSS, template.URL, template.Srcset:
 		return stringType
 	case bool:
 		return boolType
@@ -63,6 +88,32 @@ func typeOf(i interface{}) vartype {
 	return unknownType
 }
 
+// The range of integers which are interned by boxInt.
+const (
+	minSmallInt = -1
+	maxSmallInt = 256
+)
+
+// smallInts holds the boxed values of small integers, which are shared by
+// every evaluation, like CPython's small int cache.  Boxed values cannot be
+// modified, so sharing them is safe.
+var smallInts [maxSmallInt - minSmallInt + 1]interface{}
+
+func init() {
+	for i := range smallInts {
+		smallInts[i] = int64(i + minSmallInt)
+	}
+}
+
+// boxInt returns n as an interface value.  Small integers are interned, so
+// arithmetic and loop counters in tight loops do not allocate.
+func boxInt(n int64) interface{} {
+	if n >= minSmallInt && n <= maxSmallInt {
+		return smallInts[n-minSmallInt]
+	}
+	return n
+}
+
 func asBool(i interface{}) (bool, error) {
 	if typeOf(i) != boolType {
 		return false, fmt.Errorf("%s is not boolean", i)
@@ -132,5 +183,8 @@ func asFloat(i interface{}) (float64, bool) {
 }
 
 func asString(i interface{}) string {
+	if i == nil {
+		return ""
+	}
 	return fmt.Sprint(i)
 }
@@ -0,0 +1,29 @@
+package v1
+
+// Undefined is the value of an undefined name, attribute or item when the
+// environment has an undefined factory;  see Environment.SetUndefined.
+type Undefined interface {
+	// String returns the output for the undefined value.
+	String() string
+	// Bool reports whether the undefined value is true in a condition.
+	Bool() bool
+	// Attr returns the value of the attribute or item name of the undefined
+	// value, or an error to stop the render.
+	Attr(name string) (interface{}, error)
+}
+
+// SetUndefined makes factory produce the value of undefined names,
+// attributes and items, given their path, eg. "user.email".  The value is
+// rendered, tested and indexed via the Undefined interface, so a factory can
+// render placeholders, fail on use, or chain attributes of undefined values.
+// It replaces UndefinedString.  Passing nil restores the default, where
+// undefined values are nil and render as nothing.
+func (e *Environment) SetUndefined(factory func(path string) Undefined) {
+	e.undefined = factory
+}
+
+// isUndefined reports whether v is the value of something undefined.
+func isUndefined(v interface{}) bool {
+	_, ok := v.(Undefined)
+	return v == nil || ok
+}
@@ -0,0 +1,80 @@
+package v1
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// logUndefined records the paths it is made for, and renders a placeholder.
+type logUndefined struct {
+	path string
+	log  *[]string
+}
+
+func (u logUndefined) String() string { return "{" + u.path + "}" }
+func (u logUndefined) Bool() bool     { return false }
+
+func (u logUndefined) Attr(name string) (interface{}, error) {
+	return u.new(u.path + "." + name), nil
+}
+
+func (u logUndefined) new(path string) Undefined {
+	*u.log = append(*u.log, path)
+	return logUndefined{path, u.log}
+}
+
+// strictUndefined fails on any use other than testing it.
+type strictUndefined string
+
+func (u strictUndefined) String() string { return "" }
+func (u strictUndefined) Bool() bool     { return false }
+
+func (u strictUndefined) Attr(name string) (interface{}, error) {
+	return nil, errors.New(string(u) + " is undefined")
+}
+
+func TestSetUndefined(t *testing.T) {
+	var log []string
+	e := NewEnvironment()
+	e.UndefinedString = func(path string) string { return "ignored" }
+	e.SetUndefined(logUndefined{log: &log}.new)
+	ctx := m{"user": m{"name": "Ann"}, "l": []int{1}}
+	testFixtures(t, e, []evalFixture{
+		{"Name", `{{ missing }}`, ctx, "{missing}"},
+		{"Attribute", `{{ user.email }}`, ctx, "{user.email}"},
+		{"Attribute of undefined", `{{ missing.a.b }}`, ctx, "{missing.a.b}"},
+		{"Item of undefined", `{{ missing["a"] }}`, ctx, "{missing.a}"},
+		{"Filtered", `{{ missing|e }}`, ctx, "{missing}"},
+		{"Falsy", `{% if missing %}yes{% else %}no{% endif %}`, ctx, "no"},
+		{"Defined test", `{{ missing is defined }} {{ missing is undefined }} {{ user is defined }}`, ctx, "false true true"},
+		{"Default", `{{ missing|default("x") }}`, ctx, "x"},
+		{"Loop", `{% for x in missing %}{{ x }}{% else %}empty{% endfor %}`, ctx, "empty"},
+		{"Defined", `{{ user.name }}`, ctx, "Ann"},
+	})
+	want := []string{"missing", "user.email", "missing", "missing.a", "missing.a.b"}
+	if !reflect.DeepEqual(log[:len(want)], want) {
+		t.Errorf("Expected undefined log to start %v, got %v", want, log)
+	}
+
+	e = NewEnvironment()
+	e.SetUndefined(func(path string) Undefined { return strictUndefined(path) })
+	testFixtures(t, e, []evalFixture{
+		{"Strict test", `{{ missing is defined }}`, m{}, "false"},
+	})
+	tpl, err := e.ParseString(`{{ user.email.domain }}`, "strict", "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(m{"user": m{}}); err == nil || !strings.Contains(err.Error(), "user.email is undefined") {
+		t.Errorf("Expected an undefined error, got %v", err)
+	}
+	tpl, _ = e.ParseString(`{{ missing() }}`, "call", "call")
+	if _, err = tpl.Render(m{}); err == nil || !strings.Contains(err.Error(), "missing is undefined") {
+		t.Errorf("Expected an undefined error, got %v", err)
+	}
+
+	e.SetUndefined(nil)
+	testFixtures(t, e, []evalFixture{{"Reset", `[{{ missing }}]`, m{}, "[]"}})
+}
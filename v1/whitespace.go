@@ -0,0 +1,143 @@
+package v1
+
+import "io"
+
+// preserved are the elements whose content is written as-is by a
+// collapseWriter, as whitespace is significant in them.
+var preserved = map[string]bool{"pre": true, "textarea": true, "script": true, "style": true}
+
+// maxTagName is the longest tag name a collapseWriter needs to recognise,
+// including the slash of a closing tag.  Longer names are truncated to one
+// byte more, so they match none.
+const maxTagName = len("/textarea")
+
+// collapseWriter is a writer which collapses each run of whitespace between
+// html tags written through it to a single space;  see
+// Environment.CollapseWhitespace.  Whitespace in text, in tags and their
+// quoted attribute values, and inside the preserved elements is written
+// as-is.  Tags are recognised as they stream through, so they may be split
+// across writes.
+type collapseWriter struct {
+	w        io.Writer
+	space    []byte // a pending run of whitespace in text.
+	afterTag bool   // whether the text being written follows a tag.
+	inName   bool   // whether the name of a tag is being read.
+	tag      []byte // the lowercased name of the tag being read.
+	inTag    bool   // whether the attributes of a tag are being read.
+	quote    byte   // the quote of the attribute value being read, if any.
+	raw      string // the preserved element being written, if any.
+	buf      []byte
+}
+
+func newCollapseWriter(w io.Writer) *collapseWriter {
+	// the start of the output counts as following a tag, as templates are
+	// often fragments of a larger document
+	return &collapseWriter{w: w, afterTag: true, tag: make([]byte, 0, maxTagName+1)}
+}
+
+func (c *collapseWriter) Write(p []byte) (int, error) {
+	c.buf = c.buf[:0]
+	for _, b := range p {
+		if c.inName {
+			if isTagByte(b, len(c.tag)) {
+				if len(c.tag) < cap(c.tag) {
+					c.tag = append(c.tag, b|0x20)
+				}
+				c.buf = append(c.buf, b)
+				continue
+			}
+			c.endName()
+		}
+		switch {
+		case c.raw != "":
+			c.buf = append(c.buf, b)
+			c.startTag(b)
+		case c.inTag:
+			c.buf = append(c.buf, b)
+			switch {
+			case c.quote != 0:
+				if b == c.quote {
+					c.quote = 0
+				}
+			case b == '"' || b == '\'':
+				c.quote = b
+			case b == '>':
+				c.inTag = false
+				c.afterTag = true
+			}
+		case isHTMLSpace(b):
+			c.space = append(c.space, b)
+		default:
+			if len(c.space) > 0 {
+				if b == '<' && c.afterTag {
+					c.buf = append(c.buf, ' ')
+				} else {
+					c.buf = append(c.buf, c.space...)
+				}
+				c.space = c.space[:0]
+			}
+			c.buf = append(c.buf, b)
+			c.afterTag = b == '>'
+			c.startTag(b)
+		}
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// startTag starts reading a tag name if b opens one.
+func (c *collapseWriter) startTag(b byte) {
+	if b == '<' {
+		c.inName = true
+		c.tag = c.tag[:0]
+	}
+}
+
+// endName ends the name of the tag being read, entering or leaving a
+// preserved element if it opens or closes one.  A `<` without a name, as in
+// `a < b`, is text.
+func (c *collapseWriter) endName() {
+	c.inName = false
+	name := string(c.tag)
+	switch {
+	case c.raw == "" && preserved[name]:
+		c.raw = name
+	case c.raw != "" && name == "/"+c.raw:
+		c.raw = ""
+		c.inTag = true
+	case c.raw == "" && name != "" && name != "/":
+		c.inTag = true
+	}
+}
+
+// Close writes any whitespace still pending at the end of the output.
+func (c *collapseWriter) Close() error {
+	if len(c.space) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.space)
+	c.space = c.space[:0]
+	return err
+}
+
+// isTagByte reports whether b can be the i'th byte of a tag name.
+func isTagByte(b byte, i int) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z':
+		return true
+	case '0' <= b && b <= '9':
+		return i > 0
+	}
+	return b == '/' && i == 0
+}
+
+// isHTMLSpace reports whether b is html whitespace.
+func isHTMLSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\f':
+		return true
+	}
+	return false
+}
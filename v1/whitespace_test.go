@@ -0,0 +1,38 @@
+package v1
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCollapseWhitespace(t *testing.T) {
+	e := NewEnvironment()
+	e.CollapseWhitespace = true
+	fixtures := []evalFixture{
+		{"Between tags", "<ul>\n  <li>a</li>\n\t<li>b</li>\n</ul>", m{}, "<ul> <li>a</li> <li>b</li> </ul>"},
+		{"Text", "<p>a  \n b</p>", m{}, "<p>a  \n b</p>"},
+		{"Output", "<p>{{ s }}</p>", m{"s": "x \n\n y"}, "<p>x \n\n y</p>"},
+		{"Less than", "<p>a <  b</p>\n<br>", m{}, "<p>a <  b</p> <br>"},
+		{"Attribute", "<input value=\"{{ v }}\">", m{"v": "a    b"}, "<input value=\"a    b\">"},
+		{"Quoted >", "<a title='x >  y'  href=\"#\">\n  <b>", m{}, "<a title='x >  y'  href=\"#\"> <b>"},
+		{"Trailing", "<p></p>\n\n", m{}, "<p></p>\n\n"},
+		{"Pre", "<div>\n  <pre>  a\n   b </pre>\n</div>", m{}, "<div> <pre>  a\n   b </pre> </div>"},
+		{"Pre attrs", "<PRE class=\"x\">a  b</PRE>  <p>", m{}, "<PRE class=\"x\">a  b</PRE> <p>"},
+		{"Textarea", "<textarea>\n  x\n</textarea>\n<p>", m{}, "<textarea>\n  x\n</textarea> <p>"},
+		{"Prefix", "<prefix>\n  <b>a</b></prefix>", m{}, "<prefix> <b>a</b></prefix>"},
+		{"Loop", "{% for i in items %}\n  <b>{{ i }}</b>\n{% endfor %}", m{"items": []int{1, 2}}, " <b>1</b> <b>2</b>\n"},
+	}
+	testFixtures(t, e, fixtures)
+}
+
+func TestCollapseWriterSplitWrites(t *testing.T) {
+	var b bytes.Buffer
+	w := newCollapseWriter(&b)
+	for _, s := range []string{"<p>  ", "  <a></a><p", "re>  x  </p", "re>  <", "/p>"} {
+		w.Write([]byte(s))
+	}
+	w.Close()
+	if want := "<p> <a></a><pre>  x  </pre> </p>"; b.String() != want {
+		t.Errorf("Expected %q, got %q", want, b.String())
+	}
+}